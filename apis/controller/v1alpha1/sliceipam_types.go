@@ -0,0 +1,55 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SliceIpamSpec holds the persisted IPAM pool state of a slice
+type SliceIpamSpec struct {
+	SliceName string `json:"sliceName,omitempty"`
+	// SliceSubnet is the CIDR the pool allocates from
+	SliceSubnet string `json:"sliceSubnet,omitempty"`
+	// Allocated maps each cluster, and reserved names such as the VPN subnet, to its CIDR
+	Allocated map[string]string `json:"allocated,omitempty"`
+	// FreeBlocks lists the CIDRs that are still available for allocation
+	FreeBlocks []string `json:"freeBlocks,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// SliceIpam is the Schema for the sliceipams API
+type SliceIpam struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec SliceIpamSpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// SliceIpamList contains a list of SliceIpam
+type SliceIpamList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []SliceIpam `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&SliceIpam{}, &SliceIpamList{})
+}
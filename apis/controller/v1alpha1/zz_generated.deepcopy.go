@@ -793,6 +793,91 @@ func (in *SliceGatewayServiceType) DeepCopy() *SliceGatewayServiceType {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SliceIpam) DeepCopyInto(out *SliceIpam) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SliceIpam.
+func (in *SliceIpam) DeepCopy() *SliceIpam {
+	if in == nil {
+		return nil
+	}
+	out := new(SliceIpam)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *SliceIpam) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SliceIpamList) DeepCopyInto(out *SliceIpamList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]SliceIpam, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SliceIpamList.
+func (in *SliceIpamList) DeepCopy() *SliceIpamList {
+	if in == nil {
+		return nil
+	}
+	out := new(SliceIpamList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *SliceIpamList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SliceIpamSpec) DeepCopyInto(out *SliceIpamSpec) {
+	*out = *in
+	if in.Allocated != nil {
+		in, out := &in.Allocated, &out.Allocated
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.FreeBlocks != nil {
+		in, out := &in.FreeBlocks, &out.FreeBlocks
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SliceIpamSpec.
+func (in *SliceIpamSpec) DeepCopy() *SliceIpamSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(SliceIpamSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SliceNamespaceSelection) DeepCopyInto(out *SliceNamespaceSelection) {
 	*out = *in
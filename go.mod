@@ -4,6 +4,7 @@ go 1.24.0
 
 require (
 	github.com/dailymotion/allure-go v0.7.0
+	github.com/go-logr/logr v1.2.4
 	github.com/jinzhu/copier v0.3.4
 	github.com/kubeslice/kubeslice-monitoring v0.2.1
 	github.com/prometheus/client_golang v1.14.0
@@ -38,7 +39,6 @@ require (
 	github.com/fatih/camelcase v1.0.0 // indirect
 	github.com/form3tech-oss/jwt-go v3.2.3+incompatible // indirect
 	github.com/fsnotify/fsnotify v1.5.1 // indirect
-	github.com/go-logr/logr v1.2.4 // indirect
 	github.com/go-logr/zapr v1.2.3 // indirect
 	github.com/gogo/protobuf v1.3.2 // indirect
 	github.com/golang/groupcache v0.0.0-20210331224755-41bb18bfe9da // indirect
@@ -2,363 +2,2208 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
 	"net"
 	"sort"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/kubeslice/kubeslice-controller/util/cidrutil"
+)
+
+// ReservedVPNClusterKey is the Allocated key under which every slice reserves its VPN
+// subnet. It is reported by ListAllocations and LookupByIP like a cluster name, but no
+// cluster can be allocated under it.
+const ReservedVPNClusterKey = "VPN_Subnet"
+
+// legacyVPNClusterKeys are keys that earlier releases stored the VPN reservation under.
+// Loaded state is migrated from them to ReservedVPNClusterKey.
+var legacyVPNClusterKeys = []string{"KubeSlice-VPN-Reserved-Subnet"}
+
+const (
+	vpnSubnetRequiredSize = 24
+	// vpnIPv6SubnetRequiredSize is the VPN reservation in IPv6 slices, where a /24 would
+	// not fit.
+	vpnIPv6SubnetRequiredSize = 64
+)
+
+// Errors returned by the IPAM allocators, wrapped with the slice and cluster involved.
+// Use errors.Is to test for them.
+var (
+	// ErrPoolNotInitialized is returned for a slice whose pool was never initialized.
+	ErrPoolNotInitialized = errors.New("ipam pool is not initialized")
+	// ErrPoolExhausted is returned when no free block can hold the requested prefix.
+	ErrPoolExhausted = errors.New("ipam pool is exhausted")
+	// ErrPoolDeleted is returned by a Pool handle whose pool was deleted or replaced.
+	ErrPoolDeleted = errors.New("ipam pool was deleted")
+	// ErrAllocationNotFound is returned when a cluster has no allocation in a slice's pool.
+	ErrAllocationNotFound = errors.New("allocation not found")
+	// ErrAllocationExists is returned when an allocation would be moved onto a cluster
+	// that already holds one.
+	ErrAllocationExists = errors.New("allocation already exists")
+	// ErrReallocationUnsupported is returned when a cluster that already holds a block
+	// asks for a block of a different size.
+	ErrReallocationUnsupported = errors.New("re-allocation to a different size is not supported")
+	// ErrInvalidCIDR is returned for a CIDR string that does not parse.
+	ErrInvalidCIDR = errors.New("invalid CIDR")
+	// ErrReservedClusterName is returned when a caller passes one of the Allocated keys the
+	// allocator reserves for itself as a cluster name.
+	ErrReservedClusterName = errors.New("cluster name is reserved")
+	// ErrSliceSubnetMismatch is returned when a slice's pool is initialized again with a
+	// different subnet, or its stored state is for a different subnet.
+	ErrSliceSubnetMismatch = errors.New("slice subnet does not match the pool")
+	// ErrRangeExcluded is returned when a CIDR overlaps space withheld with ExcludeRange or
+	// ImportExclusions, which can be neither allocated nor reclaimed.
+	ErrRangeExcluded = errors.New("address range is excluded")
+	// ErrBlockTooLarge is returned when a request asks for a block larger than the limit
+	// set with WithMaxBlockSize.
+	ErrBlockTooLarge = errors.New("requested block exceeds the maximum block size")
+	// ErrClusterQuotaExceeded is returned when a cluster already holds as many blocks in a
+	// slice as WithPerClusterBlockLimit allows.
+	ErrClusterQuotaExceeded = errors.New("cluster block quota exceeded")
+	// ErrVPNReservationTooLarge is returned when a pool is initialized with a slice subnet
+	// smaller than the configured VPN reservation. It also matches ErrPoolExhausted.
+	ErrVPNReservationTooLarge = errors.New("VPN reservation does not fit in the slice subnet")
 )
 
+// reservedAllocationNames are the Allocated keys that belong to infrastructure rather than
+// a cluster. Clusters cannot be allocated or reclaimed under these names, including the
+// legacy VPN keys, which loaded state would migrate to the VPN reservation.
+var reservedAllocationNames = append([]string{ReservedVPNClusterKey}, legacyVPNClusterKeys...)
+
+// reservedBlockPrefix starts the Allocated key of every block reserved with ReserveBlock.
+// Kubernetes object names cannot contain a colon, so such keys never clash with a
+// cluster's.
+const reservedBlockPrefix = "reserved:"
+
+// ReservedBlockKey returns the Allocated key under which ReserveBlock records the block
+// reserved as name.
+func ReservedBlockKey(name string) string {
+	return reservedBlockPrefix + name
+}
+
+// isReservedAllocation reports whether an Allocated key belongs to infrastructure rather than a cluster.
+func isReservedAllocation(clusterName string) bool {
+	if strings.HasPrefix(clusterName, reservedBlockPrefix) {
+		return true
+	}
+	for _, reserved := range reservedAllocationNames {
+		if clusterName == reserved {
+			return true
+		}
+	}
+	return false
+}
+
+// validateClusterName rejects reserved names, which would otherwise alias the allocator's
+// own reservations; allocating for "VPN_Subnet" would hand out the VPN subnet.
+func validateClusterName(clusterName string) error {
+	if isReservedAllocation(clusterName) {
+		return fmt.Errorf("%w: %s", ErrReservedClusterName, clusterName)
+	}
+	return nil
+}
+
 type IPAMAllocator interface {
 	InitializePool(sliceName, sliceSubnet string) error
 	Allocate(ctx context.Context, sliceName string, clusterName string, requiredCIDRSize int) (string, error)
 	Reclaim(ctx context.Context, sliceName string, clusterName string) error
 }
 
+// FreeBlockLess reports whether free block a should be ordered before free block b.
+// The ordering drives both candidate selection in Allocate (the first fitting block in
+// this order wins) and the sort used before merging in Reclaim.
+type FreeBlockLess func(a, b *net.IPNet) bool
+
 // sliceIPPool holds the state for a single slice's IPAM.
 type sliceIPPool struct {
 	SliceSubnet *net.IPNet
-	// Mutex to protect concurrent access to this pool's state.
-	mu         sync.Mutex
+	// Mutex to protect concurrent access to this pool's state. Queries take the read
+	// lock and return copies, so they run concurrently with each other.
+	mu         sync.RWMutex
 	Allocated  map[string]*net.IPNet
 	FreeBlocks []*net.IPNet
+	// Preserved marks tenant allocations that ResetPool must keep.
+	Preserved map[string]bool
+	// Labels holds caller supplied labels per allocation.
+	Labels map[string]map[string]string
+	// IdempotencyKeys maps a cluster to the key its allocation was claimed with.
+	IdempotencyKeys map[string]string
+	// Expiry holds the time at which an allocation made with AllocateWithTTL lapses.
+	Expiry map[string]time.Time
+	// Excluded holds ranges that are permanently withheld from allocation, sorted by address.
+	Excluded []*net.IPNet
+	// less orders FreeBlocks; it is inherited from the allocator at pool creation.
+	less FreeBlockLess
+	// trace receives split and merge diagnostics at the allocator's split log level.
+	trace logr.Logger
+	// Quarantined holds reclaimed blocks that may not be handed out again until their
+	// release time has passed.
+	Quarantined []quarantinedBlock
+	// options holds the per-pool settings given at initialization.
+	options PoolOptions
+	// clock is inherited from the allocator and dates quarantined blocks.
+	clock Clock
+	// strategy picks the free block an allocation is carved from.
+	strategy AllocationStrategy
+	// clusterBlockLimit caps the blocks one cluster may hold; 0 means no limit.
+	clusterBlockLimit int
+	// index groups FreeBlocks by prefix length for placement; it is built on demand.
+	index *freeBlockIndex
+	// scanFreeList places allocations by scanning FreeBlocks instead of using index.
+	scanFreeList bool
+	// deleted is set when the pool is removed from its allocator, so that Pool handles
+	// still pointing at it fail instead of acting on orphaned state.
+	deleted bool
+}
+
+// PoolOptions holds per-slice settings applied when a pool is initialized.
+type PoolOptions struct {
+	// QuarantineDuration keeps reclaimed blocks out of the free list for the given time,
+	// so that a subnet is not handed to a new cluster while stale routes to the previous
+	// owner may still exist. Zero returns reclaimed blocks to the free list immediately.
+	QuarantineDuration time.Duration
+	// VPNSubnet places the slice's VPN reservation at this CIDR, for example at the top
+	// of the slice subnet to match firewall rules, instead of in the first free block that
+	// fits. It must be a network address within the slice subnet and its prefix overrides
+	// the configured VPN subnet size.
+	VPNSubnet string
 }
 
 type DynamicIPAMAllocator struct {
-	mu    sync.Mutex
-	pools map[string]*sliceIPPool
+	mu            sync.RWMutex
+	pools         map[string]*sliceIPPool
+	freeBlockLess FreeBlockLess
+	// customOrder records that freeBlockLess was overridden by WithFreeBlockLess.
+	customOrder   bool
+	metrics       IPAMMetricsRecorder
+	log           logr.Logger
+	splitLogLevel int
+	clock         Clock
+	// reserveVPN and vpnPrefix control the VPN reservation made by InitializePool; a zero
+	// vpnPrefix selects the default size for the slice's address family.
+	reserveVPN bool
+	vpnPrefix  int
+	strategy   AllocationStrategy
+	// verify enables validateNoOverlap after every Allocate and Reclaim.
+	verify bool
+	// maxBlockPrefix is the shortest prefix a cluster may request; 0 allows any size.
+	maxBlockPrefix int
+	// clusterBlockLimit is inherited by every pool; see WithPerClusterBlockLimit.
+	clusterBlockLimit int
+	// autoCompactThreshold is the free block count above which Reclaim compacts the
+	// pool; 0 disables it. See WithAutoCompact.
+	autoCompactThreshold int
+	auditSink            AuditSink
+	// watchMu guards the utilization watchers, which are checked under pool locks rather
+	// than under mu.
+	watchMu  sync.Mutex
+	watchers []*utilizationWatcher
+	// subscribersMu guards the channels returned by Subscribe.
+	subscribersMu sync.Mutex
+	subscribers   []chan AllocationEvent
 }
 
-func NewDynamicIPAMAllocator() *DynamicIPAMAllocator {
-	return &DynamicIPAMAllocator{
-		pools: make(map[string]*sliceIPPool),
+// IPAMAllocatorOption configures optional behaviour of a DynamicIPAMAllocator.
+type IPAMAllocatorOption func(*DynamicIPAMAllocator)
+
+// WithFreeBlockLess overrides the free block ordering used for placement and merging.
+// Merging only considers blocks that are neighbours in this order, so comparators that
+// keep blocks ordered by address (ascending or descending) coalesce fully.
+func WithFreeBlockLess(less FreeBlockLess) IPAMAllocatorOption {
+	return func(a *DynamicIPAMAllocator) {
+		if less != nil {
+			a.freeBlockLess = less
+			a.customOrder = true
+		}
 	}
 }
 
-func (a *DynamicIPAMAllocator) InitializePool(sliceName, sliceSubnetStr string) error {
-	a.mu.Lock()
-	defer a.mu.Unlock()
+// defaultSplitLogLevel keeps the per-block split and merge diagnostics out of normal logs.
+const defaultSplitLogLevel = 2
 
-	if _, exists := a.pools[sliceName]; exists {
-		return nil
+// WithLogger sets the logger used for pool lifecycle and placement diagnostics. By default
+// nothing is logged.
+func WithLogger(logger logr.Logger) IPAMAllocatorOption {
+	return func(a *DynamicIPAMAllocator) {
+		a.log = logger
 	}
+}
 
-	_, sliceNet, err := net.ParseCIDR(sliceSubnetStr)
-	if err != nil {
-		return fmt.Errorf("invalid slice subnet CIDR: %w", err)
+// WithSplitLogLevel sets the verbosity at which the free block split and merge internals
+// are logged. It defaults to V(2).
+func WithSplitLogLevel(level int) IPAMAllocatorOption {
+	return func(a *DynamicIPAMAllocator) {
+		if level >= 0 {
+			a.splitLogLevel = level
+		}
 	}
+}
 
-	pool := &sliceIPPool{
-		SliceSubnet: sliceNet,
-		Allocated:   make(map[string]*net.IPNet),
-		FreeBlocks:  []*net.IPNet{sliceNet}, // Initially, the entire slice subnet is free
+// WithClock sets the time source used for quarantine expiry. It defaults to the system
+// clock.
+func WithClock(clock Clock) IPAMAllocatorOption {
+	return func(a *DynamicIPAMAllocator) {
+		if clock != nil {
+			a.clock = clock
+		}
 	}
+}
 
-	a.pools[sliceName] = pool
-	fmt.Printf("InitializePool: After creation, pool.Allocated for %s: %v\n", sliceName, pool.Allocated)
-	pool.mu.Lock()
-	defer pool.mu.Unlock()
-	//Allocation if subnet for VPN is required for each slice even if it is not a cluster in the slice.
-	vpnSubnetRequiredSize := 24
-	vpnClusterName := "VPN_Subnet"
+// WithVPNSubnetSize sets the prefix length of the VPN subnet that InitializePool reserves
+// in IPv4 slices, which defaults to /24. IPv6 slices always reserve a /64. A prefix of 0
+// disables the reservation, like WithoutVPNReservation.
+func WithVPNSubnetSize(prefix int) IPAMAllocatorOption {
+	return func(a *DynamicIPAMAllocator) {
+		if prefix == 0 {
+			a.reserveVPN = false
+			return
+		}
+		a.reserveVPN = true
+		a.vpnPrefix = prefix
+	}
+}
 
-	_, err = pool.allocateSubnetForPool(vpnClusterName, vpnSubnetRequiredSize)
-	if err != nil {
-		return fmt.Errorf("failed to reserve VPN subnet for slice %s: %w", sliceName, err)
+// WithoutVPNReservation makes InitializePool leave the whole slice subnet free, for slices
+// that do not use the mesh VPN. Without it a slice smaller than the VPN subnet cannot be
+// initialized at all.
+func WithoutVPNReservation() IPAMAllocatorOption {
+	return func(a *DynamicIPAMAllocator) {
+		a.reserveVPN = false
 	}
+}
 
-	return nil
+// WithMaxBlockSize rejects requests for blocks larger than a /prefix, that is with a
+// shorter prefix, so that a single cluster cannot swallow most of a slice by mistake. The
+// VPN reservation is not subject to the limit.
+func WithMaxBlockSize(prefix int) IPAMAllocatorOption {
+	return func(a *DynamicIPAMAllocator) {
+		a.maxBlockPrefix = prefix
+	}
 }
 
-// Allocate allocates a subnet for a specific cluster within a slice.
-func (a *DynamicIPAMAllocator) Allocate(ctx context.Context, sliceName string, clusterName string, requiredCIDRSize int) (string, error) {
-	a.mu.Lock()
-	defer a.mu.Unlock()
+// WithPerClusterBlockLimit caps how many blocks a single cluster may hold in a slice, so
+// that one cluster cannot grab a shared slice piece by piece. Named allocations count
+// towards the limit of their cluster. A limit of 0 means no limit.
+func WithPerClusterBlockLimit(n int) IPAMAllocatorOption {
+	return func(a *DynamicIPAMAllocator) {
+		a.clusterBlockLimit = n
+	}
+}
 
-	pool, exists := a.pools[sliceName]
-	if !exists {
-		return "", fmt.Errorf("ipam pool for slice %s is not initialized", sliceName)
+// WithAutoCompact makes Reclaim compact a pool, as Compact does, whenever more than
+// maxFreeBlocks free blocks remain after the reclaimed block is returned. Below the
+// threshold a reclaim only merges the returned block with its buddies. A value of 0, the
+// default, never compacts automatically.
+func WithAutoCompact(maxFreeBlocks int) IPAMAllocatorOption {
+	return func(a *DynamicIPAMAllocator) {
+		a.autoCompactThreshold = maxFreeBlocks
 	}
+}
 
-	pool.mu.Lock()
-	defer pool.mu.Unlock()
+func NewDynamicIPAMAllocator(opts ...IPAMAllocatorOption) *DynamicIPAMAllocator {
+	a := &DynamicIPAMAllocator{
+		pools:         make(map[string]*sliceIPPool),
+		freeBlockLess: defaultFreeBlockLess,
+		metrics:       noopIPAMMetrics{},
+		log:           logr.Discard(),
+		splitLogLevel: defaultSplitLogLevel,
+		clock:         realClock{},
+		reserveVPN:    true,
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
 
-	allocatedNet, err := pool.allocateSubnetForPool(clusterName, requiredCIDRSize)
-	if err != nil {
-		return "", fmt.Errorf("failed to allocate subnet for cluster %s in slice %s: %w", clusterName, sliceName, err)
+// Capabilities describes the optional behaviour a DynamicIPAMAllocator was constructed
+// with, so that callers can degrade gracefully when a feature is missing.
+type Capabilities struct {
+	// Strategy names the placement strategy used to pick a free block.
+	Strategy string
+	// CustomFreeBlockOrder is set when WithFreeBlockLess replaced the address ordering.
+	CustomFreeBlockOrder bool
+	// Metrics is set when pool measurements are published to a recorder.
+	Metrics bool
+	// Logging is set when the configured logger emits output.
+	Logging bool
+	// SplitLogLevel is the verbosity of split and merge diagnostics.
+	SplitLogLevel int
+	// DualStack is set when pools may hold IPv6 as well as IPv4 subnets.
+	DualStack bool
+	// VPNReservation is set when InitializePool reserves a VPN subnet in each slice.
+	VPNReservation bool
+	// MaxBlockPrefix is the shortest prefix a cluster may request, or 0 if any is allowed.
+	MaxBlockPrefix int
+	// ClusterBlockLimit is the most blocks one cluster may hold in a slice, or 0.
+	ClusterBlockLimit int
+}
+
+// Capabilities reports the features enabled on this allocator.
+func (a *DynamicIPAMAllocator) Capabilities() Capabilities {
+	_, noMetrics := a.metrics.(noopIPAMMetrics)
+	return Capabilities{
+		Strategy:             a.strategy.String(),
+		CustomFreeBlockOrder: a.customOrder,
+		Metrics:              !noMetrics,
+		Logging:              a.log.Enabled(),
+		SplitLogLevel:        a.splitLogLevel,
+		DualStack:            true,
+		VPNReservation:       a.reserveVPN,
+		MaxBlockPrefix:       a.maxBlockPrefix,
+		ClusterBlockLimit:    a.clusterBlockLimit,
 	}
+}
 
-	return allocatedNet.String(), nil
+// defaultFreeBlockLess orders free blocks by ascending network address.
+func defaultFreeBlockLess(a, b *net.IPNet) bool {
+	return cidrutil.Compare(a, b) < 0
 }
 
-// It attempts to merge the reclaimed block with adjacent free blocks to reduce fragmentation.
-func (a *DynamicIPAMAllocator) Reclaim(ctx context.Context, sliceName string, clusterName string) error {
-	a.mu.Lock()
-	defer a.mu.Unlock()
+func (a *DynamicIPAMAllocator) InitializePool(sliceName, sliceSubnetStr string) error {
+	return a.InitializePoolWithOptions(sliceName, sliceSubnetStr, PoolOptions{})
+}
 
-	pool, exists := a.pools[sliceName]
-	if !exists {
-		return fmt.Errorf("ipam pool for slice %s is not initialized", sliceName)
-	}
+// IsInitialized reports whether the slice has a pool, so that a reconcile loop can decide
+// whether to call InitializePool without matching on errors.
+func (a *DynamicIPAMAllocator) IsInitialized(sliceName string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
 
-	pool.mu.Lock()
-	defer pool.mu.Unlock()
+	_, exists := a.pools[sliceName]
+	return exists
+}
 
-	subnetToReclaim, allocated := pool.Allocated[clusterName]
-	if !allocated {
-		return fmt.Errorf("cluster %s has no allocated subnet in slice %s to reclaim", clusterName, sliceName)
+// ListSlices returns the names of the slices that have a pool, in sorted order, for
+// tooling that reports on or operates across every pool.
+func (a *DynamicIPAMAllocator) ListSlices() []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	sliceNames := make([]string, 0, len(a.pools))
+	for sliceName := range a.pools {
+		sliceNames = append(sliceNames, sliceName)
 	}
+	sort.Strings(sliceNames)
+	return sliceNames
+}
 
-	delete(pool.Allocated, clusterName)
+// InitializePoolWithOptions initializes a slice's pool like InitializePool, applying the
+// given per-slice options. Options are ignored if the pool already exists.
+func (a *DynamicIPAMAllocator) InitializePoolWithOptions(sliceName, sliceSubnetStr string, opts PoolOptions) error {
+	if opts.QuarantineDuration < 0 {
+		return fmt.Errorf("quarantine duration must not be negative, got %s", opts.QuarantineDuration)
+	}
 
-	pool.FreeBlocks = append(pool.FreeBlocks, subnetToReclaim)
+	_, sliceNet, err := net.ParseCIDR(sliceSubnetStr)
+	if err != nil {
+		return fmt.Errorf("%w %q for slice subnet", ErrInvalidCIDR, sliceSubnetStr)
+	}
 
-	sort.Slice(pool.FreeBlocks, func(i, j int) bool {
-		return compareIPNets(pool.FreeBlocks[i], pool.FreeBlocks[j]) < 0
-	})
+	a.mu.Lock()
+	defer a.mu.Unlock()
 
-	newFreeBlocks := []*net.IPNet{}
-	if len(pool.FreeBlocks) > 0 {
-		current := pool.FreeBlocks[0]
-		for i := 1; i < len(pool.FreeBlocks); i++ {
-			next := pool.FreeBlocks[i]
-			merged, ok := tryMerge(current, next)
-			if ok {
-				current = merged // Successfully merged, continue with the larger block
-			} else {
-				newFreeBlocks = append(newFreeBlocks, current) // No merge, add current and move to next
-				current = next
-			}
-		}
-		newFreeBlocks = append(newFreeBlocks, current) // Add the last (or unmerged) block
+	if existing, exists := a.pools[sliceName]; exists {
+		return existing.checkSubnet(sliceName, sliceNet)
 	}
-	pool.FreeBlocks = newFreeBlocks
+
+	pool, err := a.newPool(sliceName, sliceNet, opts)
+	if err != nil {
+		return err
+	}
+	a.pools[sliceName] = pool
+	a.log.V(1).Info("initialized ipam pool", "slice", sliceName, "subnet", sliceNet)
+	a.recordPoolMetrics(sliceName, pool)
 
 	return nil
 }
 
-// --- Helper Functions for IPNet Manipulation ---
+// checkSubnet returns an error wrapping ErrSliceSubnetMismatch unless sliceNet is the
+// pool's slice subnet, so that re-initializing an existing pool with a changed subnet is
+// not silently ignored.
+func (pool *sliceIPPool) checkSubnet(sliceName string, sliceNet *net.IPNet) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
 
-func copyIP(ip net.IP) net.IP {
-	if ip == nil {
-		return nil
+	if current := pool.SliceSubnet.String(); current != cidrutil.Normalize(sliceNet).String() {
+		return fmt.Errorf("slice %s is initialized with subnet %s, not %s; use ResizePool to grow it: %w",
+			sliceName, current, sliceNet.String(), ErrSliceSubnetMismatch)
 	}
-	out := make(net.IP, len(ip))
-	copy(out, ip)
-	return out
+	return nil
 }
-func (pool *sliceIPPool) allocateSubnetForPool(clusterName string, requiredCIDRSize int) (*net.IPNet, error) {
-
-	if allocatedNet, found := pool.Allocated[clusterName]; found {
-		ones, _ := allocatedNet.Mask.Size()
-		existingBits := ones
-		if existingBits == requiredCIDRSize {
-			return allocatedNet, nil
-		}
 
-		return nil, fmt.Errorf("cluster %s already has subnet %s (/%d), but requested /%d. Re-allocation not supported in this version.",
-			clusterName, allocatedNet.String(), existingBits, requiredCIDRSize)
+// newPool builds the pool for a slice with the whole subnet free except for the VPN
+// reservation, if one is configured. The pool is not registered with the allocator.
+func (a *DynamicIPAMAllocator) newPool(sliceName string, sliceNet *net.IPNet, opts PoolOptions) (*sliceIPPool, error) {
+	sliceNet = cidrutil.Normalize(sliceNet)
+	pool := &sliceIPPool{
+		SliceSubnet:       sliceNet,
+		Allocated:         make(map[string]*net.IPNet),
+		FreeBlocks:        []*net.IPNet{copyIPNet(sliceNet)}, // Initially, the entire slice subnet is free
+		Preserved:         make(map[string]bool),
+		Labels:            make(map[string]map[string]string),
+		IdempotencyKeys:   make(map[string]string),
+		Expiry:            make(map[string]time.Time),
+		less:              a.freeBlockLess,
+		trace:             a.log.WithValues("slice", sliceName).V(a.splitLogLevel),
+		options:           opts,
+		clock:             a.clock,
+		strategy:          a.strategy,
+		clusterBlockLimit: a.clusterBlockLimit,
 	}
 
-	var firstFitIndex = -1
-	var firstFitNet *net.IPNet
-
-	for i, freeNet := range pool.FreeBlocks {
-		ones, _ := freeNet.Mask.Size()
-		freeBits := ones
-		if freeBits <= requiredCIDRSize {
-			firstFitIndex = i
-			ipCopy := copyIP(freeNet.IP)
-			maskCopy := append(net.IPMask(nil), freeNet.Mask...)
-			firstFitNet = &net.IPNet{IP: ipCopy, Mask: maskCopy}
-			break
+	if !a.reserveVPN {
+		if opts.VPNSubnet != "" {
+			return nil, fmt.Errorf("cannot place VPN subnet %s in slice %s: the VPN reservation is disabled", opts.VPNSubnet, sliceName)
 		}
+		return pool, nil
 	}
-
-	if firstFitIndex == -1 {
-		return nil, fmt.Errorf("no available subnet of size /%d in pool", requiredCIDRSize)
+	if opts.VPNSubnet != "" {
+		vpnNet, err := parseNetworkCIDR(opts.VPNSubnet)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reserve VPN subnet for slice %s: %w", sliceName, err)
+		}
+		if err := pool.allocateSpecific(ReservedVPNClusterKey, vpnNet); err != nil {
+			return nil, fmt.Errorf("failed to reserve VPN subnet for slice %s: %w", sliceName, err)
+		}
+		return pool, nil
+	}
+	//Allocation if subnet for VPN is required for each slice even if it is not a cluster in the slice.
+	vpnPrefix := a.vpnSubnetSize(sliceNet)
+	if sliceOnes, _ := sliceNet.Mask.Size(); vpnPrefix < sliceOnes {
+		return nil, fmt.Errorf("cannot reserve a /%d VPN subnet in slice %s, whose subnet %s is a /%d: %w: %w",
+			vpnPrefix, sliceName, sliceNet.String(), sliceOnes, ErrVPNReservationTooLarge, ErrPoolExhausted)
+	}
+	_, err := pool.allocateSubnetForPool(ReservedVPNClusterKey, vpnPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reserve VPN subnet for slice %s: %w", sliceName, err)
 	}
 
-	ones, _ := firstFitNet.Mask.Size()
-	firstFitBits := ones
-
-	var allocatedNet *net.IPNet
-	remainderNets := []*net.IPNet{}
-
-	if firstFitBits < requiredCIDRSize {
-
-		startIP := copyIP(firstFitNet.IP)
-		allocatedNet = &net.IPNet{IP: startIP, Mask: net.CIDRMask(requiredCIDRSize, 32)}
+	return pool, nil
+}
 
-		nextIP := copyIP(startIP)
-		nextIP = incIP(nextIP, 1<<uint(32-requiredCIDRSize))
+// lockPool looks up the slice's pool and returns it with its mutex held. The allocator's
+// mutex is only held for the lookup, so operations on different slices run in parallel.
+// A pool deleted or replaced while waiting for its mutex is looked up again.
+func (a *DynamicIPAMAllocator) lockPool(sliceName string) (*sliceIPPool, error) {
+	return a.acquirePool(context.Background(), sliceName, false)
+}
 
-		if firstFitNet.Contains(nextIP) {
-			remainderNets = append(remainderNets, &net.IPNet{
-				IP:   copyIP(nextIP),
-				Mask: net.CIDRMask(requiredCIDRSize, 32),
-			})
+// rlockPool is lockPool for queries: it returns the pool with its read lock held, which
+// the caller must release with pool.mu.RUnlock.
+func (a *DynamicIPAMAllocator) rlockPool(sliceName string) (*sliceIPPool, error) {
+	return a.acquirePool(context.Background(), sliceName, true)
+}
 
+// acquirePool looks up the slice's pool and locks it, waiting no longer than ctx allows.
+func (a *DynamicIPAMAllocator) acquirePool(ctx context.Context, sliceName string, read bool) (*sliceIPPool, error) {
+	for {
+		a.mu.RLock()
+		pool, exists := a.pools[sliceName]
+		a.mu.RUnlock()
+		if !exists {
+			return nil, fmt.Errorf("slice %s: %w", sliceName, ErrPoolNotInitialized)
 		}
 
-		for i := requiredCIDRSize; i > firstFitBits+1; i-- {
-			nextTonextIP := copyIP(nextIP)
+		if err := lockWithContext(ctx, &pool.mu, read); err != nil {
+			return nil, err
+		}
+		if !pool.deleted {
+			return pool, nil
+		}
+		if read {
+			pool.mu.RUnlock()
+		} else {
+			pool.mu.Unlock()
+		}
+	}
+}
 
-			nextTonextIP = incIP(nextTonextIP, 1<<uint(32-i))
+// Bounds of the interval at which lockWithContext retries a contended lock.
+const (
+	lockRetryInitial = 100 * time.Microsecond
+	lockRetryMax     = 5 * time.Millisecond
+)
 
-			copy(nextIP, nextTonextIP)
-			if firstFitNet.Contains(nextTonextIP) {
-				remainderNets = append(remainderNets, &net.IPNet{
-					IP:   copyIP(nextTonextIP),
-					Mask: net.CIDRMask(i-1, 32),
-				})
+// lockWithContext acquires mu, or its read lock if read is set, giving up with an error
+// wrapping ctx.Err() once ctx is done. A context that can never be done waits for the
+// lock like Lock. Otherwise the lock is polled with TryLock, backing off exponentially,
+// because a mutex wait cannot be abandoned.
+func lockWithContext(ctx context.Context, mu *sync.RWMutex, read bool) error {
+	tryLock, lock := mu.TryLock, mu.Lock
+	if read {
+		tryLock, lock = mu.TryRLock, mu.RLock
+	}
+	if tryLock() {
+		return nil
+	}
+	if ctx.Done() == nil {
+		lock()
+		return nil
+	}
 
-			}
+	timer := time.NewTimer(lockRetryInitial)
+	defer timer.Stop()
+	for delay := lockRetryInitial; ; {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("gave up waiting for the pool lock: %w", ctx.Err())
+		case <-timer.C:
+		}
+		if tryLock() {
+			return nil
 		}
-	} else if firstFitBits == requiredCIDRSize { // Exact fit
-		allocatedNet = &net.IPNet{IP: copyIP(firstFitNet.IP), Mask: firstFitNet.Mask}
+		if delay *= 2; delay > lockRetryMax {
+			delay = lockRetryMax
+		}
+		timer.Reset(delay)
 	}
+}
 
-	before := make([]*net.IPNet, 0, firstFitIndex)
-	before = append(before, pool.FreeBlocks[:firstFitIndex]...)
+// lockPoolContext is lockPool for operations that take a context. It fails if ctx is done,
+// before the wait, while waiting for a contended pool or once the pool's mutex is held, so
+// that a caller whose deadline passed does not hang or go on to mutate the pool.
+func (a *DynamicIPAMAllocator) lockPoolContext(ctx context.Context, operation, sliceName string) (*sliceIPPool, error) {
+	return a.acquirePoolContext(ctx, operation, sliceName, false)
+}
 
-	after := make([]*net.IPNet, 0, len(pool.FreeBlocks)-(firstFitIndex+1))
-	if firstFitIndex+1 < len(pool.FreeBlocks) {
-		after = append(after, pool.FreeBlocks[firstFitIndex+1:]...)
-	}
+// rlockPoolContext is lockPoolContext for queries; the caller releases the read lock.
+func (a *DynamicIPAMAllocator) rlockPoolContext(ctx context.Context, operation, sliceName string) (*sliceIPPool, error) {
+	return a.acquirePoolContext(ctx, operation, sliceName, true)
+}
 
-	remainderCopy := make([]*net.IPNet, 0, len(remainderNets))
-	for _, r := range remainderNets {
-		if r == nil {
-			continue
+func (a *DynamicIPAMAllocator) acquirePoolContext(ctx context.Context, operation, sliceName string, read bool) (*sliceIPPool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s in slice %s abandoned: %w", operation, sliceName, err)
+	}
+	pool, err := a.acquirePool(ctx, sliceName, read)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%s in slice %s abandoned: %w", operation, sliceName, err)
 		}
-
-		ipCp := copyIP(r.IP)
-		maskCp := append(net.IPMask(nil), r.Mask...)
-		remainderCopy = append(remainderCopy, &net.IPNet{
-			IP:   ipCp,
-			Mask: maskCp,
-		})
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		if read {
+			pool.mu.RUnlock()
+		} else {
+			pool.mu.Unlock()
+		}
+		return nil, fmt.Errorf("%s in slice %s abandoned: %w", operation, sliceName, err)
 	}
+	return pool, nil
+}
 
-	newFree := make([]*net.IPNet, 0, len(before)+len(remainderCopy)+len(after))
-	newFree = append(newFree, before...)
-	newFree = append(newFree, remainderCopy...)
-	newFree = append(newFree, after...)
+// Allocate allocates a subnet for a specific cluster within a slice.
+func (a *DynamicIPAMAllocator) Allocate(ctx context.Context, sliceName string, clusterName string, requiredCIDRSize int) (cidr string, err error) {
+	defer a.observeDuration(sliceName, ipamOperationAllocate, time.Now())
+	defer func() { a.countOperation(sliceName, ipamOperationAllocate, err) }()
+	pool, err := a.lockPoolContext(ctx, ipamOperationAllocate, sliceName)
+	if err != nil {
+		return "", err
+	}
+	defer pool.mu.Unlock()
 
-	pool.FreeBlocks = newFree
+	return a.allocateLocked(sliceName, pool, clusterName, requiredCIDRSize)
+}
 
-	pool.Allocated[clusterName] = &net.IPNet{
-		IP:   copyIP(allocatedNet.IP),
-		Mask: append(net.IPMask(nil), allocatedNet.Mask...),
+// allocateLocked allocates a block for a cluster in the given pool and records the
+// result. The caller must hold the pool's mutex.
+func (a *DynamicIPAMAllocator) allocateLocked(sliceName string, pool *sliceIPPool, clusterName string, requiredCIDRSize int) (string, error) {
+	if err := validateClusterName(clusterName); err != nil {
+		return "", err
+	}
+	if err := a.checkBlockSize(sliceName, clusterName, requiredCIDRSize); err != nil {
+		return "", err
+	}
+	_, existed := pool.Allocated[clusterName]
+	allocatedNet, err := pool.allocateSubnetForPool(clusterName, requiredCIDRSize)
+	if err != nil {
+		return "", fmt.Errorf("failed to allocate subnet for cluster %s in slice %s: %w", clusterName, sliceName, err)
+	}
+	if !existed {
+		a.audit(ipamOperationAllocate, sliceName, clusterName, allocatedNet)
+	}
+	a.recordPoolMetrics(sliceName, pool)
+	if err := a.verifyAfter(ipamOperationAllocate, sliceName, pool); err != nil {
+		return "", err
 	}
 
-	return allocatedNet, nil
+	return allocatedNet.String(), nil
 }
 
-func compareIPs(a, b net.IP) int {
+// AllocateForHosts allocates, like Allocate, the smallest block that holds at least
+// hostCount addresses: the host count is rounded up to a power of two and converted to a
+// prefix length for the slice's address family.
+func (a *DynamicIPAMAllocator) AllocateForHosts(ctx context.Context, sliceName string, clusterName string, hostCount int) (string, error) {
+	if hostCount < 1 {
+		return "", fmt.Errorf("host count for cluster %s must be positive, got %d", clusterName, hostCount)
+	}
+	pool, err := a.rlockPoolContext(ctx, ipamOperationAllocate, sliceName)
+	if err != nil {
+		return "", err
+	}
+	_, width := pool.SliceSubnet.Mask.Size()
+	pool.mu.RUnlock()
 
-	a4 := a.To4()
-	b4 := b.To4()
+	hostBits := 0
+	for hostBits <= width && uint64(1)<<hostBits < uint64(hostCount) {
+		hostBits++
+	}
+	if hostBits > width {
+		return "", fmt.Errorf("%d hosts for cluster %s do not fit the %d-bit address space of slice %s", hostCount, clusterName, width, sliceName)
+	}
 
-	if a4 != nil && b4 != nil {
+	return a.Allocate(ctx, sliceName, clusterName, width-hostBits)
+}
 
-		for i := 0; i < net.IPv4len; i++ {
-			if a4[i] < b4[i] {
-				return -1
-			}
-			if a4[i] > b4[i] {
-				return 1
-			}
-		}
-		return 0
+// checkBlockSize enforces WithMaxBlockSize for a cluster's request.
+func (a *DynamicIPAMAllocator) checkBlockSize(sliceName, clusterName string, requiredCIDRSize int) error {
+	if a.maxBlockPrefix > 0 && requiredCIDRSize < a.maxBlockPrefix {
+		return fmt.Errorf("/%d requested for cluster %s in slice %s is larger than the /%d limit: %w",
+			requiredCIDRSize, clusterName, sliceName, a.maxBlockPrefix, ErrBlockTooLarge)
 	}
+	return nil
+}
 
-	if a4 == nil && b4 == nil {
+// AllocateInRange allocates the largest block the pool can satisfy for a cluster whose
+// prefix lies between minPrefix and maxPrefix, trying minPrefix first and falling back to
+// each longer prefix up to maxPrefix. A cluster that already holds an allocation within
+// the range gets it back unchanged.
+func (a *DynamicIPAMAllocator) AllocateInRange(ctx context.Context, sliceName string, clusterName string, minPrefix, maxPrefix int) (cidr string, err error) {
+	defer a.observeDuration(sliceName, ipamOperationAllocate, time.Now())
+	defer func() { a.countOperation(sliceName, ipamOperationAllocate, err) }()
+	if err := validateClusterName(clusterName); err != nil {
+		return "", err
+	}
+	if minPrefix > maxPrefix {
+		return "", fmt.Errorf("invalid prefix range /%d-/%d: the minimum is longer than the maximum", minPrefix, maxPrefix)
+	}
+	if err := a.checkBlockSize(sliceName, clusterName, maxPrefix); err != nil {
+		return "", err
+	}
+	if minPrefix < a.maxBlockPrefix {
+		minPrefix = a.maxBlockPrefix
+	}
+	pool, err := a.lockPoolContext(ctx, ipamOperationAllocate, sliceName)
+	if err != nil {
+		return "", err
+	}
+	defer pool.mu.Unlock()
 
-		for i := 0; i < net.IPv6len; i++ {
-			if a[i] < b[i] {
-				return -1
-			}
-			if a[i] > b[i] {
-				return 1
-			}
+	if err := pool.validatePrefix(maxPrefix); err != nil {
+		return "", err
+	}
+	if allocated, found := pool.Allocated[clusterName]; found {
+		if ones, _ := allocated.Mask.Size(); ones >= minPrefix && ones <= maxPrefix {
+			return allocated.String(), nil
 		}
-		return 0
+		// Let Allocate report the size mismatch.
+		return a.allocateLocked(sliceName, pool, clusterName, maxPrefix)
 	}
 
-	if a4 != nil && b4 == nil {
-		return -1
+	for size := minPrefix; size <= maxPrefix; size++ {
+		if pool.canAllocate(size) {
+			return a.allocateLocked(sliceName, pool, clusterName, size)
+		}
 	}
-	if a4 == nil && b4 != nil {
-		return 1
+
+	return "", fmt.Errorf("failed to allocate subnet for cluster %s in slice %s: no available subnet between /%d and /%d in pool: %w",
+		clusterName, sliceName, minPrefix, maxPrefix, ErrPoolExhausted)
+}
+
+// It attempts to merge the reclaimed block with adjacent free blocks to reduce fragmentation.
+func (a *DynamicIPAMAllocator) Reclaim(ctx context.Context, sliceName string, clusterName string) (err error) {
+	defer a.observeDuration(sliceName, ipamOperationReclaim, time.Now())
+	defer func() { a.countOperation(sliceName, ipamOperationReclaim, err) }()
+	pool, err := a.lockPoolContext(ctx, ipamOperationReclaim, sliceName)
+	if err != nil {
+		return err
 	}
-	return 0
+	defer pool.mu.Unlock()
+
+	return a.reclaimLocked(sliceName, pool, clusterName)
 }
-func compareIPNets(a, b *net.IPNet) int {
-	cmp := compareIPs(a.IP, b.IP)
-	if cmp != 0 {
-		return cmp
+
+// ReclaimCIDR reclaims the allocation whose CIDR is exactly cidr, whichever cluster holds
+// it, for reconciliation when a leaked CIDR is known but its cluster is not. Reserved
+// allocations such as the VPN subnet cannot be reclaimed this way.
+func (a *DynamicIPAMAllocator) ReclaimCIDR(ctx context.Context, sliceName string, cidr string) (err error) {
+	defer a.observeDuration(sliceName, ipamOperationReclaim, time.Now())
+	defer func() { a.countOperation(sliceName, ipamOperationReclaim, err) }()
+	pool, err := a.lockPoolContext(ctx, ipamOperationReclaim, sliceName)
+	if err != nil {
+		return err
+	}
+	defer pool.mu.Unlock()
+
+	target, err := parseNetworkCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("cannot reclaim from slice %s: %w", sliceName, err)
 	}
-	onesA, _ := a.Mask.Size()
-	onesB, _ := b.Mask.Size()
-	bitsA := onesA
-	bitsB := onesB
-	if bitsA < bitsB {
-		return 1
+	for clusterName, allocated := range pool.Allocated {
+		if allocated.String() != target.String() {
+			continue
+		}
+		if isReservedAllocation(clusterName) {
+			return fmt.Errorf("cannot reclaim %s from slice %s: reserved for %s", cidr, sliceName, clusterName)
+		}
+		return a.reclaimLocked(sliceName, pool, clusterName)
 	}
-	if bitsA > bitsB {
-		return -1
+	if excluded := pool.excludedOverlapping(target); excluded != nil {
+		return fmt.Errorf("cannot reclaim %s from slice %s: overlaps exclusion %s: %w", target.String(), sliceName, excluded.String(), ErrRangeExcluded)
 	}
-	return 0
+
+	return fmt.Errorf("no cluster in slice %s holds %s: %w", sliceName, target.String(), ErrAllocationNotFound)
 }
 
-func tryMerge(a, b *net.IPNet) (*net.IPNet, bool) {
+// ReclaimAllForCluster reclaims every block the cluster holds in every slice, including
+// its named and contiguous blocks, for offboarding a cluster, and returns the freed CIDRs
+// keyed by slice name, ordered by Allocated key. A failure in one slice does not stop the
+// others; the returned error joins every failure, and the map still lists the blocks
+// that were reclaimed.
+func (a *DynamicIPAMAllocator) ReclaimAllForCluster(ctx context.Context, clusterName string) (map[string][]string, error) {
+	if err := validateClusterName(clusterName); err != nil {
+		return nil, err
+	}
 
-	if a.IP.To4() == nil || b.IP.To4() == nil {
-		return nil, false
+	sliceNames := a.ListSlices()
+	reclaimed := map[string][]string{}
+	var errs []error
+	for _, sliceName := range sliceNames {
+		cidrs, err := a.reclaimIfAllocated(ctx, sliceName, clusterName)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if len(cidrs) > 0 {
+			reclaimed[sliceName] = cidrs
+		}
 	}
 
-	bitsA, _ := a.Mask.Size()
-	bitsB, _ := b.Mask.Size()
-	if bitsA != bitsB {
-		return nil, false
+	return reclaimed, errors.Join(errs...)
+}
+
+// reclaimIfAllocated reclaims every block the cluster holds in one slice and returns their
+// CIDRs, or none if the cluster has no allocation there or the pool has since been
+// deleted. On failure the blocks reclaimed before it are still returned.
+func (a *DynamicIPAMAllocator) reclaimIfAllocated(ctx context.Context, sliceName, clusterName string) (cidrs []string, err error) {
+	defer a.observeDuration(sliceName, ipamOperationReclaim, time.Now())
+	defer func() { a.countOperation(sliceName, ipamOperationReclaim, err) }()
+	pool, err := a.lockPoolContext(ctx, ipamOperationReclaim, sliceName)
+	if errors.Is(err, ErrPoolNotInitialized) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
 	}
+	defer pool.mu.Unlock()
 
-	mergedBits := bitsA - 1
+	keys := pool.clusterKeys(clusterName)
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	for _, key := range keys {
+		allocated := pool.Allocated[key]
+		if err := a.reclaimLocked(sliceName, pool, key); err != nil {
+			return cidrs, err
+		}
+		cidrs = append(cidrs, allocated.String())
+	}
+	return cidrs, nil
+}
 
-	if mergedBits < 0 {
-		return nil, false
+// reclaimLocked returns a cluster's block to the given pool and records the result. The
+// caller must hold the pool's mutex.
+func (a *DynamicIPAMAllocator) reclaimLocked(sliceName string, pool *sliceIPPool, clusterName string) error {
+	if err := validateClusterName(clusterName); err != nil {
+		return err
+	}
+	subnetToReclaim, allocated := pool.Allocated[clusterName]
+	if !allocated {
+		return fmt.Errorf("cluster %s has no allocated subnet in slice %s to reclaim: %w", clusterName, sliceName, ErrAllocationNotFound)
 	}
 
-	mergedMask := net.CIDRMask(mergedBits, 32)
+	pool.forgetAllocation(clusterName)
 
-	potentialMergedNet := &net.IPNet{IP: a.IP, Mask: mergedMask}
+	pool.releaseBlock(subnetToReclaim)
+	a.autoCompact(sliceName, pool)
+	a.audit(ipamOperationReclaim, sliceName, clusterName, subnetToReclaim)
+	a.recordPoolMetrics(sliceName, pool)
 
-	blockSize := 1 << uint(32-bitsA)
+	return a.verifyAfter(ipamOperationReclaim, sliceName, pool)
+}
+
+// AllocateIdempotent allocates like Allocate but records idempotencyKey with the
+// allocation, so that a retried request can be recognised. A retry with a key that is
+// already recorded returns the CIDR claimed with it, while a request with a different key
+// for a cluster that already holds an allocation fails.
+func (a *DynamicIPAMAllocator) AllocateIdempotent(ctx context.Context, sliceName string, clusterName string, size int, idempotencyKey string) (cidr string, err error) {
+	defer a.observeDuration(sliceName, ipamOperationAllocate, time.Now())
+	defer func() { a.countOperation(sliceName, ipamOperationAllocate, err) }()
+	if err := validateClusterName(clusterName); err != nil {
+		return "", err
+	}
+	if idempotencyKey == "" {
+		return "", fmt.Errorf("idempotency key must not be empty")
+	}
+	if err := a.checkBlockSize(sliceName, clusterName, size); err != nil {
+		return "", err
+	}
 
-	expectedNextIP := copyIP(a.IP)
-	expectedNextIP = incIP(expectedNextIP, blockSize)
+	pool, err := a.lockPoolContext(ctx, ipamOperationAllocate, sliceName)
+	if err != nil {
+		return "", err
+	}
+	defer pool.mu.Unlock()
 
-	if expectedNextIP.Equal(b.IP) {
+	for owner, key := range pool.IdempotencyKeys {
+		if key == idempotencyKey {
+			return pool.Allocated[owner].String(), nil
+		}
+	}
+	if existing, allocated := pool.Allocated[clusterName]; allocated {
+		return "", fmt.Errorf("cluster %s already has subnet %s in slice %s claimed with a different idempotency key",
+			clusterName, existing.String(), sliceName)
+	}
 
-		return potentialMergedNet, true
+	allocatedNet, err := pool.allocateSubnetForPool(clusterName, size)
+	if err != nil {
+		return "", fmt.Errorf("failed to allocate subnet for cluster %s in slice %s: %w", clusterName, sliceName, err)
+	}
+	pool.IdempotencyKeys[clusterName] = idempotencyKey
+	a.audit(ipamOperationAllocate, sliceName, clusterName, allocatedNet)
+	a.recordPoolMetrics(sliceName, pool)
+	if err := a.verifyAfter(ipamOperationAllocate, sliceName, pool); err != nil {
+		return "", err
 	}
 
-	return nil, false
+	return allocatedNet.String(), nil
 }
 
-func incIP(ip net.IP, inc int) net.IP {
+// AllocateIndexed allocates one block of the given size for each index, keyed
+// "<baseName>-<index>", for consumers that need a predictable subnet per ordinal. Indices
+// are allocated in ascending order so the blocks come out ascending (and contiguous when
+// the free space allows). If any allocation fails, every allocation made by the call is
+// rolled back and the pool is left unchanged.
+func (a *DynamicIPAMAllocator) AllocateIndexed(ctx context.Context, sliceName string, baseName string, indices []int, size int) (allocated map[int]string, err error) {
+	defer a.observeDuration(sliceName, ipamOperationAllocate, time.Now())
+	defer func() { a.countOperation(sliceName, ipamOperationAllocate, err) }()
+	if baseName == "" {
+		return nil, fmt.Errorf("base name must not be empty")
+	}
+	if err := validateClusterName(baseName); err != nil {
+		return nil, err
+	}
+	if err := a.checkBlockSize(sliceName, baseName, size); err != nil {
+		return nil, err
+	}
+	pool, err := a.lockPoolContext(ctx, ipamOperationAllocate, sliceName)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.mu.Unlock()
+
+	ordered := append([]int(nil), indices...)
+	sort.Ints(ordered)
+	for i := 1; i < len(ordered); i++ {
+		if ordered[i] == ordered[i-1] {
+			return nil, fmt.Errorf("duplicate index %d for %s in slice %s", ordered[i], baseName, sliceName)
+		}
+	}
+
+	snapshot := pool.clone()
+	allocated = make(map[int]string, len(ordered))
+	// Indices that already hold their block get it back; only new blocks are audited.
+	var carved []string
+	for _, index := range ordered {
+		clusterName := fmt.Sprintf("%s-%d", baseName, index)
+		_, held := pool.Allocated[clusterName]
+		allocatedNet, err := pool.allocateSubnetForPool(clusterName, size)
+		if err != nil {
+			pool.restore(snapshot)
+			return nil, fmt.Errorf("failed to allocate subnet for cluster %s in slice %s: %w", clusterName, sliceName, err)
+		}
+		allocated[index] = allocatedNet.String()
+		if !held {
+			carved = append(carved, clusterName)
+		}
+	}
+	for _, clusterName := range carved {
+		a.audit(ipamOperationAllocate, sliceName, clusterName, pool.Allocated[clusterName])
+	}
+	a.recordPoolMetrics(sliceName, pool)
+	if err := a.verifyAfter(ipamOperationAllocate, sliceName, pool); err != nil {
+		return nil, err
+	}
 
-	res := copyIP(ip)
+	return allocated, nil
+}
 
-	carry := inc
-	for i := len(res) - 1; i >= 0; i-- {
-		if carry == 0 {
-			break
+// AllocateBatch allocates a block for every cluster in requests, which maps cluster names
+// to prefix lengths, under a single lock acquisition. Larger blocks are carved first,
+// ties in cluster name order, so the placement does not depend on map iteration. If any
+// allocation fails, every allocation made by the call is rolled back and the pool is left
+// unchanged.
+func (a *DynamicIPAMAllocator) AllocateBatch(ctx context.Context, sliceName string, requests map[string]int) (allocated map[string]string, err error) {
+	defer a.observeDuration(sliceName, ipamOperationAllocate, time.Now())
+	defer func() { a.countOperation(sliceName, ipamOperationAllocate, err) }()
+	for clusterName, size := range requests {
+		if err := validateClusterName(clusterName); err != nil {
+			return nil, err
 		}
-		sum := int(res[i]) + carry
-		res[i] = byte(sum % 256)
-		carry = sum / 256
+		if err := a.checkBlockSize(sliceName, clusterName, size); err != nil {
+			return nil, err
+		}
+	}
+	pool, err := a.lockPoolContext(ctx, ipamOperationAllocate, sliceName)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.mu.Unlock()
+
+	clusterNames := make([]string, 0, len(requests))
+	for clusterName := range requests {
+		clusterNames = append(clusterNames, clusterName)
+	}
+	sort.Slice(clusterNames, func(i, j int) bool {
+		if requests[clusterNames[i]] != requests[clusterNames[j]] {
+			return requests[clusterNames[i]] < requests[clusterNames[j]]
+		}
+		return clusterNames[i] < clusterNames[j]
+	})
+
+	snapshot := pool.clone()
+	allocated = make(map[string]string, len(clusterNames))
+	// Clusters that already hold their block get it back; only new blocks are audited.
+	var carved []string
+	for _, clusterName := range clusterNames {
+		_, held := pool.Allocated[clusterName]
+		allocatedNet, err := pool.allocateSubnetForPool(clusterName, requests[clusterName])
+		if err != nil {
+			pool.restore(snapshot)
+			return nil, fmt.Errorf("failed to allocate subnet for cluster %s in slice %s: %w", clusterName, sliceName, err)
+		}
+		allocated[clusterName] = allocatedNet.String()
+		if !held {
+			carved = append(carved, clusterName)
+		}
+	}
+	for _, clusterName := range carved {
+		a.audit(ipamOperationAllocate, sliceName, clusterName, pool.Allocated[clusterName])
+	}
+	a.recordPoolMetrics(sliceName, pool)
+	if err := a.verifyAfter(ipamOperationAllocate, sliceName, pool); err != nil {
+		return nil, err
+	}
+
+	return allocated, nil
+}
+
+// AllocateSpecific allocates exactly cidr to a cluster, for clusters whose subnet was
+// provisioned elsewhere. The CIDR must be a network address within the slice subnet and
+// must lie wholly inside a single free block, which is split around it. Requesting the
+// CIDR a cluster already holds is a no-op.
+func (a *DynamicIPAMAllocator) AllocateSpecific(ctx context.Context, sliceName string, clusterName string, cidr string) (err error) {
+	defer a.observeDuration(sliceName, ipamOperationAllocate, time.Now())
+	defer func() { a.countOperation(sliceName, ipamOperationAllocate, err) }()
+	if err := validateClusterName(clusterName); err != nil {
+		return err
+	}
+	pool, err := a.lockPoolContext(ctx, ipamOperationAllocate, sliceName)
+	if err != nil {
+		return err
+	}
+	defer pool.mu.Unlock()
+
+	requested, err := parseNetworkCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("cannot allocate to cluster %s: %w", clusterName, err)
+	}
+	ones, _ := requested.Mask.Size()
+	if err := a.checkBlockSize(sliceName, clusterName, ones); err != nil {
+		return err
+	}
+
+	if existing, found := pool.Allocated[clusterName]; found {
+		if existing.String() == requested.String() {
+			return nil
+		}
+		return fmt.Errorf("cluster %s already has subnet %s in slice %s, but requested %s: %w",
+			clusterName, existing.String(), sliceName, requested.String(), ErrReallocationUnsupported)
+	}
+
+	if err := pool.allocateSpecific(clusterName, requested); err != nil {
+		return fmt.Errorf("cannot allocate %s to cluster %s in slice %s: %w", requested.String(), clusterName, sliceName, err)
+	}
+	a.audit(ipamOperationAllocate, sliceName, clusterName, requested)
+	a.recordPoolMetrics(sliceName, pool)
+
+	return a.verifyAfter(ipamOperationAllocate, sliceName, pool)
+}
+
+// AllocateWithHint allocates preferred to a cluster if it is free, so that a re-created
+// cluster can get its old subnet back, and otherwise allocates a block of the required
+// size like Allocate. It returns the CIDR actually assigned. The hint must be a network
+// address of the required size; a cluster that already holds an allocation gets it back
+// as with Allocate, whatever the hint.
+func (a *DynamicIPAMAllocator) AllocateWithHint(ctx context.Context, sliceName string, clusterName string, requiredCIDRSize int, preferred string) (cidr string, err error) {
+	defer a.observeDuration(sliceName, ipamOperationAllocate, time.Now())
+	defer func() { a.countOperation(sliceName, ipamOperationAllocate, err) }()
+	hint, err := parseNetworkCIDR(preferred)
+	if err != nil {
+		return "", fmt.Errorf("invalid hint for cluster %s: %w", clusterName, err)
+	}
+	if ones, _ := hint.Mask.Size(); ones != requiredCIDRSize {
+		return "", fmt.Errorf("hint %s for cluster %s is not a /%d", hint.String(), clusterName, requiredCIDRSize)
+	}
+	if err := a.checkBlockSize(sliceName, clusterName, requiredCIDRSize); err != nil {
+		return "", err
+	}
+
+	pool, err := a.lockPoolContext(ctx, ipamOperationAllocate, sliceName)
+	if err != nil {
+		return "", err
+	}
+	defer pool.mu.Unlock()
+
+	if _, allocated := pool.Allocated[clusterName]; !allocated && !isReservedAllocation(clusterName) {
+		err := pool.allocateSpecific(clusterName, hint)
+		if err == nil {
+			a.audit(ipamOperationAllocate, sliceName, clusterName, hint)
+			a.recordPoolMetrics(sliceName, pool)
+			if err := a.verifyAfter(ipamOperationAllocate, sliceName, pool); err != nil {
+				return "", err
+			}
+			return hint.String(), nil
+		}
+		a.log.V(1).Info("allocation hint not available, falling back", "slice", sliceName, "cluster", clusterName, "hint", hint, "reason", err.Error())
+	}
+
+	return a.allocateLocked(sliceName, pool, clusterName, requiredCIDRSize)
+}
+
+// parseNetworkCIDR parses a CIDR that must be given by its network address, that is an
+// address aligned to its prefix. net.ParseCIDR would silently mask 10.0.1.64/25 to
+// 10.0.1.0/25; a caller asking for an exact block must say which block it means.
+func parseNetworkCIDR(cidr string) (*net.IPNet, error) {
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("%w %q", ErrInvalidCIDR, cidr)
+	}
+	if !ip.Equal(ipNet.IP) {
+		ones, _ := ipNet.Mask.Size()
+		return nil, fmt.Errorf("%w %q: not a network address aligned to /%d, did you mean %s?", ErrInvalidCIDR, cidr, ones, ipNet.String())
+	}
+	return cidrutil.Normalize(ipNet), nil
+}
+
+// allocateSpecific carves exactly requested out of the free block that contains it and
+// records it as the cluster's allocation. The caller must hold the pool's mutex and must
+// have checked that the cluster has no allocation yet.
+func (pool *sliceIPPool) allocateSpecific(clusterName string, requested *net.IPNet) error {
+	sliceOnes, sliceBits := pool.SliceSubnet.Mask.Size()
+	ones, bits := requested.Mask.Size()
+	// Merging assumes every block starts on its own boundary.
+	if aligned := cidrutil.NetworkIP(requested); !aligned.Equal(requested.IP) {
+		return fmt.Errorf("%s is not aligned to /%d, did you mean %s/%d?", requested.String(), ones, aligned.String(), ones)
+	}
+	if bits != sliceBits || ones < sliceOnes || !pool.SliceSubnet.Contains(requested.IP) {
+		return fmt.Errorf("not within slice subnet %s", pool.SliceSubnet.String())
+	}
+	// A large request can overlap several allocations; report the lowest so that the error
+	// does not depend on map iteration order.
+	var conflict *net.IPNet
+	var conflictOwner string
+	for owner, allocated := range pool.Allocated {
+		if cidrutil.Overlaps(requested, allocated) && (conflict == nil || cidrutil.Compare(allocated, conflict) < 0) {
+			conflict, conflictOwner = allocated, owner
+		}
+	}
+	if conflict != nil {
+		return fmt.Errorf("overlaps subnet %s allocated to %s", conflict.String(), conflictOwner)
+	}
+	if excluded := pool.excludedOverlapping(requested); excluded != nil {
+		return fmt.Errorf("overlaps exclusion %s: %w", excluded.String(), ErrRangeExcluded)
+	}
+	if err := pool.checkClusterQuota(clusterName); err != nil {
+		return err
+	}
+
+	pool.releaseExpired()
+	index := -1
+	for i, freeNet := range pool.FreeBlocks {
+		if freeOnes, _ := freeNet.Mask.Size(); freeOnes <= ones && freeNet.Contains(requested.IP) {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("not free")
+	}
+	if err := pool.carveFreeBlock(index, requested); err != nil {
+		return err
+	}
+	pool.Allocated[clusterName] = cidrutil.Normalize(requested)
+
+	return nil
+}
+
+// AllocateWithValidator allocates like Allocate, but offers each feasible candidate to
+// validate before committing it, so that callers can veto CIDRs that conflict with
+// systems outside the slice. Candidates are the aligned blocks of the required size in
+// each free block, in free list order and ascending within a block. The first accepted
+// candidate is allocated; if every candidate is rejected the pool is left unchanged.
+func (a *DynamicIPAMAllocator) AllocateWithValidator(ctx context.Context, sliceName string, clusterName string, size int, validate func(cidr string) bool) (cidr string, err error) {
+	defer a.observeDuration(sliceName, ipamOperationAllocate, time.Now())
+	defer func() { a.countOperation(sliceName, ipamOperationAllocate, err) }()
+	if err := validateClusterName(clusterName); err != nil {
+		return "", err
+	}
+	if validate == nil {
+		return "", fmt.Errorf("validator must not be nil")
+	}
+	if err := a.checkBlockSize(sliceName, clusterName, size); err != nil {
+		return "", err
+	}
+
+	pool, err := a.lockPoolContext(ctx, ipamOperationAllocate, sliceName)
+	if err != nil {
+		return "", err
+	}
+	defer pool.mu.Unlock()
+
+	if _, allocated := pool.Allocated[clusterName]; allocated {
+		// Defer to the usual handling of an existing allocation.
+		allocatedNet, err := pool.allocateSubnetForPool(clusterName, size)
+		if err != nil {
+			return "", fmt.Errorf("failed to allocate subnet for cluster %s in slice %s: %w", clusterName, sliceName, err)
+		}
+		return allocatedNet.String(), nil
+	}
+
+	if err := pool.checkClusterQuota(clusterName); err != nil {
+		return "", fmt.Errorf("failed to allocate subnet for cluster %s in slice %s: %w", clusterName, sliceName, err)
+	}
+	if err := pool.validateAllocationPrefix(size); err != nil {
+		return "", fmt.Errorf("failed to allocate subnet for cluster %s in slice %s: %w", clusterName, sliceName, err)
+	}
+	pool.releaseExpired()
+	if pool.findFit(size, nil) == -1 {
+		pool.coalesceFreeBlocks()
+	}
+	for i, block := range pool.FreeBlocks {
+		ones, bits := block.Mask.Size()
+		if ones > size || size > bits {
+			continue
+		}
+		candidate := &net.IPNet{IP: cidrutil.NetworkIP(block), Mask: net.CIDRMask(size, bits)}
+		for {
+			if validate(candidate.String()) {
+				if err := pool.carveFreeBlock(i, candidate); err != nil {
+					return "", fmt.Errorf("failed to allocate subnet for cluster %s in slice %s: %w", clusterName, sliceName, err)
+				}
+				pool.Allocated[clusterName] = cidrutil.Normalize(candidate)
+				a.audit(ipamOperationAllocate, sliceName, clusterName, candidate)
+				a.recordPoolMetrics(sliceName, pool)
+				if err := a.verifyAfter(ipamOperationAllocate, sliceName, pool); err != nil {
+					return "", err
+				}
+				return candidate.String(), nil
+			}
+			next, ok := cidrutil.Next(candidate)
+			if !ok || !block.Contains(next.IP) {
+				break
+			}
+			candidate = next
+		}
+	}
+
+	return "", fmt.Errorf("failed to allocate subnet for cluster %s in slice %s: no candidate of size /%d was accepted by the validator",
+		clusterName, sliceName, size)
+}
+
+// PreserveAllocation marks a cluster's allocation as sticky so that ResetPool keeps it.
+// The mark is dropped when the allocation is reclaimed.
+func (a *DynamicIPAMAllocator) PreserveAllocation(ctx context.Context, sliceName string, clusterName string) error {
+	pool, err := a.lockPoolContext(ctx, "preserve", sliceName)
+	if err != nil {
+		return err
+	}
+	defer pool.mu.Unlock()
+
+	if _, allocated := pool.Allocated[clusterName]; !allocated {
+		return fmt.Errorf("cluster %s has no allocated subnet in slice %s to preserve: %w", clusterName, sliceName, ErrAllocationNotFound)
+	}
+	pool.Preserved[clusterName] = true
+
+	return nil
+}
+
+// ReserveBlock withholds cidr for infrastructure, such as a DNS range, under name. Like
+// the VPN reservation, the block is listed among the allocations, under
+// ReservedBlockKey(name), never counts against a cluster quota and survives ResetPool.
+// The CIDR must be a network address of free space within the slice subnet. Reserving
+// the block name already holds is a no-op.
+func (a *DynamicIPAMAllocator) ReserveBlock(ctx context.Context, sliceName, name, cidr string) (err error) {
+	defer a.observeDuration(sliceName, ipamOperationAllocate, time.Now())
+	defer func() { a.countOperation(sliceName, ipamOperationAllocate, err) }()
+	if name == "" || strings.Contains(name, namedAllocationSeparator) {
+		return fmt.Errorf("invalid reservation name %q", name)
+	}
+	requested, err := parseNetworkCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("cannot reserve %s in slice %s: %w", name, sliceName, err)
+	}
+
+	pool, err := a.lockPoolContext(ctx, ipamOperationAllocate, sliceName)
+	if err != nil {
+		return err
+	}
+	defer pool.mu.Unlock()
+
+	key := ReservedBlockKey(name)
+	if existing, found := pool.Allocated[key]; found {
+		if existing.String() == requested.String() {
+			return nil
+		}
+		return fmt.Errorf("reservation %s already holds subnet %s in slice %s, but requested %s: %w",
+			name, existing.String(), sliceName, requested.String(), ErrReallocationUnsupported)
+	}
+	if err := pool.allocateSpecific(key, requested); err != nil {
+		return fmt.Errorf("cannot reserve %s as %s in slice %s: %w", requested.String(), name, sliceName, err)
+	}
+	a.audit(ipamOperationAllocate, sliceName, key, requested)
+	a.recordPoolMetrics(sliceName, pool)
+
+	return a.verifyAfter(ipamOperationAllocate, sliceName, pool)
+}
+
+// ReleaseBlock returns the block reserved as name with ReserveBlock to the free list.
+func (a *DynamicIPAMAllocator) ReleaseBlock(ctx context.Context, sliceName, name string) (err error) {
+	defer a.observeDuration(sliceName, ipamOperationReclaim, time.Now())
+	defer func() { a.countOperation(sliceName, ipamOperationReclaim, err) }()
+	pool, err := a.lockPoolContext(ctx, ipamOperationReclaim, sliceName)
+	if err != nil {
+		return err
+	}
+	defer pool.mu.Unlock()
+
+	key := ReservedBlockKey(name)
+	block, found := pool.Allocated[key]
+	if !found {
+		return fmt.Errorf("no block is reserved as %s in slice %s: %w", name, sliceName, ErrAllocationNotFound)
+	}
+	pool.forgetAllocation(key)
+	pool.releaseBlock(block)
+	a.autoCompact(sliceName, pool)
+	a.audit(ipamOperationReclaim, sliceName, key, block)
+	a.recordPoolMetrics(sliceName, pool)
+
+	return a.verifyAfter(ipamOperationReclaim, sliceName, pool)
+}
+
+// RenameAllocation moves a cluster's allocation to a new cluster name, for clusters that
+// are renamed during a migration. The cluster's named and contiguous blocks move with it,
+// keeping their purposes; a named key as oldName moves only that block. The CIDRs stay
+// the same and never return to the free list, so they cannot be handed to another
+// cluster in between, as they could with a Reclaim followed by an Allocate. Each
+// allocation's preserve mark, labels, idempotency key and expiry move with it. If any
+// target key is already held, or the blocks would take the new cluster past the pool's
+// per-cluster limit, nothing is renamed. Each moved block is audited and published as a
+// reclaim from the old key followed by an allocation to the new one.
+func (a *DynamicIPAMAllocator) RenameAllocation(ctx context.Context, sliceName, oldName, newName string) (err error) {
+	defer a.observeDuration(sliceName, ipamOperationRename, time.Now())
+	defer func() { a.countOperation(sliceName, ipamOperationRename, err) }()
+	for _, clusterName := range []string{oldName, newName} {
+		if err := validateClusterName(clusterName); err != nil {
+			return err
+		}
+	}
+	pool, err := a.lockPoolContext(ctx, ipamOperationRename, sliceName)
+	if err != nil {
+		return err
+	}
+	defer pool.mu.Unlock()
+
+	keys := pool.clusterKeys(oldName)
+	if len(keys) == 0 {
+		return fmt.Errorf("cluster %s has no allocated subnet in slice %s to rename: %w", oldName, sliceName, ErrAllocationNotFound)
+	}
+	if oldName == newName {
+		return nil
+	}
+	renamed := make(map[string]string, len(keys))
+	for _, key := range keys {
+		newKey := newName + strings.TrimPrefix(key, oldName)
+		if existing, exists := pool.Allocated[newKey]; exists {
+			return fmt.Errorf("cannot rename cluster %s to %s in slice %s: %s already has subnet %s: %w",
+				oldName, newName, sliceName, newKey, existing.String(), ErrAllocationExists)
+		}
+		renamed[key] = newKey
+	}
+	// Blocks that stay within the same cluster, such as one named block renamed to
+	// another, do not count against its limit again.
+	added := 0
+	for _, key := range keys {
+		if allocationCluster(key) != allocationCluster(renamed[key]) {
+			added++
+		}
+	}
+	if err := pool.checkClusterQuotaFor(newName, added); err != nil {
+		return fmt.Errorf("cannot rename cluster %s to %s in slice %s: %w", oldName, newName, sliceName, err)
+	}
+
+	for _, key := range keys {
+		newKey := renamed[key]
+		allocatedNet := pool.Allocated[key]
+		pool.Allocated[newKey] = allocatedNet
+		if pool.Preserved[key] {
+			pool.Preserved[newKey] = true
+		}
+		if labels, ok := pool.Labels[key]; ok {
+			pool.Labels[newKey] = labels
+		}
+		if idempotencyKey, ok := pool.IdempotencyKeys[key]; ok {
+			pool.IdempotencyKeys[newKey] = idempotencyKey
+		}
+		if expiry, ok := pool.Expiry[key]; ok {
+			pool.Expiry[newKey] = expiry
+		}
+		pool.forgetAllocation(key)
+		a.log.Info("renamed allocation", "slice", sliceName, "cluster", key, "newName", newKey, "cidr", allocatedNet)
+		a.audit(ipamOperationReclaim, sliceName, key, allocatedNet)
+		a.audit(ipamOperationAllocate, sliceName, newKey, allocatedNet)
+	}
+	a.recordPoolMetrics(sliceName, pool)
+
+	return a.verifyAfter(ipamOperationRename, sliceName, pool)
+}
+
+// ResetPool clears every tenant allocation of a slice during resync. Reserved allocations,
+// that is the VPN subnet and blocks reserved with ReserveBlock, and allocations marked
+// with PreserveAllocation survive the reset.
+func (a *DynamicIPAMAllocator) ResetPool(ctx context.Context, sliceName string) error {
+	pool, err := a.lockPoolContext(ctx, "reset", sliceName)
+	if err != nil {
+		return err
+	}
+	defer pool.mu.Unlock()
+
+	clusterNames := make([]string, 0, len(pool.Allocated))
+	for clusterName := range pool.Allocated {
+		if isReservedAllocation(clusterName) || pool.Preserved[clusterName] {
+			continue
+		}
+		clusterNames = append(clusterNames, clusterName)
+	}
+	sort.Strings(clusterNames)
+
+	for _, clusterName := range clusterNames {
+		block := pool.Allocated[clusterName]
+		pool.releaseBlock(block)
+		pool.forgetAllocation(clusterName)
+		a.audit(ipamOperationReclaim, sliceName, clusterName, block)
+	}
+	a.recordPoolMetrics(sliceName, pool)
+
+	return nil
+}
+
+// SetAllocationLabels replaces the labels attached to a cluster's allocation.
+func (a *DynamicIPAMAllocator) SetAllocationLabels(ctx context.Context, sliceName string, clusterName string, labels map[string]string) error {
+	pool, err := a.lockPoolContext(ctx, "label", sliceName)
+	if err != nil {
+		return err
+	}
+	defer pool.mu.Unlock()
+
+	if _, allocated := pool.Allocated[clusterName]; !allocated {
+		return fmt.Errorf("cluster %s has no allocated subnet in slice %s to label: %w", clusterName, sliceName, ErrAllocationNotFound)
+	}
+	copied := make(map[string]string, len(labels))
+	for k, v := range labels {
+		copied[k] = v
+	}
+	pool.Labels[clusterName] = copied
+
+	return nil
+}
+
+// ReclaimByLabel reclaims every allocation in the slice labelled labelKey=labelValue and
+// returns the reclaimed cluster names in sorted order. Reserved and preserved allocations
+// are skipped. The free list is coalesced once after all blocks have been returned, or the
+// blocks are quarantined together if the pool has a quarantine duration.
+func (a *DynamicIPAMAllocator) ReclaimByLabel(ctx context.Context, sliceName string, labelKey string, labelValue string) ([]string, error) {
+	pool, err := a.lockPoolContext(ctx, ipamOperationReclaim, sliceName)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.mu.Unlock()
+
+	reclaimed := []string{}
+	for clusterName, labels := range pool.Labels {
+		if isReservedAllocation(clusterName) || pool.Preserved[clusterName] {
+			continue
+		}
+		if value, ok := labels[labelKey]; ok && value == labelValue {
+			reclaimed = append(reclaimed, clusterName)
+		}
+	}
+	if len(reclaimed) == 0 {
+		return reclaimed, nil
+	}
+	sort.Strings(reclaimed)
+
+	blocks := make([]*net.IPNet, 0, len(reclaimed))
+	for _, clusterName := range reclaimed {
+		blocks = append(blocks, pool.Allocated[clusterName])
+		pool.forgetAllocation(clusterName)
+	}
+	pool.releaseBlocks(blocks)
+	for i, clusterName := range reclaimed {
+		a.audit(ipamOperationReclaim, sliceName, clusterName, blocks[i])
+	}
+	a.recordPoolMetrics(sliceName, pool)
+
+	return reclaimed, nil
+}
+
+// PeekNext returns the CIDRs that the next count Allocate calls of the given size would
+// hand out, without changing the pool. The result is shorter than count if the pool
+// would be exhausted first.
+func (a *DynamicIPAMAllocator) PeekNext(sliceName string, size, count int) ([]string, error) {
+	pool, err := a.rlockPool(sliceName)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.mu.RUnlock()
+
+	scratch := pool.clone()
+	scratch.trace = logr.Discard()
+	next := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		allocatedNet, err := scratch.carveFit(size)
+		if err != nil {
+			break
+		}
+		next = append(next, allocatedNet.String())
+	}
+
+	return next, nil
+}
+
+// MaxClustersAtSize returns how many clusters of the given prefix length the slice could
+// hold if it were perfectly packed from empty: the slice size minus reserved space,
+// divided by the block size. Unlike the current free list it ignores fragmentation; see
+// MaxAllocatableBlocks for what can still be allocated now.
+func (a *DynamicIPAMAllocator) MaxClustersAtSize(sliceName string, size int) (int, error) {
+	pool, err := a.rlockPool(sliceName)
+	if err != nil {
+		return 0, err
+	}
+	defer pool.mu.RUnlock()
+
+	sliceOnes, bits := pool.SliceSubnet.Mask.Size()
+	if size < sliceOnes || size > bits {
+		return 0, fmt.Errorf("prefix /%d is outside the range /%d-/%d of slice %s", size, sliceOnes, bits, sliceName)
+	}
+
+	available := addressCount(pool.SliceSubnet) - pool.reservedAddressCount()
+	clusters := math.Floor(available / math.Ldexp(1, bits-size))
+	if clusters > math.MaxInt {
+		return math.MaxInt, nil
+	}
+	return int(clusters), nil
+}
+
+// MaxAllocatableBlocks returns how many blocks of the given prefix length could still be
+// allocated from the slice's current free blocks. Free blocks are aligned, so each holds
+// exactly its size divided by the block size; free blocks smaller than the prefix hold
+// none, which is how fragmentation lowers the count.
+func (a *DynamicIPAMAllocator) MaxAllocatableBlocks(ctx context.Context, sliceName string, prefixSize int) (int, error) {
+	pool, err := a.rlockPoolContext(ctx, "count", sliceName)
+	if err != nil {
+		return 0, err
+	}
+	defer pool.mu.RUnlock()
+
+	sliceOnes, bits := pool.SliceSubnet.Mask.Size()
+	if prefixSize < sliceOnes || prefixSize > bits {
+		return 0, fmt.Errorf("prefix /%d is outside the range /%d-/%d of slice %s", prefixSize, sliceOnes, bits, sliceName)
+	}
+
+	var blocks float64
+	for _, freeNet := range pool.FreeBlocks {
+		if ones, _ := freeNet.Mask.Size(); ones <= prefixSize {
+			blocks += math.Ldexp(1, prefixSize-ones)
+		}
+	}
+	if blocks > math.MaxInt {
+		return math.MaxInt, nil
+	}
+	return int(blocks), nil
+}
+
+// IsExhausted reports whether the slice can no longer fit a block of the given prefix
+// length, taking the current fragmentation of the free list into account.
+func (a *DynamicIPAMAllocator) IsExhausted(sliceName string, size int) (bool, error) {
+	pool, err := a.rlockPool(sliceName)
+	if err != nil {
+		return false, err
+	}
+	defer pool.mu.RUnlock()
+
+	sliceOnes, bits := pool.SliceSubnet.Mask.Size()
+	if size < sliceOnes || size > bits {
+		return false, fmt.Errorf("prefix /%d is outside the range /%d-/%d of slice %s", size, sliceOnes, bits, sliceName)
+	}
+
+	return !pool.canAllocate(size), nil
+}
+
+// CanAllocate reports whether Allocate could currently carve a block of the given prefix
+// length from the slice, without changing the pool. A request smaller than the slice
+// subnet's prefix is simply reported as not satisfiable.
+func (a *DynamicIPAMAllocator) CanAllocate(ctx context.Context, sliceName string, requiredCIDRSize int) (bool, error) {
+	pool, err := a.rlockPoolContext(ctx, "check", sliceName)
+	if err != nil {
+		return false, err
+	}
+	defer pool.mu.RUnlock()
+
+	if err := pool.validatePrefix(requiredCIDRSize); err != nil {
+		return false, err
+	}
+
+	return pool.canAllocate(requiredCIDRSize), nil
+}
+
+// SelectPoolForAllocation returns the candidate slice best placed to hold a new block of
+// the required prefix length: among the slices where CanAllocate succeeds, the one with
+// the most free addresses, then the fewest free blocks, then the earliest in candidates.
+// The error wraps ErrPoolExhausted if no candidate can hold the block.
+func (a *DynamicIPAMAllocator) SelectPoolForAllocation(ctx context.Context, candidateSlices []string, requiredCIDRSize int) (string, error) {
+	best := ""
+	var bestStats PoolStats
+	for _, sliceName := range candidateSlices {
+		ok, err := a.CanAllocate(ctx, sliceName, requiredCIDRSize)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			continue
+		}
+		stats, err := a.PoolStats(ctx, sliceName)
+		if err != nil {
+			return "", err
+		}
+		if best == "" || stats.FreeAddresses > bestStats.FreeAddresses ||
+			(stats.FreeAddresses == bestStats.FreeAddresses && stats.FreeBlocks < bestStats.FreeBlocks) {
+			best, bestStats = sliceName, stats
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("none of the %d candidate slices can hold a /%d: %w", len(candidateSlices), requiredCIDRSize, ErrPoolExhausted)
+	}
+
+	return best, nil
+}
+
+// StuckFreeBlocks returns the free blocks that cannot coalesce because their buddy is
+// wholly or partly allocated, in free list order. Moving the allocations inside those
+// buddies is what unlocks larger contiguous space.
+func (a *DynamicIPAMAllocator) StuckFreeBlocks(sliceName string) ([]string, error) {
+	pool, err := a.rlockPool(sliceName)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.mu.RUnlock()
+
+	sliceOnes, _ := pool.SliceSubnet.Mask.Size()
+	stuck := []string{}
+	for _, block := range pool.FreeBlocks {
+		if ones, _ := block.Mask.Size(); ones <= sliceOnes {
+			continue
+		}
+		buddy, ok := buddyOf(block)
+		if !ok {
+			continue
+		}
+		for _, allocated := range pool.Allocated {
+			if cidrutil.Overlaps(buddy, allocated) {
+				stuck = append(stuck, block.String())
+				break
+			}
+		}
+	}
+
+	return stuck, nil
+}
+
+// ListAllocations returns a copy of the slice's allocations as cluster name to CIDR,
+// including reserved allocations such as the VPN subnet.
+func (a *DynamicIPAMAllocator) ListAllocations(ctx context.Context, sliceName string) (map[string]string, error) {
+	pool, err := a.rlockPoolContext(ctx, "list", sliceName)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.mu.RUnlock()
+
+	allocations := make(map[string]string, len(pool.Allocated))
+	for clusterName, ipNet := range pool.Allocated {
+		allocations[clusterName] = ipNet.String()
+	}
+
+	return allocations, nil
+}
+
+// ForEachAllocation calls fn with each of the slice's allocations, including reserved
+// allocations such as the VPN subnet, until fn returns false. Unlike ListAllocations it
+// copies nothing, but it holds the pool's read lock throughout, so fn must not call back
+// into the allocator for the same slice or it may deadlock. The order is unspecified.
+func (a *DynamicIPAMAllocator) ForEachAllocation(ctx context.Context, sliceName string, fn func(clusterName, cidr string) bool) error {
+	pool, err := a.rlockPoolContext(ctx, "iterate", sliceName)
+	if err != nil {
+		return err
+	}
+	defer pool.mu.RUnlock()
+
+	for clusterName, ipNet := range pool.Allocated {
+		if !fn(clusterName, ipNet.String()) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// GetAllocation returns the CIDR allocated to a cluster in the slice. The error wraps
+// ErrAllocationNotFound if the cluster has no allocation.
+func (a *DynamicIPAMAllocator) GetAllocation(ctx context.Context, sliceName string, clusterName string) (string, error) {
+	pool, err := a.rlockPoolContext(ctx, "get", sliceName)
+	if err != nil {
+		return "", err
+	}
+	defer pool.mu.RUnlock()
+
+	allocated, found := pool.Allocated[clusterName]
+	if !found {
+		return "", fmt.Errorf("cluster %s in slice %s: %w", clusterName, sliceName, ErrAllocationNotFound)
+	}
+
+	return allocated.String(), nil
+}
+
+// LookupByIP returns the Allocated key and CIDR of the block that contains ip, for tracing
+// an address back to its owner. The key is the cluster name, the "<cluster>/<purpose>"
+// key of a named allocation, or the VPN reservation's key. The error wraps
+// ErrAllocationNotFound if ip is free, quarantined, excluded or outside the slice subnet.
+func (a *DynamicIPAMAllocator) LookupByIP(ctx context.Context, sliceName string, ip string) (clusterName string, cidr string, err error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return "", "", fmt.Errorf("invalid IP address %q", ip)
+	}
+	pool, err := a.rlockPoolContext(ctx, "get", sliceName)
+	if err != nil {
+		return "", "", err
+	}
+	defer pool.mu.RUnlock()
+
+	if !pool.SliceSubnet.Contains(addr) {
+		return "", "", fmt.Errorf("IP %s is outside slice subnet %s of slice %s: %w", ip, pool.SliceSubnet.String(), sliceName, ErrAllocationNotFound)
+	}
+	for key, allocated := range pool.Allocated {
+		if allocated.Contains(addr) {
+			return key, allocated.String(), nil
+		}
+	}
+	return "", "", fmt.Errorf("IP %s in slice %s: %w", ip, sliceName, ErrAllocationNotFound)
+}
+
+// GetVPNSubnet returns the CIDR reserved for the slice's VPN gateway. The error wraps
+// ErrAllocationNotFound if the allocator was created WithoutVPNReservation.
+func (a *DynamicIPAMAllocator) GetVPNSubnet(ctx context.Context, sliceName string) (string, error) {
+	pool, err := a.rlockPoolContext(ctx, "get", sliceName)
+	if err != nil {
+		return "", err
+	}
+	defer pool.mu.RUnlock()
+
+	vpn, reserved := pool.Allocated[ReservedVPNClusterKey]
+	if !reserved {
+		return "", fmt.Errorf("VPN subnet of slice %s: %w", sliceName, ErrAllocationNotFound)
+	}
+
+	return vpn.String(), nil
+}
+
+// Compact sorts the slice's free blocks and merges buddies until no two free blocks can
+// merge, and returns how many free blocks were eliminated. Allocations keep the free list
+// merged as blocks are returned, so Compact only finds work after the list was built by
+// other means, such as loaded state or bulk releases; it is cheap to run periodically.
+func (a *DynamicIPAMAllocator) Compact(ctx context.Context, sliceName string) (int, error) {
+	pool, err := a.lockPoolContext(ctx, "compact", sliceName)
+	if err != nil {
+		return 0, err
+	}
+	defer pool.mu.Unlock()
+
+	before := len(pool.FreeBlocks)
+	pool.coalesceFreeBlocks()
+	merged := before - len(pool.FreeBlocks)
+	if merged > 0 {
+		a.log.V(1).Info("compacted free blocks", "slice", sliceName, "merged", merged, "freeBlocks", len(pool.FreeBlocks))
+	}
+	a.recordPoolMetrics(sliceName, pool)
+
+	return merged, nil
+}
+
+// autoCompact compacts the pool if it holds more free blocks than the WithAutoCompact
+// threshold. The caller must hold the pool's mutex.
+func (a *DynamicIPAMAllocator) autoCompact(sliceName string, pool *sliceIPPool) {
+	if a.autoCompactThreshold <= 0 || len(pool.FreeBlocks) <= a.autoCompactThreshold {
+		return
+	}
+	before := len(pool.FreeBlocks)
+	pool.coalesceFreeBlocks()
+	a.log.V(1).Info("compacted free blocks", "slice", sliceName, "merged", before-len(pool.FreeBlocks), "freeBlocks", len(pool.FreeBlocks), "threshold", a.autoCompactThreshold)
+}
+
+// GetFreeBlocks returns the slice's free blocks as CIDR strings, ordered by address
+// independently of the configured free block ordering.
+func (a *DynamicIPAMAllocator) GetFreeBlocks(ctx context.Context, sliceName string) ([]string, error) {
+	pool, err := a.rlockPoolContext(ctx, "list", sliceName)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.mu.RUnlock()
+
+	blocks := append([]*net.IPNet(nil), pool.FreeBlocks...)
+	sort.Slice(blocks, func(i, j int) bool {
+		return cidrutil.Compare(blocks[i], blocks[j]) < 0
+	})
+	free := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		free = append(free, block.String())
+	}
+
+	return free, nil
+}
+
+// clone returns a deep copy of the pool's state. The copy has its own mutex.
+func (pool *sliceIPPool) clone() *sliceIPPool {
+	out := &sliceIPPool{
+		SliceSubnet:       copyIPNet(pool.SliceSubnet),
+		Allocated:         make(map[string]*net.IPNet, len(pool.Allocated)),
+		FreeBlocks:        make([]*net.IPNet, 0, len(pool.FreeBlocks)),
+		Preserved:         make(map[string]bool, len(pool.Preserved)),
+		Labels:            make(map[string]map[string]string, len(pool.Labels)),
+		IdempotencyKeys:   make(map[string]string, len(pool.IdempotencyKeys)),
+		Expiry:            make(map[string]time.Time, len(pool.Expiry)),
+		less:              pool.less,
+		trace:             pool.trace,
+		options:           pool.options,
+		clock:             pool.clock,
+		strategy:          pool.strategy,
+		clusterBlockLimit: pool.clusterBlockLimit,
+	}
+	for clusterName, ipNet := range pool.Allocated {
+		out.Allocated[clusterName] = copyIPNet(ipNet)
+	}
+	for _, ipNet := range pool.FreeBlocks {
+		out.FreeBlocks = append(out.FreeBlocks, copyIPNet(ipNet))
+	}
+	for clusterName, preserved := range pool.Preserved {
+		out.Preserved[clusterName] = preserved
+	}
+	for clusterName, labels := range pool.Labels {
+		copied := make(map[string]string, len(labels))
+		for k, v := range labels {
+			copied[k] = v
+		}
+		out.Labels[clusterName] = copied
+	}
+	for clusterName, key := range pool.IdempotencyKeys {
+		out.IdempotencyKeys[clusterName] = key
+	}
+	for clusterName, expiry := range pool.Expiry {
+		out.Expiry[clusterName] = expiry
+	}
+	for _, ipNet := range pool.Excluded {
+		out.Excluded = append(out.Excluded, copyIPNet(ipNet))
+	}
+	for _, q := range pool.Quarantined {
+		out.Quarantined = append(out.Quarantined, quarantinedBlock{Block: copyIPNet(q.Block), ReleaseAt: q.ReleaseAt})
+	}
+	return out
+}
+
+// restore replaces the pool's state with a snapshot taken by clone. The pool keeps its
+// own mutex, so callers must hold it.
+func (pool *sliceIPPool) restore(snapshot *sliceIPPool) {
+	pool.SliceSubnet = snapshot.SliceSubnet
+	pool.Allocated = snapshot.Allocated
+	pool.FreeBlocks = snapshot.FreeBlocks
+	pool.Preserved = snapshot.Preserved
+	pool.Labels = snapshot.Labels
+	pool.IdempotencyKeys = snapshot.IdempotencyKeys
+	pool.Expiry = snapshot.Expiry
+	pool.Excluded = snapshot.Excluded
+	pool.Quarantined = snapshot.Quarantined
+	pool.index = nil
+}
+
+// canAllocate reports whether an allocation of the given size would currently succeed,
+// without changing the pool.
+func (pool *sliceIPPool) canAllocate(size int) bool {
+	scratch := pool.clone()
+	scratch.trace = logr.Discard()
+	_, err := scratch.carveFit(size)
+	return err == nil
+}
+
+// forgetAllocation drops a cluster's allocation together with all metadata kept for it.
+// The caller is responsible for returning the block to the free list.
+func (pool *sliceIPPool) forgetAllocation(clusterName string) {
+	delete(pool.Allocated, clusterName)
+	delete(pool.Preserved, clusterName)
+	delete(pool.Labels, clusterName)
+	delete(pool.IdempotencyKeys, clusterName)
+	delete(pool.Expiry, clusterName)
+}
+
+// lessFunc returns the pool's free block ordering, falling back to the default.
+func (pool *sliceIPPool) lessFunc() FreeBlockLess {
+	if pool.less == nil {
+		return defaultFreeBlockLess
+	}
+	return pool.less
+}
+
+// tracer returns the pool's split and merge logger, discarding output for pools that
+// were not created by InitializePool.
+func (pool *sliceIPPool) tracer() logr.Logger {
+	if pool.trace.GetSink() == nil {
+		return logr.Discard()
+	}
+	return pool.trace
+}
+
+// sortFreeBlocks restores the pool's free block ordering after a mutation.
+//
+// Every change to the free list ends in sortFreeBlocks or an ordered insertion, and no
+// step of placement depends on map iteration order, so an identical sequence of requests
+// on identical pools always yields identical allocations and free lists.
+func (pool *sliceIPPool) sortFreeBlocks() {
+	pool.index = nil
+	less := pool.lessFunc()
+	sort.SliceStable(pool.FreeBlocks, func(i, j int) bool {
+		return less(pool.FreeBlocks[i], pool.FreeBlocks[j])
+	})
+}
+
+// insertFreeBlock adds block to the already sorted free list. Rather than re-sorting the
+// whole list it binary searches for the insertion point and merges the block with its
+// buddy among the neighbours there, repeating for each merged parent.
+func (pool *sliceIPPool) insertFreeBlock(block *net.IPNet) {
+	block = cidrutil.Normalize(block)
+	index := pool.currentIndex()
+	less := pool.lessFunc()
+	for {
+		idx := sort.Search(len(pool.FreeBlocks), func(i int) bool {
+			return !less(pool.FreeBlocks[i], block)
+		})
+		if idx > 0 {
+			if merged, ok := cidrutil.Merge(pool.FreeBlocks[idx-1], block); ok {
+				pool.tracer().Info("merged free blocks", "block", block, "buddy", pool.FreeBlocks[idx-1], "merged", merged)
+				index.remove(pool.FreeBlocks[idx-1])
+				pool.FreeBlocks = append(pool.FreeBlocks[:idx-1], pool.FreeBlocks[idx:]...)
+				block = merged
+				continue
+			}
+		}
+		if idx < len(pool.FreeBlocks) {
+			if merged, ok := cidrutil.Merge(pool.FreeBlocks[idx], block); ok {
+				pool.tracer().Info("merged free blocks", "block", block, "buddy", pool.FreeBlocks[idx], "merged", merged)
+				index.remove(pool.FreeBlocks[idx])
+				pool.FreeBlocks = append(pool.FreeBlocks[:idx], pool.FreeBlocks[idx+1:]...)
+				block = merged
+				continue
+			}
+		}
+		pool.insertSortedFreeBlock(idx, block)
+		index.add(block)
+		index.sync(pool.FreeBlocks)
+		return
+	}
+}
+
+// insertSortedFreeBlock inserts block at position idx of the free list without merging.
+func (pool *sliceIPPool) insertSortedFreeBlock(idx int, block *net.IPNet) {
+	pool.FreeBlocks = append(pool.FreeBlocks, nil)
+	copy(pool.FreeBlocks[idx+1:], pool.FreeBlocks[idx:])
+	pool.FreeBlocks[idx] = block
+}
+
+// coalesceFreeBlocks merges buddies across the whole free list until no two free blocks
+// can merge, then re-sorts it. Blocks are walked in address order, where buddies are
+// always neighbours, and each merged parent is checked again against the block before it,
+// so a pair of /25s that completes a /24 next to a free /24 ends up as a /23.
+func (pool *sliceIPPool) coalesceFreeBlocks() {
+	for i, block := range pool.FreeBlocks {
+		pool.FreeBlocks[i] = cidrutil.Normalize(block)
+	}
+	sort.SliceStable(pool.FreeBlocks, func(i, j int) bool {
+		return cidrutil.Compare(pool.FreeBlocks[i], pool.FreeBlocks[j]) < 0
+	})
+
+	newFreeBlocks := make([]*net.IPNet, 0, len(pool.FreeBlocks))
+	for _, block := range pool.FreeBlocks {
+		newFreeBlocks = append(newFreeBlocks, block)
+		for n := len(newFreeBlocks); n > 1; n = len(newFreeBlocks) {
+			merged, ok := cidrutil.Merge(newFreeBlocks[n-2], newFreeBlocks[n-1])
+			if !ok {
+				break
+			}
+			pool.tracer().Info("merged free blocks", "block", newFreeBlocks[n-2], "buddy", newFreeBlocks[n-1], "merged", merged)
+			newFreeBlocks = append(newFreeBlocks[:n-2], merged)
+		}
+	}
+	pool.FreeBlocks = newFreeBlocks
+	pool.sortFreeBlocks()
+}
+
+// --- Helper Functions for IPNet Manipulation ---
+
+func copyIPNet(ipNet *net.IPNet) *net.IPNet {
+	if ipNet == nil {
+		return nil
+	}
+	return &net.IPNet{IP: cidrutil.CopyIP(ipNet.IP), Mask: append(net.IPMask(nil), ipNet.Mask...)}
+}
+
+func (pool *sliceIPPool) allocateSubnetForPool(clusterName string, requiredCIDRSize int) (*net.IPNet, error) {
+
+	if allocatedNet, found := pool.Allocated[clusterName]; found {
+		ones, _ := allocatedNet.Mask.Size()
+		existingBits := ones
+		if existingBits == requiredCIDRSize {
+			return allocatedNet, nil
+		}
+
+		return nil, fmt.Errorf("cluster %s already has subnet %s (/%d), but requested /%d: %w",
+			clusterName, allocatedNet.String(), existingBits, requiredCIDRSize, ErrReallocationUnsupported)
+	}
+	if err := pool.checkClusterQuota(clusterName); err != nil {
+		return nil, err
+	}
+
+	allocatedNet, err := pool.carveFit(requiredCIDRSize)
+	if err != nil {
+		return nil, err
+	}
+
+	pool.Allocated[clusterName] = cidrutil.Normalize(allocatedNet)
+
+	return allocatedNet, nil
+}
+
+// checkClusterQuota rejects a new block for an Allocated key once its cluster holds as
+// many blocks as the pool's per-cluster limit. Reserved allocations are not limited.
+func (pool *sliceIPPool) checkClusterQuota(key string) error {
+	return pool.checkClusterQuotaFor(key, 1)
+}
+
+// checkClusterQuotaFor rejects adding n blocks to the cluster of an Allocated key if that
+// would take it past the pool's per-cluster limit.
+func (pool *sliceIPPool) checkClusterQuotaFor(key string, n int) error {
+	if pool.clusterBlockLimit <= 0 || isReservedAllocation(key) || n <= 0 {
+		return nil
+	}
+	clusterName := allocationCluster(key)
+	held := 0
+	for allocatedKey := range pool.Allocated {
+		if allocationCluster(allocatedKey) == clusterName {
+			held++
+		}
+	}
+	if held+n > pool.clusterBlockLimit {
+		if n == 1 {
+			return fmt.Errorf("cluster %s already holds %d of %d blocks: %w", clusterName, held, pool.clusterBlockLimit, ErrClusterQuotaExceeded)
+		}
+		return fmt.Errorf("cluster %s already holds %d of %d blocks and cannot take %d more: %w",
+			clusterName, held, pool.clusterBlockLimit, n, ErrClusterQuotaExceeded)
+	}
+	return nil
+}
+
+// carveFit removes a block of the required prefix length from the free block chosen by
+// the pool's allocation strategy and returns it, leaving the split remainders in the free
+// list. The caller decides who owns the returned block.
+func (pool *sliceIPPool) carveFit(requiredCIDRSize int) (*net.IPNet, error) {
+	return pool.carveFitTraced(requiredCIDRSize, nil)
+}
+
+// carveFitTraced is carveFit, recording the scan in trace if it is not nil.
+func (pool *sliceIPPool) carveFitTraced(requiredCIDRSize int, trace *AllocationTrace) (*net.IPNet, error) {
+	if err := pool.validateAllocationPrefix(requiredCIDRSize); err != nil {
+		return nil, err
+	}
+	pool.releaseExpired()
+	fitIndex := pool.findFit(requiredCIDRSize, trace)
+	if fitIndex == -1 {
+		// Buddies left unmerged (e.g. by bulk edits of the free list) may still add up to
+		// a large enough block, so coalesce before declaring the pool exhausted.
+		pool.coalesceFreeBlocks()
+		if trace != nil {
+			trace.Coalesced = true
+			trace.Considered = nil
+		}
+		fitIndex = pool.findFit(requiredCIDRSize, trace)
+	}
+	if fitIndex == -1 {
+		return nil, fmt.Errorf("no available subnet of size /%d in pool: %w", requiredCIDRSize, ErrPoolExhausted)
+	}
+	allocatedNet, remainderNets := splitBlock(pool.FreeBlocks[fitIndex], requiredCIDRSize)
+	pool.replaceFreeBlock(fitIndex, allocatedNet, remainderNets)
+
+	return allocatedNet, nil
+}
+
+// splitBlock carves a block of the given prefix length from the start of parent and
+// returns it together with the minimal tiling of the rest of parent, one remainder per
+// prefix length from the allocation's up to parent's, in ascending address order. It
+// returns nil if allocPrefix is shorter than parent's prefix or longer than the address.
+func splitBlock(parent *net.IPNet, allocPrefix int) (allocated *net.IPNet, remainders []*net.IPNet) {
+	parent = cidrutil.Normalize(parent)
+	parentOnes, bits := parent.Mask.Size()
+	if bits == 0 || allocPrefix < parentOnes || allocPrefix > bits {
+		return nil, nil
+	}
+
+	allocated = &net.IPNet{IP: cidrutil.CopyIP(parent.IP), Mask: net.CIDRMask(allocPrefix, bits)}
+	remainders = make([]*net.IPNet, 0, allocPrefix-parentOnes)
+	for current := parent; ; {
+		lower, upper, ok := cidrutil.Split(current)
+		if ones, _ := current.Mask.Size(); !ok || ones == allocPrefix {
+			break
+		}
+		remainders = append(remainders, upper)
+		current = lower
+	}
+	sort.Slice(remainders, func(i, j int) bool {
+		return cidrutil.Compare(remainders[i], remainders[j]) < 0
+	})
+	return allocated, remainders
+}
+
+// carveFreeBlock removes allocatedNet, which must lie within the free block at index,
+// from the free list, leaving the split remainders in its place.
+func (pool *sliceIPPool) carveFreeBlock(index int, allocatedNet *net.IPNet) error {
+	freeNet := pool.FreeBlocks[index]
+	remainderNets, err := cidrutil.Subtract(freeNet, allocatedNet)
+	if err != nil {
+		return fmt.Errorf("failed to split free block %s: %w", freeNet.String(), err)
+	}
+	pool.replaceFreeBlock(index, allocatedNet, remainderNets)
+
+	return nil
+}
+
+// replaceFreeBlock replaces the free block at index, from which allocatedNet was carved,
+// with the remainders of the split. The remainders are inserted in order rather than
+// re-sorting the free list, and the prefix index is updated to match.
+func (pool *sliceIPPool) replaceFreeBlock(index int, allocatedNet *net.IPNet, remainderNets []*net.IPNet) {
+	blockNet := pool.FreeBlocks[index]
+	pool.tracer().Info("split free block", "block", blockNet, "allocated", allocatedNet, "remainders", remainderNets)
+
+	prefixIndex := pool.currentIndex()
+	prefixIndex.remove(blockNet)
+	pool.FreeBlocks = append(pool.FreeBlocks[:index], pool.FreeBlocks[index+1:]...)
+
+	less := pool.lessFunc()
+	for _, r := range remainderNets {
+		if r == nil {
+			continue
+		}
+		remainder := copyIPNet(r)
+		idx := sort.Search(len(pool.FreeBlocks), func(i int) bool {
+			return !less(pool.FreeBlocks[i], remainder)
+		})
+		pool.insertSortedFreeBlock(idx, remainder)
+		prefixIndex.add(remainder)
+	}
+	prefixIndex.sync(pool.FreeBlocks)
+}
+
+// validatePrefix rejects prefix lengths that do not exist in the slice's address family.
+func (pool *sliceIPPool) validatePrefix(size int) error {
+	_, bits := pool.SliceSubnet.Mask.Size()
+	if size < 0 || size > bits {
+		return fmt.Errorf("prefix /%d is outside the %d-bit width of slice subnet %s", size, bits, pool.SliceSubnet.String())
+	}
+	return nil
+}
+
+// validateAllocationPrefix rejects prefix lengths no allocation can have: those outside
+// the address family, and those shorter than the slice subnet's own prefix, which ask for
+// a block larger than the whole slice. The latter wraps ErrPoolExhausted, as the pool can
+// never hold such a block.
+func (pool *sliceIPPool) validateAllocationPrefix(size int) error {
+	if err := pool.validatePrefix(size); err != nil {
+		return err
+	}
+	if sliceOnes, _ := pool.SliceSubnet.Mask.Size(); size < sliceOnes {
+		return fmt.Errorf("prefix /%d is larger than slice subnet %s, which is a /%d: %w",
+			size, pool.SliceSubnet.String(), sliceOnes, ErrPoolExhausted)
+	}
+	return nil
+}
+
+// vpnSubnetSize returns the prefix length of the VPN reservation for a slice subnet.
+func (a *DynamicIPAMAllocator) vpnSubnetSize(sliceNet *net.IPNet) int {
+	if _, bits := sliceNet.Mask.Size(); bits == 8*net.IPv6len {
+		return vpnIPv6SubnetRequiredSize
+	}
+	if a.vpnPrefix > 0 {
+		return a.vpnPrefix
+	}
+	return vpnSubnetRequiredSize
+}
+
+// findFirstFit returns the index of the first free block able to hold a block of the
+// required prefix length, or -1 if there is none.
+func (pool *sliceIPPool) findFirstFit(requiredCIDRSize int) int {
+	return pool.scanFirstFit(requiredCIDRSize, nil)
+}
+
+// scanFirstFit is findFirstFit, appending each examined block to trace if it is not nil.
+func (pool *sliceIPPool) scanFirstFit(requiredCIDRSize int, trace *AllocationTrace) int {
+	for i, freeNet := range pool.FreeBlocks {
+		ones, _ := freeNet.Mask.Size()
+		if ones <= requiredCIDRSize {
+			trace.consider(freeNet, "")
+			return i
+		}
+		trace.consider(freeNet, fmt.Sprintf("/%d is smaller than the requested /%d", ones, requiredCIDRSize))
+	}
+	return -1
+}
+
+// buddyOf returns the other half of the parent block that contains block. A /0 has no
+// buddy.
+func buddyOf(block *net.IPNet) (*net.IPNet, bool) {
+	ones, bits := block.Mask.Size()
+	if ones == 0 || bits == 0 {
+		return nil, false
 	}
-	return res
+	ip := cidrutil.NetworkIP(block)
+	ip[(ones-1)/8] ^= 0x80 >> uint((ones-1)%8)
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, bits)}, true
 }
@@ -2,11 +2,18 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"net"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/dailymotion/allure-go"
+	"github.com/go-logr/logr/funcr"
+	"github.com/kubeslice/kubeslice-controller/util/cidrutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -23,10 +30,60 @@ func TestDynamicIPAMAllocateSuite(t *testing.T) {
 }
 
 var IPAMAllocateTestBed = map[string]func(*testing.T){
-	"TestDynamicIPAMAllocator_InitializePool": TestDynamicIPAMAllocator_InitializePool,
-	"TestDynamicIPAMAllocator_Allocate":       TestDynamicIPAMAllocator_Allocate,
-	"TestDynamicIPAMAllocator_Reclaim":        TestDynamicIPAMAllocator_Reclaim,
-	"TestHelperFunctions":                     TestHelperFunctions,
+	"TestDynamicIPAMAllocator_InitializePool":        TestDynamicIPAMAllocator_InitializePool,
+	"TestDynamicIPAMAllocator_Allocate":              TestDynamicIPAMAllocator_Allocate,
+	"TestDynamicIPAMAllocator_Reclaim":               TestDynamicIPAMAllocator_Reclaim,
+	"TestHelperFunctions":                            TestHelperFunctions,
+	"TestDynamicIPAMAllocator_FreeBlockLess":         TestDynamicIPAMAllocator_FreeBlockLess,
+	"TestSliceIPPool_InsertFreeBlock":                TestSliceIPPool_InsertFreeBlock,
+	"TestDynamicIPAMAllocator_ResetPool":             TestDynamicIPAMAllocator_ResetPool,
+	"TestDynamicIPAMAllocator_CoalesceOnDemand":      TestDynamicIPAMAllocator_CoalesceOnDemand,
+	"TestSplitBlock":                                 TestSplitBlock,
+	"TestDynamicIPAMAllocator_ReclaimByLabel":        TestDynamicIPAMAllocator_ReclaimByLabel,
+	"TestDynamicIPAMAllocator_PeekNext":              TestDynamicIPAMAllocator_PeekNext,
+	"TestDynamicIPAMAllocator_AllocateIdempotent":    TestDynamicIPAMAllocator_AllocateIdempotent,
+	"TestDynamicIPAMAllocator_SplitLogLevel":         TestDynamicIPAMAllocator_SplitLogLevel,
+	"TestDynamicIPAMAllocator_MaxClustersAtSize":     TestDynamicIPAMAllocator_MaxClustersAtSize,
+	"TestDynamicIPAMAllocator_Capabilities":          TestDynamicIPAMAllocator_Capabilities,
+	"TestDynamicIPAMAllocator_AllocateIndexed":       TestDynamicIPAMAllocator_AllocateIndexed,
+	"TestSliceIPPool_NonCanonicalMasks":              TestSliceIPPool_NonCanonicalMasks,
+	"TestDynamicIPAMAllocator_IsExhausted":           TestDynamicIPAMAllocator_IsExhausted,
+	"TestDynamicIPAMAllocator_StuckFreeBlocks":       TestDynamicIPAMAllocator_StuckFreeBlocks,
+	"TestDynamicIPAMAllocator_AllocateWithValidator": TestDynamicIPAMAllocator_AllocateWithValidator,
+	"TestDynamicIPAMAllocator_IPv6":                  TestDynamicIPAMAllocator_IPv6,
+	"TestDynamicIPAMAllocator_ListAllocations":       TestDynamicIPAMAllocator_ListAllocations,
+	"TestDynamicIPAMAllocator_GetFreeBlocks":         TestDynamicIPAMAllocator_GetFreeBlocks,
+	"TestDynamicIPAMAllocator_VPNSubnetSize":         TestDynamicIPAMAllocator_VPNSubnetSize,
+	"TestDynamicIPAMAllocator_SplitTilesFreeBlock":   TestDynamicIPAMAllocator_SplitTilesFreeBlock,
+	"TestDynamicIPAMAllocator_AllocateBatch":         TestDynamicIPAMAllocator_AllocateBatch,
+	"TestSliceIPPool_CoalesceToFixpoint":             TestSliceIPPool_CoalesceToFixpoint,
+	"TestDynamicIPAMAllocator_CanAllocate":           TestDynamicIPAMAllocator_CanAllocate,
+	"TestDynamicIPAMAllocator_GetAllocation":         TestDynamicIPAMAllocator_GetAllocation,
+	"TestDynamicIPAMAllocator_SentinelErrors":        TestDynamicIPAMAllocator_SentinelErrors,
+	"TestDynamicIPAMAllocator_AllocateSpecific":      TestDynamicIPAMAllocator_AllocateSpecific,
+	"TestDynamicIPAMAllocator_MaxAllocatableBlocks":  TestDynamicIPAMAllocator_MaxAllocatableBlocks,
+	"TestDynamicIPAMAllocator_VPNSubnetPlacement":    TestDynamicIPAMAllocator_VPNSubnetPlacement,
+	"TestDynamicIPAMAllocator_ReclaimCIDR":           TestDynamicIPAMAllocator_ReclaimCIDR,
+	"TestDynamicIPAMAllocator_AllocateInRange":       TestDynamicIPAMAllocator_AllocateInRange,
+	"TestDynamicIPAMAllocator_ReservedClusterName":   TestDynamicIPAMAllocator_ReservedClusterName,
+	"TestDynamicIPAMAllocator_Compact":               TestDynamicIPAMAllocator_Compact,
+	"TestDynamicIPAMAllocator_AutoCompact":           TestDynamicIPAMAllocator_AutoCompact,
+	"TestDynamicIPAMAllocator_ForEachAllocation":     TestDynamicIPAMAllocator_ForEachAllocation,
+	"TestDynamicIPAMAllocator_ReclaimAllForCluster":  TestDynamicIPAMAllocator_ReclaimAllForCluster,
+	"TestDynamicIPAMAllocator_Deterministic":         TestDynamicIPAMAllocator_Deterministic,
+	"TestDynamicIPAMAllocator_SortedAfterSplit":      TestDynamicIPAMAllocator_SortedAfterSplit,
+	"TestDynamicIPAMAllocator_WithoutVPNReservation": TestDynamicIPAMAllocator_WithoutVPNReservation,
+	"TestDynamicIPAMAllocator_AllocateWithHint":      TestDynamicIPAMAllocator_AllocateWithHint,
+	"TestDynamicIPAMAllocator_SelectPool":            TestDynamicIPAMAllocator_SelectPool,
+	"TestDynamicIPAMAllocator_GetVPNSubnet":          TestDynamicIPAMAllocator_GetVPNSubnet,
+	"TestDynamicIPAMAllocator_LookupByIP":            TestDynamicIPAMAllocator_LookupByIP,
+	"TestDynamicIPAMAllocator_MaxBlockSize":          TestDynamicIPAMAllocator_MaxBlockSize,
+	"TestDynamicIPAMAllocator_IsInitialized":         TestDynamicIPAMAllocator_IsInitialized,
+	"TestDynamicIPAMAllocator_ListSlices":            TestDynamicIPAMAllocator_ListSlices,
+	"TestDynamicIPAMAllocator_AllocateForHosts":      TestDynamicIPAMAllocator_AllocateForHosts,
+	"TestDynamicIPAMAllocator_RenameAllocation":      TestDynamicIPAMAllocator_RenameAllocation,
+	"TestDynamicIPAMAllocator_OperationLogging":      TestDynamicIPAMAllocator_OperationLogging,
+	"TestDynamicIPAMAllocator_ContextDone":           TestDynamicIPAMAllocator_ContextDone,
 }
 
 func TestDynamicIPAMAllocator_InitializePool(t *testing.T) {
@@ -37,7 +94,7 @@ func TestDynamicIPAMAllocator_InitializePool(t *testing.T) {
 	t.Run("Successfully initialize pool", func(t *testing.T) {
 		err := allocator.InitializePool(sliceName, sliceSubnet)
 		require.NoError(t, err)
-		vpnSubnet, err := allocator.Allocate(context.Background(), sliceName, "VPN_Subnet", 24)
+		vpnSubnet, err := allocator.GetAllocation(context.Background(), sliceName, ReservedVPNClusterKey)
 		require.NoError(t, err)
 		assert.NotEmpty(t, vpnSubnet)
 		t.Logf("VPN subnet reserved: %s", vpnSubnet)
@@ -48,10 +105,20 @@ func TestDynamicIPAMAllocator_InitializePool(t *testing.T) {
 		require.NoError(t, err, "re-initializing an existing pool should not return an error")
 	})
 
+	t.Run("Re-initialization with a different subnet", func(t *testing.T) {
+		require.NoError(t, allocator.InitializePool(sliceName, "10.0.1.1/16"), "the same network written with host bits still matches")
+
+		err := allocator.InitializePool(sliceName, "10.1.0.0/16")
+		assert.ErrorIs(t, err, ErrSliceSubnetMismatch)
+		err = allocator.InitializePool(sliceName, "10.0.0.0/15")
+		assert.ErrorIs(t, err, ErrSliceSubnetMismatch, "a grown subnet must go through ResizePool")
+		assert.Equal(t, sliceSubnet, allocator.pools[sliceName].SliceSubnet.String())
+	})
+
 	t.Run("Invalid slice subnet CIDR", func(t *testing.T) {
 		err := allocator.InitializePool("invalid-slice", "192.168.1.0/33")
 		require.Error(t, err)
-		assert.Contains(t, err.Error(), "invalid slice subnet CIDR")
+		assert.ErrorIs(t, err, ErrInvalidCIDR)
 	})
 }
 
@@ -102,7 +169,7 @@ func TestDynamicIPAMAllocator_Allocate(t *testing.T) {
 		requiredCIDRSize := 25
 		_, err := allocator.Allocate(context.Background(), sliceName, clusterName, requiredCIDRSize)
 		require.Error(t, err)
-		assert.Contains(t, err.Error(), "Re-allocation not supported in this version.")
+		assert.ErrorIs(t, err, ErrReallocationUnsupported)
 	})
 
 	t.Run("Allocation when no suitable free block is available", func(t *testing.T) {
@@ -120,21 +187,47 @@ func TestDynamicIPAMAllocator_Allocate(t *testing.T) {
 
 		_, err = smallAllocator.Allocate(context.Background(), smallSliceName, "big-cluster", 23)
 		require.Error(t, err)
-		assert.Contains(t, err.Error(), "no available subnet of size /23")
+		assert.ErrorIs(t, err, ErrPoolExhausted)
 
 		_, err = smallAllocator.Allocate(context.Background(), smallSliceName, "last-cluster", 24)
 		require.Error(t, err)
-		assert.Contains(t, err.Error(), "no available subnet of size /24")
+		assert.ErrorIs(t, err, ErrPoolExhausted)
+	})
+
+	t.Run("Prefix outside the valid range", func(t *testing.T) {
+		before := allocator.pools[sliceName].snapshot()
+		for _, tc := range []struct {
+			size    int
+			message string
+		}{
+			{size: -1, message: "prefix /-1 is outside the 32-bit width"},
+			{size: 33, message: "prefix /33 is outside the 32-bit width"},
+			{size: 0, message: "prefix /0 is larger than slice subnet 10.10.0.0/16"},
+			{size: 15, message: "prefix /15 is larger than slice subnet 10.10.0.0/16"},
+		} {
+			_, err := allocator.Allocate(context.Background(), sliceName, "bounds-cluster", tc.size)
+			require.Error(t, err, tc.size)
+			assert.Contains(t, err.Error(), tc.message)
+		}
+		assert.Equal(t, before, allocator.pools[sliceName].snapshot(), "rejected requests leave the pool unchanged")
+
+		_, err := allocator.Allocate(context.Background(), sliceName, "bounds-cluster", 15)
+		assert.ErrorIs(t, err, ErrPoolExhausted, "a block larger than the slice can never be allocated")
+
+		whole := NewDynamicIPAMAllocator(WithVPNSubnetSize(0))
+		require.NoError(t, whole.InitializePool("whole-slice", "10.11.0.0/16"))
+		cidr, err := whole.Allocate(context.Background(), "whole-slice", "bounds-cluster", 16)
+		require.NoError(t, err)
+		assert.Equal(t, "10.11.0.0/16", cidr, "the slice's own prefix is the largest valid block")
 	})
 
 	t.Run("Allocate for uninitialized slice", func(t *testing.T) {
 		_, err := allocator.Allocate(context.Background(), "non-existent-slice", "some-cluster", 24)
 		require.Error(t, err)
-		assert.Contains(t, err.Error(), "ipam pool for slice non-existent-slice is not initialized")
+		assert.ErrorIs(t, err, ErrPoolNotInitialized)
 	})
 
 	t.Run("Multiple allocations and splitting", func(t *testing.T) {
-		fmt.Printf("\n\n\n\n MULTIPLE ALLOCATIONS AND SPLITTING\n")
 		multiAllocator := NewDynamicIPAMAllocator()
 		multiSliceName := "multi-slice"
 		multiSliceSubnet := "192.168.0.0/16"
@@ -201,13 +294,13 @@ func TestDynamicIPAMAllocator_Reclaim(t *testing.T) {
 	t.Run("Reclaim non-existent allocation", func(t *testing.T) {
 		err := allocator.Reclaim(context.Background(), sliceName, "non-existent-cluster")
 		require.Error(t, err)
-		assert.Contains(t, err.Error(), "no allocated subnet")
+		assert.ErrorIs(t, err, ErrAllocationNotFound)
 	})
 
 	t.Run("Reclaim from uninitialized slice", func(t *testing.T) {
 		err := allocator.Reclaim(context.Background(), "another-slice", "some-cluster")
 		require.Error(t, err)
-		assert.Contains(t, err.Error(), "ipam pool for slice another-slice is not initialized")
+		assert.ErrorIs(t, err, ErrPoolNotInitialized)
 	})
 
 	t.Run("Reclaim and merge adjacent blocks", func(t *testing.T) {
@@ -245,81 +338,2218 @@ func TestDynamicIPAMAllocator_Reclaim(t *testing.T) {
 	})
 }
 
-func TestHelperFunctions(t *testing.T) {
-	t.Run("compareIPs", func(t *testing.T) {
-		ip1 := net.ParseIP("192.168.1.1")
-		ip2 := net.ParseIP("192.168.1.10")
-		ip3 := net.ParseIP("192.168.1.1")
-		ipV6_1 := net.ParseIP("::1")
-		ipV6_2 := net.ParseIP("::10")
+func TestDynamicIPAMAllocator_FreeBlockLess(t *testing.T) {
+	descending := func(a, b *net.IPNet) bool {
+		return cidrutil.Compare(a, b) > 0
+	}
+	allocator := NewDynamicIPAMAllocator(WithFreeBlockLess(descending))
+	sliceName := "reverse-slice"
+	err := allocator.InitializePool(sliceName, "10.40.0.0/22")
+	require.NoError(t, err)
+
+	freeBlocks := func() []string {
+		pool := allocator.pools[sliceName]
+		out := make([]string, 0, len(pool.FreeBlocks))
+		for _, b := range pool.FreeBlocks {
+			out = append(out, b.String())
+		}
+		return out
+	}
 
-		assert.Equal(t, -1, compareIPs(ip1, ip2))
-		assert.Equal(t, 1, compareIPs(ip2, ip1))
-		assert.Equal(t, 0, compareIPs(ip1, ip3))
+	t.Run("Allocation picks the first block in comparator order", func(t *testing.T) {
+		cidrA, err := allocator.Allocate(context.Background(), sliceName, "cluster-a", 25)
+		require.NoError(t, err)
+		assert.Equal(t, "10.40.2.0/25", cidrA)
 
-		assert.Equal(t, -1, compareIPs(ipV6_1, ipV6_2))
-		assert.Equal(t, 1, compareIPs(ipV6_2, ipV6_1))
-		assert.Equal(t, -1, compareIPs(ip1, ipV6_1), "IPv4 should be 'smaller' than IPv6")
-		assert.Equal(t, 1, compareIPs(ipV6_1, ip1), "IPv6 should be 'larger' than IPv4")
+		cidrB, err := allocator.Allocate(context.Background(), sliceName, "cluster-b", 25)
+		require.NoError(t, err)
+		assert.Equal(t, "10.40.3.0/25", cidrB)
+		assert.Equal(t, []string{"10.40.3.128/25", "10.40.2.128/25", "10.40.1.0/24"}, freeBlocks())
 	})
 
-	t.Run("compareIPNets", func(t *testing.T) {
-		_, net1, _ := net.ParseCIDR("192.168.1.0/24")
-		_, net2, _ := net.ParseCIDR("192.168.2.0/24")
-		_, net3, _ := net.ParseCIDR("192.168.1.0/25")
-		_, net4, _ := net.ParseCIDR("192.168.1.0/24")
+	t.Run("Reclaim sorts and merges using the comparator", func(t *testing.T) {
+		err := allocator.Reclaim(context.Background(), sliceName, "cluster-b")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"10.40.3.0/24", "10.40.2.128/25", "10.40.1.0/24"}, freeBlocks())
+
+		cidrC, err := allocator.Allocate(context.Background(), sliceName, "cluster-c", 24)
+		require.NoError(t, err)
+		assert.Equal(t, "10.40.3.0/24", cidrC, "the highest free /24 should be preferred")
+	})
 
-		assert.Equal(t, -1, compareIPNets(net1, net2))
-		assert.Equal(t, 1, compareIPNets(net2, net1))
-		assert.Equal(t, -1, compareIPNets(net3, net1), "192.168.1.0/25 should come before 192.168.1.0/24 if sorted by mask size after IP")
-		fmt.Printf("net1: %s, net3: %s, Compare: %d\n", net3.String(), net1.String(), compareIPNets(net3, net1))
-		assert.Equal(t, 1, compareIPNets(net1, net3))
-		fmt.Printf("net3: %s, net1: %s, Compare: %d\n", net1.String(), net3.String(), compareIPNets(net1, net3))
-		assert.Equal(t, 0, compareIPNets(net1, net4))
+	t.Run("Default ordering is ascending", func(t *testing.T) {
+		def := NewDynamicIPAMAllocator()
+		err := def.InitializePool(sliceName, "10.40.0.0/22")
+		require.NoError(t, err)
+		cidr, err := def.Allocate(context.Background(), sliceName, "cluster-a", 24)
+		require.NoError(t, err)
+		assert.Equal(t, "10.40.1.0/24", cidr)
 	})
+}
+
+func TestDynamicIPAMAllocator_ResetPool(t *testing.T) {
+	allocator := NewDynamicIPAMAllocator()
+	sliceName := "reset-slice"
+	err := allocator.InitializePool(sliceName, "10.70.0.0/16")
+	require.NoError(t, err)
+	vpnSubnet := allocator.pools[sliceName].Allocated[ReservedVPNClusterKey].String()
+
+	stickyCIDR, err := allocator.Allocate(context.Background(), sliceName, "sticky-cluster", 24)
+	require.NoError(t, err)
+	_, err = allocator.Allocate(context.Background(), sliceName, "tenant-a", 24)
+	require.NoError(t, err)
+	_, err = allocator.Allocate(context.Background(), sliceName, "tenant-b", 22)
+	require.NoError(t, err)
 
-	t.Run("incIP", func(t *testing.T) {
-		ip := net.ParseIP("192.168.1.254").To4()
-		ip = incIP(ip, 1)
-		assert.Equal(t, "192.168.1.255", ip.String())
+	err = allocator.PreserveAllocation(context.Background(), sliceName, "sticky-cluster")
+	require.NoError(t, err)
+	require.NoError(t, allocator.ReserveBlock(context.Background(), sliceName, "dns", "10.70.200.0/24"))
 
-		ip = net.ParseIP("192.168.1.255").To4()
-		ip = incIP(ip, 1)
-		assert.Equal(t, "192.168.2.0", ip.String())
+	err = allocator.ResetPool(context.Background(), sliceName)
+	require.NoError(t, err)
 
-		ip = net.ParseIP("10.0.0.0").To4()
-		ip = incIP(ip, 256)
-		assert.Equal(t, "10.0.1.0", ip.String())
+	allocated := allocator.pools[sliceName].Allocated
+	assert.Len(t, allocated, 3)
+	assert.Equal(t, vpnSubnet, allocated[ReservedVPNClusterKey].String(), "the VPN reservation should survive a reset")
+	assert.Equal(t, "10.70.200.0/24", allocated[ReservedBlockKey("dns")].String(), "reserved blocks should survive a reset")
+	assert.Equal(t, stickyCIDR, allocated["sticky-cluster"].String(), "preserved allocations should survive a reset")
+	assert.NotContains(t, allocated, "tenant-a")
+	assert.NotContains(t, allocated, "tenant-b")
 
-		ip = net.ParseIP("10.0.0.0").To4()
-		ip = incIP(ip, 1<<uint(32-20))
-		assert.Equal(t, "10.0.16.0", ip.String())
+	t.Run("Cleared space is allocatable again", func(t *testing.T) {
+		cidr, err := allocator.Allocate(context.Background(), sliceName, "tenant-c", 23)
+		require.NoError(t, err)
+		assert.Equal(t, "10.70.2.0/23", cidr)
 	})
 
-	t.Run("tryMerge", func(t *testing.T) {
-		_, net1, _ := net.ParseCIDR("192.168.1.0/24")
-		_, net2, _ := net.ParseCIDR("192.168.2.0/25")
-		_, net3, _ := net.ParseCIDR("192.168.2.0/24")
+	t.Run("Preserve without allocation", func(t *testing.T) {
+		err := allocator.PreserveAllocation(context.Background(), sliceName, "tenant-a")
+		require.Error(t, err)
+		assert.ErrorIs(t, err, ErrAllocationNotFound)
+	})
 
-		merged, ok := tryMerge(net1, net2)
-		assert.False(t, ok)
-		assert.Nil(t, merged)
+	t.Run("Reclaim drops the preserved mark", func(t *testing.T) {
+		err := allocator.Reclaim(context.Background(), sliceName, "sticky-cluster")
+		require.NoError(t, err)
+		assert.NotContains(t, allocator.pools[sliceName].Preserved, "sticky-cluster")
+	})
 
-		merged, ok = tryMerge(net1, net3)
-		assert.True(t, ok)
-		assert.NotNil(t, merged)
-		assert.Equal(t, "192.168.1.0/23", merged.String())
+	t.Run("Reserved blocks", func(t *testing.T) {
+		ctx := context.Background()
+		require.NoError(t, allocator.ReserveBlock(ctx, sliceName, "dns", "10.70.200.0/24"), "repeating a reservation is a no-op")
+		assert.ErrorIs(t, allocator.ReserveBlock(ctx, sliceName, "dns", "10.70.201.0/24"), ErrReallocationUnsupported)
+		assert.Error(t, allocator.ReserveBlock(ctx, sliceName, "ntp", "10.70.200.128/25"), "the space is taken")
+		assert.Error(t, allocator.ReserveBlock(ctx, sliceName, "ntp", "10.70.201.5/24"), "misaligned CIDRs are rejected")
+		assert.Error(t, allocator.ReserveBlock(ctx, sliceName, "", "10.70.201.0/24"))
+		_, err := allocator.Allocate(ctx, sliceName, ReservedBlockKey("dns"), 24)
+		assert.ErrorIs(t, err, ErrReservedClusterName, "clusters cannot claim a reservation's key")
+		assert.ErrorIs(t, allocator.Reclaim(ctx, sliceName, ReservedBlockKey("dns")), ErrReservedClusterName)
 
-		_, blockA, _ := net.ParseCIDR("192.168.1.0/25")
-		_, blockB, _ := net.ParseCIDR("192.168.1.128/25")
-		merged, ok = tryMerge(blockA, blockB)
+		require.NoError(t, allocator.ReleaseBlock(ctx, sliceName, "dns"))
+		assert.NotContains(t, allocator.pools[sliceName].Allocated, ReservedBlockKey("dns"))
+		assert.ErrorIs(t, allocator.ReleaseBlock(ctx, sliceName, "dns"), ErrAllocationNotFound)
+		require.NoError(t, allocator.Verify(ctx, sliceName))
+	})
 
-		assert.True(t, ok)
-		assert.NotNil(t, merged)
-		assert.Equal(t, "192.168.1.0/24", merged.String())
+	t.Run("Reset uninitialized slice", func(t *testing.T) {
+		err := allocator.ResetPool(context.Background(), "missing-slice")
+		require.Error(t, err)
+		assert.ErrorIs(t, err, ErrPoolNotInitialized)
+	})
+}
+
+func TestDynamicIPAMAllocator_CoalesceOnDemand(t *testing.T) {
+	allocator := NewDynamicIPAMAllocator()
+	sliceName := "fragmented-slice"
+	err := allocator.InitializePool(sliceName, "10.80.0.0/21")
+	require.NoError(t, err)
+
+	pool := allocator.pools[sliceName]
+	_, low, _ := net.ParseCIDR("10.80.4.0/23")
+	_, high, _ := net.ParseCIDR("10.80.6.0/23")
+	// Leave two free buddy /23s unmerged, as a merge-free reclaim would.
+	pool.FreeBlocks = []*net.IPNet{low, high}
+
+	t.Run("Request larger than every free block", func(t *testing.T) {
+		cidr, err := allocator.Allocate(context.Background(), sliceName, "wide-cluster", 22)
+		require.NoError(t, err, "two free buddy /23s should satisfy a /22")
+		assert.Equal(t, "10.80.4.0/22", cidr)
+		assert.Empty(t, pool.FreeBlocks)
+	})
+
+	t.Run("Exhaustion is still reported", func(t *testing.T) {
+		_, err := allocator.Allocate(context.Background(), sliceName, "another-cluster", 24)
+		require.Error(t, err)
+		assert.ErrorIs(t, err, ErrPoolExhausted)
+	})
+}
+
+func TestSplitBlock(t *testing.T) {
+	// Every parent and allocation prefix pair in a small range must tile the parent exactly:
+	// the allocation at its start, then one remainder per bit between the two prefixes,
+	// together covering every address once.
+	for _, parentCIDR := range []string{"10.0.0.0/20", "192.168.0.0/24", "fd00:10::/116"} {
+		_, parent, err := net.ParseCIDR(parentCIDR)
+		require.NoError(t, err)
+		parentOnes, bits := parent.Mask.Size()
+		for parentPrefix := parentOnes; parentPrefix <= parentOnes+8; parentPrefix++ {
+			parent := &net.IPNet{IP: parent.IP, Mask: net.CIDRMask(parentPrefix, bits)}
+			for allocPrefix := parentPrefix; allocPrefix <= bits && allocPrefix <= parentPrefix+10; allocPrefix++ {
+				name := fmt.Sprintf("%s alloc /%d", parent, allocPrefix)
+				allocated, remainders := splitBlock(parent, allocPrefix)
+				require.NotNil(t, allocated, name)
+				assert.Equal(t, fmt.Sprintf("%s/%d", parent.IP, allocPrefix), allocated.String(), name)
+				require.Len(t, remainders, allocPrefix-parentPrefix, name)
+
+				blocks := append([]*net.IPNet{allocated}, remainders...)
+				covered := uint64(0)
+				for i, block := range blocks {
+					require.True(t, cidrutil.Contains(parent, block), "%s: %s outside the parent", name, block)
+					for _, other := range blocks[i+1:] {
+						require.False(t, cidrutil.Overlaps(block, other), "%s: %s overlaps %s", name, block, other)
+					}
+					ones, _ := block.Mask.Size()
+					covered += uint64(1) << (bits - ones)
+				}
+				assert.Equal(t, uint64(1)<<(bits-parentPrefix), covered, "%s: the blocks leave a gap", name)
+				assert.True(t, sort.SliceIsSorted(remainders, func(i, j int) bool {
+					return cidrutil.Compare(remainders[i], remainders[j]) < 0
+				}), name)
+			}
+		}
+	}
+
+	t.Run("Unaligned parent is normalized", func(t *testing.T) {
+		parent := &net.IPNet{IP: net.ParseIP("10.0.0.77").To4(), Mask: net.CIDRMask(24, 32)}
+		allocated, remainders := splitBlock(parent, 26)
+		assert.Equal(t, "10.0.0.0/26", allocated.String())
+		assert.Equal(t, []string{"10.0.0.64/26", "10.0.0.128/25"}, []string{remainders[0].String(), remainders[1].String()})
+		assert.Equal(t, "10.0.0.77", parent.IP.String(), "the parent is not modified")
+	})
+
+	t.Run("Prefix out of range", func(t *testing.T) {
+		_, parent, _ := net.ParseCIDR("10.0.0.0/24")
+		for _, allocPrefix := range []int{23, 33} {
+			allocated, remainders := splitBlock(parent, allocPrefix)
+			assert.Nil(t, allocated, allocPrefix)
+			assert.Nil(t, remainders, allocPrefix)
+		}
+	})
+}
+
+func TestDynamicIPAMAllocator_ReclaimByLabel(t *testing.T) {
+	allocator := NewDynamicIPAMAllocator()
+	sliceName := "team-slice"
+	err := allocator.InitializePool(sliceName, "10.100.0.0/16")
+	require.NoError(t, err)
+
+	teams := map[string]string{
+		"foo-1": "foo",
+		"foo-2": "foo",
+		"foo-3": "foo",
+		"bar-1": "bar",
+	}
+	for _, clusterName := range []string{"bar-1", "foo-1", "foo-2", "foo-3"} {
+		_, err := allocator.Allocate(context.Background(), sliceName, clusterName, 24)
+		require.NoError(t, err)
+		err = allocator.SetAllocationLabels(context.Background(), sliceName, clusterName, map[string]string{"team": teams[clusterName]})
+		require.NoError(t, err)
+	}
+	barCIDR := allocator.pools[sliceName].Allocated["bar-1"].String()
+
+	reclaimed, err := allocator.ReclaimByLabel(context.Background(), sliceName, "team", "foo")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"foo-1", "foo-2", "foo-3"}, reclaimed)
+
+	pool := allocator.pools[sliceName]
+	assert.Len(t, pool.Allocated, 2, "only the VPN subnet and bar-1 should remain")
+	assert.Equal(t, barCIDR, pool.Allocated["bar-1"].String())
+	assert.Equal(t, map[string]string{"team": "bar"}, pool.Labels["bar-1"])
+	assert.NotContains(t, pool.Labels, "foo-1")
+
+	t.Run("Freed space is coalesced", func(t *testing.T) {
+		cidr, err := allocator.Allocate(context.Background(), sliceName, "wide", 23)
+		require.NoError(t, err)
+		assert.Equal(t, "10.100.2.0/23", cidr, "freed 10.100.2.0/24 and 10.100.3.0/24 should merge")
+	})
+
+	t.Run("Preserved allocations are skipped", func(t *testing.T) {
+		err := allocator.PreserveAllocation(context.Background(), sliceName, "bar-1")
+		require.NoError(t, err)
+		reclaimed, err := allocator.ReclaimByLabel(context.Background(), sliceName, "team", "bar")
+		require.NoError(t, err)
+		assert.Empty(t, reclaimed)
+	})
+
+	t.Run("Labelling an unallocated cluster", func(t *testing.T) {
+		err := allocator.SetAllocationLabels(context.Background(), sliceName, "foo-1", map[string]string{"team": "foo"})
+		require.Error(t, err)
+	})
+}
+
+func TestDynamicIPAMAllocator_PeekNext(t *testing.T) {
+	allocator := NewDynamicIPAMAllocator()
+	sliceName := "peek-slice"
+	err := allocator.InitializePool(sliceName, "10.110.0.0/16")
+	require.NoError(t, err)
+	_, err = allocator.Allocate(context.Background(), sliceName, "existing", 25)
+	require.NoError(t, err)
+
+	freeBefore := len(allocator.pools[sliceName].FreeBlocks)
+	peeked, err := allocator.PeekNext(sliceName, 24, 3)
+	require.NoError(t, err)
+	require.Len(t, peeked, 3)
+	assert.Len(t, allocator.pools[sliceName].FreeBlocks, freeBefore, "peeking must not change the free list")
+	assert.Len(t, allocator.pools[sliceName].Allocated, 2, "peeking must not record allocations")
+
+	for i, expected := range peeked {
+		cidr, err := allocator.Allocate(context.Background(), sliceName, fmt.Sprintf("cluster-%d", i), 24)
+		require.NoError(t, err)
+		assert.Equal(t, expected, cidr)
+	}
+
+	t.Run("Stops early when the pool would be exhausted", func(t *testing.T) {
+		small := NewDynamicIPAMAllocator()
+		err := small.InitializePool("small", "10.120.0.0/22")
+		require.NoError(t, err)
+		peeked, err := small.PeekNext("small", 24, 5)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"10.120.1.0/24", "10.120.2.0/24", "10.120.3.0/24"}, peeked)
+	})
+
+	t.Run("Uninitialized slice", func(t *testing.T) {
+		_, err := allocator.PeekNext("missing-slice", 24, 1)
+		require.Error(t, err)
+	})
+}
+
+func TestDynamicIPAMAllocator_AllocateIdempotent(t *testing.T) {
+	allocator := NewDynamicIPAMAllocator()
+	sliceName := "retry-slice"
+	err := allocator.InitializePool(sliceName, "10.130.0.0/16")
+	require.NoError(t, err)
+
+	first, err := allocator.AllocateIdempotent(context.Background(), sliceName, "cluster-a", 24, "req-1")
+	require.NoError(t, err)
+
+	t.Run("Retry with the same key returns the same CIDR", func(t *testing.T) {
+		retried, err := allocator.AllocateIdempotent(context.Background(), sliceName, "cluster-a", 24, "req-1")
+		require.NoError(t, err)
+		assert.Equal(t, first, retried)
+
+		retried, err = allocator.AllocateIdempotent(context.Background(), sliceName, "cluster-a", 25, "req-1")
+		require.NoError(t, err, "a recorded key wins over a changed request")
+		assert.Equal(t, first, retried)
+		assert.Len(t, allocator.pools[sliceName].Allocated, 2)
+	})
+
+	t.Run("Different key for an allocated cluster", func(t *testing.T) {
+		_, err := allocator.AllocateIdempotent(context.Background(), sliceName, "cluster-a", 24, "req-2")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "different idempotency key")
+	})
+
+	t.Run("Reclaim releases the key", func(t *testing.T) {
+		err := allocator.Reclaim(context.Background(), sliceName, "cluster-a")
+		require.NoError(t, err)
+		assert.Empty(t, allocator.pools[sliceName].IdempotencyKeys)
+
+		_, err = allocator.AllocateIdempotent(context.Background(), sliceName, "cluster-a", 24, "req-2")
+		require.NoError(t, err)
+	})
+
+	t.Run("Empty key", func(t *testing.T) {
+		_, err := allocator.AllocateIdempotent(context.Background(), sliceName, "cluster-b", 24, "")
+		require.Error(t, err)
+	})
+}
+
+func TestDynamicIPAMAllocator_SplitLogLevel(t *testing.T) {
+	captureAt := func(verbosity int) []string {
+		lines := []string{}
+		logger := funcr.New(func(prefix, args string) {
+			lines = append(lines, args)
+		}, funcr.Options{Verbosity: verbosity})
+
+		allocator := NewDynamicIPAMAllocator(WithLogger(logger))
+		err := allocator.InitializePool("log-slice", "10.140.0.0/20")
+		require.NoError(t, err)
+		return lines
+	}
+
+	t.Run("Split details are logged at V(2)", func(t *testing.T) {
+		lines := captureAt(2)
+		found := false
+		for _, line := range lines {
+			if strings.Contains(line, `"msg"="split free block"`) {
+				found = true
+				assert.Contains(t, line, `"block"="10.140.0.0/20"`)
+				assert.Contains(t, line, `"allocated"="10.140.0.0/24"`)
+				assert.Contains(t, line, "10.140.8.0/21")
+			}
+		}
+		assert.True(t, found, "expected split diagnostics in %v", lines)
+	})
+
+	t.Run("Nothing is logged at V(0)", func(t *testing.T) {
+		assert.Empty(t, captureAt(0))
+	})
+
+	t.Run("Split level is configurable", func(t *testing.T) {
+		lines := []string{}
+		logger := funcr.New(func(prefix, args string) {
+			lines = append(lines, args)
+		}, funcr.Options{Verbosity: 4})
+		allocator := NewDynamicIPAMAllocator(WithLogger(logger), WithSplitLogLevel(4))
+		err := allocator.InitializePool("log-slice", "10.140.0.0/20")
+		require.NoError(t, err)
+		joined := strings.Join(lines, "\n")
+		assert.Contains(t, joined, `"level"=4 "msg"="split free block"`)
+	})
+}
+
+func TestDynamicIPAMAllocator_MaxClustersAtSize(t *testing.T) {
+	allocator := NewDynamicIPAMAllocator()
+	sliceName := "planning-slice"
+	err := allocator.InitializePool(sliceName, "10.150.0.0/16")
+	require.NoError(t, err)
+
+	max, err := allocator.MaxClustersAtSize(sliceName, 24)
+	require.NoError(t, err)
+	assert.Equal(t, 255, max, "a /16 minus the VPN /24 holds 255 /24s")
+
+	max, err = allocator.MaxClustersAtSize(sliceName, 23)
+	require.NoError(t, err)
+	assert.Equal(t, 127, max, "the VPN /24 rules out one /23")
+
+	t.Run("Ignores current allocations", func(t *testing.T) {
+		_, err := allocator.Allocate(context.Background(), sliceName, "cluster-a", 20)
+		require.NoError(t, err)
+		max, err := allocator.MaxClustersAtSize(sliceName, 24)
+		require.NoError(t, err)
+		assert.Equal(t, 255, max)
+	})
+
+	t.Run("Prefix outside the slice range", func(t *testing.T) {
+		_, err := allocator.MaxClustersAtSize(sliceName, 15)
+		require.Error(t, err)
+		_, err = allocator.MaxClustersAtSize(sliceName, 33)
+		require.Error(t, err)
+	})
+
+	t.Run("Uninitialized slice", func(t *testing.T) {
+		_, err := allocator.MaxClustersAtSize("missing-slice", 24)
+		require.Error(t, err)
+	})
+}
+
+func TestDynamicIPAMAllocator_IsExhausted(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Empty pool", func(t *testing.T) {
+		allocator := NewDynamicIPAMAllocator()
+		require.NoError(t, allocator.InitializePool("empty-slice", "10.190.0.0/16"))
+		exhausted, err := allocator.IsExhausted("empty-slice", 24)
+		require.NoError(t, err)
+		assert.False(t, exhausted)
+	})
+
+	t.Run("Full pool", func(t *testing.T) {
+		allocator := NewDynamicIPAMAllocator()
+		require.NoError(t, allocator.InitializePool("full-slice", "10.191.0.0/23"))
+		_, err := allocator.Allocate(ctx, "full-slice", "cluster-a", 24)
+		require.NoError(t, err)
+		exhausted, err := allocator.IsExhausted("full-slice", 24)
+		require.NoError(t, err)
+		assert.True(t, exhausted)
+		exhausted, err = allocator.IsExhausted("full-slice", 32)
+		require.NoError(t, err)
+		assert.True(t, exhausted)
+	})
+
+	t.Run("Fragmented pool", func(t *testing.T) {
+		allocator := NewDynamicIPAMAllocator()
+		require.NoError(t, allocator.InitializePool("fragmented-slice", "10.192.0.0/23"))
+		// 10.192.1.0/26 splits the only free /24 into a /26 and a /25.
+		_, err := allocator.Allocate(ctx, "fragmented-slice", "cluster-a", 26)
+		require.NoError(t, err)
+		exhausted, err := allocator.IsExhausted("fragmented-slice", 24)
+		require.NoError(t, err)
+		assert.True(t, exhausted)
+		exhausted, err = allocator.IsExhausted("fragmented-slice", 26)
+		require.NoError(t, err)
+		assert.False(t, exhausted)
+		assert.Len(t, allocator.pools["fragmented-slice"].Allocated, 2, "IsExhausted must not allocate")
+	})
+
+	t.Run("Invalid size and uninitialized slice", func(t *testing.T) {
+		allocator := NewDynamicIPAMAllocator()
+		require.NoError(t, allocator.InitializePool("bounds-slice", "10.193.0.0/16"))
+		_, err := allocator.IsExhausted("bounds-slice", 15)
+		require.Error(t, err)
+		_, err = allocator.IsExhausted("missing-slice", 24)
+		require.Error(t, err)
+	})
+}
+
+func TestDynamicIPAMAllocator_StuckFreeBlocks(t *testing.T) {
+	allocator := NewDynamicIPAMAllocator()
+	ctx := context.Background()
+	sliceName := "defrag-slice"
+	require.NoError(t, allocator.InitializePool(sliceName, "10.194.0.0/23"))
+
+	stuck, err := allocator.StuckFreeBlocks(sliceName)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.194.1.0/24"}, stuck, "the free /24 cannot merge with the VPN subnet")
+
+	// Leave cluster-b's 10.194.1.64/26 between the free 10.194.1.0/26 and 10.194.1.128/25.
+	_, err = allocator.Allocate(ctx, sliceName, "cluster-a", 26)
+	require.NoError(t, err)
+	_, err = allocator.Allocate(ctx, sliceName, "cluster-b", 26)
+	require.NoError(t, err)
+	require.NoError(t, allocator.Reclaim(ctx, sliceName, "cluster-a"))
+
+	stuck, err = allocator.StuckFreeBlocks(sliceName)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.194.1.0/26", "10.194.1.128/25"}, stuck)
+
+	_, err = allocator.StuckFreeBlocks("missing-slice")
+	require.Error(t, err)
+}
+
+func TestDynamicIPAMAllocator_AllocateWithValidator(t *testing.T) {
+	allocator := NewDynamicIPAMAllocator()
+	ctx := context.Background()
+	sliceName := "validated-slice"
+	require.NoError(t, allocator.InitializePool(sliceName, "10.195.0.0/16"))
+
+	offered := []string{}
+	rejectFirstTwo := func(cidr string) bool {
+		offered = append(offered, cidr)
+		return len(offered) > 2
+	}
+	cidr, err := allocator.AllocateWithValidator(ctx, sliceName, "cluster-a", 24, rejectFirstTwo)
+	require.NoError(t, err)
+	assert.Equal(t, "10.195.3.0/24", cidr)
+	assert.Equal(t, []string{"10.195.1.0/24", "10.195.2.0/24", "10.195.3.0/24"}, offered)
+	assert.Equal(t, "10.195.3.0/24", allocator.pools[sliceName].Allocated["cluster-a"].String())
+
+	// The rejected candidates stay free and are handed out next.
+	cidr, err = allocator.Allocate(ctx, sliceName, "cluster-b", 24)
+	require.NoError(t, err)
+	assert.Equal(t, "10.195.1.0/24", cidr)
+
+	t.Run("All candidates rejected", func(t *testing.T) {
+		small := NewDynamicIPAMAllocator()
+		require.NoError(t, small.InitializePool("small-slice", "10.196.0.0/23"))
+		before := small.pools["small-slice"].clone()
+		calls := 0
+		_, err := small.AllocateWithValidator(ctx, "small-slice", "cluster-a", 26, func(string) bool {
+			calls++
+			return false
+		})
+		require.Error(t, err)
+		assert.Equal(t, 4, calls, "every /26 of the free /24 should be offered")
+		assert.Equal(t, before.FreeBlocks, small.pools["small-slice"].FreeBlocks)
+		assert.NotContains(t, small.pools["small-slice"].Allocated, "cluster-a")
+	})
+}
+
+func TestDynamicIPAMAllocator_IPv6(t *testing.T) {
+	allocator := NewDynamicIPAMAllocator()
+	ctx := context.Background()
+	sliceName := "dual-stack-slice-v6"
+	require.NoError(t, allocator.InitializePool(sliceName, "fd00:10::/48"))
+	pool := allocator.pools[sliceName]
+	assert.Equal(t, "fd00:10::/64", pool.Allocated[ReservedVPNClusterKey].String(), "IPv6 slices reserve a /64 for the VPN")
+
+	cidrA, err := allocator.Allocate(ctx, sliceName, "cluster-a", 64)
+	require.NoError(t, err)
+	assert.Equal(t, "fd00:10:0:1::/64", cidrA)
+	cidrB, err := allocator.Allocate(ctx, sliceName, "cluster-b", 64)
+	require.NoError(t, err)
+	assert.Equal(t, "fd00:10:0:2::/64", cidrB, "the free /63 is split")
+	assert.Equal(t, "fd00:10:0:3::/64", pool.FreeBlocks[0].String())
+
+	max, err := allocator.MaxClustersAtSize(sliceName, 64)
+	require.NoError(t, err)
+	assert.Equal(t, 65535, max)
+
+	t.Run("Prefix wider than the address family", func(t *testing.T) {
+		_, err := allocator.Allocate(ctx, sliceName, "cluster-x", 129)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "128-bit")
+
+		v4 := NewDynamicIPAMAllocator()
+		require.NoError(t, v4.InitializePool("v4-slice", "10.198.0.0/16"))
+		_, err = v4.Allocate(ctx, "v4-slice", "cluster-x", 64)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "32-bit")
+	})
+
+	require.NoError(t, allocator.Reclaim(ctx, sliceName, "cluster-b"))
+	assert.Equal(t, "fd00:10:0:2::/63", pool.FreeBlocks[0].String(), "the reclaimed /64 merges with its buddy")
+	require.NoError(t, allocator.Reclaim(ctx, sliceName, "cluster-a"))
+	assert.Equal(t, "fd00:10:0:1::/64", pool.FreeBlocks[0].String(), "the buddy of cluster-a's block is the VPN subnet")
+	assert.Len(t, pool.FreeBlocks, 16, "a /48 minus the VPN /64 leaves one free block per prefix length /49-/64")
+
+	merged, ok := cidrutil.Merge(mustParseCIDR(t, "2001:db8::/64"), mustParseCIDR(t, "2001:db8:0:1::/64"))
+	require.True(t, ok)
+	assert.Equal(t, "2001:db8::/63", merged.String())
+}
+
+func mustParseCIDR(t *testing.T, cidr string) *net.IPNet {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	require.NoError(t, err)
+	return ipNet
+}
+
+func TestDynamicIPAMAllocator_ListAllocations(t *testing.T) {
+	allocator := NewDynamicIPAMAllocator()
+	ctx := context.Background()
+	sliceName := "listed-slice"
+	require.NoError(t, allocator.InitializePool(sliceName, "10.199.0.0/16"))
+
+	want := map[string]string{ReservedVPNClusterKey: "10.199.0.0/24"}
+	for _, cluster := range []string{"cluster-a", "cluster-b", "cluster-c"} {
+		cidr, err := allocator.Allocate(ctx, sliceName, cluster, 24)
+		require.NoError(t, err)
+		want[cluster] = cidr
+	}
+
+	allocations, err := allocator.ListAllocations(ctx, sliceName)
+	require.NoError(t, err)
+	assert.Equal(t, want, allocations)
+
+	allocations["cluster-a"] = "10.199.9.0/24"
+	delete(allocations, "cluster-b")
+	allocations["cluster-d"] = "10.199.4.0/24"
+
+	cidr, err := allocator.Allocate(ctx, sliceName, "cluster-d", 24)
+	require.NoError(t, err)
+	assert.Equal(t, "10.199.4.0/24", cidr)
+	cidr, err = allocator.Allocate(ctx, sliceName, "cluster-a", 24)
+	require.NoError(t, err)
+	assert.Equal(t, want["cluster-a"], cidr, "mutating the result must not change cluster-a's allocation")
+
+	again, err := allocator.ListAllocations(ctx, sliceName)
+	require.NoError(t, err)
+	assert.Equal(t, want["cluster-b"], again["cluster-b"])
+
+	_, err = allocator.ListAllocations(ctx, "missing-slice")
+	require.ErrorIs(t, err, ErrPoolNotInitialized)
+}
+
+func TestDynamicIPAMAllocator_GetFreeBlocks(t *testing.T) {
+	allocator := NewDynamicIPAMAllocator()
+	ctx := context.Background()
+	sliceName := "inspected-slice"
+	require.NoError(t, allocator.InitializePool(sliceName, "10.201.0.0/22"))
+
+	_, err := allocator.Allocate(ctx, sliceName, "cluster-a", 25)
+	require.NoError(t, err)
+	_, err = allocator.Allocate(ctx, sliceName, "cluster-b", 25)
+	require.NoError(t, err)
+	free, err := allocator.GetFreeBlocks(ctx, sliceName)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.201.2.0/23"}, free)
+
+	require.NoError(t, allocator.Reclaim(ctx, sliceName, "cluster-a"))
+	require.NoError(t, allocator.Reclaim(ctx, sliceName, "cluster-b"))
+	free, err = allocator.GetFreeBlocks(ctx, sliceName)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.201.1.0/24", "10.201.2.0/23"}, free, "the two reclaimed /25s should merge back into a /24")
+
+	t.Run("Ordered by address under a custom ordering", func(t *testing.T) {
+		descending := NewDynamicIPAMAllocator(WithFreeBlockLess(func(a, b *net.IPNet) bool { return cidrutil.Compare(a, b) > 0 }))
+		require.NoError(t, descending.InitializePool(sliceName, "10.201.0.0/22"))
+		free, err := descending.GetFreeBlocks(ctx, sliceName)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"10.201.1.0/24", "10.201.2.0/23"}, free)
+	})
+
+	_, err = allocator.GetFreeBlocks(ctx, "missing-slice")
+	require.ErrorIs(t, err, ErrPoolNotInitialized)
+}
+
+func TestDynamicIPAMAllocator_VPNSubnetSize(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "vpn-sized-slice"
+
+	t.Run("Default /24", func(t *testing.T) {
+		allocator := NewDynamicIPAMAllocator()
+		require.NoError(t, allocator.InitializePool(sliceName, "10.205.0.0/23"))
+		free, err := allocator.GetFreeBlocks(ctx, sliceName)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"10.205.1.0/24"}, free)
+	})
+
+	t.Run("/28 reservation", func(t *testing.T) {
+		allocator := NewDynamicIPAMAllocator(WithVPNSubnetSize(28))
+		require.NoError(t, allocator.InitializePool(sliceName, "10.205.0.0/24"))
+		allocations, err := allocator.ListAllocations(ctx, sliceName)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{ReservedVPNClusterKey: "10.205.0.0/28"}, allocations)
+		free, err := allocator.GetFreeBlocks(ctx, sliceName)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"10.205.0.16/28", "10.205.0.32/27", "10.205.0.64/26", "10.205.0.128/25"}, free)
+	})
+
+	t.Run("Reservation disabled", func(t *testing.T) {
+		allocator := NewDynamicIPAMAllocator(WithVPNSubnetSize(0))
+		require.NoError(t, allocator.InitializePool(sliceName, "10.205.0.0/24"))
+		allocations, err := allocator.ListAllocations(ctx, sliceName)
+		require.NoError(t, err)
+		assert.Empty(t, allocations)
+		free, err := allocator.GetFreeBlocks(ctx, sliceName)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"10.205.0.0/24"}, free)
+	})
+
+	t.Run("Invalid prefix", func(t *testing.T) {
+		allocator := NewDynamicIPAMAllocator(WithVPNSubnetSize(33))
+		require.Error(t, allocator.InitializePool(sliceName, "10.205.0.0/24"))
+		_, err := allocator.GetFreeBlocks(ctx, sliceName)
+		require.Error(t, err, "a pool whose reservation failed must not be registered")
+	})
+}
+
+func TestDynamicIPAMAllocator_SplitTilesFreeBlock(t *testing.T) {
+	for _, size := range []int{17, 20, 24, 31, 32} {
+		t.Run(fmt.Sprintf("/%d out of a /16", size), func(t *testing.T) {
+			allocator := NewDynamicIPAMAllocator(WithVPNSubnetSize(0))
+			sliceName := "tiled-slice"
+			require.NoError(t, allocator.InitializePool(sliceName, "10.210.0.0/16"))
+			_, err := allocator.Allocate(context.Background(), sliceName, "cluster-a", size)
+			require.NoError(t, err)
+
+			pool := allocator.pools[sliceName]
+			blocks := append([]*net.IPNet{pool.Allocated["cluster-a"]}, pool.FreeBlocks...)
+			assert.Len(t, pool.FreeBlocks, size-16, "one free block per prefix length /17-/%d", size)
+
+			total := 0.0
+			for i, block := range blocks {
+				assert.True(t, pool.SliceSubnet.Contains(block.IP), "%s is outside the slice", block)
+				total += addressCount(block)
+				for _, other := range blocks[i+1:] {
+					assert.False(t, cidrutil.Overlaps(block, other), "%s overlaps %s", block, other)
+				}
+			}
+			assert.Equal(t, addressCount(pool.SliceSubnet), total, "the allocated and free blocks must tile the /16")
+		})
+	}
+}
+
+func TestDynamicIPAMAllocator_Capabilities(t *testing.T) {
+	t.Run("Defaults", func(t *testing.T) {
+		caps := NewDynamicIPAMAllocator().Capabilities()
+		assert.Equal(t, Capabilities{
+			Strategy:       "first-fit",
+			SplitLogLevel:  2,
+			DualStack:      true,
+			VPNReservation: true,
+		}, caps)
+	})
+
+	t.Run("Reflects construction options", func(t *testing.T) {
+		logger := funcr.New(func(prefix, args string) {}, funcr.Options{})
+		allocator := NewDynamicIPAMAllocator(
+			WithFreeBlockLess(func(a, b *net.IPNet) bool { return cidrutil.Compare(a, b) > 0 }),
+			WithIPAMMetrics(newFakeIPAMMetrics()),
+			WithLogger(logger),
+			WithSplitLogLevel(3),
+			WithoutVPNReservation(),
+			WithMaxBlockSize(20),
+			WithPerClusterBlockLimit(2),
+		)
+		assert.Equal(t, Capabilities{
+			Strategy:             "first-fit",
+			CustomFreeBlockOrder: true,
+			Metrics:              true,
+			Logging:              true,
+			SplitLogLevel:        3,
+			DualStack:            true,
+			MaxBlockPrefix:       20,
+			ClusterBlockLimit:    2,
+		}, allocator.Capabilities())
+	})
+}
+
+func TestDynamicIPAMAllocator_AllocateIndexed(t *testing.T) {
+	allocator := NewDynamicIPAMAllocator()
+	sliceName := "ordinal-slice"
+	err := allocator.InitializePool(sliceName, "10.180.0.0/16")
+	require.NoError(t, err)
+
+	allocated, err := allocator.AllocateIndexed(context.Background(), sliceName, "member", []int{2, 0, 1}, 24)
+	require.NoError(t, err)
+	assert.Equal(t, map[int]string{
+		0: "10.180.1.0/24",
+		1: "10.180.2.0/24",
+		2: "10.180.3.0/24",
+	}, allocated)
+	assert.Equal(t, "10.180.2.0/24", allocator.pools[sliceName].Allocated["member-1"].String())
+
+	t.Run("Failure rolls back the whole batch", func(t *testing.T) {
+		small := NewDynamicIPAMAllocator()
+		err := small.InitializePool("small", "10.190.0.0/22")
+		require.NoError(t, err)
+		freeBefore := fmt.Sprint(small.pools["small"].FreeBlocks)
+
+		_, err = small.AllocateIndexed(context.Background(), "small", "member", []int{0, 1, 2, 3}, 24)
+		require.Error(t, err)
+		assert.Len(t, small.pools["small"].Allocated, 1, "only the VPN subnet should remain")
+		assert.Equal(t, freeBefore, fmt.Sprint(small.pools["small"].FreeBlocks))
+	})
+
+	t.Run("Duplicate indices", func(t *testing.T) {
+		_, err := allocator.AllocateIndexed(context.Background(), sliceName, "dup", []int{4, 4}, 24)
+		require.Error(t, err)
+	})
+
+	t.Run("Invalid base names", func(t *testing.T) {
+		before := allocator.pools[sliceName].snapshot()
+		_, err := allocator.AllocateIndexed(context.Background(), sliceName, "", []int{0}, 24)
+		assert.Error(t, err)
+		_, err = allocator.AllocateIndexed(context.Background(), sliceName, ReservedVPNClusterKey, []int{0}, 24)
+		assert.ErrorIs(t, err, ErrReservedClusterName)
+		assert.Equal(t, before, allocator.pools[sliceName].snapshot())
+	})
+
+	t.Run("Held indices are not audited again", func(t *testing.T) {
+		sink := NewRingAuditSink(16)
+		audited := NewDynamicIPAMAllocator(WithAuditSink(sink))
+		require.NoError(t, audited.InitializePool(sliceName, "10.180.0.0/16"))
+		first, err := audited.AllocateIndexed(context.Background(), sliceName, "member", []int{0}, 24)
+		require.NoError(t, err)
+
+		again, err := audited.AllocateIndexed(context.Background(), sliceName, "member", []int{0, 1}, 24)
+		require.NoError(t, err)
+		assert.Equal(t, first[0], again[0])
+		records := sink.Records()
+		require.Len(t, records, 2)
+		assert.Equal(t, "member-0", records[0].ClusterName)
+		assert.Equal(t, "member-1", records[1].ClusterName, "only the new index is audited")
+	})
+}
+
+func TestSliceIPPool_NonCanonicalMasks(t *testing.T) {
+	_, lowHalf, _ := net.ParseCIDR("10.200.0.0/25")
+	_, far, _ := net.ParseCIDR("10.200.4.0/24")
+	pool := &sliceIPPool{FreeBlocks: []*net.IPNet{lowHalf, far}}
+
+	// The upper /25 carries its mask in 16 byte form, which Mask.Size reports as /121.
+	wideMask := &net.IPNet{IP: net.ParseIP("10.200.0.128").To4(), Mask: net.CIDRMask(121, 128)}
+	pool.insertFreeBlock(wideMask)
+	require.Len(t, pool.FreeBlocks, 2)
+	assert.Equal(t, "10.200.0.0/24", pool.FreeBlocks[0].String(), "the normalized /25 should merge with its buddy")
+
+	// A truncated mask makes Mask.Size report a 24 bit address width.
+	truncated := &net.IPNet{IP: net.ParseIP("10.200.2.0").To4(), Mask: net.IPMask{255, 255, 255}}
+	_, bits := truncated.Mask.Size()
+	require.Equal(t, 24, bits)
+	pool.insertFreeBlock(truncated)
+	assert.Equal(t, "[10.200.0.0/24 10.200.2.0/24 10.200.4.0/24]", fmt.Sprint(pool.FreeBlocks))
+
+	t.Run("cidrutil.Compare does not treat degenerate masks as /0", func(t *testing.T) {
+		_, canonical, _ := net.ParseCIDR("10.200.2.0/23")
+		odd := &net.IPNet{IP: net.ParseIP("10.200.2.0").To4(), Mask: net.IPMask{255, 255, 255}}
+		assert.Equal(t, -1, cidrutil.Compare(odd, canonical), "a truncated /24 mask still orders before the /23")
+
+		nonContiguous := &net.IPNet{IP: net.ParseIP("10.200.2.0").To4(), Mask: net.IPMask{255, 0, 255, 0}}
+		ones, bits := nonContiguous.Mask.Size()
+		require.Equal(t, 0, ones+bits, "Mask.Size reports (0, 0) for non-contiguous masks")
+		assert.Equal(t, -1, cidrutil.Compare(nonContiguous, canonical))
+		assert.Equal(t, 1, cidrutil.Compare(canonical, nonContiguous))
+	})
+
+	t.Run("Coalesce normalizes stored blocks", func(t *testing.T) {
+		odd := &net.IPNet{IP: net.ParseIP("10.200.9.0"), Mask: net.CIDRMask(120, 128)}
+		_, buddy, _ := net.ParseCIDR("10.200.8.0/24")
+		pool := &sliceIPPool{FreeBlocks: []*net.IPNet{odd, buddy}}
+		pool.coalesceFreeBlocks()
+		assert.Equal(t, "[10.200.8.0/23]", fmt.Sprint(pool.FreeBlocks))
+	})
+}
+
+func TestHelperFunctions(t *testing.T) {
+	t.Run("cidrutil.CompareIP", func(t *testing.T) {
+		ip1 := net.ParseIP("192.168.1.1")
+		ip2 := net.ParseIP("192.168.1.10")
+		ip3 := net.ParseIP("192.168.1.1")
+		ipV6_1 := net.ParseIP("::1")
+		ipV6_2 := net.ParseIP("::10")
+
+		assert.Equal(t, -1, cidrutil.CompareIP(ip1, ip2))
+		assert.Equal(t, 1, cidrutil.CompareIP(ip2, ip1))
+		assert.Equal(t, 0, cidrutil.CompareIP(ip1, ip3))
+
+		assert.Equal(t, -1, cidrutil.CompareIP(ipV6_1, ipV6_2))
+		assert.Equal(t, 1, cidrutil.CompareIP(ipV6_2, ipV6_1))
+		assert.Equal(t, -1, cidrutil.CompareIP(ip1, ipV6_1), "IPv4 should be 'smaller' than IPv6")
+		assert.Equal(t, 1, cidrutil.CompareIP(ipV6_1, ip1), "IPv6 should be 'larger' than IPv4")
+	})
+
+	t.Run("cidrutil.CompareIP normalizes IPv4 representations", func(t *testing.T) {
+		parsed := net.ParseIP("10.0.0.0")
+		_, cidr, _ := net.ParseCIDR("10.0.0.0/24")
+		require.Len(t, parsed, net.IPv6len)
+		require.Len(t, cidr.IP, net.IPv4len)
+
+		assert.Equal(t, 0, cidrutil.CompareIP(parsed, cidr.IP))
+		assert.Equal(t, 0, cidrutil.CompareIP(cidr.IP, parsed))
+		assert.Equal(t, -1, cidrutil.CompareIP(parsed, net.ParseIP("10.0.1.0").To4()))
+		assert.Equal(t, 1, cidrutil.CompareIP(net.ParseIP("10.0.1.0").To4(), parsed))
+		assert.Equal(t, -1, cidrutil.CompareIP(parsed, net.ParseIP("::1")), "IPv4 in 16 byte form is still IPv4")
+
+		wide := &net.IPNet{IP: parsed, Mask: net.CIDRMask(24, 32)}
+		assert.Equal(t, 0, cidrutil.Compare(wide, cidr))
+
+		_, next, _ := net.ParseCIDR("10.0.1.0/24")
+		sixteen := &net.IPNet{IP: net.ParseIP("10.0.2.0"), Mask: net.CIDRMask(24, 32)}
+		blocks := []*net.IPNet{sixteen, next, wide}
+		sort.Slice(blocks, func(i, j int) bool { return cidrutil.Compare(blocks[i], blocks[j]) < 0 })
+		assert.Equal(t, "[10.0.0.0/24 10.0.1.0/24 10.0.2.0/24]", fmt.Sprint(blocks))
+
+		pool := &sliceIPPool{}
+		pool.insertFreeBlock(sixteen)
+		pool.insertFreeBlock(next)
+		require.Len(t, pool.FreeBlocks, 2)
+		for _, block := range pool.FreeBlocks {
+			assert.Len(t, block.IP, net.IPv4len, "stored blocks are normalized to 4 byte addresses")
+		}
+	})
+
+	t.Run("cidrutil.Compare", func(t *testing.T) {
+		_, net1, _ := net.ParseCIDR("192.168.1.0/24")
+		_, net2, _ := net.ParseCIDR("192.168.2.0/24")
+		_, net3, _ := net.ParseCIDR("192.168.1.0/25")
+		_, net4, _ := net.ParseCIDR("192.168.1.0/24")
+
+		assert.Equal(t, -1, cidrutil.Compare(net1, net2))
+		assert.Equal(t, 1, cidrutil.Compare(net2, net1))
+		assert.Equal(t, -1, cidrutil.Compare(net3, net1), "192.168.1.0/25 should come before 192.168.1.0/24 if sorted by mask size after IP")
+		assert.Equal(t, 1, cidrutil.Compare(net1, net3))
+		assert.Equal(t, 0, cidrutil.Compare(net1, net4))
+	})
+
+	t.Run("cidrutil.Increment", func(t *testing.T) {
+		for _, tc := range []struct {
+			ip   string
+			inc  int
+			want string
+		}{
+			{ip: "192.168.1.254", inc: 1, want: "192.168.1.255"},
+			{ip: "192.168.1.255", inc: 1, want: "192.168.2.0"},
+			{ip: "10.0.0.0", inc: 256, want: "10.0.1.0"},
+			{ip: "10.0.0.0", inc: 1 << uint(32-20), want: "10.0.16.0"},
+			{ip: "255.255.255.254", inc: 1, want: "255.255.255.255"},
+			{ip: "fd00::ffff", inc: 1, want: "fd00::1:0"},
+		} {
+			ip := net.ParseIP(tc.ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			got, ok := cidrutil.Increment(ip, tc.inc)
+			assert.True(t, ok, tc.ip)
+			assert.Equal(t, tc.want, got.String())
+			assert.Equal(t, tc.ip, ip.String(), "Increment must not modify its argument")
+		}
+
+		_, ok := cidrutil.Increment(net.ParseIP("255.255.255.255").To4(), 1)
+		assert.False(t, ok, "incrementing past the last IPv4 address must not wrap to 0.0.0.0")
+		_, ok = cidrutil.Increment(net.ParseIP("255.255.255.0").To4(), 512)
+		assert.False(t, ok)
+		_, ok = cidrutil.Increment(net.ParseIP("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"), 1)
+		assert.False(t, ok)
+	})
+
+	t.Run("cidrutil.Merge", func(t *testing.T) {
+		_, net1, _ := net.ParseCIDR("192.168.1.0/24")
+		_, net2, _ := net.ParseCIDR("192.168.2.0/25")
+		_, net3, _ := net.ParseCIDR("192.168.2.0/24")
+
+		merged, ok := cidrutil.Merge(net1, net2)
+		assert.False(t, ok)
+		assert.Nil(t, merged)
+
+		merged, ok = cidrutil.Merge(net1, net3)
+		assert.False(t, ok, "192.168.1.0/24 and 192.168.2.0/24 are adjacent but not halves of one /23")
+		assert.Nil(t, merged)
+
+		_, net4, _ := net.ParseCIDR("192.168.0.0/24")
+		merged, ok = cidrutil.Merge(net4, net1)
+		assert.True(t, ok)
+		assert.Equal(t, "192.168.0.0/23", merged.String())
+
+		_, blockA, _ := net.ParseCIDR("192.168.1.0/25")
+		_, blockB, _ := net.ParseCIDR("192.168.1.128/25")
+		merged, ok = cidrutil.Merge(blockA, blockB)
+
+		assert.True(t, ok)
+		assert.NotNil(t, merged)
+		assert.Equal(t, "192.168.1.0/24", merged.String())
+
+		merged, ok = cidrutil.Merge(blockB, blockA)
+		assert.True(t, ok, "cidrutil.Merge accepts the halves in either order")
+		assert.Equal(t, "192.168.1.0/24", merged.String())
+
+		merged, ok = cidrutil.Merge(net1, net1)
+		assert.False(t, ok, "a block does not merge with itself")
+		assert.Nil(t, merged)
+	})
+
+	t.Run("cidrutil.Merge IPv6", func(t *testing.T) {
+		lower := mustParseCIDR(t, "fd00:10::/64")
+		upper := mustParseCIDR(t, "fd00:10:0:1::/64")
+		merged, ok := cidrutil.Merge(upper, lower)
+		require.True(t, ok)
+		assert.Equal(t, "fd00:10::/63", merged.String())
+		ones, bits := merged.Mask.Size()
+		assert.Equal(t, []int{63, 128}, []int{ones, bits}, "the merged mask keeps the 128-bit width")
+
+		_, ok = cidrutil.Merge(upper, mustParseCIDR(t, "fd00:10:0:2::/64"))
+		assert.False(t, ok, "adjacent /64s that straddle a /63 boundary do not merge")
+
+		// Block sizes this large overflow an int; the step is computed on the address bytes.
+		merged, ok = cidrutil.Merge(mustParseCIDR(t, "::/1"), mustParseCIDR(t, "8000::/1"))
+		require.True(t, ok)
+		assert.Equal(t, "::/0", merged.String())
+
+		_, ok = cidrutil.Merge(mustParseCIDR(t, "10.0.0.0/24"), mustParseCIDR(t, "::a00:100/120"))
+		assert.False(t, ok, "IPv4 and IPv6 blocks never merge")
+	})
+}
+
+func TestSliceIPPool_CoalesceToFixpoint(t *testing.T) {
+	pool := &sliceIPPool{FreeBlocks: []*net.IPNet{
+		mustParseCIDR(t, "10.218.1.128/25"),
+		mustParseCIDR(t, "10.218.0.0/24"),
+		mustParseCIDR(t, "10.218.1.0/25"),
+		mustParseCIDR(t, "10.218.3.0/24"),
+	}}
+	pool.coalesceFreeBlocks()
+	assert.Equal(t, []*net.IPNet{
+		mustParseCIDR(t, "10.218.0.0/23"),
+		mustParseCIDR(t, "10.218.3.0/24"),
+	}, pool.FreeBlocks, "the /24 merged from the /25s should merge again with 10.218.0.0/24")
+
+	t.Run("Reclaim", func(t *testing.T) {
+		ctx := context.Background()
+		sliceName := "fixpoint-slice"
+		allocator := NewDynamicIPAMAllocator(WithVPNSubnetSize(0))
+		require.NoError(t, allocator.InitializePool(sliceName, "10.217.0.0/23"))
+		clusters := []string{"cluster-a", "cluster-b", "cluster-c", "cluster-d"}
+		for _, clusterName := range clusters {
+			_, err := allocator.Allocate(ctx, sliceName, clusterName, 25)
+			require.NoError(t, err)
+			require.NoError(t, allocator.SetAllocationLabels(ctx, sliceName, clusterName, map[string]string{"tier": "edge"}))
+		}
+		require.Empty(t, allocator.pools[sliceName].FreeBlocks)
+
+		// Reclaim cluster-a and cluster-d alone, leaving two non-buddy /25s free, then
+		// return the middle two together.
+		require.NoError(t, allocator.Reclaim(ctx, sliceName, "cluster-a"))
+		require.NoError(t, allocator.Reclaim(ctx, sliceName, "cluster-d"))
+		_, err := allocator.ReclaimByLabel(ctx, sliceName, "tier", "edge")
+		require.NoError(t, err)
+
+		assert.Equal(t, []*net.IPNet{mustParseCIDR(t, "10.217.0.0/23")}, allocator.pools[sliceName].FreeBlocks)
+	})
+}
+
+func TestSliceIPPool_InsertFreeBlock(t *testing.T) {
+	free, allocated := fragmentedFreeList(8)
+	for _, target := range []int{0, 3, 7} {
+		sorted := &sliceIPPool{FreeBlocks: append([]*net.IPNet(nil), free...)}
+		sorted.FreeBlocks = append(sorted.FreeBlocks, allocated[target])
+		sorted.coalesceFreeBlocks()
+
+		inserted := &sliceIPPool{FreeBlocks: append([]*net.IPNet(nil), free...)}
+		inserted.insertFreeBlock(allocated[target])
+
+		assert.Equal(t, len(free), len(inserted.FreeBlocks), "the reclaimed block should merge with exactly one buddy")
+		assert.Equal(t, sorted.FreeBlocks, inserted.FreeBlocks, "insertion and full sort should agree for target %d", target)
+	}
+}
+
+// fragmentedFreeList returns a free list of n /28s separated by n allocated /28s.
+func fragmentedFreeList(n int) (free []*net.IPNet, allocated []*net.IPNet) {
+	ip := net.ParseIP("10.0.0.0").To4()
+	for i := 0; i < n; i++ {
+		free = append(free, &net.IPNet{IP: ip, Mask: net.CIDRMask(28, 32)})
+		ip, _ = cidrutil.Increment(ip, 16)
+		allocated = append(allocated, &net.IPNet{IP: ip, Mask: net.CIDRMask(28, 32)})
+		ip, _ = cidrutil.Increment(ip, 16)
+	}
+	return free, allocated
+}
+
+func benchmarkReclaim(b *testing.B, reclaim func(pool *sliceIPPool, block *net.IPNet)) {
+	free, allocated := fragmentedFreeList(10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		pool := &sliceIPPool{FreeBlocks: append([]*net.IPNet(nil), free...)}
+		b.StartTimer()
+		reclaim(pool, allocated[i%len(allocated)])
+	}
+}
+
+func BenchmarkReclaimFullSort(b *testing.B) {
+	benchmarkReclaim(b, func(pool *sliceIPPool, block *net.IPNet) {
+		pool.FreeBlocks = append(pool.FreeBlocks, block)
+		pool.coalesceFreeBlocks()
+	})
+}
+
+func BenchmarkReclaimInsertion(b *testing.B) {
+	benchmarkReclaim(b, func(pool *sliceIPPool, block *net.IPNet) {
+		pool.insertFreeBlock(block)
+	})
+}
+
+func TestDynamicIPAMAllocator_ContextDone(t *testing.T) {
+	sliceName := "context-slice"
+	allocator := NewDynamicIPAMAllocator()
+	require.NoError(t, allocator.InitializePool(sliceName, "10.214.0.0/16"))
+	_, err := allocator.Allocate(context.Background(), sliceName, "cluster-a", 24)
+	require.NoError(t, err)
+	before := allocator.pools[sliceName].snapshot()
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now())
+	defer cancelExpired()
+
+	for name, tc := range map[string]struct {
+		ctx  context.Context
+		want error
+	}{
+		"Cancelled":         {ctx: cancelled, want: context.Canceled},
+		"Deadline exceeded": {ctx: expired, want: context.DeadlineExceeded},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := allocator.Allocate(tc.ctx, sliceName, "cluster-b", 24)
+			assert.ErrorIs(t, err, tc.want)
+			assert.ErrorIs(t, allocator.Reclaim(tc.ctx, sliceName, "cluster-a"), tc.want)
+			assert.Equal(t, before, allocator.pools[sliceName].snapshot())
+		})
+	}
+
+	t.Run("Deadline passes while waiting for the lock", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		allocator.pools[sliceName].mu.Lock()
+		done := make(chan error)
+		go func() {
+			_, err := allocator.Allocate(ctx, sliceName, "cluster-b", 24)
+			done <- err
+		}()
+		<-ctx.Done()
+		allocator.pools[sliceName].mu.Unlock()
+
+		assert.ErrorIs(t, <-done, context.DeadlineExceeded)
+		assert.Equal(t, before, allocator.pools[sliceName].snapshot())
+	})
+}
+
+func TestDynamicIPAMAllocator_AllocateBatch(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "batch-slice"
+	allocator := NewDynamicIPAMAllocator()
+	// The VPN reservation takes 10.215.0.0/24, leaving 10.215.1.0/24 and 10.215.2.0/23.
+	require.NoError(t, allocator.InitializePool(sliceName, "10.215.0.0/22"))
+
+	t.Run("All succeed", func(t *testing.T) {
+		allocated, err := allocator.AllocateBatch(ctx, sliceName, map[string]int{
+			"cluster-a": 25,
+			"cluster-b": 24,
+			"cluster-c": 25,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{
+			"cluster-a": "10.215.2.0/25",
+			"cluster-b": "10.215.1.0/24",
+			"cluster-c": "10.215.2.128/25",
+		}, allocated)
+		for clusterName, cidr := range allocated {
+			assert.Equal(t, cidr, allocator.pools[sliceName].Allocated[clusterName].String())
+		}
+	})
+
+	t.Run("Exhaustion rolls back the batch", func(t *testing.T) {
+		before := allocator.pools[sliceName].snapshot()
+
+		// Only 10.215.3.0/24 is left: cluster-d fits, cluster-e does not.
+		allocated, err := allocator.AllocateBatch(ctx, sliceName, map[string]int{
+			"cluster-d": 24,
+			"cluster-e": 25,
+		})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "cluster-e")
+		assert.Nil(t, allocated)
+		assert.Equal(t, before, allocator.pools[sliceName].snapshot())
+		assert.NotContains(t, allocator.pools[sliceName].Allocated, "cluster-d")
+	})
+
+	t.Run("Uninitialized pool", func(t *testing.T) {
+		_, err := allocator.AllocateBatch(ctx, "missing-slice", map[string]int{"cluster-a": 24})
+		assert.Error(t, err)
+	})
+
+	t.Run("Held blocks are not audited again", func(t *testing.T) {
+		sink := NewRingAuditSink(16)
+		allocator := NewDynamicIPAMAllocator(WithAuditSink(sink), WithoutVPNReservation())
+		require.NoError(t, allocator.InitializePool(sliceName, "10.215.0.0/22"))
+		held, err := allocator.Allocate(ctx, sliceName, "cluster-a", 24)
+		require.NoError(t, err)
+
+		allocated, err := allocator.AllocateBatch(ctx, sliceName, map[string]int{"cluster-a": 24, "cluster-b": 24})
+		require.NoError(t, err)
+		assert.Equal(t, held, allocated["cluster-a"])
+		records := sink.Records()
+		require.Len(t, records, 2)
+		assert.Equal(t, "cluster-a", records[0].ClusterName)
+		assert.Equal(t, "cluster-b", records[1].ClusterName, "only the newly carved block is audited")
+	})
+}
+
+func TestDynamicIPAMAllocator_CanAllocate(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "can-allocate-slice"
+	allocator := NewDynamicIPAMAllocator()
+	// The VPN reservation takes 10.219.0.0/24, leaving 10.219.1.0/24.
+	require.NoError(t, allocator.InitializePool(sliceName, "10.219.0.0/23"))
+	before := allocator.pools[sliceName].snapshot()
+
+	ok, err := allocator.CanAllocate(ctx, sliceName, 25)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = allocator.CanAllocate(ctx, sliceName, 24)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = allocator.CanAllocate(ctx, sliceName, 23)
+	require.NoError(t, err)
+	assert.False(t, ok, "only a /24 is free")
+	assert.Equal(t, before, allocator.pools[sliceName].snapshot(), "CanAllocate must not change the pool")
+
+	t.Run("Exhausted", func(t *testing.T) {
+		_, err := allocator.Allocate(ctx, sliceName, "cluster-a", 24)
+		require.NoError(t, err)
+		before := allocator.pools[sliceName].snapshot()
+
+		ok, err := allocator.CanAllocate(ctx, sliceName, 32)
+		require.NoError(t, err)
+		assert.False(t, ok)
+		assert.Equal(t, before, allocator.pools[sliceName].snapshot())
+	})
+
+	t.Run("Prefix wider than the address family", func(t *testing.T) {
+		_, err := allocator.CanAllocate(ctx, sliceName, 33)
+		assert.Error(t, err)
+	})
+
+	t.Run("Uninitialized pool", func(t *testing.T) {
+		_, err := allocator.CanAllocate(ctx, "missing-slice", 24)
+		assert.Error(t, err)
+	})
+}
+
+func TestDynamicIPAMAllocator_GetAllocation(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "get-allocation-slice"
+	allocator := NewDynamicIPAMAllocator()
+	require.NoError(t, allocator.InitializePool(sliceName, "10.220.0.0/16"))
+	allocated, err := allocator.Allocate(ctx, sliceName, "cluster-a", 24)
+	require.NoError(t, err)
+
+	cidr, err := allocator.GetAllocation(ctx, sliceName, "cluster-a")
+	require.NoError(t, err)
+	assert.Equal(t, allocated, cidr)
+
+	_, err = allocator.GetAllocation(ctx, sliceName, "cluster-b")
+	require.Error(t, err)
+	assert.ErrorIs(t, err, ErrAllocationNotFound)
+
+	require.NoError(t, allocator.Reclaim(ctx, sliceName, "cluster-a"))
+	_, err = allocator.GetAllocation(ctx, sliceName, "cluster-a")
+	assert.ErrorIs(t, err, ErrAllocationNotFound, "a reclaimed cluster has no allocation")
+
+	_, err = allocator.GetAllocation(ctx, "missing-slice", "cluster-a")
+	require.Error(t, err)
+	assert.ErrorIs(t, err, ErrPoolNotInitialized)
+	assert.NotErrorIs(t, err, ErrAllocationNotFound, "an uninitialized pool is reported differently")
+}
+
+func TestDynamicIPAMAllocator_SentinelErrors(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "sentinel-slice"
+	allocator := NewDynamicIPAMAllocator()
+	assert.True(t, errors.Is(allocator.InitializePool(sliceName, "10.221.0.0/33"), ErrInvalidCIDR))
+	// The VPN reservation takes 10.221.0.0/24, leaving 10.221.1.0/24.
+	require.NoError(t, allocator.InitializePool(sliceName, "10.221.0.0/23"))
+
+	_, err := allocator.Allocate(ctx, sliceName, "cluster-a", 24)
+	require.NoError(t, err)
+	_, err = allocator.Allocate(ctx, sliceName, "cluster-b", 28)
+	assert.True(t, errors.Is(err, ErrPoolExhausted))
+	assert.Contains(t, err.Error(), "cluster-b", "the wrapped error keeps its context")
+
+	_, err = allocator.Allocate(ctx, sliceName, "cluster-a", 25)
+	assert.True(t, errors.Is(err, ErrReallocationUnsupported))
+	assert.True(t, errors.Is(allocator.Reclaim(ctx, sliceName, "cluster-b"), ErrAllocationNotFound))
+	assert.True(t, errors.Is(allocator.Reclaim(ctx, "missing-slice", "cluster-a"), ErrPoolNotInitialized))
+}
+
+func TestDynamicIPAMAllocator_AllocateSpecific(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "specific-slice"
+	allocator := NewDynamicIPAMAllocator(WithVerification())
+	// The VPN reservation takes 10.222.0.0/24.
+	require.NoError(t, allocator.InitializePool(sliceName, "10.222.0.0/22"))
+
+	require.NoError(t, allocator.AllocateSpecific(ctx, sliceName, "cluster-a", "10.222.2.64/26"))
+	cidr, err := allocator.GetAllocation(ctx, sliceName, "cluster-a")
+	require.NoError(t, err)
+	assert.Equal(t, "10.222.2.64/26", cidr)
+	free, err := allocator.GetFreeBlocks(ctx, sliceName)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.222.1.0/24", "10.222.2.0/26", "10.222.2.128/25", "10.222.3.0/24"}, free,
+		"the surrounding /23 is split into aligned remainders")
+
+	require.NoError(t, allocator.AllocateSpecific(ctx, sliceName, "cluster-a", "10.222.2.64/26"), "repeating a reservation is a no-op")
+
+	t.Run("Conflicts", func(t *testing.T) {
+		for name, tc := range map[string]struct {
+			cluster string
+			cidr    string
+			want    string
+		}{
+			"Overlaps an allocation":       {cluster: "cluster-b", cidr: "10.222.2.0/24", want: "allocated to cluster-a"},
+			"Overlaps the VPN reservation": {cluster: "cluster-b", cidr: "10.222.0.128/25", want: "allocated to " + ReservedVPNClusterKey},
+			"Different CIDR for a cluster": {cluster: "cluster-a", cidr: "10.222.3.0/24", want: "already has subnet 10.222.2.64/26"},
+			"Outside the slice subnet":     {cluster: "cluster-b", cidr: "10.223.0.0/24", want: "not within slice subnet"},
+			"Wider than the slice subnet":  {cluster: "cluster-b", cidr: "10.222.0.0/21", want: "not within slice subnet"},
+			"Host bits set":                {cluster: "cluster-b", cidr: "10.222.3.1/24", want: "did you mean 10.222.3.0/24"},
+			"Misaligned":                   {cluster: "cluster-b", cidr: "10.222.3.64/25", want: "not a network address aligned to /25, did you mean 10.222.3.0/25"},
+		} {
+			t.Run(name, func(t *testing.T) {
+				before := allocator.pools[sliceName].snapshot()
+				err := allocator.AllocateSpecific(ctx, sliceName, tc.cluster, tc.cidr)
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.want)
+				assert.Equal(t, before, allocator.pools[sliceName].snapshot())
+			})
+		}
+	})
+
+	t.Run("Aligned", func(t *testing.T) {
+		require.NoError(t, allocator.AllocateSpecific(ctx, sliceName, "cluster-c", "10.222.3.128/25"))
+		require.NoError(t, allocator.AllocateSpecific(ctx, sliceName, "cluster-d", "10.222.3.0/25"))
+	})
+
+	t.Run("Misaligned block", func(t *testing.T) {
+		pool := allocator.pools[sliceName]
+		misaligned := &net.IPNet{IP: net.ParseIP("10.222.1.64").To4(), Mask: net.CIDRMask(25, 32)}
+		pool.mu.Lock()
+		err := pool.allocateSpecific("cluster-e", misaligned)
+		pool.mu.Unlock()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "did you mean 10.222.1.0/25")
+		assert.NotContains(t, pool.Allocated, "cluster-e")
+	})
+
+	t.Run("Uninitialized pool", func(t *testing.T) {
+		assert.ErrorIs(t, allocator.AllocateSpecific(ctx, "missing-slice", "cluster-a", "10.222.3.0/24"), ErrPoolNotInitialized)
+	})
+}
+
+func TestDynamicIPAMAllocator_MaxAllocatableBlocks(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "capacity-slice"
+	allocator := NewDynamicIPAMAllocator()
+	require.NoError(t, allocator.InitializePool(sliceName, "10.223.0.0/16"))
+
+	blocks, err := allocator.MaxAllocatableBlocks(ctx, sliceName, 24)
+	require.NoError(t, err)
+	assert.Equal(t, 255, blocks, "the VPN /24 is already taken")
+	blocks, err = allocator.MaxAllocatableBlocks(ctx, sliceName, 16)
+	require.NoError(t, err)
+	assert.Equal(t, 0, blocks)
+
+	t.Run("Fragmented pool", func(t *testing.T) {
+		// Take a /26 out of every /24 between 10.223.1.0 and 10.223.15.255, leaving a /26
+		// and a /25 free in each.
+		for i := 1; i < 16; i++ {
+			require.NoError(t, allocator.AllocateSpecific(ctx, sliceName, fmt.Sprintf("cluster-%d", i), fmt.Sprintf("10.223.%d.0/26", i)))
+		}
+
+		blocks, err := allocator.MaxAllocatableBlocks(ctx, sliceName, 24)
+		require.NoError(t, err)
+		assert.Equal(t, 240, blocks, "only 10.223.16.0/20 and up still holds whole /24s")
+		maxClusters, err := allocator.MaxClustersAtSize(sliceName, 24)
+		require.NoError(t, err)
+		assert.Greater(t, maxClusters, blocks, "MaxClustersAtSize ignores fragmentation")
+
+		blocks, err = allocator.MaxAllocatableBlocks(ctx, sliceName, 26)
+		require.NoError(t, err)
+		assert.Equal(t, 240*4+15*3, blocks)
+	})
+
+	t.Run("Prefix out of range", func(t *testing.T) {
+		_, err := allocator.MaxAllocatableBlocks(ctx, sliceName, 15)
+		assert.Error(t, err)
+	})
+
+	t.Run("Uninitialized pool", func(t *testing.T) {
+		_, err := allocator.MaxAllocatableBlocks(ctx, "missing-slice", 24)
+		assert.ErrorIs(t, err, ErrPoolNotInitialized)
+	})
+}
+
+func TestDynamicIPAMAllocator_VPNSubnetPlacement(t *testing.T) {
+	ctx := context.Background()
+	for name, vpnSubnet := range map[string]string{
+		"Top of the range": "10.226.255.0/24",
+		"Middle":           "10.226.128.0/24",
+		"Smaller than /24": "10.226.64.0/26",
+	} {
+		t.Run(name, func(t *testing.T) {
+			sliceName := "vpn-placement-slice"
+			allocator := NewDynamicIPAMAllocator()
+			require.NoError(t, allocator.InitializePoolWithOptions(sliceName, "10.226.0.0/16", PoolOptions{VPNSubnet: vpnSubnet}))
+
+			vpn, err := allocator.GetAllocation(ctx, sliceName, ReservedVPNClusterKey)
+			require.NoError(t, err)
+			assert.Equal(t, vpnSubnet, vpn)
+
+			// Fill the rest of the slice; no cluster may land on the VPN subnet.
+			vpnNet := mustParseCIDR(t, vpnSubnet)
+			for i := 0; ; i++ {
+				cidr, err := allocator.Allocate(ctx, sliceName, fmt.Sprintf("cluster-%d", i), 24)
+				if err != nil {
+					assert.ErrorIs(t, err, ErrPoolExhausted)
+					break
+				}
+				assert.False(t, cidrutil.Overlaps(vpnNet, mustParseCIDR(t, cidr)), "%s overlaps the VPN subnet", cidr)
+			}
+			assert.NoError(t, allocator.Verify(ctx, sliceName))
+		})
+	}
+
+	t.Run("Invalid placement", func(t *testing.T) {
+		for name, tc := range map[string]struct {
+			opts []IPAMAllocatorOption
+			vpn  string
+		}{
+			"Outside the slice subnet": {vpn: "10.227.0.0/24"},
+			"Wider than the slice":     {vpn: "10.226.0.0/15"},
+			"Host bits set":            {vpn: "10.226.0.1/24"},
+			"Reservation disabled":     {vpn: "10.226.0.0/24", opts: []IPAMAllocatorOption{WithVPNSubnetSize(0)}},
+		} {
+			t.Run(name, func(t *testing.T) {
+				allocator := NewDynamicIPAMAllocator(tc.opts...)
+				err := allocator.InitializePoolWithOptions("vpn-placement-slice", "10.226.0.0/16", PoolOptions{VPNSubnet: tc.vpn})
+				require.Error(t, err)
+				assert.Empty(t, allocator.pools, "a failed initialization must not register the pool")
+			})
+		}
+	})
+}
+
+func TestDynamicIPAMAllocator_ReclaimCIDR(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "reclaim-cidr-slice"
+	allocator := NewDynamicIPAMAllocator()
+	// The VPN reservation takes 10.246.0.0/24.
+	require.NoError(t, allocator.InitializePool(sliceName, "10.246.0.0/22"))
+	cidrA, err := allocator.Allocate(ctx, sliceName, "cluster-a", 25)
+	require.NoError(t, err)
+	cidrB, err := allocator.Allocate(ctx, sliceName, "cluster-b", 25)
+	require.NoError(t, err)
+
+	require.NoError(t, allocator.ReclaimCIDR(ctx, sliceName, cidrA))
+	allocations, err := allocator.ListAllocations(ctx, sliceName)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{ReservedVPNClusterKey: "10.246.0.0/24", "cluster-b": cidrB}, allocations)
+
+	require.NoError(t, allocator.ReclaimCIDR(ctx, sliceName, cidrB))
+	free, err := allocator.GetFreeBlocks(ctx, sliceName)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.246.1.0/24", "10.246.2.0/23"}, free, "reclaimed blocks are merged like Reclaim")
+
+	t.Run("Not allocated", func(t *testing.T) {
+		before := allocator.pools[sliceName].snapshot()
+		for _, cidr := range []string{cidrA, "10.246.1.0/24", "10.246.0.0/25"} {
+			assert.ErrorIs(t, allocator.ReclaimCIDR(ctx, sliceName, cidr), ErrAllocationNotFound, cidr)
+		}
+		assert.ErrorIs(t, allocator.ReclaimCIDR(ctx, sliceName, "10.246.1.1/24"), ErrInvalidCIDR)
+		assert.Equal(t, before, allocator.pools[sliceName].snapshot())
+	})
+
+	t.Run("Reserved allocation", func(t *testing.T) {
+		err := allocator.ReclaimCIDR(ctx, sliceName, "10.246.0.0/24")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "reserved for "+ReservedVPNClusterKey)
+	})
+
+	t.Run("Uninitialized pool", func(t *testing.T) {
+		assert.ErrorIs(t, allocator.ReclaimCIDR(ctx, "missing-slice", cidrA), ErrPoolNotInitialized)
+	})
+}
+
+func TestDynamicIPAMAllocator_AllocateInRange(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "in-range-slice"
+	allocator := NewDynamicIPAMAllocator()
+	// The VPN reservation takes 10.249.0.0/24, leaving a /24, a /23 and a /22 free.
+	require.NoError(t, allocator.InitializePool(sliceName, "10.249.0.0/21"))
+
+	t.Run("Largest size fits", func(t *testing.T) {
+		cidr, err := allocator.AllocateInRange(ctx, sliceName, "cluster-a", 22, 24)
+		require.NoError(t, err)
+		assert.Equal(t, "10.249.4.0/22", cidr)
+
+		again, err := allocator.AllocateInRange(ctx, sliceName, "cluster-a", 22, 24)
+		require.NoError(t, err)
+		assert.Equal(t, cidr, again, "an allocation within the range is returned unchanged")
+	})
+
+	t.Run("Falls back to a smaller size", func(t *testing.T) {
+		cidr, err := allocator.AllocateInRange(ctx, sliceName, "cluster-b", 22, 24)
+		require.NoError(t, err)
+		assert.Equal(t, "10.249.2.0/23", cidr)
+	})
+
+	t.Run("Only the smallest size fits", func(t *testing.T) {
+		cidr, err := allocator.AllocateInRange(ctx, sliceName, "cluster-c", 22, 24)
+		require.NoError(t, err)
+		assert.Equal(t, "10.249.1.0/24", cidr)
+	})
+
+	t.Run("None fit", func(t *testing.T) {
+		before := allocator.pools[sliceName].snapshot()
+		_, err := allocator.AllocateInRange(ctx, sliceName, "cluster-d", 22, 24)
+		assert.ErrorIs(t, err, ErrPoolExhausted)
+		assert.Equal(t, before, allocator.pools[sliceName].snapshot())
+	})
+
+	t.Run("Existing allocation outside the range", func(t *testing.T) {
+		_, err := allocator.AllocateInRange(ctx, sliceName, "cluster-c", 22, 23)
+		assert.ErrorIs(t, err, ErrReallocationUnsupported)
+	})
+
+	t.Run("Invalid range", func(t *testing.T) {
+		_, err := allocator.AllocateInRange(ctx, sliceName, "cluster-d", 24, 22)
+		assert.Error(t, err)
+		_, err = allocator.AllocateInRange(ctx, sliceName, "cluster-d", 30, 33)
+		assert.Error(t, err)
+	})
+}
+
+func TestDynamicIPAMAllocator_ReservedClusterName(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "reserved-name-slice"
+	allocator := NewDynamicIPAMAllocator()
+	require.NoError(t, allocator.InitializePool(sliceName, "10.250.0.0/22"))
+	before := allocator.pools[sliceName].snapshot()
+
+	cidr, err := allocator.Allocate(ctx, sliceName, "VPN_Subnet", 24)
+	assert.ErrorIs(t, err, ErrReservedClusterName)
+	assert.Empty(t, cidr, "the VPN subnet must not be handed to a cluster")
+
+	assert.ErrorIs(t, allocator.Reclaim(ctx, sliceName, "VPN_Subnet"), ErrReservedClusterName)
+	_, err = allocator.AllocateInRange(ctx, sliceName, "VPN_Subnet", 22, 24)
+	assert.ErrorIs(t, err, ErrReservedClusterName)
+	assert.ErrorIs(t, allocator.AllocateSpecific(ctx, sliceName, "VPN_Subnet", "10.250.1.0/24"), ErrReservedClusterName)
+	_, err = allocator.AllocateBatch(ctx, sliceName, map[string]int{"cluster-a": 24, "VPN_Subnet": 24})
+	assert.ErrorIs(t, err, ErrReservedClusterName)
+
+	assert.Equal(t, before, allocator.pools[sliceName].snapshot())
+}
+
+func TestDynamicIPAMAllocator_Compact(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "compact-slice"
+	allocator := NewDynamicIPAMAllocator(WithVPNSubnetSize(0))
+	require.NoError(t, allocator.InitializePool(sliceName, "10.254.0.0/24"))
+	// Eight adjacent /27s, out of order, as a free list built without merging.
+	pool := allocator.pools[sliceName]
+	pool.FreeBlocks = nil
+	for _, i := range []int{5, 0, 7, 2, 1, 6, 3, 4} {
+		pool.FreeBlocks = append(pool.FreeBlocks, mustParseCIDR(t, fmt.Sprintf("10.254.0.%d/27", 32*i)))
+	}
+
+	merged, err := allocator.Compact(ctx, sliceName)
+	require.NoError(t, err)
+	assert.Equal(t, 7, merged)
+	free, err := allocator.GetFreeBlocks(ctx, sliceName)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.254.0.0/24"}, free)
+
+	merged, err = allocator.Compact(ctx, sliceName)
+	require.NoError(t, err)
+	assert.Zero(t, merged, "a compacted free list has nothing left to merge")
+
+	_, err = allocator.Compact(ctx, "missing-slice")
+	assert.ErrorIs(t, err, ErrPoolNotInitialized)
+}
+
+func TestDynamicIPAMAllocator_AutoCompact(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "auto-compact-slice"
+	newAllocator := func(t *testing.T, opts ...IPAMAllocatorOption) *DynamicIPAMAllocator {
+		allocator := NewDynamicIPAMAllocator(append(opts, WithVPNSubnetSize(0))...)
+		require.NoError(t, allocator.InitializePool(sliceName, "10.254.0.0/23"))
+		_, err := allocator.Allocate(ctx, sliceName, "cluster-a", 24)
+		require.NoError(t, err)
+		_, err = allocator.Allocate(ctx, sliceName, "cluster-b", 27)
+		require.NoError(t, err)
+		// Seven adjacent /27s, as a free list built without merging, next to cluster-b.
+		pool := allocator.pools[sliceName]
+		pool.FreeBlocks = nil
+		for _, i := range []int{5, 7, 2, 1, 6, 3, 4} {
+			pool.FreeBlocks = append(pool.FreeBlocks, mustParseCIDR(t, fmt.Sprintf("10.254.1.%d/27", 32*i)))
+		}
+		return allocator
+	}
+
+	t.Run("Above the threshold", func(t *testing.T) {
+		allocator := newAllocator(t, WithAutoCompact(4))
+		require.NoError(t, allocator.Reclaim(ctx, sliceName, "cluster-b"))
+		free, err := allocator.GetFreeBlocks(ctx, sliceName)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"10.254.1.0/24"}, free)
+	})
+
+	t.Run("At or below the threshold", func(t *testing.T) {
+		allocator := newAllocator(t, WithAutoCompact(8))
+		require.NoError(t, allocator.Reclaim(ctx, sliceName, "cluster-b"))
+		free, err := allocator.GetFreeBlocks(ctx, sliceName)
+		require.NoError(t, err)
+		assert.Len(t, free, 8, "the free list is left as it was built")
+	})
+
+	t.Run("Disabled by default", func(t *testing.T) {
+		allocator := newAllocator(t)
+		require.NoError(t, allocator.Reclaim(ctx, sliceName, "cluster-b"))
+		free, err := allocator.GetFreeBlocks(ctx, sliceName)
+		require.NoError(t, err)
+		assert.Len(t, free, 8)
+	})
+}
+
+func TestDynamicIPAMAllocator_ForEachAllocation(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "for-each-slice"
+	allocator := NewDynamicIPAMAllocator()
+	require.NoError(t, allocator.InitializePool(sliceName, "10.244.0.0/20"))
+	for i := 0; i < 5; i++ {
+		_, err := allocator.Allocate(ctx, sliceName, fmt.Sprintf("cluster-%d", i), 24)
+		require.NoError(t, err)
+	}
+	want, err := allocator.ListAllocations(ctx, sliceName)
+	require.NoError(t, err)
+
+	seen := map[string]string{}
+	require.NoError(t, allocator.ForEachAllocation(ctx, sliceName, func(clusterName, cidr string) bool {
+		seen[clusterName] = cidr
+		return true
+	}))
+	assert.Len(t, seen, 6, "five clusters and the VPN reservation")
+	assert.Equal(t, want, seen)
+
+	t.Run("Stops early", func(t *testing.T) {
+		calls := 0
+		require.NoError(t, allocator.ForEachAllocation(ctx, sliceName, func(clusterName, cidr string) bool {
+			calls++
+			return calls < 2
+		}))
+		assert.Equal(t, 2, calls)
+	})
+
+	t.Run("Uninitialized pool", func(t *testing.T) {
+		err := allocator.ForEachAllocation(ctx, "missing-slice", func(string, string) bool { return true })
+		assert.ErrorIs(t, err, ErrPoolNotInitialized)
+	})
+}
+
+func TestDynamicIPAMAllocator_ReclaimAllForCluster(t *testing.T) {
+	ctx := context.Background()
+	allocator := NewDynamicIPAMAllocator()
+	want := map[string][]string{}
+	for i, sliceName := range []string{"offboard-slice-a", "offboard-slice-b", "offboard-slice-c"} {
+		require.NoError(t, allocator.InitializePool(sliceName, fmt.Sprintf("10.%d.0.0/22", 247+i)))
+		cidr, err := allocator.Allocate(ctx, sliceName, "cluster-a", 24)
+		require.NoError(t, err)
+		want[sliceName] = []string{cidr}
+		_, err = allocator.Allocate(ctx, sliceName, "cluster-b", 24)
+		require.NoError(t, err)
+	}
+	// cluster-a's named and contiguous blocks in one slice are offboarded with it.
+	podCIDR, err := allocator.AllocateNamed(ctx, "offboard-slice-b", "cluster-a", "pod", 26)
+	require.NoError(t, err)
+	parts, err := allocator.AllocateContiguous(ctx, "offboard-slice-b", "cluster-a", 26)
+	require.NoError(t, err)
+	want["offboard-slice-b"] = append(want["offboard-slice-b"], parts[0], podCIDR)
+	_, err = allocator.AllocateNamed(ctx, "offboard-slice-b", "cluster-b", "pod", 26)
+	require.NoError(t, err)
+	require.NoError(t, allocator.InitializePool("offboard-slice-d", "10.250.0.0/22"))
+
+	reclaimed, err := allocator.ReclaimAllForCluster(ctx, "cluster-a")
+	require.NoError(t, err)
+	assert.Equal(t, want, reclaimed)
+	for sliceName := range want {
+		allocations, err := allocator.ListAllocations(ctx, sliceName)
+		require.NoError(t, err)
+		for key := range allocations {
+			assert.NotEqual(t, "cluster-a", allocationCluster(key), "%s: %s", sliceName, key)
+		}
+		assert.Contains(t, allocations, "cluster-b", "other clusters keep their allocations")
+	}
+	allocations, err := allocator.ListAllocations(ctx, "offboard-slice-b")
+	require.NoError(t, err)
+	assert.Contains(t, allocations, "cluster-b/pod")
+
+	t.Run("Nothing to reclaim", func(t *testing.T) {
+		reclaimed, err := allocator.ReclaimAllForCluster(ctx, "cluster-a")
+		require.NoError(t, err)
+		assert.Empty(t, reclaimed)
+	})
+
+	t.Run("Partial failure", func(t *testing.T) {
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		reclaimed, err := allocator.ReclaimAllForCluster(canceled, "cluster-b")
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Empty(t, reclaimed)
+	})
+
+	t.Run("Reserved name", func(t *testing.T) {
+		_, err := allocator.ReclaimAllForCluster(ctx, ReservedVPNClusterKey)
+		assert.ErrorIs(t, err, ErrReservedClusterName)
+	})
+}
+
+func TestDynamicIPAMAllocator_Deterministic(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "deterministic-slice"
+	run := func(t *testing.T, strategy AllocationStrategy) poolSnapshot {
+		allocator := NewDynamicIPAMAllocator()
+		require.NoError(t, allocator.SetAllocationStrategy(strategy))
+		require.NoError(t, allocator.InitializePool(sliceName, "10.244.0.0/18"))
+
+		// The same seed replays the same mix of allocations and reclaims.
+		rng := rand.New(rand.NewSource(1289))
+		var live []string
+		for i := 0; i < 300; i++ {
+			if len(live) > 0 && rng.Intn(3) == 0 {
+				j := rng.Intn(len(live))
+				require.NoError(t, allocator.Reclaim(ctx, sliceName, live[j]))
+				live = append(live[:j], live[j+1:]...)
+				continue
+			}
+			clusterName := fmt.Sprintf("cluster-%d", i)
+			if _, err := allocator.Allocate(ctx, sliceName, clusterName, 23+rng.Intn(6)); err == nil {
+				live = append(live, clusterName)
+			}
+		}
+		_, err := allocator.AllocateBatch(ctx, sliceName, map[string]int{"batch-a": 28, "batch-b": 27, "batch-c": 28})
+		require.NoError(t, err)
+
+		return allocator.pools[sliceName].snapshot()
+	}
+
+	for _, strategy := range []AllocationStrategy{FirstFit, BestFit, WorstFit} {
+		t.Run(strategy.String(), func(t *testing.T) {
+			first := run(t, strategy)
+			require.NotEmpty(t, first.FreeBlocks)
+			for i := 0; i < 3; i++ {
+				assert.Equal(t, first, run(t, strategy))
+			}
+			assert.True(t, sort.SliceIsSorted(first.FreeBlocks, func(i, j int) bool {
+				return cidrutil.Compare(mustParseCIDR(t, first.FreeBlocks[i]), mustParseCIDR(t, first.FreeBlocks[j])) < 0
+			}), "free blocks stay sorted by address")
+		})
+	}
+}
+
+func TestDynamicIPAMAllocator_SortedAfterSplit(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "sorted-split-slice"
+	allocator := NewDynamicIPAMAllocator()
+	// The VPN reservation splits the /22 into 10.245.1.0/24 and 10.245.2.0/23.
+	require.NoError(t, allocator.InitializePool(sliceName, "10.245.0.0/22"))
+
+	cidr, err := allocator.Allocate(ctx, sliceName, "cluster-a", 27)
+	require.NoError(t, err)
+	require.Equal(t, "10.245.1.0/27", cidr)
+
+	want := []string{"10.245.1.32/27", "10.245.1.64/26", "10.245.1.128/25", "10.245.2.0/23"}
+	free, err := allocator.GetFreeBlocks(ctx, sliceName)
+	require.NoError(t, err)
+	assert.Equal(t, want, free, "the remainders of the split are in address order")
+	assert.Equal(t, want, allocator.pools[sliceName].snapshot().FreeBlocks, "the stored free list is kept sorted, not only the GetFreeBlocks copy")
+}
+
+func TestDynamicIPAMAllocator_WithoutVPNReservation(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "tiny-slice"
+
+	t.Run("With the reservation", func(t *testing.T) {
+		allocator := NewDynamicIPAMAllocator()
+		err := allocator.InitializePool(sliceName, "10.244.8.0/25")
+		assert.ErrorIs(t, err, ErrVPNReservationTooLarge, "a /24 VPN subnet cannot fit in a /25")
+		assert.ErrorIs(t, err, ErrPoolExhausted)
+		assert.Contains(t, err.Error(), "/24 VPN subnet")
+		assert.Contains(t, err.Error(), "10.244.8.0/25")
+		assert.NotContains(t, allocator.pools, sliceName)
+	})
+
+	t.Run("With a reservation as large as the slice", func(t *testing.T) {
+		allocator := NewDynamicIPAMAllocator(WithVPNSubnetSize(25))
+		require.NoError(t, allocator.InitializePool(sliceName, "10.244.8.0/25"))
+		vpn, err := allocator.GetAllocation(ctx, sliceName, ReservedVPNClusterKey)
+		require.NoError(t, err)
+		assert.Equal(t, "10.244.8.0/25", vpn)
+	})
+
+	t.Run("Without the reservation", func(t *testing.T) {
+		allocator := NewDynamicIPAMAllocator(WithoutVPNReservation())
+		require.NoError(t, allocator.InitializePool(sliceName, "10.244.8.0/25"))
+		_, err := allocator.GetAllocation(ctx, sliceName, ReservedVPNClusterKey)
+		assert.ErrorIs(t, err, ErrAllocationNotFound)
+
+		cidrA, err := allocator.Allocate(ctx, sliceName, "cluster-a", 26)
+		require.NoError(t, err)
+		cidrB, err := allocator.Allocate(ctx, sliceName, "cluster-b", 26)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"10.244.8.0/26", "10.244.8.64/26"}, []string{cidrA, cidrB}, "the whole /25 is available to clusters")
+	})
+}
+
+func TestDynamicIPAMAllocator_AllocateWithHint(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "hint-slice"
+	allocator := NewDynamicIPAMAllocator(WithVerification())
+	// The VPN reservation takes 10.244.16.0/24.
+	require.NoError(t, allocator.InitializePool(sliceName, "10.244.16.0/22"))
+
+	t.Run("Hint honored", func(t *testing.T) {
+		cidr, err := allocator.AllocateWithHint(ctx, sliceName, "cluster-a", 24, "10.244.18.0/24")
+		require.NoError(t, err)
+		assert.Equal(t, "10.244.18.0/24", cidr)
+
+		again, err := allocator.AllocateWithHint(ctx, sliceName, "cluster-a", 24, "10.244.19.0/24")
+		require.NoError(t, err)
+		assert.Equal(t, cidr, again, "an existing allocation is kept whatever the hint")
+	})
+
+	t.Run("Falls back when the hint is taken", func(t *testing.T) {
+		cidr, err := allocator.AllocateWithHint(ctx, sliceName, "cluster-b", 24, "10.244.18.0/24")
+		require.NoError(t, err)
+		assert.Equal(t, "10.244.17.0/24", cidr, "first-fit placement")
+	})
+
+	t.Run("Falls back when the hint is reserved or outside the slice", func(t *testing.T) {
+		cidr, err := allocator.AllocateWithHint(ctx, sliceName, "cluster-c", 25, "10.244.16.0/25")
+		require.NoError(t, err)
+		assert.Equal(t, "10.244.19.0/25", cidr)
+
+		cidr, err = allocator.AllocateWithHint(ctx, sliceName, "cluster-d", 25, "10.227.0.0/25")
+		require.NoError(t, err)
+		assert.Equal(t, "10.244.19.128/25", cidr)
+	})
+
+	t.Run("Invalid hint", func(t *testing.T) {
+		before := allocator.pools[sliceName].snapshot()
+		_, err := allocator.AllocateWithHint(ctx, sliceName, "cluster-e", 24, "10.244.18.1/24")
+		assert.ErrorIs(t, err, ErrInvalidCIDR)
+		_, err = allocator.AllocateWithHint(ctx, sliceName, "cluster-e", 24, "10.244.18.0/25")
+		assert.Error(t, err, "the hint must have the required size")
+		assert.Equal(t, before, allocator.pools[sliceName].snapshot())
+	})
+
+	t.Run("Exhausted", func(t *testing.T) {
+		_, err := allocator.AllocateWithHint(ctx, sliceName, "cluster-e", 24, "10.244.16.0/24")
+		assert.ErrorIs(t, err, ErrPoolExhausted)
+	})
+}
+
+func TestDynamicIPAMAllocator_SelectPool(t *testing.T) {
+	ctx := context.Background()
+	allocator := NewDynamicIPAMAllocator()
+	candidates := []string{"select-full", "select-half", "select-empty"}
+	for i, sliceName := range candidates {
+		// Each slice is a /22 whose VPN reservation takes the first /24.
+		require.NoError(t, allocator.InitializePool(sliceName, fmt.Sprintf("10.244.%d.0/22", 32+4*i)))
+	}
+	for i := 0; i < 3; i++ {
+		_, err := allocator.Allocate(ctx, "select-full", fmt.Sprintf("cluster-%d", i), 24)
+		require.NoError(t, err)
+	}
+	_, err := allocator.Allocate(ctx, "select-half", "cluster-a", 24)
+	require.NoError(t, err)
+
+	selected, err := allocator.SelectPoolForAllocation(ctx, candidates, 24)
+	require.NoError(t, err)
+	assert.Equal(t, "select-empty", selected, "the slice with the most free space wins")
+
+	t.Run("Only slices that fit are considered", func(t *testing.T) {
+		_, err := allocator.Allocate(ctx, "select-empty", "cluster-b", 25)
+		require.NoError(t, err)
+		_, err = allocator.Allocate(ctx, "select-empty", "cluster-c", 24)
+		require.NoError(t, err)
+		// select-empty now has more free addresses in total (a /25 and a /24) than
+		// select-half (a /23 in one piece), but only select-half can hold a /23.
+		selected, err := allocator.SelectPoolForAllocation(ctx, candidates, 23)
+		require.NoError(t, err)
+		assert.Equal(t, "select-half", selected)
+	})
+
+	t.Run("None fit", func(t *testing.T) {
+		_, err := allocator.SelectPoolForAllocation(ctx, []string{"select-full"}, 24)
+		assert.ErrorIs(t, err, ErrPoolExhausted)
+		_, err = allocator.SelectPoolForAllocation(ctx, nil, 24)
+		assert.ErrorIs(t, err, ErrPoolExhausted)
+	})
+
+	t.Run("Uninitialized candidate", func(t *testing.T) {
+		_, err := allocator.SelectPoolForAllocation(ctx, []string{"select-half", "missing-slice"}, 24)
+		assert.ErrorIs(t, err, ErrPoolNotInitialized)
+	})
+}
+
+func TestDynamicIPAMAllocator_GetVPNSubnet(t *testing.T) {
+	ctx := context.Background()
+	allocator := NewDynamicIPAMAllocator()
+	require.NoError(t, allocator.InitializePool("vpn-slice", "10.244.0.0/16"))
+	vpn, err := allocator.GetVPNSubnet(ctx, "vpn-slice")
+	require.NoError(t, err)
+	assert.Equal(t, "10.244.0.0/24", vpn, "the VPN reservation is the first /24 of the slice")
+
+	_, err = allocator.GetVPNSubnet(ctx, "missing-slice")
+	assert.ErrorIs(t, err, ErrPoolNotInitialized)
+
+	t.Run("No reservation", func(t *testing.T) {
+		allocator := NewDynamicIPAMAllocator(WithoutVPNReservation())
+		require.NoError(t, allocator.InitializePool("vpn-slice", "10.244.0.0/16"))
+		_, err := allocator.GetVPNSubnet(ctx, "vpn-slice")
+		assert.ErrorIs(t, err, ErrAllocationNotFound)
+	})
+}
+
+func TestDynamicIPAMAllocator_LookupByIP(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "lookup-slice"
+	allocator := NewDynamicIPAMAllocator()
+	require.NoError(t, allocator.InitializePool(sliceName, "10.244.0.0/16"))
+	cidrA, err := allocator.Allocate(ctx, sliceName, "cluster-a", 24)
+	require.NoError(t, err)
+	require.Equal(t, "10.244.1.0/24", cidrA)
+	cidrB, err := allocator.Allocate(ctx, sliceName, "cluster-b", 26)
+	require.NoError(t, err)
+	require.Equal(t, "10.244.2.0/26", cidrB)
+
+	for ip, want := range map[string][2]string{
+		"10.244.1.0":   {"cluster-a", cidrA},
+		"10.244.1.77":  {"cluster-a", cidrA},
+		"10.244.1.255": {"cluster-a", cidrA},
+		"10.244.2.63":  {"cluster-b", cidrB},
+		"10.244.0.1":   {ReservedVPNClusterKey, "10.244.0.0/24"},
+	} {
+		clusterName, cidr, err := allocator.LookupByIP(ctx, sliceName, ip)
+		require.NoError(t, err, ip)
+		assert.Equal(t, want, [2]string{clusterName, cidr}, ip)
+	}
+
+	t.Run("Free address", func(t *testing.T) {
+		_, _, err := allocator.LookupByIP(ctx, sliceName, "10.244.2.64")
+		assert.ErrorIs(t, err, ErrAllocationNotFound)
+		require.NoError(t, allocator.Reclaim(ctx, sliceName, "cluster-b"))
+		_, _, err = allocator.LookupByIP(ctx, sliceName, "10.244.2.1")
+		assert.ErrorIs(t, err, ErrAllocationNotFound, "a reclaimed block has no owner")
+	})
+
+	t.Run("Outside the slice subnet", func(t *testing.T) {
+		_, _, err := allocator.LookupByIP(ctx, sliceName, "10.245.1.1")
+		assert.ErrorIs(t, err, ErrAllocationNotFound)
+		assert.Contains(t, err.Error(), "outside slice subnet 10.244.0.0/16")
+		_, _, err = allocator.LookupByIP(ctx, sliceName, "fd00::1")
+		assert.ErrorIs(t, err, ErrAllocationNotFound)
+	})
+
+	t.Run("Invalid requests", func(t *testing.T) {
+		_, _, err := allocator.LookupByIP(ctx, sliceName, "10.244.1.0/24")
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, ErrAllocationNotFound)
+		_, _, err = allocator.LookupByIP(ctx, "missing-slice", "10.244.1.1")
+		assert.ErrorIs(t, err, ErrPoolNotInitialized)
+	})
+}
+
+func TestDynamicIPAMAllocator_MaxBlockSize(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "max-block-slice"
+	allocator := NewDynamicIPAMAllocator(WithMaxBlockSize(20))
+	require.NoError(t, allocator.InitializePool(sliceName, "10.244.0.0/16"))
+
+	cidr, err := allocator.Allocate(ctx, sliceName, "cluster-a", 20)
+	require.NoError(t, err, "a request at the limit is allowed")
+	assert.Equal(t, "10.244.16.0/20", cidr)
+
+	before := allocator.pools[sliceName].snapshot()
+	_, err = allocator.Allocate(ctx, sliceName, "cluster-b", 17)
+	assert.ErrorIs(t, err, ErrBlockTooLarge)
+	assert.Contains(t, err.Error(), "/17")
+	_, err = allocator.AllocateBatch(ctx, sliceName, map[string]int{"cluster-c": 24, "cluster-d": 19})
+	assert.ErrorIs(t, err, ErrBlockTooLarge)
+	_, err = allocator.AllocateIdempotent(ctx, sliceName, "cluster-e", 18, "key-e")
+	assert.ErrorIs(t, err, ErrBlockTooLarge)
+	err = allocator.AllocateSpecific(ctx, sliceName, "cluster-h", "10.244.128.0/17")
+	assert.ErrorIs(t, err, ErrBlockTooLarge)
+	assert.Equal(t, before, allocator.pools[sliceName].snapshot(), "rejected requests leave the pool unchanged")
+
+	t.Run("AllocateInRange skips sizes above the limit", func(t *testing.T) {
+		cidr, err := allocator.AllocateInRange(ctx, sliceName, "cluster-f", 17, 22)
+		require.NoError(t, err)
+		assert.Equal(t, "10.244.32.0/20", cidr)
+		_, err = allocator.AllocateInRange(ctx, sliceName, "cluster-g", 17, 19)
+		assert.ErrorIs(t, err, ErrBlockTooLarge)
+	})
+
+	require.NoError(t, allocator.AllocateSpecific(ctx, sliceName, "cluster-h", "10.244.128.0/20"), "a specific block at the limit is allowed")
+}
+
+func TestDynamicIPAMAllocator_IsInitialized(t *testing.T) {
+	allocator := NewDynamicIPAMAllocator()
+	assert.False(t, allocator.IsInitialized("init-slice"))
+	require.NoError(t, allocator.InitializePool("init-slice", "10.244.0.0/16"))
+	assert.True(t, allocator.IsInitialized("init-slice"))
+	assert.False(t, allocator.IsInitialized("other-slice"))
+
+	require.NoError(t, allocator.DeletePool(context.Background(), "init-slice"))
+	assert.False(t, allocator.IsInitialized("init-slice"))
+}
+
+func TestDynamicIPAMAllocator_ListSlices(t *testing.T) {
+	allocator := NewDynamicIPAMAllocator()
+	assert.Empty(t, allocator.ListSlices())
+
+	for _, sliceName := range []string{"slice-c", "slice-a", "slice-b"} {
+		require.NoError(t, allocator.InitializePool(sliceName, "10.244.0.0/16"))
+	}
+	assert.Equal(t, []string{"slice-a", "slice-b", "slice-c"}, allocator.ListSlices())
+
+	require.NoError(t, allocator.DeletePool(context.Background(), "slice-b"))
+	assert.Equal(t, []string{"slice-a", "slice-c"}, allocator.ListSlices())
+}
+
+func TestDynamicIPAMAllocator_AllocateForHosts(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "hosts-slice"
+	allocator := NewDynamicIPAMAllocator(WithoutVPNReservation())
+	require.NoError(t, allocator.InitializePool(sliceName, "10.244.0.0/22"))
+
+	for _, tc := range []struct {
+		clusterName string
+		hosts       int
+		want        string
+	}{
+		{clusterName: "cluster-a", hosts: 256, want: "10.244.0.0/24"},
+		{clusterName: "cluster-b", hosts: 100, want: "10.244.1.0/25"},
+		{clusterName: "cluster-c", hosts: 128, want: "10.244.1.128/25"},
+		{clusterName: "cluster-d", hosts: 1, want: "10.244.2.0/32"},
+	} {
+		cidr, err := allocator.AllocateForHosts(ctx, sliceName, tc.clusterName, tc.hosts)
+		require.NoError(t, err, "%d hosts", tc.hosts)
+		assert.Equal(t, tc.want, cidr, "%d hosts", tc.hosts)
+	}
+
+	_, err := allocator.AllocateForHosts(ctx, sliceName, "cluster-e", 2048)
+	assert.Error(t, err, "more hosts than the slice holds")
+	_, err = allocator.AllocateForHosts(ctx, sliceName, "cluster-e", 0)
+	assert.Error(t, err)
+	_, err = allocator.AllocateForHosts(ctx, "missing-slice", "cluster-e", 10)
+	assert.ErrorIs(t, err, ErrPoolNotInitialized)
+
+	t.Run("IPv6", func(t *testing.T) {
+		allocator := NewDynamicIPAMAllocator(WithoutVPNReservation())
+		require.NoError(t, allocator.InitializePool(sliceName, "fd00:10::/48"))
+		cidr, err := allocator.AllocateForHosts(ctx, sliceName, "cluster-a", 1<<20)
+		require.NoError(t, err)
+		assert.Equal(t, "fd00:10::/108", cidr)
+	})
+}
+
+func TestDynamicIPAMAllocator_RenameAllocation(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "rename-slice"
+	allocator := NewDynamicIPAMAllocator()
+	require.NoError(t, allocator.InitializePool(sliceName, "10.219.0.0/22"))
+	oldCIDR, err := allocator.Allocate(ctx, sliceName, "cluster-old", 24)
+	require.NoError(t, err)
+	_, err = allocator.Allocate(ctx, sliceName, "cluster-b", 25)
+	require.NoError(t, err)
+	require.NoError(t, allocator.PreserveAllocation(ctx, sliceName, "cluster-old"))
+	require.NoError(t, allocator.SetAllocationLabels(ctx, sliceName, "cluster-old", map[string]string{"tier": "edge"}))
+	free, err := allocator.GetFreeBlocks(ctx, sliceName)
+	require.NoError(t, err)
+
+	require.NoError(t, allocator.RenameAllocation(ctx, sliceName, "cluster-old", "cluster-new"))
+	cidr, err := allocator.GetAllocation(ctx, sliceName, "cluster-new")
+	require.NoError(t, err)
+	assert.Equal(t, oldCIDR, cidr)
+	_, err = allocator.GetAllocation(ctx, sliceName, "cluster-old")
+	assert.ErrorIs(t, err, ErrAllocationNotFound)
+	after, err := allocator.GetFreeBlocks(ctx, sliceName)
+	require.NoError(t, err)
+	assert.Equal(t, free, after, "the free list is untouched")
+	pool := allocator.pools[sliceName]
+	assert.True(t, pool.Preserved["cluster-new"])
+	assert.Equal(t, map[string]string{"tier": "edge"}, pool.Labels["cluster-new"])
+	assert.NotContains(t, pool.Preserved, "cluster-old")
+	assert.NotContains(t, pool.Labels, "cluster-old")
+
+	t.Run("Renaming to the same name", func(t *testing.T) {
+		require.NoError(t, allocator.RenameAllocation(ctx, sliceName, "cluster-new", "cluster-new"))
+		cidr, err := allocator.GetAllocation(ctx, sliceName, "cluster-new")
+		require.NoError(t, err)
+		assert.Equal(t, oldCIDR, cidr)
+	})
+
+	t.Run("Conflicts and missing allocations", func(t *testing.T) {
+		before, err := allocator.ListAllocations(ctx, sliceName)
+		require.NoError(t, err)
+
+		err = allocator.RenameAllocation(ctx, sliceName, "cluster-new", "cluster-b")
+		assert.ErrorIs(t, err, ErrAllocationExists)
+		err = allocator.RenameAllocation(ctx, sliceName, "cluster-old", "cluster-c")
+		assert.ErrorIs(t, err, ErrAllocationNotFound)
+		err = allocator.RenameAllocation(ctx, sliceName, "cluster-new", ReservedVPNClusterKey)
+		assert.ErrorIs(t, err, ErrReservedClusterName)
+		err = allocator.RenameAllocation(ctx, sliceName, ReservedVPNClusterKey, "cluster-c")
+		assert.ErrorIs(t, err, ErrReservedClusterName)
+		err = allocator.RenameAllocation(ctx, "missing-slice", "cluster-new", "cluster-c")
+		assert.ErrorIs(t, err, ErrPoolNotInitialized)
+
+		after, err := allocator.ListAllocations(ctx, sliceName)
+		require.NoError(t, err)
+		assert.Equal(t, before, after, "failed renames change nothing")
+	})
+
+	t.Run("Named and contiguous blocks move with the cluster", func(t *testing.T) {
+		podCIDR, err := allocator.AllocateNamed(ctx, sliceName, "cluster-new", "pod", 26)
+		require.NoError(t, err)
+		parts, err := allocator.AllocateContiguous(ctx, sliceName, "cluster-new", 27)
+		require.NoError(t, err)
+		_, err = allocator.AllocateNamed(ctx, sliceName, "cluster-d", "pod", 27)
+		require.NoError(t, err)
+		before, err := allocator.ListAllocations(ctx, sliceName)
+		require.NoError(t, err)
+
+		err = allocator.RenameAllocation(ctx, sliceName, "cluster-new", "cluster-d")
+		assert.ErrorIs(t, err, ErrAllocationExists, "cluster-d already holds a pod block")
+		after, err := allocator.ListAllocations(ctx, sliceName)
+		require.NoError(t, err)
+		assert.Equal(t, before, after, "a conflict on one block renames none")
+
+		require.NoError(t, allocator.RenameAllocation(ctx, sliceName, "cluster-new", "cluster-e"))
+		allocations, err := allocator.ListAllocations(ctx, sliceName)
+		require.NoError(t, err)
+		assert.Equal(t, oldCIDR, allocations["cluster-e"])
+		assert.Equal(t, podCIDR, allocations["cluster-e/pod"])
+		assert.Equal(t, parts[0], allocations["cluster-e/contiguous-0"])
+		for key := range allocations {
+			assert.NotEqual(t, "cluster-new", allocationCluster(key), key)
+		}
+
+		require.NoError(t, allocator.RenameAllocation(ctx, sliceName, "cluster-e/pod", "cluster-f/pod"))
+		allocations, err = allocator.ListAllocations(ctx, sliceName)
+		require.NoError(t, err)
+		assert.Equal(t, podCIDR, allocations["cluster-f/pod"])
+		assert.Equal(t, oldCIDR, allocations["cluster-e"], "renaming a named key moves only that block")
+	})
+
+	t.Run("Audit and metrics", func(t *testing.T) {
+		sink := NewRingAuditSink(8)
+		recorder := newFakeIPAMMetrics()
+		allocator := NewDynamicIPAMAllocator(WithAuditSink(sink), WithIPAMMetrics(recorder), WithClock(&fakeClock{}))
+		require.NoError(t, allocator.InitializePool(sliceName, "10.219.0.0/22"))
+		cidr, err := allocator.Allocate(ctx, sliceName, "cluster-a", 24)
+		require.NoError(t, err)
+
+		require.NoError(t, allocator.RenameAllocation(ctx, sliceName, "cluster-a", "cluster-b"))
+		require.Error(t, allocator.RenameAllocation(ctx, sliceName, "cluster-a", "cluster-c"))
+		records := sink.Records()
+		require.Len(t, records, 3)
+		assert.Equal(t, AuditRecord{Operation: ipamOperationReclaim, SliceName: sliceName, ClusterName: "cluster-a", CIDR: cidr}, records[1])
+		assert.Equal(t, AuditRecord{Operation: ipamOperationAllocate, SliceName: sliceName, ClusterName: "cluster-b", CIDR: cidr}, records[2])
+		assert.Equal(t, 1, recorder.operations[sliceName+"/rename/success"])
+		assert.Equal(t, 1, recorder.operations[sliceName+"/rename/failure"])
+	})
+
+	t.Run("Per-cluster block limit", func(t *testing.T) {
+		allocator := NewDynamicIPAMAllocator(WithPerClusterBlockLimit(2))
+		require.NoError(t, allocator.InitializePool(sliceName, "10.219.0.0/22"))
+		_, err := allocator.Allocate(ctx, sliceName, "cluster-a", 25)
+		require.NoError(t, err)
+		_, err = allocator.AllocateNamed(ctx, sliceName, "cluster-a", "pod", 25)
+		require.NoError(t, err)
+		_, err = allocator.AllocateNamed(ctx, sliceName, "cluster-b", "db", 25)
+		require.NoError(t, err)
+		before, err := allocator.ListAllocations(ctx, sliceName)
+		require.NoError(t, err)
+
+		err = allocator.RenameAllocation(ctx, sliceName, "cluster-a", "cluster-c")
+		assert.NoError(t, err)
+		err = allocator.RenameAllocation(ctx, sliceName, "cluster-c", "cluster-b")
+		assert.ErrorIs(t, err, ErrClusterQuotaExceeded, "both blocks of cluster-c would move")
+		require.NoError(t, allocator.RenameAllocation(ctx, sliceName, "cluster-c", "cluster-a"))
+		err = allocator.RenameAllocation(ctx, sliceName, "cluster-a/pod", "cluster-b/pod")
+		assert.NoError(t, err, "cluster-b may take a second block")
+		err = allocator.RenameAllocation(ctx, sliceName, "cluster-b/pod", "cluster-b/svc")
+		assert.NoError(t, err, "a block renamed within its cluster is not counted twice")
+		err = allocator.RenameAllocation(ctx, sliceName, "cluster-a", "cluster-b/web")
+		assert.ErrorIs(t, err, ErrClusterQuotaExceeded)
+
+		require.NoError(t, allocator.RenameAllocation(ctx, sliceName, "cluster-b/svc", "cluster-a/pod"))
+		after, err := allocator.ListAllocations(ctx, sliceName)
+		require.NoError(t, err)
+		assert.Equal(t, before, after, "failed renames change nothing")
+	})
+}
+
+func TestDynamicIPAMAllocator_OperationLogging(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "logging-slice"
+	lines := []string{}
+	logger := funcr.New(func(prefix, args string) {
+		lines = append(lines, args)
+	}, funcr.Options{Verbosity: 1})
+	allocator := NewDynamicIPAMAllocator(WithLogger(logger))
+	require.NoError(t, allocator.InitializePool(sliceName, "10.220.0.0/22"))
+
+	lines = lines[:0]
+	_, err := allocator.Allocate(ctx, sliceName, "cluster-a", 24)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		`"level"=1 "msg"="committed ipam operation" "operation"="allocate" "slice"="logging-slice" "cluster"="cluster-a" "cidr"="10.220.1.0/24"`,
+	}, lines, "split details stay at V(2)")
 
-		merged, ok = tryMerge(blockB, blockA)
-		assert.False(t, ok, "tryMerge expects blocks in sorted order for simpler logic, otherwise order check is needed")
+	lines = lines[:0]
+	require.NoError(t, allocator.Reclaim(ctx, sliceName, "cluster-a"))
+	_, err = allocator.Allocate(ctx, sliceName, "cluster-b", 21)
+	require.Error(t, err)
+	require.Len(t, lines, 2)
+	assert.Equal(t, `"level"=1 "msg"="committed ipam operation" "operation"="reclaim" "slice"="logging-slice" "cluster"="cluster-a" "cidr"="10.220.1.0/24"`, lines[0])
+	assert.Contains(t, lines[1], `"msg"="ipam operation failed" "operation"="allocate" "slice"="logging-slice"`)
+	assert.Contains(t, lines[1], ErrPoolExhausted.Error())
 
+	t.Run("Nothing is logged by default", func(t *testing.T) {
+		allocator := NewDynamicIPAMAllocator()
+		assert.False(t, allocator.Capabilities().Logging)
 	})
 }
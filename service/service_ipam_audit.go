@@ -0,0 +1,95 @@
+package service
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// AuditRecord describes one committed allocation or reclaim.
+type AuditRecord struct {
+	Time        time.Time
+	Operation   string
+	SliceName   string
+	ClusterName string
+	CIDR        string
+}
+
+// AuditSink receives a record of every allocation and reclaim. Record is called after the
+// pool has changed and while it is still locked, so records for a slice arrive in the
+// order the changes were made. It must not call back into the allocator for that slice.
+type AuditSink interface {
+	Record(record AuditRecord)
+}
+
+// WithAuditSink sends an AuditRecord to sink for every allocation and reclaim. Calls that
+// fail, and repeated Allocate calls that return an existing allocation, are not recorded.
+func WithAuditSink(sink AuditSink) IPAMAllocatorOption {
+	return func(a *DynamicIPAMAllocator) {
+		a.auditSink = sink
+	}
+}
+
+// audit records a committed change to a cluster's allocation, logs it at V(1) and
+// publishes it to subscribers. The caller must hold the pool's mutex.
+func (a *DynamicIPAMAllocator) audit(operation, sliceName, clusterName string, ipNet *net.IPNet) {
+	a.log.V(1).Info("committed ipam operation", "operation", operation, "slice", sliceName, "cluster", clusterName, "cidr", ipNet)
+	a.publish(AllocationEvent{
+		Operation:   operation,
+		SliceName:   sliceName,
+		ClusterName: clusterName,
+		CIDR:        ipNet.String(),
+	})
+	if a.auditSink == nil {
+		return
+	}
+	a.auditSink.Record(AuditRecord{
+		Time:        a.clock.Now(),
+		Operation:   operation,
+		SliceName:   sliceName,
+		ClusterName: clusterName,
+		CIDR:        ipNet.String(),
+	})
+}
+
+// RingAuditSink is an AuditSink that keeps the most recent records in memory, dropping the
+// oldest once it holds its capacity.
+type RingAuditSink struct {
+	mu      sync.Mutex
+	records []AuditRecord
+	next    int
+	full    bool
+}
+
+// NewRingAuditSink returns a RingAuditSink that holds up to capacity records.
+func NewRingAuditSink(capacity int) *RingAuditSink {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &RingAuditSink{records: make([]AuditRecord, capacity)}
+}
+
+// Record implements AuditSink.
+func (s *RingAuditSink) Record(record AuditRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records[s.next] = record
+	s.next = (s.next + 1) % len(s.records)
+	if s.next == 0 {
+		s.full = true
+	}
+}
+
+// Records returns the retained records, oldest first.
+func (s *RingAuditSink) Records() []AuditRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.full {
+		return append([]AuditRecord(nil), s.records[:s.next]...)
+	}
+	out := make([]AuditRecord, 0, len(s.records))
+	out = append(out, s.records[s.next:]...)
+	return append(out, s.records[:s.next]...)
+}
@@ -0,0 +1,75 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dailymotion/allure-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPAMAuditSuite(t *testing.T) {
+	for k, v := range IPAMAuditTestBed {
+		t.Run(k, func(t *testing.T) {
+			allure.Test(t, allure.Name(k),
+				allure.Action(func() {
+					v(t)
+				}))
+		})
+	}
+}
+
+var IPAMAuditTestBed = map[string]func(*testing.T){
+	"TestDynamicIPAMAllocator_AuditSink": TestDynamicIPAMAllocator_AuditSink,
+	"TestRingAuditSink":                  TestRingAuditSink,
+}
+
+func TestDynamicIPAMAllocator_AuditSink(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "audit-slice"
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	sink := NewRingAuditSink(16)
+	allocator := NewDynamicIPAMAllocator(WithAuditSink(sink), WithClock(clock))
+	// The VPN reservation takes 10.255.0.0/24 and is not audited.
+	require.NoError(t, allocator.InitializePool(sliceName, "10.255.0.0/22"))
+	start := clock.Now()
+
+	_, err := allocator.Allocate(ctx, sliceName, "cluster-a", 24)
+	require.NoError(t, err)
+	clock.Advance(time.Minute)
+	_, err = allocator.Allocate(ctx, sliceName, "cluster-b", 25)
+	require.NoError(t, err)
+	_, err = allocator.Allocate(ctx, sliceName, "cluster-a", 24)
+	require.NoError(t, err, "a repeated Allocate returns the existing allocation")
+	_, err = allocator.Allocate(ctx, sliceName, "cluster-c", 22)
+	require.Error(t, err)
+	clock.Advance(time.Minute)
+	require.NoError(t, allocator.Reclaim(ctx, sliceName, "cluster-a"))
+	require.Error(t, allocator.Reclaim(ctx, sliceName, "cluster-a"))
+	require.NoError(t, allocator.AllocateSpecific(ctx, sliceName, "cluster-d", "10.255.3.0/24"))
+
+	assert.Equal(t, []AuditRecord{
+		{Time: start, Operation: ipamOperationAllocate, SliceName: sliceName, ClusterName: "cluster-a", CIDR: "10.255.1.0/24"},
+		{Time: start.Add(time.Minute), Operation: ipamOperationAllocate, SliceName: sliceName, ClusterName: "cluster-b", CIDR: "10.255.2.0/25"},
+		{Time: start.Add(2 * time.Minute), Operation: ipamOperationReclaim, SliceName: sliceName, ClusterName: "cluster-a", CIDR: "10.255.1.0/24"},
+		{Time: start.Add(2 * time.Minute), Operation: ipamOperationAllocate, SliceName: sliceName, ClusterName: "cluster-d", CIDR: "10.255.3.0/24"},
+	}, sink.Records(), "only committed changes are recorded, in order")
+}
+
+func TestRingAuditSink(t *testing.T) {
+	sink := NewRingAuditSink(3)
+	assert.Empty(t, sink.Records())
+
+	for _, clusterName := range []string{"cluster-a", "cluster-b"} {
+		sink.Record(AuditRecord{ClusterName: clusterName})
+	}
+	assert.Equal(t, []AuditRecord{{ClusterName: "cluster-a"}, {ClusterName: "cluster-b"}}, sink.Records())
+
+	for _, clusterName := range []string{"cluster-c", "cluster-d"} {
+		sink.Record(AuditRecord{ClusterName: clusterName})
+	}
+	assert.Equal(t, []AuditRecord{{ClusterName: "cluster-b"}, {ClusterName: "cluster-c"}, {ClusterName: "cluster-d"}}, sink.Records(),
+		"the oldest record is dropped once the ring is full")
+}
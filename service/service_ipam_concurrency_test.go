@@ -0,0 +1,413 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dailymotion/allure-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPAMConcurrencySuite(t *testing.T) {
+	for k, v := range IPAMConcurrencyTestBed {
+		t.Run(k, func(t *testing.T) {
+			allure.Test(t, allure.Name(k),
+				allure.Action(func() {
+					v(t)
+				}))
+		})
+	}
+}
+
+var IPAMConcurrencyTestBed = map[string]func(*testing.T){
+	"TestDynamicIPAMAllocator_ConcurrentSlices":    TestDynamicIPAMAllocator_ConcurrentSlices,
+	"TestDynamicIPAMAllocator_SlicesDoNotBlock":    TestDynamicIPAMAllocator_SlicesDoNotBlock,
+	"TestDynamicIPAMAllocator_ConcurrentReads":     TestDynamicIPAMAllocator_ConcurrentReads,
+	"TestDynamicIPAMAllocator_ReadsDoNotBlock":     TestDynamicIPAMAllocator_ReadsDoNotBlock,
+	"TestDynamicIPAMAllocator_LockTimeout":         TestDynamicIPAMAllocator_LockTimeout,
+	"TestDynamicIPAMAllocator_MarshalDuringWrites": TestDynamicIPAMAllocator_MarshalDuringWrites,
+}
+
+// newConcurrencyTestAllocator initializes n slices named "stress-slice-<i>", each a /16
+// starting at 10.<228+i>.0.0.
+func newConcurrencyTestAllocator(t testing.TB, n int) (*DynamicIPAMAllocator, []string) {
+	allocator := NewDynamicIPAMAllocator(WithIPAMMetrics(newFakeIPAMMetrics()))
+	sliceNames := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		sliceName := fmt.Sprintf("stress-slice-%d", i)
+		require.NoError(t, allocator.InitializePool(sliceName, fmt.Sprintf("10.%d.0.0/16", 228+i)))
+		sliceNames = append(sliceNames, sliceName)
+	}
+	return allocator, sliceNames
+}
+
+func TestDynamicIPAMAllocator_ConcurrentSlices(t *testing.T) {
+	const (
+		slices     = 4
+		workers    = 8
+		iterations = 50
+	)
+	ctx := context.Background()
+	allocator, sliceNames := newConcurrencyTestAllocator(t, slices)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, slices*workers)
+	for _, sliceName := range sliceNames {
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(sliceName string, w int) {
+				defer wg.Done()
+				for i := 0; i < iterations; i++ {
+					clusterName := fmt.Sprintf("cluster-%d-%d", w, i)
+					if _, err := allocator.Allocate(ctx, sliceName, clusterName, 24+i%4); err != nil {
+						errs <- err
+						return
+					}
+					// Keep every other allocation so the pools fill up while others churn.
+					if i%2 == 0 {
+						if err := allocator.Reclaim(ctx, sliceName, clusterName); err != nil {
+							errs <- err
+							return
+						}
+					}
+					if _, err := allocator.PoolStats(ctx, sliceName); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}(sliceName, w)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	for _, sliceName := range sliceNames {
+		require.NoError(t, allocator.Verify(ctx, sliceName))
+		allocations, err := allocator.ListAllocations(ctx, sliceName)
+		require.NoError(t, err)
+		assert.Len(t, allocations, workers*iterations/2+1, "%s keeps every odd allocation and the VPN subnet", sliceName)
+	}
+}
+
+func TestDynamicIPAMAllocator_SlicesDoNotBlock(t *testing.T) {
+	ctx := context.Background()
+	allocator, sliceNames := newConcurrencyTestAllocator(t, 2)
+	busy, idle := sliceNames[0], sliceNames[1]
+
+	// Hold the busy slice's pool as a long-running operation would and queue an
+	// allocation behind it.
+	allocator.pools[busy].mu.Lock()
+	queued := make(chan error)
+	go func() {
+		_, err := allocator.Allocate(ctx, busy, "cluster-a", 24)
+		queued <- err
+	}()
+
+	done := make(chan error)
+	go func() {
+		_, err := allocator.Allocate(ctx, idle, "cluster-a", 24)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("allocation in an idle slice waited for another slice's pool")
+	}
+
+	allocator.pools[busy].mu.Unlock()
+	assert.NoError(t, <-queued)
+}
+
+// TestDynamicIPAMAllocator_ConcurrentReads mixes queries with allocations in one slice;
+// run with -race to check that queries only read the pool and return copies.
+func TestDynamicIPAMAllocator_ConcurrentReads(t *testing.T) {
+	const (
+		writers    = 4
+		readers    = 8
+		iterations = 50
+	)
+	ctx := context.Background()
+	allocator, sliceNames := newConcurrencyTestAllocator(t, 1)
+	sliceName := sliceNames[0]
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers+readers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				clusterName := fmt.Sprintf("cluster-%d-%d", w, i)
+				if _, err := allocator.Allocate(ctx, sliceName, clusterName, 26); err != nil {
+					errs <- err
+					return
+				}
+				if i%2 == 0 {
+					if err := allocator.Reclaim(ctx, sliceName, clusterName); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				allocations, err := allocator.ListAllocations(ctx, sliceName)
+				if err != nil {
+					errs <- err
+					return
+				}
+				for clusterName := range allocations {
+					allocations[clusterName] = "modified by the caller"
+				}
+				free, err := allocator.GetFreeBlocks(ctx, sliceName)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if len(free) > 0 {
+					free[0] = "modified by the caller"
+				}
+				if _, err := allocator.PoolStats(ctx, sliceName); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := allocator.CanAllocate(ctx, sliceName, 24); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	require.NoError(t, allocator.Verify(ctx, sliceName))
+	allocations, err := allocator.ListAllocations(ctx, sliceName)
+	require.NoError(t, err)
+	assert.Len(t, allocations, writers*iterations/2+1)
+	assert.NotContains(t, allocations, "modified by the caller")
+}
+
+// TestDynamicIPAMAllocator_MarshalDuringWrites serializes the allocator while writers
+// change every per-cluster map; run with -race to check that snapshots are copies.
+func TestDynamicIPAMAllocator_MarshalDuringWrites(t *testing.T) {
+	const (
+		writers    = 4
+		iterations = 200
+	)
+	ctx := context.Background()
+	allocator, sliceNames := newConcurrencyTestAllocator(t, 1)
+	sliceName := sliceNames[0]
+
+	var writes, marshals sync.WaitGroup
+	done := make(chan struct{})
+	errs := make(chan error, writers+2)
+	for w := 0; w < writers; w++ {
+		writes.Add(1)
+		go func(w int) {
+			defer writes.Done()
+			// Keep writing until the marshalers are done, so that they overlap.
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				clusterName := fmt.Sprintf("cluster-%d-%d", w, i)
+				if _, err := allocator.AllocateWithTTL(ctx, sliceName, clusterName, 26, time.Hour); err != nil {
+					errs <- err
+					return
+				}
+				if err := allocator.SetAllocationLabels(ctx, sliceName, clusterName, map[string]string{"worker": fmt.Sprint(w)}); err != nil {
+					errs <- err
+					return
+				}
+				keyed := clusterName + "-keyed"
+				if _, err := allocator.AllocateIdempotent(ctx, sliceName, keyed, 26, keyed); err != nil {
+					errs <- err
+					return
+				}
+				for _, name := range []string{clusterName, keyed} {
+					if err := allocator.Reclaim(ctx, sliceName, name); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	for _, marshal := range []func() ([]byte, error){allocator.MarshalState, allocator.SnapshotAll} {
+		marshals.Add(1)
+		go func(marshal func() ([]byte, error)) {
+			defer marshals.Done()
+			for i := 0; i < iterations; i++ {
+				if _, err := marshal(); err != nil {
+					errs <- err
+					return
+				}
+				runtime.Gosched()
+			}
+		}(marshal)
+	}
+	marshals.Wait()
+	close(done)
+	writes.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	require.NoError(t, allocator.Verify(ctx, sliceName))
+	allocations, err := allocator.ListAllocations(ctx, sliceName)
+	require.NoError(t, err)
+	assert.Len(t, allocations, 1, "only the VPN subnet is left")
+}
+
+func TestDynamicIPAMAllocator_ReadsDoNotBlock(t *testing.T) {
+	ctx := context.Background()
+	allocator, sliceNames := newConcurrencyTestAllocator(t, 1)
+	sliceName := sliceNames[0]
+
+	// Hold the pool's read lock as a long-running query would.
+	allocator.pools[sliceName].mu.RLock()
+	done := make(chan error)
+	go func() {
+		_, err := allocator.ListAllocations(ctx, sliceName)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("a query waited for another query on the same slice")
+	}
+
+	queued := make(chan error)
+	go func() {
+		_, err := allocator.Allocate(ctx, sliceName, "cluster-a", 24)
+		queued <- err
+	}()
+	select {
+	case <-queued:
+		t.Fatal("an allocation did not wait for a query in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	allocator.pools[sliceName].mu.RUnlock()
+	assert.NoError(t, <-queued)
+}
+
+func TestDynamicIPAMAllocator_LockTimeout(t *testing.T) {
+	allocator, sliceNames := newConcurrencyTestAllocator(t, 1)
+	sliceName := sliceNames[0]
+	handle, err := allocator.GetPool(sliceName)
+	require.NoError(t, err)
+
+	// Hold the pool as a slow operation would.
+	held := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		allocator.pools[sliceName].mu.Lock()
+		close(held)
+		<-release
+		allocator.pools[sliceName].mu.Unlock()
+	}()
+	<-held
+
+	for name, op := range map[string]func(ctx context.Context) error{
+		"Allocate": func(ctx context.Context) error {
+			_, err := allocator.Allocate(ctx, sliceName, "cluster-a", 24)
+			return err
+		},
+		"ListAllocations": func(ctx context.Context) error {
+			_, err := allocator.ListAllocations(ctx, sliceName)
+			return err
+		},
+		"Pool.Allocate": func(ctx context.Context) error {
+			_, err := handle.Allocate(ctx, "cluster-a", 24)
+			return err
+		},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		start := time.Now()
+		err := op(ctx)
+		cancel()
+		assert.ErrorIs(t, err, context.DeadlineExceeded, name)
+		assert.ErrorContains(t, err, "waiting for the pool lock", name)
+		assert.Less(t, time.Since(start), 5*time.Second, name)
+	}
+
+	close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = allocator.Allocate(ctx, sliceName, "cluster-a", 24)
+	assert.NoError(t, err, "the pool is usable once the slow operation is done")
+}
+
+// BenchmarkAllocateParallelSlices allocates and reclaims in parallel, each goroutine in
+// its own slice, so throughput scales with GOMAXPROCS only if slices do not contend.
+func BenchmarkAllocateParallelSlices(b *testing.B) {
+	const slices = 16
+	ctx := context.Background()
+	allocator, sliceNames := newConcurrencyTestAllocator(b, slices)
+	var next int32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		worker := int(atomic.AddInt32(&next, 1) - 1)
+		sliceName := sliceNames[worker%slices]
+		clusterName := fmt.Sprintf("bench-cluster-%d", worker)
+		for pb.Next() {
+			if _, err := allocator.Allocate(ctx, sliceName, clusterName, 24); err != nil {
+				b.Error(err)
+				return
+			}
+			if err := allocator.Reclaim(ctx, sliceName, clusterName); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkQueryParallel runs queries in parallel against a single slice, so throughput
+// scales with GOMAXPROCS only if queries do not exclude each other.
+func BenchmarkQueryParallel(b *testing.B) {
+	ctx := context.Background()
+	allocator, sliceNames := newConcurrencyTestAllocator(b, 1)
+	sliceName := sliceNames[0]
+	for i := 0; i < 64; i++ {
+		if _, err := allocator.Allocate(ctx, sliceName, fmt.Sprintf("bench-cluster-%d", i), 24); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := allocator.ListAllocations(ctx, sliceName); err != nil {
+				b.Error(err)
+				return
+			}
+			if _, err := allocator.PoolStats(ctx, sliceName); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
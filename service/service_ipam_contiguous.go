@@ -0,0 +1,175 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/kubeslice/kubeslice-controller/util/cidrutil"
+)
+
+// contiguousPurposePrefix names the parts of a contiguous allocation; part i is held
+// under the named allocation purpose "contiguous-<i>".
+const contiguousPurposePrefix = "contiguous-"
+
+// AllocateContiguous allocates a cluster as many addresses as a /totalPrefix block
+// holds, for clusters that need more space than any single free block offers. If one
+// aligned block of that size is free it is used; otherwise the space is taken from the
+// start of the first run of adjacent free blocks, in address order, that is large enough,
+// and returned as the fewest aligned CIDRs that cover it, in address order. The parts are
+// held as named allocations "<clusterName>/contiguous-<i>" and are reclaimed with
+// ReclaimNamed. Repeating the call returns the same parts. If no run of free space is
+// large enough the error wraps ErrPoolExhausted and the pool is left unchanged.
+func (a *DynamicIPAMAllocator) AllocateContiguous(ctx context.Context, sliceName string, clusterName string, totalPrefix int) (cidrs []string, err error) {
+	if err := validateClusterName(clusterName); err != nil {
+		return nil, err
+	}
+	if err := a.checkBlockSize(sliceName, clusterName, totalPrefix); err != nil {
+		return nil, err
+	}
+
+	defer a.observeDuration(sliceName, ipamOperationAllocate, time.Now())
+	defer func() { a.countOperation(sliceName, ipamOperationAllocate, err) }()
+	pool, err := a.lockPoolContext(ctx, ipamOperationAllocate, sliceName)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.mu.Unlock()
+
+	if err := pool.validateAllocationPrefix(totalPrefix); err != nil {
+		return nil, fmt.Errorf("failed to allocate contiguous space for cluster %s in slice %s: %w", clusterName, sliceName, err)
+	}
+	_, bits := pool.SliceSubnet.Mask.Size()
+	capacity := new(big.Int).Lsh(big.NewInt(1), uint(bits-totalPrefix))
+
+	if existing := pool.contiguousParts(clusterName); len(existing) > 0 {
+		held := new(big.Int)
+		for _, part := range existing {
+			held.Add(held, blockSize(part))
+			cidrs = append(cidrs, part.String())
+		}
+		if held.Cmp(capacity) != 0 {
+			return nil, fmt.Errorf("cluster %s already holds %s contiguous addresses in slice %s, but requested a /%d: %w",
+				clusterName, held.String(), sliceName, totalPrefix, ErrReallocationUnsupported)
+		}
+		return cidrs, nil
+	}
+
+	pool.releaseExpired()
+	// A single block goes where the pool's strategy would place it, found on a scratch copy
+	// so that it is claimed below like any other part.
+	scratch := pool.clone()
+	scratch.trace = logr.Discard()
+	var parts []*net.IPNet
+	if block, err := scratch.carveFit(totalPrefix); err == nil {
+		parts = []*net.IPNet{block}
+	} else {
+		parts = pool.contiguousRun(capacity, bits)
+	}
+	if parts == nil {
+		return nil, fmt.Errorf("failed to allocate contiguous space for cluster %s in slice %s: no run of free space holds a /%d: %w",
+			clusterName, sliceName, totalPrefix, ErrPoolExhausted)
+	}
+
+	// The plan may span free buddies that were never merged, or were merged only on the
+	// scratch copy; allocateSpecific needs each part inside a single free block.
+	pool.coalesceFreeBlocks()
+	snapshot := pool.clone()
+	for i, part := range parts {
+		if err := pool.allocateSpecific(contiguousPartKey(clusterName, i), part); err != nil {
+			pool.restore(snapshot)
+			return nil, fmt.Errorf("failed to allocate contiguous space for cluster %s in slice %s: %s: %w", clusterName, sliceName, part.String(), err)
+		}
+	}
+	for i, part := range parts {
+		a.audit(ipamOperationAllocate, sliceName, contiguousPartKey(clusterName, i), part)
+		cidrs = append(cidrs, part.String())
+	}
+	a.recordPoolMetrics(sliceName, pool)
+	if err := a.verifyAfter(ipamOperationAllocate, sliceName, pool); err != nil {
+		return nil, err
+	}
+
+	return cidrs, nil
+}
+
+// contiguousPartKey returns the Allocated key of part i of a contiguous allocation.
+func contiguousPartKey(clusterName string, i int) string {
+	return clusterName + namedAllocationSeparator + contiguousPurposePrefix + strconv.Itoa(i)
+}
+
+// contiguousParts returns the parts of the cluster's contiguous allocation in part order.
+func (pool *sliceIPPool) contiguousParts(clusterName string) []*net.IPNet {
+	var parts []*net.IPNet
+	for i := 0; ; i++ {
+		part, ok := pool.Allocated[contiguousPartKey(clusterName, i)]
+		if !ok {
+			return parts
+		}
+		parts = append(parts, part)
+	}
+}
+
+// contiguousRun finds the first run of adjacent free blocks, in address order, holding at
+// least capacity addresses and returns the fewest aligned blocks that cover capacity
+// addresses from the start of the run, or nil if no run is large enough.
+func (pool *sliceIPPool) contiguousRun(capacity *big.Int, bits int) []*net.IPNet {
+	free := append([]*net.IPNet(nil), pool.FreeBlocks...)
+	sort.Slice(free, func(i, j int) bool {
+		return cidrutil.Compare(free[i], free[j]) < 0
+	})
+
+	var start, end *big.Int
+	for _, block := range free {
+		blockStart := ipToInt(block.IP)
+		if end == nil || blockStart.Cmp(end) != 0 {
+			start = blockStart
+		}
+		end = new(big.Int).Add(blockStart, blockSize(block))
+		if new(big.Int).Sub(end, start).Cmp(capacity) >= 0 {
+			return alignedBlocks(start, capacity, bits)
+		}
+	}
+	return nil
+}
+
+// alignedBlocks returns the fewest aligned blocks covering size addresses from start:
+// at each step the largest block that starts on its own boundary and still fits.
+func alignedBlocks(start, size *big.Int, bits int) []*net.IPNet {
+	var blocks []*net.IPNet
+	cur := new(big.Int).Set(start)
+	remaining := new(big.Int).Set(size)
+	for remaining.Sign() > 0 {
+		hostBits := 0
+		for hostBits < bits && cur.Bit(hostBits) == 0 && new(big.Int).Lsh(big.NewInt(1), uint(hostBits+1)).Cmp(remaining) <= 0 {
+			hostBits++
+		}
+		blocks = append(blocks, &net.IPNet{IP: intToIP(cur, bits), Mask: net.CIDRMask(bits-hostBits, bits)})
+		step := new(big.Int).Lsh(big.NewInt(1), uint(hostBits))
+		cur.Add(cur, step)
+		remaining.Sub(remaining, step)
+	}
+	return blocks
+}
+
+// blockSize returns the number of addresses in a block.
+func blockSize(block *net.IPNet) *big.Int {
+	ones, bits := block.Mask.Size()
+	return new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+}
+
+func ipToInt(ip net.IP) *big.Int {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	return new(big.Int).SetBytes(ip)
+}
+
+func intToIP(n *big.Int, bits int) net.IP {
+	return n.FillBytes(make(net.IP, bits/8))
+}
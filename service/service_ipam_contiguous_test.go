@@ -0,0 +1,161 @@
+package service
+
+import (
+	"context"
+	"math/big"
+	"net"
+	"testing"
+
+	"github.com/dailymotion/allure-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPAMContiguousSuite(t *testing.T) {
+	for k, v := range IPAMContiguousTestBed {
+		t.Run(k, func(t *testing.T) {
+			allure.Test(t, allure.Name(k),
+				allure.Action(func() {
+					v(t)
+				}))
+		})
+	}
+}
+
+var IPAMContiguousTestBed = map[string]func(*testing.T){
+	"TestDynamicIPAMAllocator_AllocateContiguous": TestDynamicIPAMAllocator_AllocateContiguous,
+	"TestAlignedBlocks":                           TestAlignedBlocks,
+}
+
+func TestDynamicIPAMAllocator_AllocateContiguous(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "contiguous-slice"
+	// newAllocator returns a /22 pool with the given /24s, numbered 0-3, left free.
+	newAllocator := func(t *testing.T, free ...int) *DynamicIPAMAllocator {
+		allocator := NewDynamicIPAMAllocator(WithVPNSubnetSize(0))
+		require.NoError(t, allocator.InitializePool(sliceName, "10.222.0.0/22"))
+		for _, name := range []string{"cluster-0", "cluster-1", "cluster-2", "cluster-3"} {
+			_, err := allocator.Allocate(ctx, sliceName, name, 24)
+			require.NoError(t, err)
+		}
+		for _, i := range free {
+			require.NoError(t, allocator.Reclaim(ctx, sliceName, []string{"cluster-0", "cluster-1", "cluster-2", "cluster-3"}[i]))
+		}
+		return allocator
+	}
+
+	t.Run("Adjacent blocks that cannot merge", func(t *testing.T) {
+		allocator := newAllocator(t, 1, 2)
+		_, err := allocator.Allocate(ctx, sliceName, "single", 23)
+		require.ErrorIs(t, err, ErrPoolExhausted, "10.222.1.0/24 and 10.222.2.0/24 are not buddies")
+
+		cidrs, err := allocator.AllocateContiguous(ctx, sliceName, "wide", 23)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"10.222.1.0/24", "10.222.2.0/24"}, cidrs)
+		allocations, err := allocator.ListAllocations(ctx, sliceName)
+		require.NoError(t, err)
+		assert.Equal(t, "10.222.1.0/24", allocations["wide/contiguous-0"])
+		assert.Equal(t, "10.222.2.0/24", allocations["wide/contiguous-1"])
+		free, err := allocator.GetFreeBlocks(ctx, sliceName)
+		require.NoError(t, err)
+		assert.Empty(t, free)
+
+		again, err := allocator.AllocateContiguous(ctx, sliceName, "wide", 23)
+		require.NoError(t, err)
+		assert.Equal(t, cidrs, again, "a repeated call returns the same parts")
+		_, err = allocator.AllocateContiguous(ctx, sliceName, "wide", 24)
+		assert.ErrorIs(t, err, ErrReallocationUnsupported)
+
+		require.NoError(t, allocator.ReclaimNamed(ctx, sliceName, "wide", "contiguous-1"))
+		free, err = allocator.GetFreeBlocks(ctx, sliceName)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"10.222.2.0/24"}, free)
+	})
+
+	t.Run("Run that starts off a boundary", func(t *testing.T) {
+		allocator := newAllocator(t, 1, 2)
+		// Leave 10.222.1.128/25 and 10.222.2.0/25 free.
+		require.NoError(t, allocator.AllocateSpecific(ctx, sliceName, "low-half", "10.222.1.0/25"))
+		require.NoError(t, allocator.AllocateSpecific(ctx, sliceName, "high-half", "10.222.2.128/25"))
+
+		cidrs, err := allocator.AllocateContiguous(ctx, sliceName, "wide", 24)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"10.222.1.128/25", "10.222.2.0/25"}, cidrs)
+		free, err := allocator.GetFreeBlocks(ctx, sliceName)
+		require.NoError(t, err)
+		assert.Empty(t, free)
+	})
+
+	t.Run("A single aligned block is preferred", func(t *testing.T) {
+		allocator := newAllocator(t, 0, 1, 2)
+		cidrs, err := allocator.AllocateContiguous(ctx, sliceName, "wide", 23)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"10.222.0.0/23"}, cidrs)
+	})
+
+	t.Run("Free buddies that were never merged", func(t *testing.T) {
+		allocator := newAllocator(t, 0, 1)
+		// Leave 10.222.0.0/23 free as two unmerged /24 buddies.
+		allocator.pools[sliceName].FreeBlocks = []*net.IPNet{mustParseCIDR(t, "10.222.0.0/24"), mustParseCIDR(t, "10.222.1.0/24")}
+		cidrs, err := allocator.AllocateContiguous(ctx, sliceName, "wide", 23)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"10.222.0.0/23"}, cidrs)
+
+		allocator = newAllocator(t, 1, 2)
+		// Leave 10.222.1.0/24 free as two unmerged /25 buddies.
+		allocator.pools[sliceName].FreeBlocks = []*net.IPNet{
+			mustParseCIDR(t, "10.222.1.0/25"), mustParseCIDR(t, "10.222.1.128/25"), mustParseCIDR(t, "10.222.2.0/24"),
+		}
+		cidrs, err = allocator.AllocateContiguous(ctx, sliceName, "wide", 23)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"10.222.1.0/24", "10.222.2.0/24"}, cidrs)
+		free, err := allocator.GetFreeBlocks(ctx, sliceName)
+		require.NoError(t, err)
+		assert.Empty(t, free)
+	})
+
+	t.Run("Only scattered space", func(t *testing.T) {
+		allocator := newAllocator(t, 0, 2)
+		before := allocator.pools[sliceName].snapshot()
+
+		_, err := allocator.AllocateContiguous(ctx, sliceName, "wide", 23)
+		assert.ErrorIs(t, err, ErrPoolExhausted, "half the pool is free, but not in one run")
+		assert.Equal(t, before, allocator.pools[sliceName].snapshot())
+	})
+
+	t.Run("Invalid requests", func(t *testing.T) {
+		allocator := newAllocator(t, 1, 2)
+		_, err := allocator.AllocateContiguous(ctx, sliceName, "wide", 21)
+		assert.ErrorIs(t, err, ErrPoolExhausted)
+		_, err = allocator.AllocateContiguous(ctx, sliceName, ReservedVPNClusterKey, 23)
+		assert.ErrorIs(t, err, ErrReservedClusterName)
+		_, err = allocator.AllocateContiguous(ctx, "missing-slice", "wide", 23)
+		assert.ErrorIs(t, err, ErrPoolNotInitialized)
+	})
+}
+
+func TestAlignedBlocks(t *testing.T) {
+	for _, tc := range []struct {
+		start string
+		size  int64
+		want  []string
+	}{
+		{start: "10.0.0.0", size: 256, want: []string{"10.0.0.0/24"}},
+		{start: "10.0.0.128", size: 256, want: []string{"10.0.0.128/25", "10.0.1.0/25"}},
+		{start: "10.0.0.64", size: 512, want: []string{"10.0.0.64/26", "10.0.0.128/25", "10.0.1.0/24", "10.0.2.0/26"}},
+		{start: "10.0.0.1", size: 4, want: []string{"10.0.0.1/32", "10.0.0.2/31", "10.0.0.4/32"}},
+		{start: "fd00::8", size: 16, want: []string{"fd00::8/125", "fd00::10/125"}},
+	} {
+		ip := net.ParseIP(tc.start)
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			bits = 8 * net.IPv4len
+		}
+		blocks := alignedBlocks(ipToInt(ip), big.NewInt(tc.size), bits)
+		got := []string{}
+		for _, block := range blocks {
+			got = append(got, block.String())
+		}
+		assert.Equal(t, tc.want, got, "%d addresses from %s", tc.size, tc.start)
+	}
+}
@@ -0,0 +1,40 @@
+package service
+
+// allocationEventBuffer is the number of events a subscriber may fall behind by before
+// further events to it are dropped.
+const allocationEventBuffer = 64
+
+// AllocationEvent describes one committed allocation or reclaim.
+type AllocationEvent struct {
+	Operation   string
+	SliceName   string
+	ClusterName string
+	CIDR        string
+}
+
+// Subscribe returns a channel that receives an AllocationEvent after every allocation and
+// reclaim, in the order the changes were made to each slice. Events are sent without
+// blocking while the pool is locked, so a subscriber that falls more than
+// allocationEventBuffer events behind misses events rather than stalling the allocator;
+// it should resync from ListAllocations if it cannot keep up. The channel is never closed.
+func (a *DynamicIPAMAllocator) Subscribe() <-chan AllocationEvent {
+	events := make(chan AllocationEvent, allocationEventBuffer)
+	a.subscribersMu.Lock()
+	a.subscribers = append(a.subscribers, events)
+	a.subscribersMu.Unlock()
+	return events
+}
+
+// publish sends event to every subscriber that has room for it.
+func (a *DynamicIPAMAllocator) publish(event AllocationEvent) {
+	a.subscribersMu.Lock()
+	defer a.subscribersMu.Unlock()
+
+	for _, events := range a.subscribers {
+		select {
+		case events <- event:
+		default:
+			a.log.V(1).Info("dropped allocation event for a slow subscriber", "slice", event.SliceName, "cluster", event.ClusterName, "operation", event.Operation)
+		}
+	}
+}
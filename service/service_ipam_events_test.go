@@ -0,0 +1,81 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/dailymotion/allure-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPAMEventsSuite(t *testing.T) {
+	for k, v := range IPAMEventsTestBed {
+		t.Run(k, func(t *testing.T) {
+			allure.Test(t, allure.Name(k),
+				allure.Action(func() {
+					v(t)
+				}))
+		})
+	}
+}
+
+var IPAMEventsTestBed = map[string]func(*testing.T){
+	"TestDynamicIPAMAllocator_Subscribe":           TestDynamicIPAMAllocator_Subscribe,
+	"TestDynamicIPAMAllocator_SubscribeSlowReader": TestDynamicIPAMAllocator_SubscribeSlowReader,
+}
+
+// drainEvents returns the events already buffered on events.
+func drainEvents(events <-chan AllocationEvent) []AllocationEvent {
+	var out []AllocationEvent
+	for {
+		select {
+		case event := <-events:
+			out = append(out, event)
+		default:
+			return out
+		}
+	}
+}
+
+func TestDynamicIPAMAllocator_Subscribe(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "events-slice"
+	allocator := NewDynamicIPAMAllocator()
+	// The VPN reservation takes 10.250.0.0/24 and is not published.
+	require.NoError(t, allocator.InitializePool(sliceName, "10.250.0.0/22"))
+	first, second := allocator.Subscribe(), allocator.Subscribe()
+
+	_, err := allocator.Allocate(ctx, sliceName, "cluster-a", 24)
+	require.NoError(t, err)
+	_, err = allocator.Allocate(ctx, sliceName, "cluster-a", 24)
+	require.NoError(t, err, "a repeated Allocate returns the existing allocation")
+	_, err = allocator.Allocate(ctx, sliceName, "cluster-b", 22)
+	require.Error(t, err)
+	require.NoError(t, allocator.Reclaim(ctx, sliceName, "cluster-a"))
+
+	want := []AllocationEvent{
+		{Operation: ipamOperationAllocate, SliceName: sliceName, ClusterName: "cluster-a", CIDR: "10.250.1.0/24"},
+		{Operation: ipamOperationReclaim, SliceName: sliceName, ClusterName: "cluster-a", CIDR: "10.250.1.0/24"},
+	}
+	assert.Equal(t, want, drainEvents(first), "only committed changes are published, in order")
+	assert.Equal(t, want, drainEvents(second), "every subscriber receives every event")
+}
+
+func TestDynamicIPAMAllocator_SubscribeSlowReader(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "events-slow-slice"
+	allocator := NewDynamicIPAMAllocator(WithoutVPNReservation())
+	require.NoError(t, allocator.InitializePool(sliceName, "10.250.0.0/16"))
+	events := allocator.Subscribe()
+
+	// Nobody reads events, so the allocator must carry on once the buffer is full.
+	for i := 0; i < allocationEventBuffer+8; i++ {
+		_, err := allocator.Allocate(ctx, sliceName, fmt.Sprintf("cluster-%d", i), 26)
+		require.NoError(t, err)
+	}
+	received := drainEvents(events)
+	require.Len(t, received, allocationEventBuffer, "events beyond the buffer are dropped")
+	assert.Equal(t, "cluster-0", received[0].ClusterName)
+}
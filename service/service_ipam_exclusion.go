@@ -0,0 +1,148 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/kubeslice/kubeslice-controller/util/cidrutil"
+)
+
+// ImportExclusions withholds every given CIDR from allocation. All CIDRs are validated
+// first: each must be a network address within the slice subnet and must not overlap an
+// allocation, an existing exclusion or another CIDR in the list. If any check fails
+// nothing is excluded. The free list is carved in a single pass, which makes this much
+// cheaper than excluding the ranges one at a time when adopting a network with many
+// reserved ranges.
+func (a *DynamicIPAMAllocator) ImportExclusions(sliceName string, cidrs []string) error {
+	pool, err := a.lockPool(sliceName)
+	if err != nil {
+		return err
+	}
+	defer pool.mu.Unlock()
+
+	exclusions := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		excluded, err := parseNetworkCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("cannot exclude from slice %s: %w", sliceName, err)
+		}
+		if err := pool.validateExclusion(excluded); err != nil {
+			return fmt.Errorf("cannot exclude %s from slice %s: %w", cidr, sliceName, err)
+		}
+		for _, other := range exclusions {
+			if cidrutil.Overlaps(excluded, other) {
+				return fmt.Errorf("cannot exclude %s from slice %s: overlaps %s in the same import", cidr, sliceName, other.String())
+			}
+		}
+		exclusions = append(exclusions, excluded)
+	}
+
+	pool.exclude(exclusions)
+	a.recordPoolMetrics(sliceName, pool)
+
+	return nil
+}
+
+// ExcludeRange permanently withholds cidr, such as a gateway range or a legacy static
+// assignment, from allocation. The CIDR must lie within the slice subnet and must only
+// cover free space; the free block holding it is split around it. Excluded space is never
+// merged back into the free list, so reclaiming a neighbouring block cannot recreate it.
+func (a *DynamicIPAMAllocator) ExcludeRange(ctx context.Context, sliceName string, cidr string) error {
+	excluded, err := parseNetworkCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("cannot exclude from slice %s: %w", sliceName, err)
+	}
+
+	pool, err := a.lockPoolContext(ctx, "exclude", sliceName)
+	if err != nil {
+		return err
+	}
+	defer pool.mu.Unlock()
+
+	if err := pool.validateExclusion(excluded); err != nil {
+		return fmt.Errorf("cannot exclude %s from slice %s: %w", cidr, sliceName, err)
+	}
+	pool.exclude([]*net.IPNet{excluded})
+	a.log.V(1).Info("excluded range", "slice", sliceName, "cidr", excluded)
+	a.recordPoolMetrics(sliceName, pool)
+
+	return nil
+}
+
+// exclude carves validated exclusions out of the free list and records them. The caller
+// must hold the pool's mutex.
+func (pool *sliceIPPool) exclude(exclusions []*net.IPNet) {
+	pool.FreeBlocks = carveOut(pool.FreeBlocks, exclusions)
+	pool.sortFreeBlocks()
+	pool.Excluded = append(pool.Excluded, exclusions...)
+	sort.Slice(pool.Excluded, func(i, j int) bool {
+		return cidrutil.Compare(pool.Excluded[i], pool.Excluded[j]) < 0
+	})
+}
+
+// excludedOverlapping returns the exclusion that overlaps block, or nil if there is none.
+func (pool *sliceIPPool) excludedOverlapping(block *net.IPNet) *net.IPNet {
+	for _, excluded := range pool.Excluded {
+		if cidrutil.Overlaps(block, excluded) {
+			return excluded
+		}
+	}
+	return nil
+}
+
+// validateExclusion checks that a prospective exclusion only covers free space.
+func (pool *sliceIPPool) validateExclusion(excluded *net.IPNet) error {
+	sliceOnes, sliceBits := pool.SliceSubnet.Mask.Size()
+	ones, bits := excluded.Mask.Size()
+	if bits != sliceBits || ones < sliceOnes || !pool.SliceSubnet.Contains(excluded.IP) {
+		return fmt.Errorf("not within slice subnet %s", pool.SliceSubnet.String())
+	}
+	for clusterName, allocated := range pool.Allocated {
+		if cidrutil.Overlaps(excluded, allocated) {
+			return fmt.Errorf("overlaps subnet %s allocated to %s", allocated.String(), clusterName)
+		}
+	}
+	for _, existing := range pool.Excluded {
+		if cidrutil.Overlaps(excluded, existing) {
+			return fmt.Errorf("overlaps existing exclusion %s", existing.String())
+		}
+	}
+	for _, q := range pool.Quarantined {
+		if cidrutil.Overlaps(excluded, q.Block) {
+			return fmt.Errorf("overlaps quarantined block %s", q.Block.String())
+		}
+	}
+	return nil
+}
+
+// carveOut removes every hole from blocks, returning the aligned blocks that remain.
+// Blocks partially covered by a hole are halved until each piece is either fully covered
+// or untouched.
+func carveOut(blocks []*net.IPNet, holes []*net.IPNet) []*net.IPNet {
+	remaining := make([]*net.IPNet, 0, len(blocks))
+	for _, block := range blocks {
+		remaining = append(remaining, carveBlock(block, holes)...)
+	}
+	return remaining
+}
+
+func carveBlock(block *net.IPNet, holes []*net.IPNet) []*net.IPNet {
+	blockOnes, _ := block.Mask.Size()
+	overlapping := false
+	for _, hole := range holes {
+		if !cidrutil.Overlaps(block, hole) {
+			continue
+		}
+		if holeOnes, _ := hole.Mask.Size(); holeOnes <= blockOnes {
+			return nil // the hole covers the whole block
+		}
+		overlapping = true
+	}
+	if !overlapping {
+		return []*net.IPNet{block}
+	}
+	lower, upper, _ := cidrutil.Split(block)
+	return append(carveBlock(lower, holes), carveBlock(upper, holes)...)
+}
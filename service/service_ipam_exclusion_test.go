@@ -0,0 +1,176 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/dailymotion/allure-go"
+	"github.com/kubeslice/kubeslice-controller/util/cidrutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPAMExclusionSuite(t *testing.T) {
+	for k, v := range IPAMExclusionTestBed {
+		t.Run(k, func(t *testing.T) {
+			allure.Test(t, allure.Name(k),
+				allure.Action(func() {
+					v(t)
+				}))
+		})
+	}
+}
+
+var IPAMExclusionTestBed = map[string]func(*testing.T){
+	"TestDynamicIPAMAllocator_ImportExclusions":             TestDynamicIPAMAllocator_ImportExclusions,
+	"TestDynamicIPAMAllocator_ImportExclusionsAllOrNothing": TestDynamicIPAMAllocator_ImportExclusionsAllOrNothing,
+	"TestDynamicIPAMAllocator_ExcludeRange":                 TestDynamicIPAMAllocator_ExcludeRange,
+}
+
+func TestDynamicIPAMAllocator_ImportExclusions(t *testing.T) {
+	recorder := newFakeIPAMMetrics()
+	allocator := NewDynamicIPAMAllocator(WithIPAMMetrics(recorder))
+	sliceName := "adopted-slice"
+	err := allocator.InitializePool(sliceName, "10.160.0.0/16")
+	require.NoError(t, err)
+
+	exclusions := []string{}
+	for i := 1; i <= 10; i++ {
+		exclusions = append(exclusions, fmt.Sprintf("10.160.%d.0/24", i))
+	}
+	err = allocator.ImportExclusions(sliceName, exclusions)
+	require.NoError(t, err)
+
+	pool := allocator.pools[sliceName]
+	free := []string{}
+	for _, b := range pool.FreeBlocks {
+		free = append(free, b.String())
+	}
+	assert.Equal(t, []string{
+		"10.160.11.0/24",
+		"10.160.12.0/22",
+		"10.160.16.0/20",
+		"10.160.32.0/19",
+		"10.160.64.0/18",
+		"10.160.128.0/17",
+	}, free)
+	assert.Len(t, pool.Excluded, 10)
+	assert.Equal(t, float64(11*256), recorder.reserved[sliceName], "exclusions count as reserved space")
+
+	max, err := allocator.MaxClustersAtSize(sliceName, 24)
+	require.NoError(t, err)
+	assert.Equal(t, 245, max)
+
+	// Drain the pool and make sure nothing handed out touches an excluded range.
+	for i := 0; ; i++ {
+		cidr, err := allocator.Allocate(context.Background(), sliceName, fmt.Sprintf("cluster-%d", i), 24)
+		if err != nil {
+			assert.Equal(t, 245, i, "every non-excluded /24 should be allocatable")
+			break
+		}
+		_, allocated, _ := net.ParseCIDR(cidr)
+		for _, excluded := range pool.Excluded {
+			assert.False(t, cidrutil.Overlaps(allocated, excluded), "%s overlaps excluded %s", cidr, excluded.String())
+		}
+	}
+}
+
+func TestDynamicIPAMAllocator_ImportExclusionsAllOrNothing(t *testing.T) {
+	allocator := NewDynamicIPAMAllocator()
+	sliceName := "strict-slice"
+	err := allocator.InitializePool(sliceName, "10.170.0.0/16")
+	require.NoError(t, err)
+	allocated, err := allocator.Allocate(context.Background(), sliceName, "cluster-a", 24)
+	require.NoError(t, err)
+	freeBefore := append([]*net.IPNet(nil), allocator.pools[sliceName].FreeBlocks...)
+
+	cases := map[string][]string{
+		"outside the slice":          {"10.170.8.0/24", "10.171.0.0/24"},
+		"overlapping an allocation":  {"10.170.8.0/24", allocated},
+		"overlapping each other":     {"10.170.8.0/22", "10.170.9.0/24"},
+		"larger than the slice":      {"10.170.0.0/15"},
+		"invalid CIDR":               {"10.170.8.0/33"},
+		"misaligned CIDR":            {"10.170.8.0/24", "10.170.9.5/24"},
+		"overlapping the VPN subnet": {"10.170.0.128/25"},
+	}
+	for name, cidrs := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := allocator.ImportExclusions(sliceName, cidrs)
+			require.Error(t, err)
+			assert.Empty(t, allocator.pools[sliceName].Excluded)
+			assert.Equal(t, freeBefore, allocator.pools[sliceName].FreeBlocks)
+		})
+	}
+
+	t.Run("Misaligned CIDR is not masked", func(t *testing.T) {
+		err := allocator.ImportExclusions(sliceName, []string{"10.170.8.5/24"})
+		assert.ErrorIs(t, err, ErrInvalidCIDR)
+		assert.Contains(t, err.Error(), "did you mean 10.170.8.0/24")
+	})
+
+	t.Run("Overlapping an existing exclusion", func(t *testing.T) {
+		err := allocator.ImportExclusions(sliceName, []string{"10.170.64.0/18"})
+		require.NoError(t, err)
+		err = allocator.ImportExclusions(sliceName, []string{"10.170.8.0/24", "10.170.65.0/24"})
+		require.Error(t, err)
+		assert.Len(t, allocator.pools[sliceName].Excluded, 1)
+	})
+
+	t.Run("Uninitialized slice", func(t *testing.T) {
+		err := allocator.ImportExclusions("missing-slice", []string{"10.170.8.0/24"})
+		require.Error(t, err)
+	})
+}
+
+func TestDynamicIPAMAllocator_ExcludeRange(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "exclude-range-slice"
+	allocator := NewDynamicIPAMAllocator(WithVPNSubnetSize(0), WithVerification())
+	require.NoError(t, allocator.InitializePool(sliceName, "10.253.0.0/24"))
+
+	require.NoError(t, allocator.ExcludeRange(ctx, sliceName, "10.253.0.16/28"))
+	free, err := allocator.GetFreeBlocks(ctx, sliceName)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.253.0.0/28", "10.253.0.32/27", "10.253.0.64/26", "10.253.0.128/25"}, free)
+
+	cidrA, err := allocator.Allocate(ctx, sliceName, "cluster-a", 28)
+	require.NoError(t, err)
+	assert.Equal(t, "10.253.0.0/28", cidrA)
+	cidrB, err := allocator.Allocate(ctx, sliceName, "cluster-b", 28)
+	require.NoError(t, err)
+	assert.Equal(t, "10.253.0.32/28", cidrB, "allocation skips the excluded /28")
+
+	t.Run("Reclaim does not merge across the exclusion", func(t *testing.T) {
+		require.NoError(t, allocator.Reclaim(ctx, sliceName, "cluster-a"))
+		free, err := allocator.GetFreeBlocks(ctx, sliceName)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"10.253.0.0/28", "10.253.0.48/28", "10.253.0.64/26", "10.253.0.128/25"}, free)
+
+		_, err = allocator.Compact(ctx, sliceName)
+		require.NoError(t, err)
+		assert.NotContains(t, allocator.pools[sliceName].snapshot().FreeBlocks, "10.253.0.0/27")
+	})
+
+	t.Run("Excluded space cannot be allocated or reclaimed", func(t *testing.T) {
+		assert.ErrorIs(t, allocator.AllocateSpecific(ctx, sliceName, "cluster-c", "10.253.0.16/28"), ErrRangeExcluded)
+		assert.ErrorIs(t, allocator.AllocateSpecific(ctx, sliceName, "cluster-c", "10.253.0.0/27"), ErrRangeExcluded)
+		assert.ErrorIs(t, allocator.ReclaimCIDR(ctx, sliceName, "10.253.0.16/28"), ErrRangeExcluded)
+		assert.ErrorIs(t, allocator.ReclaimCIDR(ctx, sliceName, "10.253.0.0/28"), ErrAllocationNotFound, "free space is not reported as excluded")
+	})
+
+	t.Run("Rejected", func(t *testing.T) {
+		before := allocator.pools[sliceName].snapshot()
+		for name, cidr := range map[string]string{
+			"Allocated":        cidrB,
+			"Already excluded": "10.253.0.16/28",
+			"Outside slice":    "10.227.0.0/28",
+			"Host bits set":    "10.253.0.65/28",
+		} {
+			assert.Error(t, allocator.ExcludeRange(ctx, sliceName, cidr), name)
+		}
+		assert.Equal(t, before, allocator.pools[sliceName].snapshot())
+		assert.ErrorIs(t, allocator.ExcludeRange(ctx, "missing-slice", "10.253.0.64/28"), ErrPoolNotInitialized)
+	})
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"net"
+	"sort"
+
+	"github.com/kubeslice/kubeslice-controller/util/cidrutil"
+)
+
+// freeBlockIndex groups a pool's free blocks by prefix length, each group kept in free
+// block order, so that placement can go straight to the sizes that fit instead of
+// scanning the whole free list.
+//
+// Split and merge update the index in place. Any other change to the free list ends in
+// sortFreeBlocks, which drops the index, and an index that no longer matches the free
+// list it was built for is rebuilt on next use, so direct edits of FreeBlocks are safe.
+type freeBlockIndex struct {
+	less     FreeBlockLess
+	byPrefix map[int][]*net.IPNet
+	// built is the free list the index describes; a different slice or length means the
+	// free list was replaced without updating the index.
+	built []*net.IPNet
+}
+
+// freeIndex returns the pool's free block index, building it if it is missing or stale.
+func (pool *sliceIPPool) freeIndex() *freeBlockIndex {
+	if pool.index != nil && pool.index.matches(pool.FreeBlocks) {
+		return pool.index
+	}
+	index := &freeBlockIndex{less: pool.lessFunc(), byPrefix: map[int][]*net.IPNet{}}
+	// The free list is already in order, so appending keeps every group in order.
+	for _, block := range pool.FreeBlocks {
+		ones, _ := block.Mask.Size()
+		index.byPrefix[ones] = append(index.byPrefix[ones], block)
+	}
+	index.built = pool.FreeBlocks
+	pool.index = index
+	return index
+}
+
+// currentIndex returns the pool's free block index if it still matches the free list,
+// dropping it otherwise, so that incremental updates never apply to a stale index.
+func (pool *sliceIPPool) currentIndex() *freeBlockIndex {
+	if pool.index != nil && !pool.index.matches(pool.FreeBlocks) {
+		pool.index = nil
+	}
+	return pool.index
+}
+
+func (index *freeBlockIndex) matches(free []*net.IPNet) bool {
+	if len(index.built) != len(free) {
+		return false
+	}
+	return len(free) == 0 || &index.built[0] == &free[0]
+}
+
+// sync records that the index matches free after an incremental update.
+func (index *freeBlockIndex) sync(free []*net.IPNet) {
+	if index != nil {
+		index.built = free
+	}
+}
+
+// add and remove keep a current index in step with the free list; on a nil index, which
+// is rebuilt on next use anyway, they do nothing.
+func (index *freeBlockIndex) add(block *net.IPNet) {
+	if index == nil {
+		return
+	}
+	ones, _ := block.Mask.Size()
+	group := index.byPrefix[ones]
+	i := sort.Search(len(group), func(i int) bool {
+		return !index.less(group[i], block)
+	})
+	group = append(group, nil)
+	copy(group[i+1:], group[i:])
+	group[i] = block
+	index.byPrefix[ones] = group
+}
+
+func (index *freeBlockIndex) remove(block *net.IPNet) {
+	if index == nil {
+		return
+	}
+	ones, _ := block.Mask.Size()
+	group := index.byPrefix[ones]
+	if i := searchBlock(group, block, index.less); i != -1 {
+		index.byPrefix[ones] = append(group[:i], group[i+1:]...)
+	}
+}
+
+// fit returns the free block the strategy picks for a block of the required prefix
+// length, or nil if none fits. It matches the choice of the linear scans in findFit:
+// each group's first block is the first block of that size in free block order.
+func (index *freeBlockIndex) fit(strategy AllocationStrategy, requiredCIDRSize int) *net.IPNet {
+	var best *net.IPNet
+	for ones := 0; ones <= requiredCIDRSize; ones++ {
+		group := index.byPrefix[ones]
+		if len(group) == 0 {
+			continue
+		}
+		switch strategy {
+		case WorstFit:
+			return group[0]
+		case BestFit:
+			best = group[0]
+		default:
+			if best == nil || index.less(group[0], best) {
+				best = group[0]
+			}
+		}
+	}
+	return best
+}
+
+// findIndexedFit is findFit answered from the prefix index.
+func (pool *sliceIPPool) findIndexedFit(requiredCIDRSize int) int {
+	block := pool.freeIndex().fit(pool.strategy, requiredCIDRSize)
+	if block == nil {
+		return -1
+	}
+	return searchBlock(pool.FreeBlocks, block, pool.lessFunc())
+}
+
+// searchBlock returns the position of block in blocks, which are sorted by less, or -1.
+func searchBlock(blocks []*net.IPNet, block *net.IPNet, less FreeBlockLess) int {
+	i := sort.Search(len(blocks), func(i int) bool {
+		return !less(blocks[i], block)
+	})
+	for ; i < len(blocks) && !less(block, blocks[i]); i++ {
+		if cidrutil.Compare(blocks[i], block) == 0 {
+			return i
+		}
+	}
+	return -1
+}
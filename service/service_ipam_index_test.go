@@ -0,0 +1,125 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/dailymotion/allure-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPAMIndexSuite(t *testing.T) {
+	for k, v := range IPAMIndexTestBed {
+		t.Run(k, func(t *testing.T) {
+			allure.Test(t, allure.Name(k),
+				allure.Action(func() {
+					v(t)
+				}))
+		})
+	}
+}
+
+var IPAMIndexTestBed = map[string]func(*testing.T){
+	"TestSliceIPPool_IndexedFitMatchesScan": TestSliceIPPool_IndexedFitMatchesScan,
+}
+
+func TestSliceIPPool_IndexedFitMatchesScan(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "index-slice"
+	for _, strategy := range []AllocationStrategy{FirstFit, BestFit, WorstFit} {
+		t.Run(strategy.String(), func(t *testing.T) {
+			indexed := NewDynamicIPAMAllocator(WithVPNSubnetSize(0))
+			scanned := NewDynamicIPAMAllocator(WithVPNSubnetSize(0))
+			for _, allocator := range []*DynamicIPAMAllocator{indexed, scanned} {
+				require.NoError(t, allocator.SetAllocationStrategy(strategy))
+				require.NoError(t, allocator.InitializePool(sliceName, "10.240.0.0/16"))
+			}
+			scanned.pools[sliceName].scanFreeList = true
+
+			rng := rand.New(rand.NewSource(7))
+			var live []string
+			for step := 0; step < 2000; step++ {
+				if len(live) > 0 && rng.Intn(3) == 0 {
+					i := rng.Intn(len(live))
+					clusterName := live[i]
+					live = append(live[:i], live[i+1:]...)
+					require.NoError(t, indexed.Reclaim(ctx, sliceName, clusterName))
+					require.NoError(t, scanned.Reclaim(ctx, sliceName, clusterName))
+				} else {
+					clusterName := fmt.Sprintf("cluster-%d", step)
+					size := 20 + rng.Intn(9)
+					want, wantErr := scanned.Allocate(ctx, sliceName, clusterName, size)
+					got, gotErr := indexed.Allocate(ctx, sliceName, clusterName, size)
+					require.Equal(t, wantErr == nil, gotErr == nil, "step %d: /%d", step, size)
+					require.Equal(t, want, got, "step %d: /%d", step, size)
+					if gotErr == nil {
+						live = append(live, clusterName)
+					}
+				}
+
+				pool := indexed.pools[sliceName]
+				require.Equal(t, scanned.pools[sliceName].FreeBlocks, pool.FreeBlocks, "step %d", step)
+				if pool.index != nil && pool.index.matches(pool.FreeBlocks) {
+					rebuilt := &sliceIPPool{FreeBlocks: pool.FreeBlocks}
+					assertSameIndex(t, rebuilt.freeIndex(), pool.index, step)
+				}
+			}
+		})
+	}
+
+	t.Run("Free list replaced directly", func(t *testing.T) {
+		allocator := NewDynamicIPAMAllocator(WithVPNSubnetSize(0))
+		require.NoError(t, allocator.InitializePool(sliceName, "10.241.0.0/22"))
+		_, err := allocator.Allocate(ctx, sliceName, "cluster-a", 24)
+		require.NoError(t, err)
+
+		pool := allocator.pools[sliceName]
+		pool.FreeBlocks = append(pool.FreeBlocks[:0:0], mustParseCIDR(t, "10.241.2.0/23"))
+		cidr, err := allocator.Allocate(ctx, sliceName, "cluster-b", 24)
+		require.NoError(t, err)
+		assert.Equal(t, "10.241.2.0/24", cidr, "a stale index is rebuilt rather than used")
+	})
+}
+
+func assertSameIndex(t *testing.T, want, got *freeBlockIndex, step int) {
+	t.Helper()
+	for ones, group := range want.byPrefix {
+		assert.Equal(t, group, got.byPrefix[ones], "step %d: /%d", step, ones)
+	}
+	for ones, group := range got.byPrefix {
+		if len(group) > 0 {
+			assert.Contains(t, want.byPrefix, ones, "step %d: /%d", step, ones)
+		}
+	}
+}
+
+// benchmarkFragmentedAllocate carves and returns a /24 in a pool whose free list starts
+// with thousands of /28s, so a linear scan must pass all of them on every call.
+func benchmarkFragmentedAllocate(b *testing.B, scan bool) {
+	// The /28s span 10.0.0.0/14; the /24s are carved from the /16 after it.
+	free, _ := fragmentedFreeList(8192)
+	_, sliceNet, _ := net.ParseCIDR("10.0.0.0/8")
+	_, spare, _ := net.ParseCIDR("10.4.0.0/16")
+	pool := &sliceIPPool{SliceSubnet: sliceNet, FreeBlocks: append(free, spare), scanFreeList: scan}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		block, err := pool.carveFit(24)
+		if err != nil {
+			b.Fatal(err)
+		}
+		pool.insertFreeBlock(block)
+	}
+}
+
+func BenchmarkAllocateFragmentedScan(b *testing.B) {
+	benchmarkFragmentedAllocate(b, true)
+}
+
+func BenchmarkAllocateFragmentedIndexed(b *testing.B) {
+	benchmarkFragmentedAllocate(b, false)
+}
@@ -0,0 +1,331 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// IPAMMetricsRecorder receives per-slice IPAM measurements after every committed pool mutation.
+type IPAMMetricsRecorder interface {
+	// SetReservedIPs records the addresses held by infrastructure reservations such as the VPN subnet.
+	SetReservedIPs(sliceName string, count float64)
+	// SetTenantIPs records the addresses allocated to clusters.
+	SetTenantIPs(sliceName string, count float64)
+	// ObserveOperationDuration records how long an operation took, including time spent
+	// waiting for the allocator and pool locks.
+	ObserveOperationDuration(sliceName string, operation string, seconds float64)
+	// SetPoolStats records the address and free block counts of a pool.
+	SetPoolStats(sliceName string, stats PoolStats)
+	// CountOperation counts a completed operation, with result "success" or "failure".
+	CountOperation(sliceName string, operation string, result string)
+}
+
+// PoolStats summarizes how a slice's address space is used.
+type PoolStats struct {
+	// TotalAddresses is the size of the slice subnet.
+	TotalAddresses float64
+	// AllocatedAddresses is every address not on the free list: cluster allocations,
+	// reservations, exclusions and quarantined blocks.
+	AllocatedAddresses float64
+	// FreeAddresses is the sum of the free block sizes.
+	FreeAddresses float64
+	// FreeBlocks is the number of free blocks. More blocks for the same free space means
+	// a more fragmented pool.
+	FreeBlocks int
+	// Fragmentation is 1 minus the size of the largest free block as a fraction of
+	// FreeAddresses: 0 when all free space is one block, approaching 1 as it is scattered
+	// over many small blocks. It is 0 when nothing is free.
+	Fragmentation float64
+	// Utilization is AllocatedAddresses as a fraction of TotalAddresses.
+	Utilization float64
+	// AllocatedUsableHosts is the number of host addresses in the allocated and reserved
+	// blocks, counted per block as UsableHosts does.
+	AllocatedUsableHosts float64
+}
+
+const (
+	ipamOperationAllocate = "allocate"
+	ipamOperationReclaim  = "reclaim"
+	ipamOperationRename   = "rename"
+
+	ipamResultSuccess = "success"
+	ipamResultFailure = "failure"
+)
+
+// ipamDurationBuckets spans uncontended operations (tens of microseconds) up to
+// multi-second waits on a contended lock.
+var ipamDurationBuckets = []float64{.00005, .0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+
+// WithIPAMMetrics publishes pool measurements to the given recorder.
+func WithIPAMMetrics(recorder IPAMMetricsRecorder) IPAMAllocatorOption {
+	return func(a *DynamicIPAMAllocator) {
+		if recorder != nil {
+			a.metrics = recorder
+		}
+	}
+}
+
+type noopIPAMMetrics struct{}
+
+func (noopIPAMMetrics) SetReservedIPs(string, float64)                   {}
+func (noopIPAMMetrics) SetTenantIPs(string, float64)                     {}
+func (noopIPAMMetrics) ObserveOperationDuration(string, string, float64) {}
+func (noopIPAMMetrics) SetPoolStats(string, PoolStats)                   {}
+func (noopIPAMMetrics) CountOperation(string, string, string)            {}
+
+type prometheusIPAMMetrics struct {
+	reservedIPs  *prometheus.GaugeVec
+	tenantIPs    *prometheus.GaugeVec
+	duration     *prometheus.HistogramVec
+	totalIPs     *prometheus.GaugeVec
+	allocatedIPs *prometheus.GaugeVec
+	freeIPs      *prometheus.GaugeVec
+	freeBlocks   *prometheus.GaugeVec
+	fragmented   *prometheus.GaugeVec
+	operations   *prometheus.CounterVec
+}
+
+// NewPrometheusIPAMMetrics creates the IPAM gauges and registers them with the given registerer.
+func NewPrometheusIPAMMetrics(registerer prometheus.Registerer) (IPAMMetricsRecorder, error) {
+	m := &prometheusIPAMMetrics{
+		reservedIPs: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kubeslice_ipam_reserved_ips",
+			Help: "Number of slice addresses held by infrastructure reservations",
+		}, []string{"slice_name"}),
+		tenantIPs: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kubeslice_ipam_tenant_ips",
+			Help: "Number of slice addresses allocated to clusters",
+		}, []string{"slice_name"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "kubeslice_ipam_allocate_duration_seconds",
+			Help:    "Latency of IPAM operations including lock acquisition",
+			Buckets: ipamDurationBuckets,
+		}, []string{"slice_name", "operation"}),
+		totalIPs: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kubeslice_ipam_total_ips",
+			Help: "Number of addresses in the slice subnet",
+		}, []string{"slice_name"}),
+		allocatedIPs: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kubeslice_ipam_allocated_ips",
+			Help: "Number of slice addresses not available for allocation",
+		}, []string{"slice_name"}),
+		freeIPs: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kubeslice_ipam_free_ips",
+			Help: "Number of slice addresses available for allocation",
+		}, []string{"slice_name"}),
+		freeBlocks: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kubeslice_ipam_free_blocks",
+			Help: "Number of free blocks in the slice pool, an indicator of fragmentation",
+		}, []string{"slice_name"}),
+		fragmented: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kubeslice_ipam_fragmentation_ratio",
+			Help: "One minus the largest free block's share of the slice's free addresses",
+		}, []string{"slice_name"}),
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kubeslice_ipam_operations_total",
+			Help: "Number of completed IPAM operations by result",
+		}, []string{"slice_name", "operation", "result"}),
+	}
+	for _, c := range []prometheus.Collector{m.reservedIPs, m.tenantIPs, m.duration, m.totalIPs, m.allocatedIPs, m.freeIPs, m.freeBlocks, m.fragmented, m.operations} {
+		if err := registerer.Register(c); err != nil {
+			return nil, fmt.Errorf("failed to register ipam metrics: %w", err)
+		}
+	}
+	return m, nil
+}
+
+func (m *prometheusIPAMMetrics) SetReservedIPs(sliceName string, count float64) {
+	m.reservedIPs.WithLabelValues(sliceName).Set(count)
+}
+
+func (m *prometheusIPAMMetrics) SetTenantIPs(sliceName string, count float64) {
+	m.tenantIPs.WithLabelValues(sliceName).Set(count)
+}
+
+func (m *prometheusIPAMMetrics) ObserveOperationDuration(sliceName string, operation string, seconds float64) {
+	m.duration.WithLabelValues(sliceName, operation).Observe(seconds)
+}
+
+func (m *prometheusIPAMMetrics) SetPoolStats(sliceName string, stats PoolStats) {
+	m.totalIPs.WithLabelValues(sliceName).Set(stats.TotalAddresses)
+	m.allocatedIPs.WithLabelValues(sliceName).Set(stats.AllocatedAddresses)
+	m.freeIPs.WithLabelValues(sliceName).Set(stats.FreeAddresses)
+	m.freeBlocks.WithLabelValues(sliceName).Set(float64(stats.FreeBlocks))
+	m.fragmented.WithLabelValues(sliceName).Set(stats.Fragmentation)
+}
+
+func (m *prometheusIPAMMetrics) CountOperation(sliceName string, operation string, result string) {
+	m.operations.WithLabelValues(sliceName, operation, result).Inc()
+}
+
+// PoolStats returns the current address usage of a slice's pool.
+func (a *DynamicIPAMAllocator) PoolStats(ctx context.Context, sliceName string) (PoolStats, error) {
+	pool, err := a.rlockPoolContext(ctx, "stats", sliceName)
+	if err != nil {
+		return PoolStats{}, err
+	}
+	defer pool.mu.RUnlock()
+
+	return pool.stats(), nil
+}
+
+// Fragmentation returns how scattered a slice's free space is, as defined for
+// PoolStats.Fragmentation. A value near 1 means the free space is spread over many
+// small blocks, so large allocations may fail even though plenty of addresses are free.
+func (a *DynamicIPAMAllocator) Fragmentation(ctx context.Context, sliceName string) (float64, error) {
+	stats, err := a.PoolStats(ctx, sliceName)
+	if err != nil {
+		return 0, err
+	}
+	return stats.Fragmentation, nil
+}
+
+// stats computes the pool's address usage. The caller must hold the pool's mutex.
+func (pool *sliceIPPool) stats() PoolStats {
+	stats := PoolStats{
+		TotalAddresses: addressCount(pool.SliceSubnet),
+		FreeBlocks:     len(pool.FreeBlocks),
+	}
+	var largest float64
+	for _, ipNet := range pool.FreeBlocks {
+		size := addressCount(ipNet)
+		stats.FreeAddresses += size
+		largest = math.Max(largest, size)
+	}
+	if stats.FreeAddresses > 0 {
+		stats.Fragmentation = 1 - largest/stats.FreeAddresses
+	}
+	stats.AllocatedAddresses = stats.TotalAddresses - stats.FreeAddresses
+	stats.Utilization = stats.AllocatedAddresses / stats.TotalAddresses
+	for _, ipNet := range pool.Allocated {
+		stats.AllocatedUsableHosts += usableHostCount(ipNet)
+	}
+	return stats
+}
+
+// countOperation counts an operation as a success or failure depending on err, logging
+// failures at V(1). It is meant to be deferred with the operation's named error result.
+func (a *DynamicIPAMAllocator) countOperation(sliceName string, operation string, err error) {
+	result := ipamResultSuccess
+	if err != nil {
+		result = ipamResultFailure
+		a.log.V(1).Info("ipam operation failed", "operation", operation, "slice", sliceName, "reason", err.Error())
+	}
+	a.metrics.CountOperation(sliceName, operation, result)
+}
+
+// observeDuration records the time elapsed since start for an operation on a slice.
+// It is meant to be deferred before the allocator lock is taken.
+func (a *DynamicIPAMAllocator) observeDuration(sliceName string, operation string, start time.Time) {
+	a.metrics.ObserveOperationDuration(sliceName, operation, time.Since(start).Seconds())
+}
+
+// recordPoolMetrics splits the pool's allocations into reserved and tenant address counts.
+// Callers must hold pool.mu.
+func (a *DynamicIPAMAllocator) recordPoolMetrics(sliceName string, pool *sliceIPPool) {
+	var tenant float64
+	for clusterName, ipNet := range pool.Allocated {
+		if !isReservedAllocation(clusterName) {
+			tenant += addressCount(ipNet)
+		}
+	}
+	a.metrics.SetReservedIPs(sliceName, pool.reservedAddressCount())
+	a.metrics.SetTenantIPs(sliceName, tenant)
+	stats := pool.stats()
+	a.metrics.SetPoolStats(sliceName, stats)
+	a.checkUtilization(sliceName, stats.Utilization)
+}
+
+// utilizationWatcher is a callback registered with OnUtilizationThreshold. above records
+// the slices currently at or over the threshold, so that the callback only fires when a
+// slice crosses it upward.
+type utilizationWatcher struct {
+	threshold float64
+	callback  func(sliceName string, utilization float64)
+	above     map[string]bool
+}
+
+// OnUtilizationThreshold registers cb to be called whenever an operation raises a slice's
+// utilization, as reported by PoolStats, from below threshold to threshold or above. It
+// fires again only after the slice has dropped back below the threshold. A slice that is
+// already above the threshold when cb is registered fires on its next operation.
+//
+// cb runs synchronously while the slice's pool is locked, so it must not call back into
+// the allocator for the same slice.
+func (a *DynamicIPAMAllocator) OnUtilizationThreshold(threshold float64, cb func(sliceName string, utilization float64)) {
+	if cb == nil {
+		return
+	}
+	a.watchMu.Lock()
+	defer a.watchMu.Unlock()
+	a.watchers = append(a.watchers, &utilizationWatcher{threshold: threshold, callback: cb, above: map[string]bool{}})
+}
+
+// checkUtilization fires the callbacks whose threshold the slice has just crossed upward.
+func (a *DynamicIPAMAllocator) checkUtilization(sliceName string, utilization float64) {
+	a.watchMu.Lock()
+	var crossed []*utilizationWatcher
+	for _, w := range a.watchers {
+		above := utilization >= w.threshold
+		if above && !w.above[sliceName] {
+			crossed = append(crossed, w)
+		}
+		w.above[sliceName] = above
+	}
+	a.watchMu.Unlock()
+
+	for _, w := range crossed {
+		w.callback(sliceName, utilization)
+	}
+}
+
+// reservedAddressCount sums the addresses held by reserved allocations and exclusions.
+func (pool *sliceIPPool) reservedAddressCount() float64 {
+	var reserved float64
+	for clusterName, ipNet := range pool.Allocated {
+		if isReservedAllocation(clusterName) {
+			reserved += addressCount(ipNet)
+		}
+	}
+	for _, ipNet := range pool.Excluded {
+		reserved += addressCount(ipNet)
+	}
+	return reserved
+}
+
+// addressCount returns the number of addresses covered by ipNet.
+func addressCount(ipNet *net.IPNet) float64 {
+	ones, bits := ipNet.Mask.Size()
+	return math.Ldexp(1, bits-ones)
+}
+
+// UsableHosts returns the number of addresses in cidr that can be assigned to hosts. An
+// IPv4 block loses its network and broadcast addresses, except that a /31 and a /32 are
+// all hosts, following RFC 3021. IPv6 has no broadcast address, so every address of an
+// IPv6 block counts. Counts beyond the range of int are capped, and an invalid CIDR has
+// no usable hosts.
+func UsableHosts(cidr string) int {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return 0
+	}
+	count := usableHostCount(ipNet)
+	if count >= math.MaxInt {
+		return math.MaxInt
+	}
+	return int(count)
+}
+
+func usableHostCount(ipNet *net.IPNet) float64 {
+	ones, bits := ipNet.Mask.Size()
+	count := addressCount(ipNet)
+	if bits == 8*net.IPv4len && bits-ones > 1 {
+		count -= 2
+	}
+	return count
+}
@@ -0,0 +1,335 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/dailymotion/allure-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPAMMetricsSuite(t *testing.T) {
+	for k, v := range IPAMMetricsTestBed {
+		t.Run(k, func(t *testing.T) {
+			allure.Test(t, allure.Name(k),
+				allure.Action(func() {
+					v(t)
+				}))
+		})
+	}
+}
+
+var IPAMMetricsTestBed = map[string]func(*testing.T){
+	"TestIPAMMetrics_ReservedVsTenant":     TestIPAMMetrics_ReservedVsTenant,
+	"TestIPAMMetrics_PrometheusRegistered": TestIPAMMetrics_PrometheusRegistered,
+	"TestIPAMMetrics_OperationDuration":    TestIPAMMetrics_OperationDuration,
+	"TestIPAMMetrics_PoolStats":            TestIPAMMetrics_PoolStats,
+	"TestIPAMMetrics_UtilizationThreshold": TestIPAMMetrics_UtilizationThreshold,
+	"TestIPAMMetrics_Fragmentation":        TestIPAMMetrics_Fragmentation,
+	"TestUsableHosts":                      TestUsableHosts,
+}
+
+type fakeIPAMMetrics struct {
+	mu       sync.Mutex
+	reserved map[string]float64
+	tenant   map[string]float64
+	// durations holds the observed operations in order, as "slice/operation".
+	durations []string
+	stats     map[string]PoolStats
+	// operations counts completed operations by "slice/operation/result".
+	operations map[string]int
+}
+
+func newFakeIPAMMetrics() *fakeIPAMMetrics {
+	return &fakeIPAMMetrics{
+		reserved:   map[string]float64{},
+		tenant:     map[string]float64{},
+		stats:      map[string]PoolStats{},
+		operations: map[string]int{},
+	}
+}
+
+func (f *fakeIPAMMetrics) SetReservedIPs(sliceName string, count float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reserved[sliceName] = count
+}
+
+func (f *fakeIPAMMetrics) SetTenantIPs(sliceName string, count float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tenant[sliceName] = count
+}
+
+func (f *fakeIPAMMetrics) ObserveOperationDuration(sliceName string, operation string, seconds float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.durations = append(f.durations, sliceName+"/"+operation)
+}
+
+func (f *fakeIPAMMetrics) SetPoolStats(sliceName string, stats PoolStats) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stats[sliceName] = stats
+}
+
+func (f *fakeIPAMMetrics) CountOperation(sliceName string, operation string, result string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.operations[sliceName+"/"+operation+"/"+result]++
+}
+
+func TestIPAMMetrics_ReservedVsTenant(t *testing.T) {
+	recorder := newFakeIPAMMetrics()
+	allocator := NewDynamicIPAMAllocator(WithIPAMMetrics(recorder))
+	sliceName := "metrics-slice"
+
+	err := allocator.InitializePool(sliceName, "10.50.0.0/16")
+	require.NoError(t, err)
+	assert.Equal(t, float64(256), recorder.reserved[sliceName], "the VPN /24 is reserved space")
+	assert.Equal(t, float64(0), recorder.tenant[sliceName])
+
+	_, err = allocator.Allocate(context.Background(), sliceName, "cluster-a", 24)
+	require.NoError(t, err)
+	_, err = allocator.Allocate(context.Background(), sliceName, "cluster-b", 25)
+	require.NoError(t, err)
+	assert.Equal(t, float64(256), recorder.reserved[sliceName])
+	assert.Equal(t, float64(384), recorder.tenant[sliceName])
+
+	err = allocator.Reclaim(context.Background(), sliceName, "cluster-a")
+	require.NoError(t, err)
+	assert.Equal(t, float64(256), recorder.reserved[sliceName])
+	assert.Equal(t, float64(128), recorder.tenant[sliceName])
+}
+
+func TestIPAMMetrics_PrometheusRegistered(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	recorder, err := NewPrometheusIPAMMetrics(registry)
+	require.NoError(t, err)
+
+	allocator := NewDynamicIPAMAllocator(WithIPAMMetrics(recorder))
+	err = allocator.InitializePool("prom-slice", "10.60.0.0/16")
+	require.NoError(t, err)
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	names := []string{}
+	for _, f := range families {
+		names = append(names, f.GetName())
+	}
+	assert.Contains(t, names, "kubeslice_ipam_reserved_ips")
+	assert.Contains(t, names, "kubeslice_ipam_tenant_ips")
+	assert.Contains(t, names, "kubeslice_ipam_free_ips")
+	assert.Contains(t, names, "kubeslice_ipam_free_blocks")
+	assert.Contains(t, names, "kubeslice_ipam_fragmentation_ratio")
+
+	_, err = allocator.Allocate(context.Background(), "prom-slice", "cluster-a", 24)
+	require.NoError(t, err)
+	families, err = registry.Gather()
+	require.NoError(t, err)
+	for _, f := range families {
+		if f.GetName() == "kubeslice_ipam_allocate_duration_seconds" {
+			require.Len(t, f.GetMetric(), 1)
+			assert.Equal(t, uint64(1), f.GetMetric()[0].GetHistogram().GetSampleCount())
+		}
+	}
+
+	_, err = NewPrometheusIPAMMetrics(registry)
+	require.Error(t, err, "registering the same collectors twice should fail")
+}
+
+func TestIPAMMetrics_OperationDuration(t *testing.T) {
+	recorder := newFakeIPAMMetrics()
+	allocator := NewDynamicIPAMAllocator(WithIPAMMetrics(recorder))
+	sliceName := "latency-slice"
+	err := allocator.InitializePool(sliceName, "10.90.0.0/16")
+	require.NoError(t, err)
+
+	_, err = allocator.Allocate(context.Background(), sliceName, "cluster-a", 24)
+	require.NoError(t, err)
+	err = allocator.Reclaim(context.Background(), sliceName, "cluster-a")
+	require.NoError(t, err)
+	_, err = allocator.Allocate(context.Background(), "missing-slice", "cluster-a", 24)
+	require.Error(t, err)
+
+	assert.Equal(t, []string{
+		sliceName + "/allocate",
+		sliceName + "/reclaim",
+		"missing-slice/allocate",
+	}, recorder.durations, "every operation should be observed, including failures")
+
+	t.Run("Every allocation path is counted", func(t *testing.T) {
+		ctx := context.Background()
+		recorder := newFakeIPAMMetrics()
+		allocator := NewDynamicIPAMAllocator(WithIPAMMetrics(recorder), WithoutVPNReservation())
+		sliceName := "counted-slice"
+		require.NoError(t, allocator.InitializePool(sliceName, "10.91.0.0/16"))
+
+		_, err := allocator.AllocateIdempotent(ctx, sliceName, "cluster-a", 24, "key-a")
+		require.NoError(t, err)
+		_, err = allocator.AllocateIndexed(ctx, sliceName, "worker", []int{0, 1}, 24)
+		require.NoError(t, err)
+		_, err = allocator.AllocateBatch(ctx, sliceName, map[string]int{"cluster-b": 24})
+		require.NoError(t, err)
+		require.NoError(t, allocator.AllocateSpecific(ctx, sliceName, "cluster-c", "10.91.100.0/24"))
+		_, err = allocator.AllocateWithValidator(ctx, sliceName, "cluster-d", 24, func(string) bool { return true })
+		require.NoError(t, err)
+		_, _, err = allocator.AllocateTraced(ctx, sliceName, "cluster-e", 24)
+		require.NoError(t, err)
+		err = allocator.AllocateSpecific(ctx, sliceName, "cluster-f", "10.91.100.0/24")
+		require.Error(t, err)
+
+		assert.Equal(t, map[string]int{
+			sliceName + "/allocate/success": 6,
+			sliceName + "/allocate/failure": 1,
+		}, recorder.operations)
+	})
+}
+
+func TestIPAMMetrics_PoolStats(t *testing.T) {
+	ctx := context.Background()
+	recorder := newFakeIPAMMetrics()
+	allocator := NewDynamicIPAMAllocator(WithIPAMMetrics(recorder))
+	sliceName := "stats-slice"
+	require.NoError(t, allocator.InitializePool(sliceName, "10.216.0.0/22"))
+
+	stats, err := allocator.PoolStats(ctx, sliceName)
+	require.NoError(t, err)
+	assert.InDelta(t, 1.0/3, stats.Fragmentation, 1e-9, "the /23 is two thirds of the free space")
+	assert.Equal(t, PoolStats{
+		TotalAddresses:       1024,
+		AllocatedAddresses:   256,
+		FreeAddresses:        768,
+		FreeBlocks:           2,
+		Fragmentation:        stats.Fragmentation,
+		Utilization:          0.25,
+		AllocatedUsableHosts: 254,
+	}, stats, "the VPN /24 is the only allocation")
+	assert.Equal(t, stats, recorder.stats[sliceName])
+
+	_, err = allocator.Allocate(ctx, sliceName, "cluster-a", 26)
+	require.NoError(t, err)
+	stats, err = allocator.PoolStats(ctx, sliceName)
+	require.NoError(t, err)
+	assert.Equal(t, float64(320), stats.AllocatedAddresses)
+	assert.Equal(t, float64(704), stats.FreeAddresses)
+	assert.Equal(t, 3, stats.FreeBlocks, "splitting 10.216.1.0/24 leaves a /26 and a /25 behind")
+	assert.Equal(t, 0.3125, stats.Utilization)
+	assert.Equal(t, float64(254+62), stats.AllocatedUsableHosts)
+	assert.Equal(t, stats, recorder.stats[sliceName])
+
+	require.NoError(t, allocator.Reclaim(ctx, sliceName, "cluster-a"))
+	stats, err = allocator.PoolStats(ctx, sliceName)
+	require.NoError(t, err)
+	assert.Equal(t, float64(256), stats.AllocatedAddresses)
+	assert.Equal(t, float64(768), stats.FreeAddresses)
+	assert.Equal(t, stats, recorder.stats[sliceName])
+
+	require.Error(t, allocator.Reclaim(ctx, sliceName, "cluster-a"))
+	_, err = allocator.Allocate(ctx, sliceName, "cluster-b", 21)
+	require.Error(t, err)
+	assert.Equal(t, map[string]int{
+		sliceName + "/allocate/success": 1,
+		sliceName + "/allocate/failure": 1,
+		sliceName + "/reclaim/success":  1,
+		sliceName + "/reclaim/failure":  1,
+	}, recorder.operations)
+
+	_, err = allocator.PoolStats(ctx, "missing-slice")
+	assert.Error(t, err)
+}
+
+func TestIPAMMetrics_UtilizationThreshold(t *testing.T) {
+	ctx := context.Background()
+	allocator := NewDynamicIPAMAllocator()
+	sliceName := "threshold-slice"
+	// The VPN reservation takes a quarter of the slice.
+	require.NoError(t, allocator.InitializePool(sliceName, "10.247.0.0/22"))
+	require.NoError(t, allocator.InitializePool("other-slice", "10.248.0.0/22"))
+
+	type call struct {
+		sliceName   string
+		utilization float64
+	}
+	var calls []call
+	allocator.OnUtilizationThreshold(0.5, func(sliceName string, utilization float64) {
+		calls = append(calls, call{sliceName, utilization})
+	})
+
+	_, err := allocator.Allocate(ctx, sliceName, "cluster-a", 26)
+	require.NoError(t, err)
+	assert.Empty(t, calls, "0.3125 is below the threshold")
+
+	_, err = allocator.Allocate(ctx, sliceName, "cluster-b", 25)
+	require.NoError(t, err)
+	_, err = allocator.Allocate(ctx, sliceName, "cluster-c", 26)
+	require.NoError(t, err)
+	require.Equal(t, []call{{sliceName, 0.5}}, calls, "crossing the threshold fires once")
+
+	_, err = allocator.Allocate(ctx, sliceName, "cluster-d", 24)
+	require.NoError(t, err)
+	assert.Len(t, calls, 1, "staying above the threshold does not fire again")
+
+	t.Run("Re-armed after dropping below", func(t *testing.T) {
+		require.NoError(t, allocator.Reclaim(ctx, sliceName, "cluster-d"))
+		require.NoError(t, allocator.Reclaim(ctx, sliceName, "cluster-c"))
+		_, err := allocator.Allocate(ctx, sliceName, "cluster-e", 26)
+		require.NoError(t, err)
+		assert.Equal(t, []call{{sliceName, 0.5}, {sliceName, 0.5}}, calls)
+	})
+}
+
+func TestIPAMMetrics_Fragmentation(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "fragmentation-slice"
+	allocator := NewDynamicIPAMAllocator(WithVPNSubnetSize(0))
+	require.NoError(t, allocator.InitializePool(sliceName, "10.218.0.0/24"))
+
+	fragmentation, err := allocator.Fragmentation(ctx, sliceName)
+	require.NoError(t, err)
+	assert.Zero(t, fragmentation, "a fresh pool is a single free block")
+
+	for i := 0; i < 16; i++ {
+		_, err := allocator.Allocate(ctx, sliceName, fmt.Sprintf("cluster-%d", i), 28)
+		require.NoError(t, err)
+	}
+	fragmentation, err = allocator.Fragmentation(ctx, sliceName)
+	require.NoError(t, err)
+	assert.Zero(t, fragmentation, "a full pool has no free space to fragment")
+
+	// Free every other /28, leaving eight blocks of 16 addresses none of which can merge.
+	for i := 0; i < 16; i += 2 {
+		require.NoError(t, allocator.Reclaim(ctx, sliceName, fmt.Sprintf("cluster-%d", i)))
+	}
+	fragmentation, err = allocator.Fragmentation(ctx, sliceName)
+	require.NoError(t, err)
+	assert.Equal(t, 0.875, fragmentation)
+	_, err = allocator.Allocate(ctx, sliceName, "wide-cluster", 27)
+	assert.ErrorIs(t, err, ErrPoolExhausted, "half the pool is free, but not in one /27")
+
+	_, err = allocator.Fragmentation(ctx, "missing-slice")
+	assert.ErrorIs(t, err, ErrPoolNotInitialized)
+}
+
+func TestUsableHosts(t *testing.T) {
+	for cidr, want := range map[string]int{
+		"10.0.0.0/24":   254,
+		"10.0.0.0/30":   2,
+		"10.0.0.0/31":   2,
+		"10.0.0.1/32":   1,
+		"10.0.0.0/8":    1<<24 - 2,
+		"fd00::/120":    256,
+		"fd00::/127":    2,
+		"fd00::/64":     math.MaxInt,
+		"not-a-cidr":    0,
+		"10.0.0.0/33":   0,
+		"10.0.0.0/24/1": 0,
+	} {
+		assert.Equal(t, want, UsableHosts(cidr), cidr)
+	}
+}
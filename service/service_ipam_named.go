@@ -0,0 +1,65 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// namedAllocationSeparator joins a cluster name and a purpose into the Allocated key of a
+// named allocation. Kubernetes object names cannot contain it, so named keys never clash
+// with a plain cluster allocation.
+const namedAllocationSeparator = "/"
+
+// namedAllocationKey returns the Allocated key of a cluster's block for purpose.
+func namedAllocationKey(clusterName, purpose string) (string, error) {
+	if purpose == "" || strings.Contains(purpose, namedAllocationSeparator) {
+		return "", fmt.Errorf("invalid allocation purpose %q for cluster %s", purpose, clusterName)
+	}
+	return clusterName + namedAllocationSeparator + purpose, nil
+}
+
+// allocationCluster returns the cluster that owns an Allocated key, which is the key
+// itself unless it is a named allocation.
+func allocationCluster(key string) string {
+	clusterName, _, _ := strings.Cut(key, namedAllocationSeparator)
+	return clusterName
+}
+
+// clusterKeys returns the Allocated keys held under clusterName in sorted order: the
+// plain allocation and every named or contiguous part. A named key passed as clusterName
+// matches only itself.
+func (pool *sliceIPPool) clusterKeys(clusterName string) []string {
+	var keys []string
+	for key := range pool.Allocated {
+		if key == clusterName || allocationCluster(key) == clusterName {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// AllocateNamed allocates a block for one purpose of a cluster, such as "pod" or
+// "service", so that a cluster can hold several independent blocks in a slice. Each
+// purpose behaves like a separate cluster for Allocate: repeating the call returns the
+// same block, and ReclaimNamed returns it. The block is listed under
+// "<clusterName>/<purpose>".
+func (a *DynamicIPAMAllocator) AllocateNamed(ctx context.Context, sliceName string, clusterName string, purpose string, size int) (string, error) {
+	key, err := namedAllocationKey(clusterName, purpose)
+	if err != nil {
+		return "", err
+	}
+	return a.Allocate(ctx, sliceName, key, size)
+}
+
+// ReclaimNamed returns the block a cluster holds for purpose, leaving its other blocks in
+// place.
+func (a *DynamicIPAMAllocator) ReclaimNamed(ctx context.Context, sliceName string, clusterName string, purpose string) error {
+	key, err := namedAllocationKey(clusterName, purpose)
+	if err != nil {
+		return err
+	}
+	return a.Reclaim(ctx, sliceName, key)
+}
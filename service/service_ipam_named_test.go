@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dailymotion/allure-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPAMNamedSuite(t *testing.T) {
+	for k, v := range IPAMNamedTestBed {
+		t.Run(k, func(t *testing.T) {
+			allure.Test(t, allure.Name(k),
+				allure.Action(func() {
+					v(t)
+				}))
+		})
+	}
+}
+
+var IPAMNamedTestBed = map[string]func(*testing.T){
+	"TestDynamicIPAMAllocator_AllocateNamed":        TestDynamicIPAMAllocator_AllocateNamed,
+	"TestDynamicIPAMAllocator_PerClusterBlockLimit": TestDynamicIPAMAllocator_PerClusterBlockLimit,
+}
+
+func TestDynamicIPAMAllocator_AllocateNamed(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "named-slice"
+	allocator := NewDynamicIPAMAllocator(WithoutVPNReservation())
+	require.NoError(t, allocator.InitializePool(sliceName, "10.249.0.0/22"))
+
+	pod, err := allocator.AllocateNamed(ctx, sliceName, "cluster-a", "pod", 23)
+	require.NoError(t, err)
+	service, err := allocator.AllocateNamed(ctx, sliceName, "cluster-a", "service", 24)
+	require.NoError(t, err)
+	assert.Equal(t, "10.249.0.0/23", pod)
+	assert.Equal(t, "10.249.2.0/24", service)
+	again, err := allocator.AllocateNamed(ctx, sliceName, "cluster-a", "pod", 23)
+	require.NoError(t, err)
+	assert.Equal(t, pod, again, "a repeated request returns the same block")
+
+	require.NoError(t, allocator.ReclaimNamed(ctx, sliceName, "cluster-a", "pod"))
+	allocations, err := allocator.ListAllocations(ctx, sliceName)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"cluster-a/service": service}, allocations, "only the pod block is reclaimed")
+	assert.ErrorIs(t, allocator.ReclaimNamed(ctx, sliceName, "cluster-a", "pod"), ErrAllocationNotFound)
+
+	for _, purpose := range []string{"", "pod/extra"} {
+		_, err := allocator.AllocateNamed(ctx, sliceName, "cluster-a", purpose, 24)
+		assert.Error(t, err, "purpose %q", purpose)
+	}
+}
+
+func TestDynamicIPAMAllocator_PerClusterBlockLimit(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "quota-slice"
+	allocator := NewDynamicIPAMAllocator(WithPerClusterBlockLimit(2))
+	require.NoError(t, allocator.InitializePool(sliceName, "10.249.0.0/20"))
+
+	_, err := allocator.Allocate(ctx, sliceName, "cluster-a", 24)
+	require.NoError(t, err)
+	_, err = allocator.AllocateNamed(ctx, sliceName, "cluster-a", "service", 24)
+	require.NoError(t, err, "the second block is within the quota")
+	_, err = allocator.Allocate(ctx, sliceName, "cluster-a", 24)
+	require.NoError(t, err, "a repeated request for a held block does not count again")
+
+	before := allocator.pools[sliceName].snapshot()
+	_, err = allocator.AllocateNamed(ctx, sliceName, "cluster-a", "pod", 24)
+	assert.ErrorIs(t, err, ErrClusterQuotaExceeded)
+	err = allocator.AllocateSpecific(ctx, sliceName, "cluster-a/extra", "10.249.8.0/24")
+	assert.ErrorIs(t, err, ErrClusterQuotaExceeded)
+	assert.Equal(t, before, allocator.pools[sliceName].snapshot(), "rejected requests leave the pool unchanged")
+
+	_, err = allocator.AllocateNamed(ctx, sliceName, "cluster-b", "pod", 24)
+	assert.NoError(t, err, "the quota is per cluster")
+
+	require.NoError(t, allocator.ReclaimNamed(ctx, sliceName, "cluster-a", "service"))
+	_, err = allocator.AllocateNamed(ctx, sliceName, "cluster-a", "pod", 24)
+	assert.NoError(t, err, "reclaiming a block frees quota")
+
+	t.Run("Validator and traced allocations", func(t *testing.T) {
+		before := allocator.pools[sliceName].snapshot()
+		_, err := allocator.AllocateWithValidator(ctx, sliceName, "cluster-a/validated", 24, func(string) bool { return true })
+		assert.ErrorIs(t, err, ErrClusterQuotaExceeded)
+		_, _, err = allocator.AllocateTraced(ctx, sliceName, "cluster-a/traced", 24)
+		assert.ErrorIs(t, err, ErrClusterQuotaExceeded)
+		assert.Equal(t, before, allocator.pools[sliceName].snapshot())
+
+		_, err = allocator.AllocateWithValidator(ctx, sliceName, "cluster-b/validated", 24, func(string) bool { return true })
+		assert.NoError(t, err)
+		_, _, err = allocator.AllocateTraced(ctx, sliceName, "cluster-b/traced", 24)
+		assert.ErrorIs(t, err, ErrClusterQuotaExceeded, "cluster-b now holds two blocks")
+		cidr, _, err := allocator.AllocateTraced(ctx, sliceName, "cluster-a", 24)
+		assert.NoError(t, err, "a held block is returned regardless of the quota")
+		assert.NotEmpty(t, cidr)
+	})
+}
@@ -0,0 +1,342 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	controllerv1alpha1 "github.com/kubeslice/kubeslice-controller/apis/controller/v1alpha1"
+	"github.com/kubeslice/kubeslice-controller/util"
+	k8sError "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// PersistentIPAMAllocator is an IPAMAllocator that keeps each slice's pool in a SliceIpam
+// object named after the slice, so that allocations survive a controller restart. Every
+// mutation is written while the pool is still locked and is rolled back in memory if the
+// write fails, so the stored and in-memory state cannot diverge.
+type PersistentIPAMAllocator struct {
+	client    util.Client
+	namespace string
+	mem       *DynamicIPAMAllocator
+	backoff   wait.Backoff
+}
+
+// DefaultPersistBackoff paces the retries of a failed SliceIpam write: up to five
+// attempts, starting 100ms apart and doubling.
+var DefaultPersistBackoff = wait.Backoff{
+	Duration: 100 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    5,
+	Cap:      2 * time.Second,
+}
+
+var _ IPAMAllocator = &PersistentIPAMAllocator{}
+
+// NewPersistentIPAMAllocator returns an allocator that stores SliceIpam objects in the
+// given namespace using c, typically the manager's client. The options configure the
+// in-memory allocator it wraps.
+func NewPersistentIPAMAllocator(c util.Client, namespace string, opts ...IPAMAllocatorOption) *PersistentIPAMAllocator {
+	return &PersistentIPAMAllocator{
+		client:    c,
+		namespace: namespace,
+		mem:       NewDynamicIPAMAllocator(opts...),
+		backoff:   DefaultPersistBackoff,
+	}
+}
+
+// SetPersistBackoff replaces DefaultPersistBackoff as the schedule for retrying writes
+// that fail with a transient error, such as a conflict or an unavailable API server.
+// Steps is the number of attempts; 1 disables retries. It must be called before the
+// allocator is used.
+func (p *PersistentIPAMAllocator) SetPersistBackoff(backoff wait.Backoff) {
+	p.backoff = backoff
+}
+
+// InitializePool loads the slice's pool from its SliceIpam object, or creates the pool
+// and the object if none is stored yet. IPAMAllocator gives InitializePool no context, so
+// the store is accessed with a background context. The store is read and written without
+// the allocator's lock, so that a slow API server does not stall the other slices; if
+// another caller initializes the slice meanwhile, its pool is kept.
+func (p *PersistentIPAMAllocator) InitializePool(sliceName, sliceSubnetStr string) error {
+	ctx := context.Background()
+
+	_, sliceNet, err := net.ParseCIDR(sliceSubnetStr)
+	if err != nil {
+		return fmt.Errorf("%w %q for slice subnet", ErrInvalidCIDR, sliceSubnetStr)
+	}
+
+	a := p.mem
+	a.mu.RLock()
+	existing, exists := a.pools[sliceName]
+	a.mu.RUnlock()
+	if exists {
+		return existing.checkSubnet(sliceName, sliceNet)
+	}
+
+	pool, restored, err := p.loadPool(ctx, sliceName, sliceNet)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if existing, exists := a.pools[sliceName]; exists {
+		return existing.checkSubnet(sliceName, sliceNet)
+	}
+	a.pools[sliceName] = pool
+	a.log.V(1).Info("initialized ipam pool", "slice", sliceName, "subnet", sliceNet, "restored", restored)
+	a.recordPoolMetrics(sliceName, pool)
+
+	return nil
+}
+
+// loadPool reads the slice's pool from its SliceIpam object, or creates a new pool and
+// stores it if there is no object. A stored pool is checked like one passed to LoadState
+// and rejected if it is inconsistent. It reports whether the pool was restored from the
+// store. The caller must not hold the allocator's lock.
+func (p *PersistentIPAMAllocator) loadPool(ctx context.Context, sliceName string, sliceNet *net.IPNet) (*sliceIPPool, bool, error) {
+	a := p.mem
+	stored := &controllerv1alpha1.SliceIpam{}
+	err := p.client.Get(ctx, p.key(sliceName), stored)
+	if k8sError.IsNotFound(err) {
+		pool, err := a.newPool(sliceName, sliceNet, PoolOptions{})
+		if err != nil {
+			return nil, false, err
+		}
+		err = p.store(ctx, sliceName, pool)
+		if err == nil {
+			return pool, false, nil
+		}
+		if !k8sError.IsAlreadyExists(err) {
+			return nil, false, err
+		}
+		// The object was created since the Get, by another caller or replica; load it.
+		stored = &controllerv1alpha1.SliceIpam{}
+		if err := p.client.Get(ctx, p.key(sliceName), stored); err != nil {
+			return nil, false, fmt.Errorf("failed to load ipam state for slice %s: %w", sliceName, err)
+		}
+	} else if err != nil {
+		return nil, false, fmt.Errorf("failed to load ipam state for slice %s: %w", sliceName, err)
+	}
+
+	if stored.Spec.SliceSubnet != sliceNet.String() {
+		return nil, false, fmt.Errorf("stored ipam state for slice %s is for subnet %s, not %s: %w", sliceName, stored.Spec.SliceSubnet, sliceNet.String(), ErrSliceSubnetMismatch)
+	}
+	pool, err := a.poolFromSnapshot(sliceName, poolSnapshot{
+		SliceSubnet: stored.Spec.SliceSubnet,
+		Allocated:   stored.Spec.Allocated,
+		FreeBlocks:  stored.Spec.FreeBlocks,
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to load ipam state for slice %s: %w", sliceName, err)
+	}
+	if err := validateNoOverlap(pool); err != nil {
+		return nil, false, fmt.Errorf("failed to load ipam state for slice %s: %w", sliceName, err)
+	}
+	if hasLegacyVPNClusterKey(stored.Spec.Allocated) {
+		if err := p.store(ctx, sliceName, pool); err != nil {
+			return nil, false, err
+		}
+		a.log.Info("migrated legacy VPN reservation key", "slice", sliceName, "key", ReservedVPNClusterKey)
+	}
+
+	return pool, true, nil
+}
+
+// Allocate allocates a subnet for a cluster and persists the pool before returning. A
+// cluster that already holds a block of the requested size, loaded from the store or
+// allocated earlier, gets that block back without a write, so a reconcile loop repeating
+// its requests after a restart sees the CIDRs that are already deployed.
+func (p *PersistentIPAMAllocator) Allocate(ctx context.Context, sliceName string, clusterName string, requiredCIDRSize int) (cidr string, err error) {
+	defer p.mem.observeDuration(sliceName, ipamOperationAllocate, time.Now())
+	defer func() { p.mem.countOperation(sliceName, ipamOperationAllocate, err) }()
+
+	if err := validateClusterName(clusterName); err != nil {
+		return "", err
+	}
+	if err := p.mem.checkBlockSize(sliceName, clusterName, requiredCIDRSize); err != nil {
+		return "", err
+	}
+	if cidr, held := p.heldAllocation(ctx, sliceName, clusterName, requiredCIDRSize); held {
+		return cidr, nil
+	}
+	var audited *net.IPNet
+	err = p.mutate(ctx, ipamOperationAllocate, sliceName, func(pool *sliceIPPool) error {
+		_, existed := pool.Allocated[clusterName]
+		allocatedNet, err := pool.allocateSubnetForPool(clusterName, requiredCIDRSize)
+		if err != nil {
+			return fmt.Errorf("failed to allocate subnet for cluster %s in slice %s: %w", clusterName, sliceName, err)
+		}
+		if !existed {
+			audited = allocatedNet
+		}
+		cidr = allocatedNet.String()
+		return nil
+	}, func() {
+		if audited != nil {
+			p.mem.audit(ipamOperationAllocate, sliceName, clusterName, audited)
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return cidr, nil
+}
+
+// heldAllocation returns the block the cluster holds if it is of the requested size. Any
+// other case, including a failure to lock the pool, is left to the write path to report.
+func (p *PersistentIPAMAllocator) heldAllocation(ctx context.Context, sliceName string, clusterName string, requiredCIDRSize int) (string, bool) {
+	pool, err := p.mem.rlockPoolContext(ctx, ipamOperationAllocate, sliceName)
+	if err != nil {
+		return "", false
+	}
+	defer pool.mu.RUnlock()
+
+	allocated, found := pool.Allocated[clusterName]
+	if !found {
+		return "", false
+	}
+	if ones, _ := allocated.Mask.Size(); ones != requiredCIDRSize {
+		return "", false
+	}
+	return allocated.String(), true
+}
+
+// Reclaim returns a cluster's subnet to the pool and persists the pool before returning.
+func (p *PersistentIPAMAllocator) Reclaim(ctx context.Context, sliceName string, clusterName string) (err error) {
+	defer p.mem.observeDuration(sliceName, ipamOperationReclaim, time.Now())
+	defer func() { p.mem.countOperation(sliceName, ipamOperationReclaim, err) }()
+
+	if err := validateClusterName(clusterName); err != nil {
+		return err
+	}
+	var subnetToReclaim *net.IPNet
+	return p.mutate(ctx, ipamOperationReclaim, sliceName, func(pool *sliceIPPool) error {
+		var allocated bool
+		subnetToReclaim, allocated = pool.Allocated[clusterName]
+		if !allocated {
+			return fmt.Errorf("cluster %s has no allocated subnet in slice %s to reclaim: %w", clusterName, sliceName, ErrAllocationNotFound)
+		}
+		pool.forgetAllocation(clusterName)
+		pool.releaseBlock(subnetToReclaim)
+		p.mem.autoCompact(sliceName, pool)
+		return nil
+	}, func() {
+		p.mem.audit(ipamOperationReclaim, sliceName, clusterName, subnetToReclaim)
+	})
+}
+
+// mutate applies change to the slice's pool and stores the result, all under the pool's
+// lock. A write that fails with a transient error is retried, as configured with
+// SetPersistBackoff, until it succeeds, fails permanently or ctx is done; the pool stays
+// locked meanwhile. If either step fails the pool is restored to its previous state;
+// otherwise committed is called, still under the lock.
+func (p *PersistentIPAMAllocator) mutate(ctx context.Context, operation, sliceName string, change func(pool *sliceIPPool) error, committed func()) error {
+	a := p.mem
+	pool, err := a.lockPoolContext(ctx, operation, sliceName)
+	if err != nil {
+		return err
+	}
+	defer pool.mu.Unlock()
+
+	snapshot := pool.clone()
+	if err := change(pool); err != nil {
+		pool.restore(snapshot)
+		return err
+	}
+	if err := p.storeWithRetry(ctx, sliceName, pool); err != nil {
+		pool.restore(snapshot)
+		return err
+	}
+	committed()
+	a.recordPoolMetrics(sliceName, pool)
+
+	return nil
+}
+
+// store writes the pool to the slice's SliceIpam object, creating it if needed.
+func (p *PersistentIPAMAllocator) store(ctx context.Context, sliceName string, pool *sliceIPPool) error {
+	snapshot := pool.snapshot()
+	spec := controllerv1alpha1.SliceIpamSpec{
+		SliceName:   sliceName,
+		SliceSubnet: snapshot.SliceSubnet,
+		Allocated:   snapshot.Allocated,
+		FreeBlocks:  snapshot.FreeBlocks,
+	}
+
+	stored := &controllerv1alpha1.SliceIpam{}
+	err := p.client.Get(ctx, p.key(sliceName), stored)
+	if k8sError.IsNotFound(err) {
+		stored = &controllerv1alpha1.SliceIpam{
+			ObjectMeta: metav1.ObjectMeta{Name: sliceName, Namespace: p.namespace},
+			Spec:       spec,
+		}
+		if err := p.client.Create(ctx, stored); err != nil {
+			return fmt.Errorf("failed to persist ipam state for slice %s: %w", sliceName, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to persist ipam state for slice %s: %w", sliceName, err)
+	}
+
+	stored.Spec = spec
+	if err := p.client.Update(ctx, stored); err != nil {
+		return fmt.Errorf("failed to persist ipam state for slice %s: %w", sliceName, err)
+	}
+	return nil
+}
+
+// storeWithRetry calls store, retrying transient failures with the allocator's backoff.
+// The error wraps the last failure.
+func (p *PersistentIPAMAllocator) storeWithRetry(ctx context.Context, sliceName string, pool *sliceIPPool) error {
+	backoff := p.backoff
+	if backoff.Steps < 1 {
+		backoff.Steps = 1
+	}
+	attempts := 0
+	var lastErr error
+	err := wait.ExponentialBackoffWithContext(ctx, backoff, func() (bool, error) {
+		attempts++
+		lastErr = p.store(ctx, sliceName, pool)
+		if lastErr == nil {
+			return true, nil
+		}
+		if !isTransientStoreError(lastErr) {
+			return false, lastErr
+		}
+		p.mem.log.V(1).Info("retrying ipam state write", "slice", sliceName, "attempt", attempts, "error", lastErr.Error())
+		return false, nil
+	})
+	switch {
+	case err == nil:
+		return nil
+	case lastErr == nil || err == lastErr:
+		return err
+	case errors.Is(err, wait.ErrWaitTimeout):
+		return fmt.Errorf("%w (gave up after %d attempts)", lastErr, attempts)
+	default:
+		return fmt.Errorf("%w (stopped after %d attempts: %w)", lastErr, attempts, err)
+	}
+}
+
+// isTransientStoreError reports whether a failed write may succeed if repeated.
+func isTransientStoreError(err error) bool {
+	return k8sError.IsConflict(err) ||
+		k8sError.IsServerTimeout(err) ||
+		k8sError.IsTimeout(err) ||
+		k8sError.IsTooManyRequests(err) ||
+		k8sError.IsServiceUnavailable(err) ||
+		k8sError.IsInternalError(err)
+}
+
+func (p *PersistentIPAMAllocator) key(sliceName string) client.ObjectKey {
+	return client.ObjectKey{Namespace: p.namespace, Name: sliceName}
+}
@@ -0,0 +1,435 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dailymotion/allure-go"
+	controllerv1alpha1 "github.com/kubeslice/kubeslice-controller/apis/controller/v1alpha1"
+	"github.com/kubeslice/kubeslice-controller/util"
+	utilMock "github.com/kubeslice/kubeslice-controller/util/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	k8sError "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+)
+
+func TestIPAMPersistenceSuite(t *testing.T) {
+	for k, v := range IPAMPersistenceTestBed {
+		t.Run(k, func(t *testing.T) {
+			allure.Test(t, allure.Name(k),
+				allure.Action(func() {
+					v(t)
+				}))
+		})
+	}
+}
+
+var IPAMPersistenceTestBed = map[string]func(*testing.T){
+	"TestPersistentIPAMAllocator_SurvivesRestart":       TestPersistentIPAMAllocator_SurvivesRestart,
+	"TestPersistentIPAMAllocator_RollbackOnStoreError":  TestPersistentIPAMAllocator_RollbackOnStoreError,
+	"TestPersistentIPAMAllocator_ReRequestAfterRestart": TestPersistentIPAMAllocator_ReRequestAfterRestart,
+	"TestPersistentIPAMAllocator_LegacyVPNKey":          TestPersistentIPAMAllocator_LegacyVPNKey,
+	"TestPersistentIPAMAllocator_RetryTransientErrors":  TestPersistentIPAMAllocator_RetryTransientErrors,
+	"TestPersistentIPAMAllocator_InitializeUnlocked":    TestPersistentIPAMAllocator_InitializeUnlocked,
+	"TestPersistentIPAMAllocator_CorruptedState":        TestPersistentIPAMAllocator_CorruptedState,
+	"TestPersistentIPAMAllocator_EnvTest":               TestPersistentIPAMAllocator_EnvTest,
+}
+
+// sliceIpamStore backs a mocked client with an in-memory set of SliceIpam objects, so
+// that the state written by one allocator can be read by the next.
+type sliceIpamStore struct {
+	objects   map[types.NamespacedName]*controllerv1alpha1.SliceIpam
+	updateErr error
+	// failures are returned by the next updates, one each, before updateErr is checked.
+	failures []error
+	updates  int
+}
+
+func newSliceIpamStore() (*sliceIpamStore, *utilMock.Client) {
+	store := &sliceIpamStore{objects: map[types.NamespacedName]*controllerv1alpha1.SliceIpam{}}
+	clientMock := &utilMock.Client{}
+	clientMock.On("Get", mock.Anything, mock.Anything, mock.AnythingOfType("*v1alpha1.SliceIpam")).Return(
+		func(ctx context.Context, key types.NamespacedName, obj client.Object) error {
+			stored, ok := store.objects[key]
+			if !ok {
+				return k8sError.NewNotFound(util.Resource("sliceipams"), key.Name)
+			}
+			stored.DeepCopyInto(obj.(*controllerv1alpha1.SliceIpam))
+			return nil
+		})
+	clientMock.On("Create", mock.Anything, mock.AnythingOfType("*v1alpha1.SliceIpam")).Return(
+		func(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+			store.objects[client.ObjectKeyFromObject(obj)] = obj.(*controllerv1alpha1.SliceIpam).DeepCopy()
+			return nil
+		})
+	clientMock.On("Update", mock.Anything, mock.AnythingOfType("*v1alpha1.SliceIpam")).Return(
+		func(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+			store.updates++
+			if len(store.failures) > 0 {
+				err := store.failures[0]
+				store.failures = store.failures[1:]
+				return err
+			}
+			if store.updateErr != nil {
+				return store.updateErr
+			}
+			store.objects[client.ObjectKeyFromObject(obj)] = obj.(*controllerv1alpha1.SliceIpam).DeepCopy()
+			return nil
+		})
+	return store, clientMock
+}
+
+func TestPersistentIPAMAllocator_SurvivesRestart(t *testing.T) {
+	store, clientMock := newSliceIpamStore()
+	ctx := context.Background()
+	namespace := "kubeslice-cisco"
+	sliceName := "persistent-slice"
+
+	allocator := NewPersistentIPAMAllocator(clientMock, namespace)
+	require.NoError(t, allocator.InitializePool(sliceName, "10.202.0.0/16"))
+	cidrA, err := allocator.Allocate(ctx, sliceName, "cluster-a", 24)
+	require.NoError(t, err)
+	cidrB, err := allocator.Allocate(ctx, sliceName, "cluster-b", 24)
+	require.NoError(t, err)
+	cidrC, err := allocator.Allocate(ctx, sliceName, "cluster-c", 24)
+	require.NoError(t, err)
+	require.NoError(t, allocator.Reclaim(ctx, sliceName, "cluster-b"))
+
+	stored := store.objects[types.NamespacedName{Namespace: namespace, Name: sliceName}]
+	require.NotNil(t, stored)
+	assert.Equal(t, "10.202.0.0/16", stored.Spec.SliceSubnet)
+	assert.Equal(t, map[string]string{
+		ReservedVPNClusterKey: "10.202.0.0/24",
+		"cluster-a":           cidrA,
+		"cluster-c":           cidrC,
+	}, stored.Spec.Allocated)
+
+	restarted := NewPersistentIPAMAllocator(clientMock, namespace)
+	require.NoError(t, restarted.InitializePool(sliceName, "10.202.0.0/16"))
+	allocations, err := restarted.mem.ListAllocations(ctx, sliceName)
+	require.NoError(t, err)
+	assert.Equal(t, stored.Spec.Allocated, allocations)
+
+	cidr, err := restarted.Allocate(ctx, sliceName, "cluster-a", 24)
+	require.NoError(t, err)
+	assert.Equal(t, cidrA, cidr, "an existing allocation is returned after a restart")
+	cidr, err = restarted.Allocate(ctx, sliceName, "cluster-d", 24)
+	require.NoError(t, err)
+	assert.Equal(t, cidrB, cidr, "the block reclaimed before the restart is reused instead of a duplicate")
+
+	t.Run("Subnet mismatch", func(t *testing.T) {
+		other := NewPersistentIPAMAllocator(clientMock, namespace)
+		err := other.InitializePool(sliceName, "10.203.0.0/16")
+		require.Error(t, err)
+	})
+}
+
+func TestPersistentIPAMAllocator_RollbackOnStoreError(t *testing.T) {
+	store, clientMock := newSliceIpamStore()
+	ctx := context.Background()
+	sliceName := "flaky-slice"
+
+	allocator := NewPersistentIPAMAllocator(clientMock, "kubeslice-cisco")
+	require.NoError(t, allocator.InitializePool(sliceName, "10.204.0.0/16"))
+
+	store.updateErr = errors.New("etcd unavailable")
+	_, err := allocator.Allocate(ctx, sliceName, "cluster-a", 24)
+	require.Error(t, err)
+	allocations, err := allocator.mem.ListAllocations(ctx, sliceName)
+	require.NoError(t, err)
+	assert.NotContains(t, allocations, "cluster-a", "a failed write must roll back the allocation")
+
+	store.updateErr = nil
+	cidr, err := allocator.Allocate(ctx, sliceName, "cluster-a", 24)
+	require.NoError(t, err)
+	assert.Equal(t, "10.204.1.0/24", cidr)
+}
+
+func TestPersistentIPAMAllocator_ReRequestAfterRestart(t *testing.T) {
+	store, clientMock := newSliceIpamStore()
+	ctx := context.Background()
+	namespace := "kubeslice-cisco"
+	sliceName := "rerequest-slice"
+
+	allocator := NewPersistentIPAMAllocator(clientMock, namespace)
+	require.NoError(t, allocator.InitializePool(sliceName, "10.205.0.0/16"))
+	_, err := allocator.Allocate(ctx, sliceName, "cluster-a", 24)
+	require.NoError(t, err)
+	require.NoError(t, allocator.Reclaim(ctx, sliceName, "cluster-a"))
+	cidrB, err := allocator.Allocate(ctx, sliceName, "cluster-b", 23)
+	require.NoError(t, err)
+	// cluster-c takes the block cluster-a left free, below cluster-b, so a fresh
+	// allocation for it would come back different.
+	cidrC, err := allocator.Allocate(ctx, sliceName, "cluster-c", 24)
+	require.NoError(t, err)
+	require.Equal(t, "10.205.1.0/24", cidrC)
+
+	restarted := NewPersistentIPAMAllocator(clientMock, namespace)
+	require.NoError(t, restarted.InitializePool(sliceName, "10.205.0.0/16"))
+	// The store is down: requests for blocks that are already held need no write.
+	store.updateErr = errors.New("etcd unavailable")
+	for i := 0; i < 2; i++ {
+		cidr, err := restarted.Allocate(ctx, sliceName, "cluster-c", 24)
+		require.NoError(t, err)
+		assert.Equal(t, cidrC, cidr)
+		cidr, err = restarted.Allocate(ctx, sliceName, "cluster-b", 23)
+		require.NoError(t, err)
+		assert.Equal(t, cidrB, cidr)
+	}
+	_, err = restarted.Allocate(ctx, sliceName, "cluster-b", 24)
+	assert.ErrorIs(t, err, ErrReallocationUnsupported)
+	_, err = restarted.Allocate(ctx, sliceName, "cluster-d", 24)
+	require.Error(t, err, "a new allocation still has to be written")
+
+	t.Run("In-memory state reloaded with LoadState", func(t *testing.T) {
+		state, err := restarted.mem.MarshalState()
+		require.NoError(t, err)
+		reloaded := NewDynamicIPAMAllocator()
+		require.NoError(t, reloaded.LoadState(state))
+
+		cidr, err := reloaded.Allocate(ctx, sliceName, "cluster-c", 24)
+		require.NoError(t, err)
+		assert.Equal(t, cidrC, cidr)
+		cidr, err = reloaded.Allocate(ctx, sliceName, "cluster-b", 23)
+		require.NoError(t, err)
+		assert.Equal(t, cidrB, cidr)
+	})
+}
+
+func TestPersistentIPAMAllocator_LegacyVPNKey(t *testing.T) {
+	store, clientMock := newSliceIpamStore()
+	ctx := context.Background()
+	namespace := "kubeslice-cisco"
+	sliceName := "legacy-slice"
+	key := types.NamespacedName{Namespace: namespace, Name: sliceName}
+	store.objects[key] = &controllerv1alpha1.SliceIpam{
+		ObjectMeta: metav1.ObjectMeta{Name: sliceName, Namespace: namespace},
+		Spec: controllerv1alpha1.SliceIpamSpec{
+			SliceName:   sliceName,
+			SliceSubnet: "10.206.0.0/22",
+			Allocated:   map[string]string{"KubeSlice-VPN-Reserved-Subnet": "10.206.0.0/24", "cluster-a": "10.206.1.0/24"},
+			FreeBlocks:  []string{"10.206.2.0/23"},
+		},
+	}
+
+	allocator := NewPersistentIPAMAllocator(clientMock, namespace)
+	require.NoError(t, allocator.InitializePool(sliceName, "10.206.0.0/22"))
+	vpn, err := allocator.mem.GetVPNSubnet(ctx, sliceName)
+	require.NoError(t, err)
+	assert.Equal(t, "10.206.0.0/24", vpn)
+	assert.Equal(t, map[string]string{
+		ReservedVPNClusterKey: "10.206.0.0/24",
+		"cluster-a":           "10.206.1.0/24",
+	}, store.objects[key].Spec.Allocated, "the migrated key is written back")
+
+	cidr, err := allocator.Allocate(ctx, sliceName, "cluster-b", 24)
+	require.NoError(t, err)
+	assert.Equal(t, "10.206.2.0/24", cidr, "the VPN subnet is still reserved")
+}
+
+func TestPersistentIPAMAllocator_RetryTransientErrors(t *testing.T) {
+	store, clientMock := newSliceIpamStore()
+	ctx := context.Background()
+	namespace := "kubeslice-cisco"
+	sliceName := "retry-slice"
+	key := types.NamespacedName{Namespace: namespace, Name: sliceName}
+	conflict := k8sError.NewConflict(util.Resource("sliceipams"), sliceName, errors.New("the object has been modified"))
+	unavailable := k8sError.NewServiceUnavailable("etcd unavailable")
+
+	allocator := NewPersistentIPAMAllocator(clientMock, namespace)
+	allocator.SetPersistBackoff(wait.Backoff{Duration: time.Millisecond, Factor: 2, Steps: 3})
+	require.NoError(t, allocator.InitializePool(sliceName, "10.207.0.0/16"))
+	assertConsistent := func(t *testing.T) {
+		t.Helper()
+		allocations, err := allocator.mem.ListAllocations(ctx, sliceName)
+		require.NoError(t, err)
+		assert.Equal(t, store.objects[key].Spec.Allocated, allocations, "memory and store agree")
+	}
+
+	store.failures = []error{conflict, unavailable}
+	store.updates = 0
+	cidr, err := allocator.Allocate(ctx, sliceName, "cluster-a", 24)
+	require.NoError(t, err, "two transient failures are retried")
+	assert.Equal(t, "10.207.1.0/24", cidr)
+	assert.Equal(t, 3, store.updates)
+	assertConsistent(t)
+
+	store.failures = []error{unavailable, conflict}
+	require.NoError(t, allocator.Reclaim(ctx, sliceName, "cluster-a"))
+	assertConsistent(t)
+	assert.NotContains(t, store.objects[key].Spec.Allocated, "cluster-a")
+
+	t.Run("Retries exhausted", func(t *testing.T) {
+		store.failures = []error{conflict, conflict, conflict, conflict}
+		store.updates = 0
+		_, err := allocator.Allocate(ctx, sliceName, "cluster-b", 24)
+		require.Error(t, err)
+		assert.True(t, k8sError.IsConflict(err), "the last failure is returned")
+		assert.Contains(t, err.Error(), "after 3 attempts")
+		assert.Equal(t, 3, store.updates)
+		assertConsistent(t)
+		store.failures = nil
+	})
+
+	t.Run("Permanent error", func(t *testing.T) {
+		store.updateErr = errors.New("admission webhook denied the request")
+		store.updates = 0
+		_, err := allocator.Allocate(ctx, sliceName, "cluster-b", 24)
+		require.Error(t, err)
+		assert.Equal(t, 1, store.updates, "a permanent error is not retried")
+		assertConsistent(t)
+		store.updateErr = nil
+	})
+
+	t.Run("Context deadline", func(t *testing.T) {
+		allocator.SetPersistBackoff(wait.Backoff{Duration: time.Hour, Steps: 3})
+		defer allocator.SetPersistBackoff(wait.Backoff{Duration: time.Millisecond, Factor: 2, Steps: 3})
+		store.failures = []error{unavailable}
+		deadline, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		defer cancel()
+		_, err := allocator.Allocate(deadline, sliceName, "cluster-b", 24)
+		require.Error(t, err)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.True(t, k8sError.IsServiceUnavailable(err))
+		assertConsistent(t)
+
+		cidr, err := allocator.Allocate(ctx, sliceName, "cluster-b", 24)
+		require.NoError(t, err)
+		assert.Equal(t, "10.207.1.0/24", cidr, "failed attempts left no trace")
+		assertConsistent(t)
+	})
+}
+
+func TestPersistentIPAMAllocator_CorruptedState(t *testing.T) {
+	store, clientMock := newSliceIpamStore()
+	namespace := "kubeslice-cisco"
+	sliceName := "corrupted-slice"
+	// A hand edit left cluster-a's block on the free list as well.
+	store.objects[types.NamespacedName{Namespace: namespace, Name: sliceName}] = &controllerv1alpha1.SliceIpam{
+		ObjectMeta: metav1.ObjectMeta{Name: sliceName, Namespace: namespace},
+		Spec: controllerv1alpha1.SliceIpamSpec{
+			SliceName:   sliceName,
+			SliceSubnet: "10.209.0.0/22",
+			Allocated:   map[string]string{ReservedVPNClusterKey: "10.209.0.0/24", "cluster-a": "10.209.1.0/24"},
+			FreeBlocks:  []string{"10.209.1.0/24", "10.209.2.0/23"},
+		},
+	}
+
+	allocator := NewPersistentIPAMAllocator(clientMock, namespace)
+	err := allocator.InitializePool(sliceName, "10.209.0.0/22")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "10.209.1.0/24 (allocated to cluster-a)")
+	assert.Empty(t, allocator.mem.ListSlices(), "an inconsistent pool is not installed")
+}
+
+func TestPersistentIPAMAllocator_InitializeUnlocked(t *testing.T) {
+	loading := make(chan struct{})
+	release := make(chan struct{})
+	clientMock := &utilMock.Client{}
+	clientMock.On("Get", mock.Anything, mock.Anything, mock.AnythingOfType("*v1alpha1.SliceIpam")).Return(
+		func(ctx context.Context, key types.NamespacedName, obj client.Object) error {
+			close(loading)
+			<-release
+			return k8sError.NewNotFound(util.Resource("sliceipams"), key.Name)
+		}).Once()
+	clientMock.On("Get", mock.Anything, mock.Anything, mock.AnythingOfType("*v1alpha1.SliceIpam")).Return(
+		func(ctx context.Context, key types.NamespacedName, obj client.Object) error {
+			return k8sError.NewNotFound(util.Resource("sliceipams"), key.Name)
+		})
+	clientMock.On("Create", mock.Anything, mock.AnythingOfType("*v1alpha1.SliceIpam")).Return(nil)
+
+	allocator := NewPersistentIPAMAllocator(clientMock, "kubeslice-cisco")
+	initialized := make(chan error, 1)
+	go func() {
+		initialized <- allocator.InitializePool("slow-slice", "10.206.0.0/16")
+	}()
+	<-loading
+
+	listed := make(chan []string, 1)
+	go func() {
+		listed <- allocator.mem.ListSlices()
+	}()
+	select {
+	case slices := <-listed:
+		assert.Empty(t, slices, "the pool is installed only once it is loaded")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the allocator stayed locked while the store was read")
+	}
+
+	close(release)
+	require.NoError(t, <-initialized)
+	assert.Equal(t, []string{"slow-slice"}, allocator.mem.ListSlices())
+}
+
+// TestPersistentIPAMAllocator_EnvTest runs the allocator against a real API server. It is
+// skipped unless KUBEBUILDER_ASSETS points at the envtest binaries, as the Makefile's test
+// targets arrange.
+func TestPersistentIPAMAllocator_EnvTest(t *testing.T) {
+	if os.Getenv("KUBEBUILDER_ASSETS") == "" {
+		t.Skip("KUBEBUILDER_ASSETS is not set")
+	}
+	testEnv := &envtest.Environment{
+		CRDDirectoryPaths:     []string{filepath.Join("..", "config", "crd", "bases")},
+		ErrorIfCRDPathMissing: true,
+	}
+	cfg, err := testEnv.Start()
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, testEnv.Stop())
+	}()
+
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	require.NoError(t, controllerv1alpha1.AddToScheme(scheme))
+	k8sClient, err := client.New(cfg, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	namespace := "kubeslice-envtest"
+	sliceName := "envtest-slice"
+	require.NoError(t, k8sClient.Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}))
+
+	// Replicas starting together race to create the object; the losers load the winner's.
+	replicas := make([]*PersistentIPAMAllocator, 3)
+	errs := make([]error, len(replicas))
+	var wg sync.WaitGroup
+	for i := range replicas {
+		replicas[i] = NewPersistentIPAMAllocator(k8sClient, namespace)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = replicas[i].InitializePool(sliceName, "10.207.0.0/16")
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	cidr, err := replicas[0].Allocate(ctx, sliceName, "cluster-a", 24)
+	require.NoError(t, err)
+	stored := &controllerv1alpha1.SliceIpam{}
+	require.NoError(t, k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: sliceName}, stored))
+	assert.Equal(t, cidr, stored.Spec.Allocated["cluster-a"])
+
+	restarted := NewPersistentIPAMAllocator(k8sClient, namespace)
+	require.NoError(t, restarted.InitializePool(sliceName, "10.207.0.0/16"))
+	allocations, err := restarted.mem.ListAllocations(ctx, sliceName)
+	require.NoError(t, err)
+	assert.Equal(t, stored.Spec.Allocated, allocations)
+	assert.ErrorIs(t, restarted.InitializePool(sliceName, "10.208.0.0/16"), ErrSliceSubnetMismatch)
+}
@@ -0,0 +1,140 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Pool is a handle on a single slice's pool, returned by GetPool. It saves multi-step
+// callers the allocator lookup on every call. A handle stays safe to use after its pool
+// is deleted or replaced by a restore; it then fails with ErrPoolDeleted.
+type Pool struct {
+	allocator *DynamicIPAMAllocator
+	sliceName string
+	pool      *sliceIPPool
+}
+
+// GetPool returns a handle on the slice's pool.
+func (a *DynamicIPAMAllocator) GetPool(sliceName string) (*Pool, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	pool, exists := a.pools[sliceName]
+	if !exists {
+		return nil, fmt.Errorf("slice %s: %w", sliceName, ErrPoolNotInitialized)
+	}
+
+	return &Pool{allocator: a, sliceName: sliceName, pool: pool}, nil
+}
+
+// DeletePool removes the slice's pool and all of its allocations. Handles obtained from
+// GetPool fail from then on, even if the slice is initialized again.
+func (a *DynamicIPAMAllocator) DeletePool(ctx context.Context, sliceName string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	pool, exists := a.pools[sliceName]
+	if !exists {
+		return fmt.Errorf("slice %s: %w", sliceName, ErrPoolNotInitialized)
+	}
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pool.deleted = true
+	delete(a.pools, sliceName)
+	a.log.V(1).Info("deleted ipam pool", "slice", sliceName)
+
+	return nil
+}
+
+// SliceName returns the name of the slice the handle is scoped to.
+func (p *Pool) SliceName() string {
+	return p.sliceName
+}
+
+// Allocate allocates a subnet for a cluster in the handle's slice, like
+// DynamicIPAMAllocator.Allocate.
+func (p *Pool) Allocate(ctx context.Context, clusterName string, requiredCIDRSize int) (cidr string, err error) {
+	a := p.allocator
+	defer a.observeDuration(p.sliceName, ipamOperationAllocate, time.Now())
+	defer func() { a.countOperation(p.sliceName, ipamOperationAllocate, err) }()
+
+	if err := p.lock(ctx, ipamOperationAllocate); err != nil {
+		return "", err
+	}
+	defer p.pool.mu.Unlock()
+
+	return a.allocateLocked(p.sliceName, p.pool, clusterName, requiredCIDRSize)
+}
+
+// Reclaim returns a cluster's subnet to the handle's slice, like
+// DynamicIPAMAllocator.Reclaim.
+func (p *Pool) Reclaim(ctx context.Context, clusterName string) (err error) {
+	a := p.allocator
+	defer a.observeDuration(p.sliceName, ipamOperationReclaim, time.Now())
+	defer func() { a.countOperation(p.sliceName, ipamOperationReclaim, err) }()
+
+	if err := p.lock(ctx, ipamOperationReclaim); err != nil {
+		return err
+	}
+	defer p.pool.mu.Unlock()
+
+	return a.reclaimLocked(p.sliceName, p.pool, clusterName)
+}
+
+// List returns a copy of the slice's allocations as cluster name to CIDR, like
+// DynamicIPAMAllocator.ListAllocations.
+func (p *Pool) List(ctx context.Context) (map[string]string, error) {
+	if err := p.rlock(ctx, "list"); err != nil {
+		return nil, err
+	}
+	defer p.pool.mu.RUnlock()
+
+	allocations := make(map[string]string, len(p.pool.Allocated))
+	for clusterName, ipNet := range p.pool.Allocated {
+		allocations[clusterName] = ipNet.String()
+	}
+	return allocations, nil
+}
+
+// Stats returns the slice's address usage, like DynamicIPAMAllocator.PoolStats.
+func (p *Pool) Stats(ctx context.Context) (PoolStats, error) {
+	if err := p.rlock(ctx, "stats"); err != nil {
+		return PoolStats{}, err
+	}
+	defer p.pool.mu.RUnlock()
+
+	return p.pool.stats(), nil
+}
+
+// lock acquires the pool's mutex unless ctx is done or the pool was deleted.
+func (p *Pool) lock(ctx context.Context, operation string) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%s in slice %s abandoned: %w", operation, p.sliceName, err)
+	}
+	if err := lockWithContext(ctx, &p.pool.mu, false); err != nil {
+		return fmt.Errorf("%s in slice %s abandoned: %w", operation, p.sliceName, err)
+	}
+	if p.pool.deleted {
+		p.pool.mu.Unlock()
+		return fmt.Errorf("slice %s: %w", p.sliceName, ErrPoolDeleted)
+	}
+	return nil
+}
+
+// rlock is lock for queries; it acquires the pool's read lock.
+func (p *Pool) rlock(ctx context.Context, operation string) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%s in slice %s abandoned: %w", operation, p.sliceName, err)
+	}
+	if err := lockWithContext(ctx, &p.pool.mu, true); err != nil {
+		return fmt.Errorf("%s in slice %s abandoned: %w", operation, p.sliceName, err)
+	}
+	if p.pool.deleted {
+		p.pool.mu.RUnlock()
+		return fmt.Errorf("slice %s: %w", p.sliceName, ErrPoolDeleted)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dailymotion/allure-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPAMPoolSuite(t *testing.T) {
+	for k, v := range IPAMPoolTestBed {
+		t.Run(k, func(t *testing.T) {
+			allure.Test(t, allure.Name(k),
+				allure.Action(func() {
+					v(t)
+				}))
+		})
+	}
+}
+
+var IPAMPoolTestBed = map[string]func(*testing.T){
+	"TestPool_AllocationSequence": TestPool_AllocationSequence,
+	"TestPool_DeletePool":         TestPool_DeletePool,
+}
+
+func TestPool_AllocationSequence(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "handle-slice"
+	allocator := NewDynamicIPAMAllocator()
+	require.NoError(t, allocator.InitializePool(sliceName, "10.224.0.0/16"))
+
+	pool, err := allocator.GetPool(sliceName)
+	require.NoError(t, err)
+	assert.Equal(t, sliceName, pool.SliceName())
+
+	cidrA, err := pool.Allocate(ctx, "cluster-a", 24)
+	require.NoError(t, err)
+	assert.Equal(t, "10.224.1.0/24", cidrA)
+	cidrB, err := pool.Allocate(ctx, "cluster-b", 25)
+	require.NoError(t, err)
+	assert.Equal(t, "10.224.2.0/25", cidrB)
+
+	allocations, err := pool.List(ctx)
+	require.NoError(t, err)
+	want, err := allocator.ListAllocations(ctx, sliceName)
+	require.NoError(t, err)
+	assert.Equal(t, want, allocations, "the handle and the allocator share the pool")
+	assert.Equal(t, cidrA, allocations["cluster-a"])
+
+	stats, err := pool.Stats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, float64(256+256+128), stats.AllocatedAddresses)
+
+	require.NoError(t, pool.Reclaim(ctx, "cluster-a"))
+	assert.ErrorIs(t, pool.Reclaim(ctx, "cluster-a"), ErrAllocationNotFound)
+	_, err = allocator.GetAllocation(ctx, sliceName, "cluster-a")
+	assert.ErrorIs(t, err, ErrAllocationNotFound)
+
+	_, err = allocator.GetPool("missing-slice")
+	assert.ErrorIs(t, err, ErrPoolNotInitialized)
+}
+
+func TestPool_DeletePool(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "deleted-handle-slice"
+	allocator := NewDynamicIPAMAllocator()
+	require.NoError(t, allocator.InitializePool(sliceName, "10.225.0.0/16"))
+	pool, err := allocator.GetPool(sliceName)
+	require.NoError(t, err)
+	_, err = pool.Allocate(ctx, "cluster-a", 24)
+	require.NoError(t, err)
+
+	require.NoError(t, allocator.DeletePool(ctx, sliceName))
+	assert.ErrorIs(t, allocator.DeletePool(ctx, sliceName), ErrPoolNotInitialized)
+
+	_, err = pool.Allocate(ctx, "cluster-b", 24)
+	assert.ErrorIs(t, err, ErrPoolDeleted)
+	assert.ErrorIs(t, pool.Reclaim(ctx, "cluster-a"), ErrPoolDeleted)
+	_, err = pool.List(ctx)
+	assert.ErrorIs(t, err, ErrPoolDeleted)
+	_, err = pool.Stats(ctx)
+	assert.ErrorIs(t, err, ErrPoolDeleted)
+
+	// Re-initializing the slice creates a new pool; the old handle stays dead.
+	require.NoError(t, allocator.InitializePool(sliceName, "10.225.0.0/16"))
+	_, err = pool.Allocate(ctx, "cluster-b", 24)
+	assert.ErrorIs(t, err, ErrPoolDeleted)
+	allocations, err := allocator.ListAllocations(ctx, sliceName)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{ReservedVPNClusterKey: "10.225.0.0/24"}, allocations)
+
+	t.Run("Restore replaces the pool", func(t *testing.T) {
+		pool, err := allocator.GetPool(sliceName)
+		require.NoError(t, err)
+		data, err := allocator.SnapshotAll()
+		require.NoError(t, err)
+		require.NoError(t, allocator.RestoreAll(data))
+
+		_, err = pool.Allocate(ctx, "cluster-b", 24)
+		assert.ErrorIs(t, err, ErrPoolDeleted)
+	})
+}
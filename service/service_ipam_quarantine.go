@@ -0,0 +1,118 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/kubeslice/kubeslice-controller/util/cidrutil"
+)
+
+// Clock is the time source used by the allocator. It exists so that tests can control
+// quarantine expiry.
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock reads the system clock.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// quarantinedBlock is a reclaimed block waiting to be returned to the free list.
+type quarantinedBlock struct {
+	Block     *net.IPNet
+	ReleaseAt time.Time
+}
+
+// SweepExpired reclaims every allocation whose TTL, set with AllocateWithTTL, has lapsed
+// and returns every quarantined block whose quarantine has elapsed to its pool's free
+// list, merging it with free neighbours, across all pools. It returns the reclaimed
+// allocations as "<slice>/<cluster>", ordered by slice and then cluster. Allocations also
+// release expired quarantined blocks of their own pool before searching, but lapsed
+// allocations are only reclaimed by a sweep. Pools are locked one at a time, and the
+// sweep stops waiting for a lock once ctx is done; pools deleted meanwhile are skipped.
+func (a *DynamicIPAMAllocator) SweepExpired(ctx context.Context) (reclaimed []string, err error) {
+	for _, sliceName := range a.ListSlices() {
+		pool, err := a.lockPoolContext(ctx, "sweep", sliceName)
+		if errors.Is(err, ErrPoolNotInitialized) {
+			continue
+		}
+		if err != nil {
+			return reclaimed, err
+		}
+		lapsed, err := a.reclaimLapsed(sliceName, pool)
+		for _, clusterName := range lapsed {
+			reclaimed = append(reclaimed, sliceName+"/"+clusterName)
+		}
+		if pool.releaseExpired() > 0 {
+			a.recordPoolMetrics(sliceName, pool)
+		}
+		pool.mu.Unlock()
+		if err != nil {
+			return reclaimed, err
+		}
+	}
+
+	return reclaimed, nil
+}
+
+// now reads the pool's clock, falling back to the system clock for pools that were not
+// created by InitializePool.
+func (pool *sliceIPPool) now() time.Time {
+	if pool.clock == nil {
+		return time.Now()
+	}
+	return pool.clock.Now()
+}
+
+// releaseBlock returns a reclaimed block to the free list, or quarantines it if the pool
+// has a quarantine duration.
+func (pool *sliceIPPool) releaseBlock(block *net.IPNet) {
+	if pool.options.QuarantineDuration <= 0 {
+		pool.insertFreeBlock(block)
+		return
+	}
+	pool.quarantine(block)
+}
+
+// releaseBlocks returns several reclaimed blocks at once, coalescing the free list a
+// single time instead of merging each block on insertion.
+func (pool *sliceIPPool) releaseBlocks(blocks []*net.IPNet) {
+	if pool.options.QuarantineDuration <= 0 {
+		pool.FreeBlocks = append(pool.FreeBlocks, blocks...)
+		pool.coalesceFreeBlocks()
+		return
+	}
+	for _, block := range blocks {
+		pool.quarantine(block)
+	}
+}
+
+func (pool *sliceIPPool) quarantine(block *net.IPNet) {
+	releaseAt := pool.now().Add(pool.options.QuarantineDuration)
+	pool.Quarantined = append(pool.Quarantined, quarantinedBlock{Block: cidrutil.Normalize(block), ReleaseAt: releaseAt})
+	pool.tracer().Info("quarantined reclaimed block", "block", block, "releaseAt", releaseAt)
+}
+
+// releaseExpired moves quarantined blocks whose release time has passed to the free list
+// and returns how many were released.
+func (pool *sliceIPPool) releaseExpired() int {
+	if len(pool.Quarantined) == 0 {
+		return 0
+	}
+	now := pool.now()
+	kept := pool.Quarantined[:0]
+	released := 0
+	for _, q := range pool.Quarantined {
+		if now.Before(q.ReleaseAt) {
+			kept = append(kept, q)
+			continue
+		}
+		pool.insertFreeBlock(q.Block)
+		released++
+	}
+	pool.Quarantined = kept
+	return released
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dailymotion/allure-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPAMQuarantineSuite(t *testing.T) {
+	for k, v := range IPAMQuarantineTestBed {
+		t.Run(k, func(t *testing.T) {
+			allure.Test(t, allure.Name(k),
+				allure.Action(func() {
+					v(t)
+				}))
+		})
+	}
+}
+
+var IPAMQuarantineTestBed = map[string]func(*testing.T){
+	"TestDynamicIPAMAllocator_QuarantineReclaimedBlocks": TestDynamicIPAMAllocator_QuarantineReclaimedBlocks,
+}
+
+// fakeClock is a Clock that only moves when advanced.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func TestDynamicIPAMAllocator_QuarantineReclaimedBlocks(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	allocator := NewDynamicIPAMAllocator(WithClock(clock))
+	ctx := context.Background()
+	sliceName := "quarantine-slice"
+	err := allocator.InitializePoolWithOptions(sliceName, "10.170.0.0/22", PoolOptions{QuarantineDuration: time.Hour})
+	require.NoError(t, err)
+
+	for _, cluster := range []string{"cluster-a", "cluster-b", "cluster-c"} {
+		_, err := allocator.Allocate(ctx, sliceName, cluster, 24)
+		require.NoError(t, err)
+	}
+	require.NoError(t, allocator.Reclaim(ctx, sliceName, "cluster-c"))
+	require.NoError(t, allocator.Reclaim(ctx, sliceName, "cluster-b"))
+
+	pool := allocator.pools[sliceName]
+	assert.Empty(t, pool.FreeBlocks, "reclaimed blocks must not be free while quarantined")
+	assert.Len(t, pool.Quarantined, 2)
+
+	_, err = allocator.Allocate(ctx, sliceName, "cluster-d", 24)
+	assert.Error(t, err, "a quarantined block must not be allocatable")
+
+	clock.Advance(59 * time.Minute)
+	reclaimed, err := allocator.SweepExpired(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, reclaimed)
+	assert.Empty(t, pool.FreeBlocks)
+	_, err = allocator.Allocate(ctx, sliceName, "cluster-d", 24)
+	assert.Error(t, err, "the quarantine has not elapsed yet")
+
+	clock.Advance(time.Minute)
+	_, err = allocator.SweepExpired(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, pool.Quarantined)
+	require.Len(t, pool.FreeBlocks, 1, "released buddies should merge")
+	assert.Equal(t, "10.170.2.0/23", pool.FreeBlocks[0].String())
+
+	cidr, err := allocator.Allocate(ctx, sliceName, "cluster-d", 23)
+	require.NoError(t, err)
+	assert.Equal(t, "10.170.2.0/23", cidr)
+
+	// Allocation releases expired blocks itself, without an explicit sweep.
+	require.NoError(t, allocator.Reclaim(ctx, sliceName, "cluster-a"))
+	clock.Advance(time.Hour)
+	cidr, err = allocator.Allocate(ctx, sliceName, "cluster-e", 24)
+	require.NoError(t, err)
+	assert.Equal(t, "10.170.1.0/24", cidr)
+}
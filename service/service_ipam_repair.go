@@ -0,0 +1,148 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/kubeslice/kubeslice-controller/util/cidrutil"
+)
+
+// StateRepair describes one change RepairState made to bring a pool back to a consistent
+// state.
+type StateRepair struct {
+	SliceName string
+	// ClusterName is the owner of a dropped allocation, or empty for any other block.
+	ClusterName string
+	CIDR        string
+	// Action says what was done and why, naming the block it conflicted with.
+	Action string
+}
+
+// repairPool makes the pool's allocated, excluded, quarantined and free blocks disjoint
+// and confines them to the slice subnet, so that validateNoOverlap accepts it. Blocks are
+// kept first come, first served: reserved allocations, then tenant allocations by
+// address, then exclusions, quarantined blocks and finally free blocks. An allocation,
+// exclusion or quarantined block that conflicts with a kept block is dropped; a free
+// block keeps whatever part of it does not conflict.
+func repairPool(sliceName string, pool *sliceIPPool) []StateRepair {
+	clusterNames := make([]string, 0, len(pool.Allocated))
+	for clusterName := range pool.Allocated {
+		clusterNames = append(clusterNames, clusterName)
+	}
+	sort.Slice(clusterNames, func(i, j int) bool {
+		ri, rj := isReservedAllocation(clusterNames[i]), isReservedAllocation(clusterNames[j])
+		if ri != rj {
+			return ri
+		}
+		if cmp := cidrutil.Compare(pool.Allocated[clusterNames[i]], pool.Allocated[clusterNames[j]]); cmp != 0 {
+			return cmp < 0
+		}
+		return clusterNames[i] < clusterNames[j]
+	})
+
+	sliceOnes, sliceBits := pool.SliceSubnet.Mask.Size()
+	within := func(block *net.IPNet) bool {
+		ones, bits := block.Mask.Size()
+		return bits == sliceBits && ones >= sliceOnes && pool.SliceSubnet.Contains(block.IP)
+	}
+
+	var repairs []StateRepair
+	var kept []ownedBlock
+	conflict := func(block *net.IPNet) string {
+		if !within(block) {
+			return "outside slice subnet " + pool.SliceSubnet.String()
+		}
+		for _, k := range kept {
+			if cidrutil.Overlaps(k.block, block) {
+				return "overlaps " + k.String()
+			}
+		}
+		return ""
+	}
+
+	for _, clusterName := range clusterNames {
+		allocated := pool.Allocated[clusterName]
+		if reason := conflict(allocated); reason != "" {
+			pool.forgetAllocation(clusterName)
+			repairs = append(repairs, StateRepair{
+				SliceName:   sliceName,
+				ClusterName: clusterName,
+				CIDR:        allocated.String(),
+				Action:      "dropped allocation: " + reason,
+			})
+			continue
+		}
+		kept = append(kept, ownedBlock{block: allocated, owner: "allocated to " + clusterName})
+	}
+
+	excluded := make([]*net.IPNet, 0, len(pool.Excluded))
+	for _, block := range pool.Excluded {
+		if reason := conflict(block); reason != "" {
+			repairs = append(repairs, StateRepair{SliceName: sliceName, CIDR: block.String(), Action: "dropped exclusion: " + reason})
+			continue
+		}
+		excluded = append(excluded, block)
+		kept = append(kept, ownedBlock{block: block, owner: "excluded"})
+	}
+	pool.Excluded = excluded
+
+	quarantined := make([]quarantinedBlock, 0, len(pool.Quarantined))
+	for _, q := range pool.Quarantined {
+		if reason := conflict(q.Block); reason != "" {
+			repairs = append(repairs, StateRepair{SliceName: sliceName, CIDR: q.Block.String(), Action: "dropped quarantined block: " + reason})
+			continue
+		}
+		quarantined = append(quarantined, q)
+		kept = append(kept, ownedBlock{block: q.Block, owner: "quarantined"})
+	}
+	pool.Quarantined = quarantined
+
+	free := make([]*net.IPNet, 0, len(pool.FreeBlocks))
+	for _, block := range pool.FreeBlocks {
+		reason := conflict(block)
+		if reason == "" {
+			free = append(free, block)
+			kept = append(kept, ownedBlock{block: block, owner: "free"})
+			continue
+		}
+		// Keep the part of the block that is within the slice subnet and not taken.
+		base := block
+		if !within(block) {
+			base = nil
+			if ones, bits := block.Mask.Size(); bits == sliceBits && ones < sliceOnes && block.Contains(pool.SliceSubnet.IP) {
+				base = pool.SliceSubnet
+			}
+		}
+		var pieces []*net.IPNet
+		if base != nil {
+			holes := make([]*net.IPNet, 0, len(kept))
+			for _, k := range kept {
+				holes = append(holes, k.block)
+			}
+			pieces = carveOut([]*net.IPNet{base}, holes)
+		}
+		action := "dropped free block: " + reason
+		if len(pieces) > 0 {
+			remaining := make([]string, 0, len(pieces))
+			for _, piece := range pieces {
+				remaining = append(remaining, piece.String())
+			}
+			action = fmt.Sprintf("trimmed free block to %s: %s", strings.Join(remaining, ", "), reason)
+		}
+		repairs = append(repairs, StateRepair{
+			SliceName: sliceName,
+			CIDR:      block.String(),
+			Action:    action,
+		})
+		for _, piece := range pieces {
+			free = append(free, piece)
+			kept = append(kept, ownedBlock{block: piece, owner: "free"})
+		}
+	}
+	pool.FreeBlocks = free
+	pool.coalesceFreeBlocks()
+
+	return repairs
+}
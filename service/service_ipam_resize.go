@@ -0,0 +1,50 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// ResizePool grows a slice's subnet to newSliceSubnet, which must strictly contain the
+// current slice subnet. The added address space is returned to the free list, merging
+// with free blocks at the old boundary; existing allocations are left where they are.
+// Shrinking is not supported.
+func (a *DynamicIPAMAllocator) ResizePool(ctx context.Context, sliceName string, newSliceSubnet string) error {
+	newNet, err := parseNetworkCIDR(newSliceSubnet)
+	if err != nil {
+		return fmt.Errorf("cannot resize slice %s: %w", sliceName, err)
+	}
+
+	pool, err := a.lockPoolContext(ctx, "resize", sliceName)
+	if err != nil {
+		return err
+	}
+	defer pool.mu.Unlock()
+
+	oldNet := pool.SliceSubnet
+	oldOnes, oldBits := oldNet.Mask.Size()
+	newOnes, newBits := newNet.Mask.Size()
+	if newBits != oldBits || newOnes >= oldOnes || !newNet.Contains(oldNet.IP) {
+		return fmt.Errorf("cannot resize slice %s to %s: it does not strictly contain the current subnet %s",
+			sliceName, newNet.String(), oldNet.String())
+	}
+	// Every allocation lies within the old subnet, but check rather than assume so that a
+	// pool loaded from hand-edited state cannot end up with blocks outside its subnet.
+	for clusterName, allocated := range pool.Allocated {
+		if !newNet.Contains(allocated.IP) {
+			return fmt.Errorf("cannot resize slice %s to %s: subnet %s allocated to %s lies outside it",
+				sliceName, newNet.String(), allocated.String(), clusterName)
+		}
+	}
+
+	added := carveOut([]*net.IPNet{newNet}, []*net.IPNet{oldNet})
+	pool.SliceSubnet = newNet
+	for _, block := range added {
+		pool.insertFreeBlock(block)
+	}
+	a.log.V(1).Info("resized ipam pool", "slice", sliceName, "from", oldNet, "to", newNet, "added", added)
+	a.recordPoolMetrics(sliceName, pool)
+
+	return a.verifyAfter("resize", sliceName, pool)
+}
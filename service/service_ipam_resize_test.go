@@ -0,0 +1,90 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dailymotion/allure-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPAMResizeSuite(t *testing.T) {
+	for k, v := range IPAMResizeTestBed {
+		t.Run(k, func(t *testing.T) {
+			allure.Test(t, allure.Name(k),
+				allure.Action(func() {
+					v(t)
+				}))
+		})
+	}
+}
+
+var IPAMResizeTestBed = map[string]func(*testing.T){
+	"TestDynamicIPAMAllocator_ResizePool":         TestDynamicIPAMAllocator_ResizePool,
+	"TestDynamicIPAMAllocator_ResizePoolRejected": TestDynamicIPAMAllocator_ResizePoolRejected,
+}
+
+func TestDynamicIPAMAllocator_ResizePool(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "resize-slice"
+	allocator := NewDynamicIPAMAllocator(WithVPNSubnetSize(0), WithVerification())
+	require.NoError(t, allocator.InitializePool(sliceName, "10.251.0.0/24"))
+	for _, clusterName := range []string{"cluster-a", "cluster-b"} {
+		_, err := allocator.Allocate(ctx, sliceName, clusterName, 25)
+		require.NoError(t, err)
+	}
+	_, err := allocator.Allocate(ctx, sliceName, "cluster-c", 25)
+	require.ErrorIs(t, err, ErrPoolExhausted)
+
+	require.NoError(t, allocator.ResizePool(ctx, sliceName, "10.251.0.0/23"))
+	assert.Equal(t, "10.251.0.0/23", allocator.pools[sliceName].SliceSubnet.String())
+	free, err := allocator.GetFreeBlocks(ctx, sliceName)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.251.1.0/24"}, free)
+
+	for _, clusterName := range []string{"cluster-c", "cluster-d"} {
+		_, err := allocator.Allocate(ctx, sliceName, clusterName, 25)
+		require.NoError(t, err)
+	}
+	allocations, err := allocator.ListAllocations(ctx, sliceName)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"cluster-a": "10.251.0.0/25",
+		"cluster-b": "10.251.0.128/25",
+		"cluster-c": "10.251.1.0/25",
+		"cluster-d": "10.251.1.128/25",
+	}, allocations)
+
+	t.Run("Added space merges with free blocks", func(t *testing.T) {
+		allocator := NewDynamicIPAMAllocator(WithVPNSubnetSize(0))
+		require.NoError(t, allocator.InitializePool(sliceName, "10.251.4.0/24"))
+		require.NoError(t, allocator.ResizePool(ctx, sliceName, "10.251.0.0/21"))
+		free, err := allocator.GetFreeBlocks(ctx, sliceName)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"10.251.0.0/21"}, free)
+	})
+}
+
+func TestDynamicIPAMAllocator_ResizePoolRejected(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "resize-rejected-slice"
+	allocator := NewDynamicIPAMAllocator()
+	require.NoError(t, allocator.InitializePool(sliceName, "10.252.0.0/23"))
+	_, err := allocator.Allocate(ctx, sliceName, "cluster-a", 25)
+	require.NoError(t, err)
+	before := allocator.pools[sliceName].snapshot()
+
+	for name, newSubnet := range map[string]string{
+		"Shrink":         "10.252.0.0/24",
+		"Same size":      "10.252.0.0/23",
+		"Disjoint":       "10.253.0.0/22",
+		"Other family":   "fd00:10::/48",
+		"Host bits set":  "10.252.0.1/22",
+		"Does not parse": "10.252.0.0/33",
+	} {
+		assert.Error(t, allocator.ResizePool(ctx, sliceName, newSubnet), name)
+	}
+	assert.ErrorIs(t, allocator.ResizePool(ctx, "missing-slice", "10.252.0.0/22"), ErrPoolNotInitialized)
+	assert.Equal(t, before, allocator.pools[sliceName].snapshot())
+}
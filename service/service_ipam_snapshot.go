@@ -0,0 +1,370 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// ipamSnapshot is the serialized form written by SnapshotAll. Checksum is the hex encoded
+// SHA-256 of the exact Pools bytes, so a truncated or altered blob is detected before any
+// state is restored.
+type ipamSnapshot struct {
+	Checksum string          `json:"checksum"`
+	Pools    json.RawMessage `json:"pools"`
+}
+
+// poolSnapshot is the serialized state of a single slice's pool.
+type poolSnapshot struct {
+	SliceSubnet        string                       `json:"sliceSubnet"`
+	Allocated          map[string]string            `json:"allocated"`
+	FreeBlocks         []string                     `json:"freeBlocks"`
+	Preserved          []string                     `json:"preserved,omitempty"`
+	Labels             map[string]map[string]string `json:"labels,omitempty"`
+	IdempotencyKeys    map[string]string            `json:"idempotencyKeys,omitempty"`
+	Expiry             map[string]time.Time         `json:"expiry,omitempty"`
+	Excluded           []string                     `json:"excluded,omitempty"`
+	Quarantined        []quarantineSnapshot         `json:"quarantined,omitempty"`
+	QuarantineDuration time.Duration                `json:"quarantineDuration,omitempty"`
+}
+
+type quarantineSnapshot struct {
+	Block     string    `json:"block"`
+	ReleaseAt time.Time `json:"releaseAt"`
+}
+
+// SnapshotAll serializes the state of every pool together with a checksum over the
+// serialized content.
+func (a *DynamicIPAMAllocator) SnapshotAll() ([]byte, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	pools := make(map[string]poolSnapshot, len(a.pools))
+	for sliceName, pool := range a.pools {
+		pool.mu.RLock()
+		pools[sliceName] = pool.snapshot()
+		pool.mu.RUnlock()
+	}
+
+	content, err := json.Marshal(pools)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize ipam pools: %w", err)
+	}
+	return json.Marshal(ipamSnapshot{Checksum: checksum(content), Pools: content})
+}
+
+// RestoreAll replaces every pool with the state in a SnapshotAll blob. The checksum is
+// verified and every pool is decoded and validated before anything is replaced, so
+// corrupted data leaves the allocator unchanged.
+func (a *DynamicIPAMAllocator) RestoreAll(data []byte) error {
+	var envelope ipamSnapshot
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return fmt.Errorf("failed to decode ipam snapshot: %w", err)
+	}
+	if sum := checksum(envelope.Pools); sum != envelope.Checksum {
+		return fmt.Errorf("ipam snapshot failed integrity check: checksum %s does not match content checksum %s", envelope.Checksum, sum)
+	}
+
+	var snapshots map[string]poolSnapshot
+	if err := json.Unmarshal(envelope.Pools, &snapshots); err != nil {
+		return fmt.Errorf("failed to decode ipam pools: %w", err)
+	}
+
+	_, err := a.replacePools(snapshots, false)
+	return err
+}
+
+// MarshalState serializes every pool as JSON for backup or migration. Unlike SnapshotAll
+// the output carries no checksum, so it can be inspected and edited by hand; LoadState
+// validates it instead.
+func (a *DynamicIPAMAllocator) MarshalState() ([]byte, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	pools := make(map[string]poolSnapshot, len(a.pools))
+	for sliceName, pool := range a.pools {
+		pool.mu.RLock()
+		pools[sliceName] = pool.snapshot()
+		pool.mu.RUnlock()
+	}
+
+	data, err := json.Marshal(pools)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize ipam pools: %w", err)
+	}
+	return data, nil
+}
+
+// LoadState replaces every pool with the state in a MarshalState blob. Each pool's
+// allocated and free blocks must be disjoint and lie within its slice subnet; if any pool
+// fails to decode or validate the allocator is left unchanged.
+func (a *DynamicIPAMAllocator) LoadState(data []byte) error {
+	var snapshots map[string]poolSnapshot
+	if err := json.Unmarshal(data, &snapshots); err != nil {
+		return fmt.Errorf("failed to decode ipam pools: %w", err)
+	}
+
+	_, err := a.replacePools(snapshots, false)
+	return err
+}
+
+// RepairState loads a MarshalState blob like LoadState, but repairs pools whose blocks
+// conflict instead of rejecting them, for recovery from corrupted stored state. Every
+// repair is logged and returned, ordered by slice name. A blob that does not decode still
+// leaves the allocator unchanged.
+func (a *DynamicIPAMAllocator) RepairState(data []byte) ([]StateRepair, error) {
+	var snapshots map[string]poolSnapshot
+	if err := json.Unmarshal(data, &snapshots); err != nil {
+		return nil, fmt.Errorf("failed to decode ipam pools: %w", err)
+	}
+
+	return a.replacePools(snapshots, true)
+}
+
+// replacePools builds and validates a pool from every snapshot and, only if all succeed,
+// swaps them in for the current pools. With repair set, conflicting blocks are repaired
+// with repairPool before validation and the repairs are returned.
+func (a *DynamicIPAMAllocator) replacePools(snapshots map[string]poolSnapshot, repair bool) ([]StateRepair, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	sliceNames := make([]string, 0, len(snapshots))
+	for sliceName := range snapshots {
+		sliceNames = append(sliceNames, sliceName)
+	}
+	sort.Strings(sliceNames)
+
+	var repairs []StateRepair
+	pools := make(map[string]*sliceIPPool, len(snapshots))
+	for _, sliceName := range sliceNames {
+		pool, err := a.poolFromSnapshot(sliceName, snapshots[sliceName])
+		if err != nil {
+			return nil, fmt.Errorf("failed to restore ipam pool for slice %s: %w", sliceName, err)
+		}
+		if repair {
+			for _, r := range repairPool(sliceName, pool) {
+				a.log.Info("repaired ipam state", "slice", sliceName, "cluster", r.ClusterName, "cidr", r.CIDR, "repair", r.Action)
+				repairs = append(repairs, r)
+			}
+		}
+		if err := validateNoOverlap(pool); err != nil {
+			return nil, fmt.Errorf("failed to restore ipam pool for slice %s: %w", sliceName, err)
+		}
+		pools[sliceName] = pool
+	}
+
+	for _, old := range a.pools {
+		old.mu.Lock()
+		old.deleted = true
+		old.mu.Unlock()
+	}
+	a.pools = pools
+	for sliceName, pool := range pools {
+		a.recordPoolMetrics(sliceName, pool)
+	}
+	return repairs, nil
+}
+
+// Clone returns an independent deep copy of the allocator and every pool, for what-if
+// simulations. The clone has the same configuration but reports to no metrics recorder,
+// audit sink or utilization callback, so that hypothetical allocations do not show up in
+// the live allocator's telemetry.
+func (a *DynamicIPAMAllocator) Clone() *DynamicIPAMAllocator {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	out := &DynamicIPAMAllocator{
+		pools:                make(map[string]*sliceIPPool, len(a.pools)),
+		freeBlockLess:        a.freeBlockLess,
+		customOrder:          a.customOrder,
+		metrics:              noopIPAMMetrics{},
+		log:                  a.log,
+		splitLogLevel:        a.splitLogLevel,
+		clock:                a.clock,
+		reserveVPN:           a.reserveVPN,
+		vpnPrefix:            a.vpnPrefix,
+		strategy:             a.strategy,
+		verify:               a.verify,
+		maxBlockPrefix:       a.maxBlockPrefix,
+		clusterBlockLimit:    a.clusterBlockLimit,
+		autoCompactThreshold: a.autoCompactThreshold,
+	}
+	for sliceName, pool := range a.pools {
+		pool.mu.RLock()
+		out.pools[sliceName] = pool.clone()
+		pool.mu.RUnlock()
+	}
+	return out
+}
+
+func checksum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// snapshot returns the serializable state of the pool. The caller must hold the pool's
+// mutex.
+func (pool *sliceIPPool) snapshot() poolSnapshot {
+	out := poolSnapshot{
+		SliceSubnet:        pool.SliceSubnet.String(),
+		Allocated:          make(map[string]string, len(pool.Allocated)),
+		FreeBlocks:         make([]string, 0, len(pool.FreeBlocks)),
+		QuarantineDuration: pool.options.QuarantineDuration,
+	}
+	// Every map is copied: the snapshot is marshaled after the pool's lock is released.
+	if len(pool.Labels) > 0 {
+		out.Labels = make(map[string]map[string]string, len(pool.Labels))
+		for clusterName, labels := range pool.Labels {
+			copied := make(map[string]string, len(labels))
+			for k, v := range labels {
+				copied[k] = v
+			}
+			out.Labels[clusterName] = copied
+		}
+	}
+	if len(pool.IdempotencyKeys) > 0 {
+		out.IdempotencyKeys = make(map[string]string, len(pool.IdempotencyKeys))
+		for clusterName, key := range pool.IdempotencyKeys {
+			out.IdempotencyKeys[clusterName] = key
+		}
+	}
+	if len(pool.Expiry) > 0 {
+		out.Expiry = make(map[string]time.Time, len(pool.Expiry))
+		for clusterName, expiry := range pool.Expiry {
+			out.Expiry[clusterName] = expiry
+		}
+	}
+	for clusterName, ipNet := range pool.Allocated {
+		out.Allocated[clusterName] = ipNet.String()
+	}
+	for _, ipNet := range pool.FreeBlocks {
+		out.FreeBlocks = append(out.FreeBlocks, ipNet.String())
+	}
+	for clusterName, preserved := range pool.Preserved {
+		if preserved {
+			out.Preserved = append(out.Preserved, clusterName)
+		}
+	}
+	sort.Strings(out.Preserved)
+	for _, ipNet := range pool.Excluded {
+		out.Excluded = append(out.Excluded, ipNet.String())
+	}
+	for _, q := range pool.Quarantined {
+		out.Quarantined = append(out.Quarantined, quarantineSnapshot{Block: q.Block.String(), ReleaseAt: q.ReleaseAt})
+	}
+	return out
+}
+
+// poolFromSnapshot rebuilds a pool from its serialized state, wiring it to the
+// allocator's ordering, logger and clock as InitializePool would.
+func (a *DynamicIPAMAllocator) poolFromSnapshot(sliceName string, snapshot poolSnapshot) (*sliceIPPool, error) {
+	_, sliceNet, err := net.ParseCIDR(snapshot.SliceSubnet)
+	if err != nil {
+		return nil, fmt.Errorf("%w %q for slice subnet", ErrInvalidCIDR, snapshot.SliceSubnet)
+	}
+	pool := &sliceIPPool{
+		SliceSubnet:       sliceNet,
+		Allocated:         make(map[string]*net.IPNet, len(snapshot.Allocated)),
+		FreeBlocks:        make([]*net.IPNet, 0, len(snapshot.FreeBlocks)),
+		Preserved:         make(map[string]bool, len(snapshot.Preserved)),
+		Labels:            make(map[string]map[string]string, len(snapshot.Labels)),
+		IdempotencyKeys:   make(map[string]string, len(snapshot.IdempotencyKeys)),
+		Expiry:            make(map[string]time.Time, len(snapshot.Expiry)),
+		less:              a.freeBlockLess,
+		trace:             a.log.WithValues("slice", sliceName).V(a.splitLogLevel),
+		options:           PoolOptions{QuarantineDuration: snapshot.QuarantineDuration},
+		clock:             a.clock,
+		strategy:          a.strategy,
+		clusterBlockLimit: a.clusterBlockLimit,
+	}
+	allocated, err := migrateVPNClusterKey(snapshot.Allocated)
+	if err != nil {
+		return nil, err
+	}
+	for clusterName, cidr := range allocated {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q for cluster %s", ErrInvalidCIDR, cidr, clusterName)
+		}
+		pool.Allocated[clusterName] = ipNet
+	}
+	for _, cidr := range snapshot.FreeBlocks {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q for free block", ErrInvalidCIDR, cidr)
+		}
+		pool.FreeBlocks = append(pool.FreeBlocks, ipNet)
+	}
+	pool.sortFreeBlocks()
+	for _, clusterName := range snapshot.Preserved {
+		pool.Preserved[clusterName] = true
+	}
+	for clusterName, labels := range snapshot.Labels {
+		copied := make(map[string]string, len(labels))
+		for k, v := range labels {
+			copied[k] = v
+		}
+		pool.Labels[clusterName] = copied
+	}
+	for clusterName, key := range snapshot.IdempotencyKeys {
+		pool.IdempotencyKeys[clusterName] = key
+	}
+	for clusterName, expiry := range snapshot.Expiry {
+		pool.Expiry[clusterName] = expiry
+	}
+	for _, cidr := range snapshot.Excluded {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q for exclusion", ErrInvalidCIDR, cidr)
+		}
+		pool.Excluded = append(pool.Excluded, ipNet)
+	}
+	for _, q := range snapshot.Quarantined {
+		_, ipNet, err := net.ParseCIDR(q.Block)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q for quarantined block", ErrInvalidCIDR, q.Block)
+		}
+		pool.Quarantined = append(pool.Quarantined, quarantinedBlock{Block: ipNet, ReleaseAt: q.ReleaseAt})
+	}
+	return pool, nil
+}
+
+// migrateVPNClusterKey returns the allocations with a VPN reservation stored under a
+// legacy key moved to ReservedVPNClusterKey. The input map is not modified. Two
+// different reservations under the legacy and current keys are an error.
+func migrateVPNClusterKey(allocated map[string]string) (map[string]string, error) {
+	if !hasLegacyVPNClusterKey(allocated) {
+		return allocated, nil
+	}
+	migrated := make(map[string]string, len(allocated))
+	for clusterName, cidr := range allocated {
+		migrated[clusterName] = cidr
+	}
+	for _, legacy := range legacyVPNClusterKeys {
+		cidr, found := migrated[legacy]
+		if !found {
+			continue
+		}
+		if current, exists := migrated[ReservedVPNClusterKey]; exists && current != cidr {
+			return nil, fmt.Errorf("VPN subnet is reserved as both %s under %s and %s under %s",
+				current, ReservedVPNClusterKey, cidr, legacy)
+		}
+		migrated[ReservedVPNClusterKey] = cidr
+		delete(migrated, legacy)
+	}
+	return migrated, nil
+}
+
+// hasLegacyVPNClusterKey reports whether the allocations hold a legacy VPN key.
+func hasLegacyVPNClusterKey(allocated map[string]string) bool {
+	for _, legacy := range legacyVPNClusterKeys {
+		if _, found := allocated[legacy]; found {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,315 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+
+	"github.com/dailymotion/allure-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPAMSnapshotSuite(t *testing.T) {
+	for k, v := range IPAMSnapshotTestBed {
+		t.Run(k, func(t *testing.T) {
+			allure.Test(t, allure.Name(k),
+				allure.Action(func() {
+					v(t)
+				}))
+		})
+	}
+}
+
+var IPAMSnapshotTestBed = map[string]func(*testing.T){
+	"TestDynamicIPAMAllocator_SnapshotAllRoundTrip":    TestDynamicIPAMAllocator_SnapshotAllRoundTrip,
+	"TestDynamicIPAMAllocator_RestoreAllCorruptedData": TestDynamicIPAMAllocator_RestoreAllCorruptedData,
+	"TestDynamicIPAMAllocator_MarshalStateRoundTrip":   TestDynamicIPAMAllocator_MarshalStateRoundTrip,
+	"TestDynamicIPAMAllocator_LoadStateInvalid":        TestDynamicIPAMAllocator_LoadStateInvalid,
+	"TestDynamicIPAMAllocator_RepairState":             TestDynamicIPAMAllocator_RepairState,
+	"TestDynamicIPAMAllocator_LoadStateLegacyVPNKey":   TestDynamicIPAMAllocator_LoadStateLegacyVPNKey,
+	"TestDynamicIPAMAllocator_Clone":                   TestDynamicIPAMAllocator_Clone,
+}
+
+func newSnapshotTestAllocator(t *testing.T) *DynamicIPAMAllocator {
+	allocator := NewDynamicIPAMAllocator()
+	ctx := context.Background()
+	require.NoError(t, allocator.InitializePool("slice-a", "10.180.0.0/16"))
+	require.NoError(t, allocator.InitializePool("slice-b", "10.181.0.0/16"))
+	_, err := allocator.Allocate(ctx, "slice-a", "cluster-1", 24)
+	require.NoError(t, err)
+	_, err = allocator.Allocate(ctx, "slice-b", "cluster-2", 20)
+	require.NoError(t, err)
+	require.NoError(t, allocator.SetAllocationLabels(ctx, "slice-a", "cluster-1", map[string]string{"env": "dev"}))
+	return allocator
+}
+
+func TestDynamicIPAMAllocator_SnapshotAllRoundTrip(t *testing.T) {
+	allocator := newSnapshotTestAllocator(t)
+	data, err := allocator.SnapshotAll()
+	require.NoError(t, err)
+
+	restored := NewDynamicIPAMAllocator()
+	require.NoError(t, restored.RestoreAll(data))
+
+	require.Len(t, restored.pools, 2)
+	for sliceName, pool := range allocator.pools {
+		got := restored.pools[sliceName]
+		require.NotNil(t, got, sliceName)
+		assert.Equal(t, pool.snapshot(), got.snapshot(), sliceName)
+	}
+
+	// The restored allocator continues where the original left off.
+	ctx := context.Background()
+	want, err := allocator.Allocate(ctx, "slice-a", "cluster-3", 24)
+	require.NoError(t, err)
+	got, err := restored.Allocate(ctx, "slice-a", "cluster-3", 24)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+}
+
+func TestDynamicIPAMAllocator_RestoreAllCorruptedData(t *testing.T) {
+	allocator := newSnapshotTestAllocator(t)
+	data, err := allocator.SnapshotAll()
+	require.NoError(t, err)
+
+	idx := bytes.Index(data, []byte("10.180.1.0/24"))
+	require.NotEqual(t, -1, idx, "snapshot should contain cluster-1's subnet")
+	corrupted := append([]byte(nil), data...)
+	corrupted[idx+7] = '7' // 10.180.1.0/24 -> 10.180.7.0/24
+
+	restored := newSnapshotTestAllocator(t)
+	before, err := restored.SnapshotAll()
+	require.NoError(t, err)
+
+	err = restored.RestoreAll(corrupted)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "integrity check")
+
+	after, err := restored.SnapshotAll()
+	require.NoError(t, err)
+	assert.Equal(t, before, after, "a failed restore must leave the allocator unchanged")
+}
+
+func TestDynamicIPAMAllocator_MarshalStateRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	allocator := newSnapshotTestAllocator(t)
+	data, err := allocator.MarshalState()
+	require.NoError(t, err)
+
+	loaded := NewDynamicIPAMAllocator()
+	require.NoError(t, loaded.LoadState(data))
+
+	for _, sliceName := range []string{"slice-a", "slice-b"} {
+		want, err := allocator.ListAllocations(ctx, sliceName)
+		require.NoError(t, err)
+		got, err := loaded.ListAllocations(ctx, sliceName)
+		require.NoError(t, err)
+		assert.Equal(t, want, got, sliceName)
+
+		wantFree, err := allocator.GetFreeBlocks(ctx, sliceName)
+		require.NoError(t, err)
+		gotFree, err := loaded.GetFreeBlocks(ctx, sliceName)
+		require.NoError(t, err)
+		assert.Equal(t, wantFree, gotFree, sliceName)
+	}
+}
+
+func TestDynamicIPAMAllocator_LoadStateInvalid(t *testing.T) {
+	for name, state := range map[string]string{
+		"Not JSON":     `{"slice-a":`,
+		"Invalid CIDR": `{"slice-a":{"sliceSubnet":"10.182.0.0/16","allocated":{"cluster-1":"10.182.0.0/33"},"freeBlocks":[]}}`,
+		"Allocation overlaps a free block": `{"slice-a":{"sliceSubnet":"10.182.0.0/16",` +
+			`"allocated":{"cluster-1":"10.182.0.0/24"},"freeBlocks":["10.182.0.0/17","10.182.128.0/17"]}}`,
+		"Allocation outside the slice subnet": `{"slice-a":{"sliceSubnet":"10.182.0.0/16",` +
+			`"allocated":{"cluster-1":"10.183.0.0/24"},"freeBlocks":["10.182.0.0/16"]}}`,
+		"Exclusion overlaps a free block": `{"slice-a":{"sliceSubnet":"10.182.0.0/24",` +
+			`"freeBlocks":["10.182.0.0/24"],"excluded":["10.182.0.0/26"]}}`,
+		"Exclusion overlaps an allocation": `{"slice-a":{"sliceSubnet":"10.182.0.0/24",` +
+			`"allocated":{"cluster-1":"10.182.0.0/25"},"freeBlocks":["10.182.0.128/25"],"excluded":["10.182.0.0/26"]}}`,
+		"Exclusions overlap each other": `{"slice-a":{"sliceSubnet":"10.182.0.0/24",` +
+			`"freeBlocks":["10.182.0.128/25"],"excluded":["10.182.0.0/25","10.182.0.0/26"]}}`,
+		"Exclusion outside the slice subnet": `{"slice-a":{"sliceSubnet":"10.182.0.0/24",` +
+			`"freeBlocks":["10.182.0.0/24"],"excluded":["10.183.0.0/26"]}}`,
+		"Quarantined block overlaps a free block": `{"slice-a":{"sliceSubnet":"10.182.0.0/24",` +
+			`"freeBlocks":["10.182.0.0/24"],"quarantined":[{"block":"10.182.0.0/26","releaseAt":"2030-01-01T00:00:00Z"}]}}`,
+		"Quarantined block overlaps an allocation": `{"slice-a":{"sliceSubnet":"10.182.0.0/24",` +
+			`"allocated":{"cluster-1":"10.182.0.0/25"},"freeBlocks":["10.182.0.128/25"],` +
+			`"quarantined":[{"block":"10.182.0.0/26","releaseAt":"2030-01-01T00:00:00Z"}]}}`,
+		"Quarantined block overlaps an exclusion": `{"slice-a":{"sliceSubnet":"10.182.0.0/24",` +
+			`"freeBlocks":["10.182.0.128/25"],"excluded":["10.182.0.0/25"],` +
+			`"quarantined":[{"block":"10.182.0.0/26","releaseAt":"2030-01-01T00:00:00Z"}]}}`,
+		"Quarantined block outside the slice subnet": `{"slice-a":{"sliceSubnet":"10.182.0.0/24",` +
+			`"freeBlocks":["10.182.0.0/24"],"quarantined":[{"block":"10.183.0.0/26","releaseAt":"2030-01-01T00:00:00Z"}]}}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			allocator := newSnapshotTestAllocator(t)
+			before, err := allocator.MarshalState()
+			require.NoError(t, err)
+
+			require.Error(t, allocator.LoadState([]byte(state)))
+
+			after, err := allocator.MarshalState()
+			require.NoError(t, err)
+			assert.JSONEq(t, string(before), string(after), "a rejected state must leave the allocator unchanged")
+		})
+	}
+}
+
+func TestDynamicIPAMAllocator_LoadStateLegacyVPNKey(t *testing.T) {
+	ctx := context.Background()
+	state := `{"slice-a": {"sliceSubnet": "10.185.0.0/22",
+		"allocated": {"KubeSlice-VPN-Reserved-Subnet": "10.185.0.0/24", "cluster-1": "10.185.1.0/24"},
+		"freeBlocks": ["10.185.2.0/23"]}}`
+	allocator := NewDynamicIPAMAllocator()
+	require.NoError(t, allocator.LoadState([]byte(state)))
+
+	allocations, err := allocator.ListAllocations(ctx, "slice-a")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{ReservedVPNClusterKey: "10.185.0.0/24", "cluster-1": "10.185.1.0/24"}, allocations)
+	vpn, err := allocator.GetVPNSubnet(ctx, "slice-a")
+	require.NoError(t, err)
+	assert.Equal(t, "10.185.0.0/24", vpn)
+	data, err := allocator.MarshalState()
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "KubeSlice-VPN-Reserved-Subnet", "the legacy key is not written back")
+
+	_, err = allocator.Allocate(ctx, "slice-a", "KubeSlice-VPN-Reserved-Subnet", 24)
+	assert.ErrorIs(t, err, ErrReservedClusterName)
+
+	t.Run("Both keys", func(t *testing.T) {
+		allocator := NewDynamicIPAMAllocator()
+		same := `{"slice-a": {"sliceSubnet": "10.185.0.0/22",
+			"allocated": {"KubeSlice-VPN-Reserved-Subnet": "10.185.0.0/24", "VPN_Subnet": "10.185.0.0/24"},
+			"freeBlocks": ["10.185.1.0/24", "10.185.2.0/23"]}}`
+		require.NoError(t, allocator.LoadState([]byte(same)), "the same reservation under both keys is merged")
+		allocations, err := allocator.ListAllocations(ctx, "slice-a")
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{ReservedVPNClusterKey: "10.185.0.0/24"}, allocations)
+
+		conflicting := `{"slice-a": {"sliceSubnet": "10.185.0.0/22",
+			"allocated": {"KubeSlice-VPN-Reserved-Subnet": "10.185.1.0/24", "VPN_Subnet": "10.185.0.0/24"},
+			"freeBlocks": ["10.185.2.0/23"]}}`
+		err = allocator.LoadState([]byte(conflicting))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "10.185.1.0/24 under KubeSlice-VPN-Reserved-Subnet")
+	})
+}
+
+func TestDynamicIPAMAllocator_RepairState(t *testing.T) {
+	ctx := context.Background()
+	state := `{
+		"slice-b": {"sliceSubnet": "10.182.0.0/22",
+			"allocated": {"VPN_Subnet": "10.182.0.0/24", "cluster-1": "10.182.1.0/24", "cluster-2": "10.182.1.128/25", "cluster-3": "10.182.0.0/25"},
+			"freeBlocks": ["10.182.1.0/25", "10.182.2.0/23", "10.182.2.0/24"]},
+		"slice-a": {"sliceSubnet": "10.183.0.0/16",
+			"allocated": {"cluster-1": "10.184.0.0/24"},
+			"freeBlocks": ["10.182.0.0/15"]}
+	}`
+	allocator := newSnapshotTestAllocator(t)
+	before, err := allocator.MarshalState()
+	require.NoError(t, err)
+	require.Error(t, allocator.LoadState([]byte(state)), "LoadState rejects conflicting blocks")
+	after, err := allocator.MarshalState()
+	require.NoError(t, err)
+	require.JSONEq(t, string(before), string(after))
+
+	repairs, err := allocator.RepairState([]byte(state))
+	require.NoError(t, err)
+	assert.Equal(t, []StateRepair{
+		{SliceName: "slice-a", ClusterName: "cluster-1", CIDR: "10.184.0.0/24", Action: "dropped allocation: outside slice subnet 10.183.0.0/16"},
+		{SliceName: "slice-a", CIDR: "10.182.0.0/15", Action: "trimmed free block to 10.183.0.0/16: outside slice subnet 10.183.0.0/16"},
+		{SliceName: "slice-b", ClusterName: "cluster-3", CIDR: "10.182.0.0/25", Action: "dropped allocation: overlaps 10.182.0.0/24 (allocated to VPN_Subnet)"},
+		{SliceName: "slice-b", ClusterName: "cluster-2", CIDR: "10.182.1.128/25", Action: "dropped allocation: overlaps 10.182.1.0/24 (allocated to cluster-1)"},
+		{SliceName: "slice-b", CIDR: "10.182.1.0/25", Action: "dropped free block: overlaps 10.182.1.0/24 (allocated to cluster-1)"},
+		{SliceName: "slice-b", CIDR: "10.182.2.0/23", Action: "trimmed free block to 10.182.3.0/24: overlaps 10.182.2.0/24 (free)"},
+	}, repairs)
+
+	for _, sliceName := range []string{"slice-a", "slice-b"} {
+		require.NoError(t, allocator.Verify(ctx, sliceName))
+	}
+	allocations, err := allocator.ListAllocations(ctx, "slice-b")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"VPN_Subnet": "10.182.0.0/24", "cluster-1": "10.182.1.0/24"}, allocations)
+	free, err := allocator.GetFreeBlocks(ctx, "slice-b")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.182.2.0/23"}, free)
+	free, err = allocator.GetFreeBlocks(ctx, "slice-a")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.183.0.0/16"}, free, "a free block covering the slice is trimmed to the slice subnet")
+
+	_, err = allocator.RepairState([]byte(`{"slice-a":`))
+	assert.Error(t, err)
+
+	t.Run("Exclusions and quarantined blocks", func(t *testing.T) {
+		state := `{"slice-c": {"sliceSubnet": "10.186.0.0/24",
+			"allocated": {"cluster-1": "10.186.0.0/26"},
+			"freeBlocks": ["10.186.0.0/24"],
+			"excluded": ["10.186.0.0/27", "10.186.0.64/26"],
+			"quarantined": [{"block": "10.186.0.64/27", "releaseAt": "2030-01-01T00:00:00Z"},
+				{"block": "10.186.0.128/26", "releaseAt": "2030-01-01T00:00:00Z"}]}}`
+		allocator := NewDynamicIPAMAllocator()
+		repairs, err := allocator.RepairState([]byte(state))
+		require.NoError(t, err)
+		assert.Equal(t, []StateRepair{
+			{SliceName: "slice-c", CIDR: "10.186.0.0/27", Action: "dropped exclusion: overlaps 10.186.0.0/26 (allocated to cluster-1)"},
+			{SliceName: "slice-c", CIDR: "10.186.0.64/27", Action: "dropped quarantined block: overlaps 10.186.0.64/26 (excluded)"},
+			{SliceName: "slice-c", CIDR: "10.186.0.0/24", Action: "trimmed free block to 10.186.0.192/26: overlaps 10.186.0.0/26 (allocated to cluster-1)"},
+		}, repairs)
+		require.NoError(t, allocator.Verify(ctx, "slice-c"))
+	})
+}
+
+func TestDynamicIPAMAllocator_Clone(t *testing.T) {
+	ctx := context.Background()
+	allocator := newSnapshotTestAllocator(t)
+	require.NoError(t, allocator.ImportExclusions("slice-a", []string{"10.180.255.0/24"}))
+	before := map[string]poolSnapshot{}
+	for sliceName, pool := range allocator.pools {
+		before[sliceName] = pool.snapshot()
+	}
+
+	clone := allocator.Clone()
+	for sliceName, pool := range clone.pools {
+		assert.Equal(t, before[sliceName], pool.snapshot(), sliceName)
+	}
+
+	_, err := clone.Allocate(ctx, "slice-a", "cluster-3", 20)
+	require.NoError(t, err)
+	require.NoError(t, clone.Reclaim(ctx, "slice-a", "cluster-1"))
+	require.NoError(t, clone.SetAllocationLabels(ctx, "slice-b", "cluster-2", map[string]string{"env": "what-if"}))
+	require.NoError(t, clone.ExcludeRange(ctx, "slice-b", "10.181.255.0/24"))
+	require.NoError(t, clone.InitializePool("slice-c", "10.182.0.0/16"))
+	// Mutate a stored block in place, which would show through a shallow copy.
+	clone.pools["slice-b"].Allocated["cluster-2"].IP[2] = 0xff
+
+	require.Len(t, allocator.pools, 2, "pools added to the clone are not added to the original")
+	for sliceName, pool := range allocator.pools {
+		assert.Equal(t, before[sliceName], pool.snapshot(), "the original %s is unchanged", sliceName)
+	}
+	// Check the original's label maps directly as well.
+	assert.Empty(t, allocator.pools["slice-b"].Labels["cluster-2"])
+	assert.Equal(t, map[string]string{"env": "dev"}, allocator.pools["slice-a"].Labels["cluster-1"])
+
+	t.Run("Reclaim compacts like the original", func(t *testing.T) {
+		allocator := NewDynamicIPAMAllocator(WithAutoCompact(2), WithoutVPNReservation())
+		require.NoError(t, allocator.InitializePool("slice-a", "10.187.0.0/24"))
+		_, err := allocator.Allocate(ctx, "slice-a", "cluster-1", 26)
+		require.NoError(t, err)
+		// Unmerged buddies, as a free list built without merging.
+		allocator.pools["slice-a"].FreeBlocks = []*net.IPNet{
+			mustParseCIDR(t, "10.187.0.64/26"), mustParseCIDR(t, "10.187.0.128/26"), mustParseCIDR(t, "10.187.0.192/26"),
+		}
+
+		clone := allocator.Clone()
+		require.NoError(t, allocator.Reclaim(ctx, "slice-a", "cluster-1"))
+		require.NoError(t, clone.Reclaim(ctx, "slice-a", "cluster-1"))
+		want, err := allocator.GetFreeBlocks(ctx, "slice-a")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"10.187.0.0/24"}, want)
+		got, err := clone.GetFreeBlocks(ctx, "slice-a")
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	})
+}
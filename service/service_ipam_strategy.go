@@ -0,0 +1,129 @@
+package service
+
+import "fmt"
+
+// AllocationStrategy selects the free block an allocation is carved from.
+type AllocationStrategy int
+
+const (
+	// FirstFit carves from the first free block, in free block order, that can hold the
+	// request. It is the default.
+	FirstFit AllocationStrategy = iota
+	// BestFit carves from the smallest free block that can hold the request, keeping
+	// larger blocks intact for larger requests.
+	BestFit
+	// WorstFit carves from the largest free block, so that a run of small requests
+	// leaves medium-sized blocks intact instead of nibbling at whichever comes first.
+	WorstFit
+)
+
+func (s AllocationStrategy) String() string {
+	switch s {
+	case FirstFit:
+		return "first-fit"
+	case BestFit:
+		return "best-fit"
+	case WorstFit:
+		return "worst-fit"
+	default:
+		return fmt.Sprintf("AllocationStrategy(%d)", int(s))
+	}
+}
+
+// SetAllocationStrategy switches the placement strategy of the allocator and of every
+// pool it holds. Existing allocations are not moved.
+func (a *DynamicIPAMAllocator) SetAllocationStrategy(strategy AllocationStrategy) error {
+	if strategy != FirstFit && strategy != BestFit && strategy != WorstFit {
+		return fmt.Errorf("unknown allocation strategy %s", strategy)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.strategy = strategy
+	for _, pool := range a.pools {
+		pool.mu.Lock()
+		pool.strategy = strategy
+		pool.mu.Unlock()
+	}
+
+	return nil
+}
+
+// findFit returns the index of the free block the pool's strategy picks for a block of
+// the required prefix length, or -1 if there is none. Examined blocks are appended to
+// trace if it is not nil; otherwise the choice comes from the pool's prefix index, which
+// picks the same block as the scans below without visiting every free block.
+func (pool *sliceIPPool) findFit(requiredCIDRSize int, trace *AllocationTrace) int {
+	if trace == nil && !pool.scanFreeList {
+		return pool.findIndexedFit(requiredCIDRSize)
+	}
+	switch pool.strategy {
+	case BestFit:
+		return pool.scanBestFit(requiredCIDRSize, trace)
+	case WorstFit:
+		return pool.scanWorstFit(requiredCIDRSize, trace)
+	default:
+		return pool.scanFirstFit(requiredCIDRSize, trace)
+	}
+}
+
+// scanBestFit returns the index of the fitting free block with the longest prefix; ties
+// go to the block that comes first in free block order.
+func (pool *sliceIPPool) scanBestFit(requiredCIDRSize int, trace *AllocationTrace) int {
+	best, bestOnes := -1, -1
+	for i, freeNet := range pool.FreeBlocks {
+		ones, _ := freeNet.Mask.Size()
+		if ones <= requiredCIDRSize && ones > bestOnes {
+			best, bestOnes = i, ones
+		}
+	}
+
+	if trace != nil {
+		for i, freeNet := range pool.FreeBlocks {
+			ones, _ := freeNet.Mask.Size()
+			switch {
+			case ones > requiredCIDRSize:
+				trace.consider(freeNet, fmt.Sprintf("/%d is smaller than the requested /%d", ones, requiredCIDRSize))
+			case i == best:
+				trace.consider(freeNet, "")
+			case ones == bestOnes:
+				trace.consider(freeNet, fmt.Sprintf("an earlier /%d fits as tightly", ones))
+			default:
+				trace.consider(freeNet, fmt.Sprintf("/%d is larger than the best fit /%d", ones, bestOnes))
+			}
+		}
+	}
+
+	return best
+}
+
+// scanWorstFit returns the index of the free block with the shortest prefix, provided it
+// can hold the request; ties go to the block that comes first in free block order.
+func (pool *sliceIPPool) scanWorstFit(requiredCIDRSize int, trace *AllocationTrace) int {
+	worst, worstOnes := -1, requiredCIDRSize+1
+	for i, freeNet := range pool.FreeBlocks {
+		ones, _ := freeNet.Mask.Size()
+		if ones < worstOnes {
+			worst, worstOnes = i, ones
+		}
+	}
+
+	if trace != nil {
+		for i, freeNet := range pool.FreeBlocks {
+			ones, _ := freeNet.Mask.Size()
+			switch {
+			case ones > requiredCIDRSize:
+				trace.consider(freeNet, fmt.Sprintf("/%d is smaller than the requested /%d", ones, requiredCIDRSize))
+			case i == worst:
+				trace.consider(freeNet, "")
+			case ones == worstOnes:
+				trace.consider(freeNet, fmt.Sprintf("an earlier /%d is as large", ones))
+			default:
+				trace.consider(freeNet, fmt.Sprintf("/%d is smaller than the largest free /%d", ones, worstOnes))
+			}
+		}
+	}
+
+	return worst
+}
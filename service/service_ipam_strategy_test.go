@@ -0,0 +1,167 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/dailymotion/allure-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPAMStrategySuite(t *testing.T) {
+	for k, v := range IPAMStrategyTestBed {
+		t.Run(k, func(t *testing.T) {
+			allure.Test(t, allure.Name(k),
+				allure.Action(func() {
+					v(t)
+				}))
+		})
+	}
+}
+
+var IPAMStrategyTestBed = map[string]func(*testing.T){
+	"TestDynamicIPAMAllocator_BestFit":               TestDynamicIPAMAllocator_BestFit,
+	"TestDynamicIPAMAllocator_SetAllocationStrategy": TestDynamicIPAMAllocator_SetAllocationStrategy,
+	"TestDynamicIPAMAllocator_WorstFit":              TestDynamicIPAMAllocator_WorstFit,
+}
+
+// newHoleyAllocator returns an allocator whose free list starts with a free /21 at
+// 10.207.8.0 followed by a lone /24 at 10.207.17.0.
+func newHoleyAllocator(t *testing.T, sliceName string) *DynamicIPAMAllocator {
+	allocator := NewDynamicIPAMAllocator()
+	ctx := context.Background()
+	require.NoError(t, allocator.InitializePool(sliceName, "10.207.0.0/16"))
+	for _, request := range []struct {
+		cluster string
+		size    int
+	}{{"cluster-x", 21}, {"cluster-a", 24}, {"cluster-b", 23}, {"cluster-c", 22}, {"cluster-d", 24}} {
+		_, err := allocator.Allocate(ctx, sliceName, request.cluster, request.size)
+		require.NoError(t, err)
+	}
+	require.NoError(t, allocator.Reclaim(ctx, sliceName, "cluster-x"))
+
+	free, err := allocator.GetFreeBlocks(ctx, sliceName)
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.207.8.0/21", "10.207.17.0/24"}, free[:2])
+	return allocator
+}
+
+func TestDynamicIPAMAllocator_BestFit(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "holey-slice"
+
+	firstFit := newHoleyAllocator(t, sliceName)
+	cidr, err := firstFit.Allocate(ctx, sliceName, "cluster-e", 24)
+	require.NoError(t, err)
+	assert.Equal(t, "10.207.8.0/24", cidr, "first-fit splits the /21")
+	free, err := firstFit.GetFreeBlocks(ctx, sliceName)
+	require.NoError(t, err)
+	assert.NotContains(t, free, "10.207.8.0/21")
+
+	bestFit := newHoleyAllocator(t, sliceName)
+	require.NoError(t, bestFit.SetAllocationStrategy(BestFit))
+	cidr, err = bestFit.Allocate(ctx, sliceName, "cluster-e", 24)
+	require.NoError(t, err)
+	assert.Equal(t, "10.207.17.0/24", cidr, "best-fit fills the exact hole")
+	free, err = bestFit.GetFreeBlocks(ctx, sliceName)
+	require.NoError(t, err)
+	assert.Contains(t, free, "10.207.8.0/21", "the /21 stays intact")
+
+	cidr, err = bestFit.Allocate(ctx, sliceName, "cluster-f", 21)
+	require.NoError(t, err)
+	assert.Equal(t, "10.207.8.0/21", cidr)
+}
+
+func TestDynamicIPAMAllocator_SetAllocationStrategy(t *testing.T) {
+	allocator := NewDynamicIPAMAllocator()
+	assert.Equal(t, "first-fit", allocator.Capabilities().Strategy)
+
+	require.NoError(t, allocator.InitializePool("existing-slice", "10.208.0.0/16"))
+	require.NoError(t, allocator.SetAllocationStrategy(BestFit))
+	assert.Equal(t, "best-fit", allocator.Capabilities().Strategy)
+	assert.Equal(t, BestFit, allocator.pools["existing-slice"].strategy, "existing pools switch strategy")
+	require.NoError(t, allocator.InitializePool("new-slice", "10.209.0.0/16"))
+	assert.Equal(t, BestFit, allocator.pools["new-slice"].strategy)
+
+	require.Error(t, allocator.SetAllocationStrategy(AllocationStrategy(42)))
+	assert.Equal(t, "best-fit", allocator.Capabilities().Strategy)
+}
+
+func TestDynamicIPAMAllocator_WorstFit(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "worst-fit-slice"
+
+	// newAllocator leaves a medium /24 at 10.245.0.0 free ahead of a large /20.
+	newAllocator := func(t *testing.T, strategy AllocationStrategy) *DynamicIPAMAllocator {
+		allocator := NewDynamicIPAMAllocator(WithVPNSubnetSize(0))
+		require.NoError(t, allocator.SetAllocationStrategy(strategy))
+		require.NoError(t, allocator.InitializePool(sliceName, "10.245.0.0/19"))
+		for cluster, cidr := range map[string]string{
+			"infra-a": "10.245.1.0/24",
+			"infra-b": "10.245.2.0/23",
+			"infra-c": "10.245.4.0/22",
+			"infra-d": "10.245.8.0/21",
+		} {
+			require.NoError(t, allocator.AllocateSpecific(ctx, sliceName, cluster, cidr))
+		}
+		free, err := allocator.GetFreeBlocks(ctx, sliceName)
+		require.NoError(t, err)
+		require.Equal(t, []string{"10.245.0.0/24", "10.245.16.0/20"}, free)
+		return allocator
+	}
+
+	// allocateSmall makes n /26 allocations, named by index, and reports whether the medium /24 survived.
+	allocateSmall := func(t *testing.T, allocator *DynamicIPAMAllocator, n int) bool {
+		for i := 0; i < n; i++ {
+			_, err := allocator.Allocate(ctx, sliceName, fmt.Sprintf("cluster-%d", i), 26)
+			require.NoError(t, err)
+		}
+		free, err := allocator.GetFreeBlocks(ctx, sliceName)
+		require.NoError(t, err)
+		for _, block := range free {
+			if block == "10.245.0.0/24" {
+				return true
+			}
+		}
+		return false
+	}
+
+	worstFit := newAllocator(t, WorstFit)
+	cidr, err := worstFit.Allocate(ctx, sliceName, "cluster-first", 26)
+	require.NoError(t, err)
+	assert.Equal(t, "10.245.16.0/26", cidr, "worst-fit splits the largest block")
+	// Seven more /26s split the rest of the /20 down to /24s and smaller.
+	assert.True(t, allocateSmall(t, worstFit, 7), "worst-fit leaves the medium block alone while larger ones remain")
+	_, err = worstFit.Allocate(ctx, sliceName, "cluster-last", 26)
+	require.NoError(t, err)
+	free, err := worstFit.GetFreeBlocks(ctx, sliceName)
+	require.NoError(t, err)
+	assert.NotContains(t, free, "10.245.0.0/24", "the medium block is the earliest of the largest blocks left")
+
+	firstFit := newAllocator(t, FirstFit)
+	assert.False(t, allocateSmall(t, firstFit, 1), "first-fit breaks the medium block on the first request")
+
+	t.Run("Falls back to smaller blocks", func(t *testing.T) {
+		allocator := newAllocator(t, WorstFit)
+		_, err := allocator.Allocate(ctx, sliceName, "cluster-large", 20)
+		require.NoError(t, err)
+		cidr, err := allocator.Allocate(ctx, sliceName, "cluster-small", 26)
+		require.NoError(t, err)
+		assert.Equal(t, "10.245.0.0/26", cidr)
+		_, err = allocator.Allocate(ctx, sliceName, "cluster-too-large", 23)
+		assert.ErrorIs(t, err, ErrPoolExhausted)
+	})
+
+	t.Run("Trace", func(t *testing.T) {
+		allocator := newAllocator(t, WorstFit)
+		_, trace, err := allocator.AllocateTraced(ctx, sliceName, "cluster-traced", 26)
+		require.NoError(t, err)
+		assert.Equal(t, "worst-fit", trace.Strategy)
+		assert.Equal(t, []ConsideredBlock{
+			{Block: "10.245.0.0/24", Reason: "/24 is smaller than the largest free /20"},
+			{Block: "10.245.16.0/20"},
+		}, trace.Considered)
+	})
+}
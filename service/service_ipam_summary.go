@@ -0,0 +1,98 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/kubeslice/kubeslice-controller/util/cidrutil"
+)
+
+// GetPoolSummary returns a human-readable report of a slice's pool for CLI tooling and
+// logs: the subnet and its size, the VPN reservation, every allocation, exclusion and
+// quarantined block, the free blocks grouped by size and the utilization. Every list is
+// sorted, so the report for a given state is always identical and can be diffed.
+func (a *DynamicIPAMAllocator) GetPoolSummary(ctx context.Context, sliceName string) (string, error) {
+	pool, err := a.rlockPoolContext(ctx, "summary", sliceName)
+	if err != nil {
+		return "", err
+	}
+	defer pool.mu.RUnlock()
+
+	stats := pool.stats()
+	var b strings.Builder
+	fmt.Fprintf(&b, "slice: %s\n", sliceName)
+	fmt.Fprintf(&b, "subnet: %s (%.0f addresses)\n", pool.SliceSubnet.String(), stats.TotalAddresses)
+	if vpn, reserved := pool.Allocated[ReservedVPNClusterKey]; reserved {
+		fmt.Fprintf(&b, "vpn: %s\n", vpn.String())
+	} else {
+		b.WriteString("vpn: none\n")
+	}
+
+	clusterNames := make([]string, 0, len(pool.Allocated))
+	width := 0
+	for clusterName := range pool.Allocated {
+		if isReservedAllocation(clusterName) {
+			continue
+		}
+		clusterNames = append(clusterNames, clusterName)
+		if len(clusterName) > width {
+			width = len(clusterName)
+		}
+	}
+	sort.Strings(clusterNames)
+	fmt.Fprintf(&b, "allocations: %d\n", len(clusterNames))
+	for _, clusterName := range clusterNames {
+		fmt.Fprintf(&b, "  %-*s %s\n", width, clusterName, pool.Allocated[clusterName].String())
+	}
+
+	writeBlocks(&b, "excluded", pool.Excluded)
+	quarantined := make([]*net.IPNet, 0, len(pool.Quarantined))
+	for _, q := range pool.Quarantined {
+		quarantined = append(quarantined, q.Block)
+	}
+	writeBlocks(&b, "quarantined", quarantined)
+
+	sizes := map[int]int{}
+	for _, block := range pool.FreeBlocks {
+		ones, _ := block.Mask.Size()
+		sizes[ones]++
+	}
+	prefixes := make([]int, 0, len(sizes))
+	for ones := range sizes {
+		prefixes = append(prefixes, ones)
+	}
+	sort.Ints(prefixes)
+	counts := make([]string, 0, len(prefixes))
+	for _, ones := range prefixes {
+		counts = append(counts, fmt.Sprintf("/%d x%d", ones, sizes[ones]))
+	}
+	fmt.Fprintf(&b, "free blocks: %d", len(pool.FreeBlocks))
+	if len(counts) > 0 {
+		fmt.Fprintf(&b, " (%s)", strings.Join(counts, ", "))
+	}
+	b.WriteString("\n")
+	writeBlockLines(&b, pool.FreeBlocks)
+
+	fmt.Fprintf(&b, "utilization: %.1f%% (%.0f of %.0f addresses)\n", 100*stats.Utilization, stats.AllocatedAddresses, stats.TotalAddresses)
+
+	return b.String(), nil
+}
+
+// writeBlocks writes a counted, address-ordered list of blocks under a heading.
+func writeBlocks(b *strings.Builder, heading string, blocks []*net.IPNet) {
+	fmt.Fprintf(b, "%s: %d\n", heading, len(blocks))
+	writeBlockLines(b, blocks)
+}
+
+func writeBlockLines(b *strings.Builder, blocks []*net.IPNet) {
+	sorted := append([]*net.IPNet(nil), blocks...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return cidrutil.Compare(sorted[i], sorted[j]) < 0
+	})
+	for _, block := range sorted {
+		fmt.Fprintf(b, "  %s\n", block.String())
+	}
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dailymotion/allure-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var updateGolden = flag.Bool("update-golden", false, "rewrite the golden files under testdata")
+
+func TestIPAMSummarySuite(t *testing.T) {
+	for k, v := range IPAMSummaryTestBed {
+		t.Run(k, func(t *testing.T) {
+			allure.Test(t, allure.Name(k),
+				allure.Action(func() {
+					v(t)
+				}))
+		})
+	}
+}
+
+var IPAMSummaryTestBed = map[string]func(*testing.T){
+	"TestDynamicIPAMAllocator_GetPoolSummary": TestDynamicIPAMAllocator_GetPoolSummary,
+}
+
+func TestDynamicIPAMAllocator_GetPoolSummary(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "summary-slice"
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	allocator := NewDynamicIPAMAllocator(WithClock(clock))
+	require.NoError(t, allocator.InitializePoolWithOptions(sliceName, "10.252.0.0/22", PoolOptions{QuarantineDuration: time.Hour}))
+	require.NoError(t, allocator.ExcludeRange(ctx, sliceName, "10.252.3.240/28"))
+	for _, request := range []struct {
+		clusterName string
+		size        int
+	}{{"worker-east", 25}, {"worker-west", 26}, {"edge", 27}, {"scratch", 27}} {
+		_, err := allocator.Allocate(ctx, sliceName, request.clusterName, request.size)
+		require.NoError(t, err)
+	}
+	require.NoError(t, allocator.Reclaim(ctx, sliceName, "scratch"))
+
+	summary, err := allocator.GetPoolSummary(ctx, sliceName)
+	require.NoError(t, err)
+	golden := filepath.Join("testdata", "ipam_pool_summary.golden")
+	if *updateGolden {
+		require.NoError(t, os.WriteFile(golden, []byte(summary), 0o644))
+	}
+	want, err := os.ReadFile(golden)
+	require.NoError(t, err)
+	assert.Equal(t, string(want), summary, "run the test with -update-golden to accept the new output")
+
+	again, err := allocator.GetPoolSummary(ctx, sliceName)
+	require.NoError(t, err)
+	assert.Equal(t, summary, again)
+
+	_, err = allocator.GetPoolSummary(ctx, "missing-slice")
+	assert.ErrorIs(t, err, ErrPoolNotInitialized)
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/kubeslice/kubeslice-controller/util/cidrutil"
+)
+
+// AllocationTrace records how a placement decision was made.
+type AllocationTrace struct {
+	// Strategy names the placement strategy that made the decision.
+	Strategy string
+	// Size is the requested prefix length.
+	Size int
+	// Coalesced is set when no free block fitted until the free list was coalesced;
+	// Considered then only holds the scan of the coalesced list.
+	Coalesced bool
+	// Considered lists the free blocks examined, in scan order.
+	Considered []ConsideredBlock
+	// Selected is the allocated CIDR. It is empty if the allocation failed.
+	Selected string
+}
+
+// ConsideredBlock is a free block examined during placement. Reason explains why the
+// block was passed over and is empty for the block that was chosen.
+type ConsideredBlock struct {
+	Block  string
+	Reason string
+}
+
+// consider records a scanned block. It is a no-op on a nil trace so that untraced
+// allocations share the same scan.
+func (t *AllocationTrace) consider(block *net.IPNet, reason string) {
+	if t == nil {
+		return
+	}
+	t.Considered = append(t.Considered, ConsideredBlock{Block: block.String(), Reason: reason})
+}
+
+// AllocateTraced allocates like Allocate and additionally returns a trace of the free
+// blocks that were considered, why each was rejected and which one was chosen. The trace
+// is returned even if the allocation fails.
+func (a *DynamicIPAMAllocator) AllocateTraced(ctx context.Context, sliceName string, clusterName string, size int) (cidr string, trace AllocationTrace, err error) {
+	defer a.observeDuration(sliceName, ipamOperationAllocate, time.Now())
+	defer func() { a.countOperation(sliceName, ipamOperationAllocate, err) }()
+	trace = AllocationTrace{Size: size}
+	if err := validateClusterName(clusterName); err != nil {
+		return "", trace, err
+	}
+	if err := a.checkBlockSize(sliceName, clusterName, size); err != nil {
+		return "", trace, err
+	}
+
+	pool, err := a.lockPoolContext(ctx, ipamOperationAllocate, sliceName)
+	if err != nil {
+		return "", trace, err
+	}
+	defer pool.mu.Unlock()
+
+	trace.Strategy = pool.strategy.String()
+	if _, allocated := pool.Allocated[clusterName]; allocated {
+		// Defer to the usual handling of an existing allocation; no free block is scanned.
+		allocatedNet, err := pool.allocateSubnetForPool(clusterName, size)
+		if err != nil {
+			return "", trace, fmt.Errorf("failed to allocate subnet for cluster %s in slice %s: %w", clusterName, sliceName, err)
+		}
+		trace.Selected = allocatedNet.String()
+		return trace.Selected, trace, nil
+	}
+
+	if err := pool.checkClusterQuota(clusterName); err != nil {
+		return "", trace, fmt.Errorf("failed to allocate subnet for cluster %s in slice %s: %w", clusterName, sliceName, err)
+	}
+	allocatedNet, err := pool.carveFitTraced(size, &trace)
+	if err != nil {
+		return "", trace, fmt.Errorf("failed to allocate subnet for cluster %s in slice %s: %w", clusterName, sliceName, err)
+	}
+	pool.Allocated[clusterName] = cidrutil.Normalize(allocatedNet)
+	a.audit(ipamOperationAllocate, sliceName, clusterName, allocatedNet)
+	a.recordPoolMetrics(sliceName, pool)
+	if err := a.verifyAfter(ipamOperationAllocate, sliceName, pool); err != nil {
+		return "", trace, err
+	}
+
+	trace.Selected = allocatedNet.String()
+	return trace.Selected, trace, nil
+}
@@ -0,0 +1,79 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dailymotion/allure-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPAMTraceSuite(t *testing.T) {
+	for k, v := range IPAMTraceTestBed {
+		t.Run(k, func(t *testing.T) {
+			allure.Test(t, allure.Name(k),
+				allure.Action(func() {
+					v(t)
+				}))
+		})
+	}
+}
+
+var IPAMTraceTestBed = map[string]func(*testing.T){
+	"TestDynamicIPAMAllocator_AllocateTraced":        TestDynamicIPAMAllocator_AllocateTraced,
+	"TestDynamicIPAMAllocator_AllocateTracedBestFit": TestDynamicIPAMAllocator_AllocateTracedBestFit,
+}
+
+func TestDynamicIPAMAllocator_AllocateTraced(t *testing.T) {
+	allocator := NewDynamicIPAMAllocator()
+	ctx := context.Background()
+	sliceName := "traced-slice"
+	require.NoError(t, allocator.InitializePool(sliceName, "10.197.0.0/22"))
+	// Leave 10.197.1.64/26, 10.197.1.128/25 and 10.197.2.0/23 free.
+	_, err := allocator.Allocate(ctx, sliceName, "cluster-a", 26)
+	require.NoError(t, err)
+
+	cidr, trace, err := allocator.AllocateTraced(ctx, sliceName, "cluster-b", 25)
+	require.NoError(t, err)
+	assert.Equal(t, "10.197.1.128/25", cidr)
+	assert.Equal(t, AllocationTrace{
+		Strategy: "first-fit",
+		Size:     25,
+		Considered: []ConsideredBlock{
+			{Block: "10.197.1.64/26", Reason: "/26 is smaller than the requested /25"},
+			{Block: "10.197.1.128/25"},
+		},
+		Selected: "10.197.1.128/25",
+	}, trace)
+	assert.Equal(t, cidr, allocator.pools[sliceName].Allocated["cluster-b"].String())
+
+	t.Run("Failed allocation keeps the scan", func(t *testing.T) {
+		_, trace, err := allocator.AllocateTraced(ctx, sliceName, "cluster-c", 22)
+		require.Error(t, err)
+		assert.True(t, trace.Coalesced)
+		assert.Len(t, trace.Considered, 2)
+		assert.Empty(t, trace.Selected)
+	})
+}
+
+func TestDynamicIPAMAllocator_AllocateTracedBestFit(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "traced-best-fit-slice"
+	allocator := newHoleyAllocator(t, sliceName)
+	require.NoError(t, allocator.SetAllocationStrategy(BestFit))
+
+	cidr, trace, err := allocator.AllocateTraced(ctx, sliceName, "cluster-e", 24)
+	require.NoError(t, err)
+	assert.Equal(t, "10.207.17.0/24", cidr)
+	assert.Equal(t, "best-fit", trace.Strategy)
+	assert.Equal(t, "10.207.17.0/24", trace.Selected)
+
+	free := allocator.pools[sliceName].FreeBlocks
+	require.Len(t, trace.Considered, len(free)+1, "best-fit scans every free block")
+	assert.Equal(t, ConsideredBlock{Block: "10.207.8.0/21", Reason: "/21 is larger than the best fit /24"}, trace.Considered[0])
+	assert.Equal(t, ConsideredBlock{Block: "10.207.17.0/24"}, trace.Considered[1])
+	for _, considered := range trace.Considered[2:] {
+		assert.NotEmpty(t, considered.Reason, considered.Block)
+	}
+}
@@ -0,0 +1,67 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// AllocateWithTTL allocates like Allocate, but the allocation lapses ttl after the call,
+// as read from the allocator's clock, for ephemeral clusters that may disappear without
+// reclaiming their subnet. A lapsed allocation is held until SweepExpired reclaims it.
+// Calling it again for a cluster that already holds a block of the same size with a TTL
+// returns that block and renews its TTL. A block allocated without a TTL is never given
+// one: the call fails with ErrAllocationExists.
+func (a *DynamicIPAMAllocator) AllocateWithTTL(ctx context.Context, sliceName string, clusterName string, size int, ttl time.Duration) (cidr string, err error) {
+	if ttl <= 0 {
+		return "", fmt.Errorf("allocation TTL for cluster %s in slice %s must be positive, got %s", clusterName, sliceName, ttl)
+	}
+
+	defer a.observeDuration(sliceName, ipamOperationAllocate, time.Now())
+	defer func() { a.countOperation(sliceName, ipamOperationAllocate, err) }()
+	pool, err := a.lockPoolContext(ctx, ipamOperationAllocate, sliceName)
+	if err != nil {
+		return "", err
+	}
+	defer pool.mu.Unlock()
+
+	if existing, allocated := pool.Allocated[clusterName]; allocated {
+		if _, expires := pool.Expiry[clusterName]; !expires {
+			return "", fmt.Errorf("cluster %s already holds subnet %s in slice %s without a TTL: %w",
+				clusterName, existing.String(), sliceName, ErrAllocationExists)
+		}
+	}
+	cidr, err = a.allocateLocked(sliceName, pool, clusterName, size)
+	if err != nil {
+		return "", err
+	}
+	pool.Expiry[clusterName] = pool.now().Add(ttl)
+
+	return cidr, nil
+}
+
+// reclaimLapsed reclaims every allocation whose expiry has passed and returns their
+// cluster names in sorted order. The caller must hold the pool's mutex.
+func (a *DynamicIPAMAllocator) reclaimLapsed(sliceName string, pool *sliceIPPool) ([]string, error) {
+	if len(pool.Expiry) == 0 {
+		return nil, nil
+	}
+	now := pool.now()
+	var lapsed []string
+	for clusterName, expiry := range pool.Expiry {
+		if !now.Before(expiry) {
+			lapsed = append(lapsed, clusterName)
+		}
+	}
+	sort.Strings(lapsed)
+
+	for i, clusterName := range lapsed {
+		expiry := pool.Expiry[clusterName]
+		if err := a.reclaimLocked(sliceName, pool, clusterName); err != nil {
+			return lapsed[:i], fmt.Errorf("failed to reclaim expired allocation of cluster %s in slice %s: %w", clusterName, sliceName, err)
+		}
+		a.log.V(1).Info("reclaimed expired allocation", "slice", sliceName, "cluster", clusterName, "expiry", expiry)
+	}
+	return lapsed, nil
+}
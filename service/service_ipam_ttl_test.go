@@ -0,0 +1,142 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dailymotion/allure-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPAMTTLSuite(t *testing.T) {
+	for k, v := range IPAMTTLTestBed {
+		t.Run(k, func(t *testing.T) {
+			allure.Test(t, allure.Name(k),
+				allure.Action(func() {
+					v(t)
+				}))
+		})
+	}
+}
+
+var IPAMTTLTestBed = map[string]func(*testing.T){
+	"TestDynamicIPAMAllocator_AllocateWithTTL": TestDynamicIPAMAllocator_AllocateWithTTL,
+}
+
+func TestDynamicIPAMAllocator_AllocateWithTTL(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	allocator := NewDynamicIPAMAllocator(WithClock(clock), WithVPNSubnetSize(0))
+	for _, sliceName := range []string{"ttl-slice-a", "ttl-slice-b"} {
+		require.NoError(t, allocator.InitializePool(sliceName, "10.221.0.0/22"))
+	}
+
+	ephemeral, err := allocator.AllocateWithTTL(ctx, "ttl-slice-a", "ephemeral", 24, time.Minute)
+	require.NoError(t, err)
+	_, err = allocator.AllocateWithTTL(ctx, "ttl-slice-a", "long-lived", 24, time.Hour)
+	require.NoError(t, err)
+	_, err = allocator.Allocate(ctx, "ttl-slice-a", "permanent", 24)
+	require.NoError(t, err)
+	_, err = allocator.AllocateWithTTL(ctx, "ttl-slice-b", "ephemeral", 24, time.Minute)
+	require.NoError(t, err)
+
+	clock.Advance(30 * time.Second)
+	reclaimed, err := allocator.SweepExpired(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, reclaimed, "nothing has lapsed yet")
+
+	clock.Advance(30 * time.Second)
+	reclaimed, err = allocator.SweepExpired(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ttl-slice-a/ephemeral", "ttl-slice-b/ephemeral"}, reclaimed)
+	allocations, err := allocator.ListAllocations(ctx, "ttl-slice-a")
+	require.NoError(t, err)
+	assert.NotContains(t, allocations, "ephemeral")
+	assert.Contains(t, allocations, "long-lived")
+	assert.Contains(t, allocations, "permanent")
+	cidr, err := allocator.Allocate(ctx, "ttl-slice-a", "successor", 24)
+	require.NoError(t, err)
+	assert.Equal(t, ephemeral, cidr, "the reclaimed block is free again")
+
+	reclaimed, err = allocator.SweepExpired(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, reclaimed, "a lapsed allocation is reclaimed once")
+
+	t.Run("Renewal pushes the expiry back", func(t *testing.T) {
+		clock.Advance(50 * time.Minute)
+		_, err := allocator.AllocateWithTTL(ctx, "ttl-slice-a", "long-lived", 24, time.Hour)
+		require.NoError(t, err)
+		clock.Advance(30 * time.Minute)
+		reclaimed, err := allocator.SweepExpired(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, reclaimed)
+
+		clock.Advance(30 * time.Minute)
+		reclaimed, err = allocator.SweepExpired(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"ttl-slice-a/long-lived"}, reclaimed)
+	})
+
+	t.Run("Expiry survives a state round trip", func(t *testing.T) {
+		_, err := allocator.AllocateWithTTL(ctx, "ttl-slice-b", "restored", 24, time.Minute)
+		require.NoError(t, err)
+		state, err := allocator.MarshalState()
+		require.NoError(t, err)
+
+		restored := NewDynamicIPAMAllocator(WithClock(clock), WithVPNSubnetSize(0))
+		require.NoError(t, restored.LoadState(state))
+		clock.Advance(time.Minute)
+		reclaimed, err := restored.SweepExpired(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"ttl-slice-b/restored"}, reclaimed)
+	})
+
+	t.Run("A permanent allocation is not given a TTL", func(t *testing.T) {
+		_, err := allocator.AllocateWithTTL(ctx, "ttl-slice-a", "permanent", 24, time.Minute)
+		assert.ErrorIs(t, err, ErrAllocationExists)
+		assert.NotContains(t, allocator.pools["ttl-slice-a"].Expiry, "permanent")
+
+		clock.Advance(time.Hour)
+		_, err = allocator.SweepExpired(ctx)
+		require.NoError(t, err)
+		assert.Contains(t, allocator.pools["ttl-slice-a"].Allocated, "permanent", "the sweep leaves it alone")
+	})
+
+	t.Run("Invalid requests", func(t *testing.T) {
+		for _, ttl := range []time.Duration{0, -time.Second} {
+			_, err := allocator.AllocateWithTTL(ctx, "ttl-slice-a", "no-ttl", 24, ttl)
+			assert.Error(t, err, ttl)
+		}
+		_, err := allocator.AllocateWithTTL(ctx, "missing-slice", "cluster-a", 24, time.Minute)
+		assert.ErrorIs(t, err, ErrPoolNotInitialized)
+		_, err = allocator.SweepExpired(ctx)
+		require.NoError(t, err)
+
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err = allocator.SweepExpired(cancelled)
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("A held pool lock does not block past the deadline", func(t *testing.T) {
+		pool := allocator.pools["ttl-slice-a"]
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+
+		sweep, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		done := make(chan error, 1)
+		go func() {
+			_, err := allocator.SweepExpired(sweep)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+		case <-time.After(5 * time.Second):
+			t.Fatal("SweepExpired ignored its deadline")
+		}
+	})
+}
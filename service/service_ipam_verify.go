@@ -0,0 +1,125 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/kubeslice/kubeslice-controller/util/cidrutil"
+)
+
+// WithVerification makes the allocator check a pool's invariants after every Allocate and
+// Reclaim, failing the call with the violation if one is found. It is meant for tests
+// and debugging, as each check sorts every block in the pool.
+func WithVerification() IPAMAllocatorOption {
+	return func(a *DynamicIPAMAllocator) {
+		a.verify = true
+	}
+}
+
+// Verify checks that no two of the pool's allocations, free blocks, exclusions and
+// quarantined blocks overlap and that every block lies within the slice subnet. The
+// error names the offending CIDRs.
+func (a *DynamicIPAMAllocator) Verify(ctx context.Context, sliceName string) error {
+	pool, err := a.rlockPoolContext(ctx, "verify", sliceName)
+	if err != nil {
+		return err
+	}
+	defer pool.mu.RUnlock()
+
+	if err := validateNoOverlap(pool); err != nil {
+		return fmt.Errorf("ipam pool for slice %s is inconsistent: %w", sliceName, err)
+	}
+	return nil
+}
+
+// HealthCheck runs the checks of Verify on every pool, in slice order, and returns the
+// violations found joined into one error, each naming its slice. It holds one pool's
+// read lock at a time, and gives up waiting for one once ctx is done, so it is cheap
+// enough for a readiness probe to call periodically. Pools deleted meanwhile are skipped.
+func (a *DynamicIPAMAllocator) HealthCheck(ctx context.Context) error {
+	var errs []error
+	for _, sliceName := range a.ListSlices() {
+		pool, err := a.rlockPoolContext(ctx, "health check", sliceName)
+		if errors.Is(err, ErrPoolNotInitialized) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = validateNoOverlap(pool)
+		pool.mu.RUnlock()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("ipam pool for slice %s is inconsistent: %w", sliceName, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// verifyAfter runs validateNoOverlap when verification is enabled. The caller must hold
+// the pool's mutex.
+func (a *DynamicIPAMAllocator) verifyAfter(operation, sliceName string, pool *sliceIPPool) error {
+	if !a.verify {
+		return nil
+	}
+	if err := validateNoOverlap(pool); err != nil {
+		return fmt.Errorf("ipam pool for slice %s is inconsistent after %s: %w", sliceName, operation, err)
+	}
+	return nil
+}
+
+// ownedBlock is a block of a pool together with a description of who holds it.
+type ownedBlock struct {
+	block *net.IPNet
+	owner string
+}
+
+func (b ownedBlock) String() string {
+	return fmt.Sprintf("%s (%s)", b.block.String(), b.owner)
+}
+
+// validateNoOverlap checks the pool's allocated, free, excluded and quarantined blocks
+// against each other and against the slice subnet.
+func validateNoOverlap(pool *sliceIPPool) error {
+	blocks := make([]ownedBlock, 0, len(pool.Allocated)+len(pool.FreeBlocks)+len(pool.Excluded)+len(pool.Quarantined))
+	for clusterName, allocated := range pool.Allocated {
+		blocks = append(blocks, ownedBlock{block: allocated, owner: "allocated to " + clusterName})
+	}
+	for _, free := range pool.FreeBlocks {
+		blocks = append(blocks, ownedBlock{block: free, owner: "free"})
+	}
+	for _, excluded := range pool.Excluded {
+		blocks = append(blocks, ownedBlock{block: excluded, owner: "excluded"})
+	}
+	for _, q := range pool.Quarantined {
+		blocks = append(blocks, ownedBlock{block: q.Block, owner: "quarantined"})
+	}
+
+	sliceOnes, sliceBits := pool.SliceSubnet.Mask.Size()
+	for _, b := range blocks {
+		ones, bits := b.block.Mask.Size()
+		if bits != sliceBits || ones < sliceOnes || !pool.SliceSubnet.Contains(b.block.IP) {
+			return fmt.Errorf("%s is not within slice subnet %s", b, pool.SliceSubnet.String())
+		}
+	}
+
+	// CIDR blocks are either nested or disjoint, so after sorting by address any overlap
+	// shows up as a block starting inside the block before it.
+	sort.Slice(blocks, func(i, j int) bool {
+		if cmp := cidrutil.Compare(blocks[i].block, blocks[j].block); cmp != 0 {
+			return cmp < 0
+		}
+		return blocks[i].owner < blocks[j].owner
+	})
+	for i := 1; i < len(blocks); i++ {
+		if cidrutil.Overlaps(blocks[i-1].block, blocks[i].block) {
+			if blocks[i-1].owner == "free" && blocks[i].owner == "free" {
+				return fmt.Errorf("free blocks %s and %s overlap", blocks[i-1].block, blocks[i].block)
+			}
+			return fmt.Errorf("%s overlaps %s", blocks[i-1], blocks[i])
+		}
+	}
+	return nil
+}
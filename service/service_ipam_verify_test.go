@@ -0,0 +1,232 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dailymotion/allure-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPAMVerifySuite(t *testing.T) {
+	for k, v := range IPAMVerifyTestBed {
+		t.Run(k, func(t *testing.T) {
+			allure.Test(t, allure.Name(k),
+				allure.Action(func() {
+					v(t)
+				}))
+		})
+	}
+}
+
+var IPAMVerifyTestBed = map[string]func(*testing.T){
+	"TestDynamicIPAMAllocator_Verify":              TestDynamicIPAMAllocator_Verify,
+	"TestDynamicIPAMAllocator_VerifyAfterMutation": TestDynamicIPAMAllocator_VerifyAfterMutation,
+	"TestDynamicIPAMAllocator_HealthCheck":         TestDynamicIPAMAllocator_HealthCheck,
+}
+
+func TestDynamicIPAMAllocator_Verify(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "verify-slice"
+
+	newAllocator := func(t *testing.T) *DynamicIPAMAllocator {
+		allocator := NewDynamicIPAMAllocator()
+		require.NoError(t, allocator.InitializePool(sliceName, "10.211.0.0/16"))
+		_, err := allocator.Allocate(ctx, sliceName, "cluster-a", 24)
+		require.NoError(t, err)
+		_, err = allocator.Allocate(ctx, sliceName, "cluster-b", 24)
+		require.NoError(t, err)
+		return allocator
+	}
+
+	t.Run("Consistent pool", func(t *testing.T) {
+		allocator := newAllocator(t)
+		assert.NoError(t, allocator.Verify(ctx, sliceName))
+		require.NoError(t, allocator.Reclaim(ctx, sliceName, "cluster-a"))
+		assert.NoError(t, allocator.Verify(ctx, sliceName))
+	})
+
+	t.Run("Double allocation", func(t *testing.T) {
+		allocator := newAllocator(t)
+		pool := allocator.pools[sliceName]
+		pool.Allocated["cluster-c"] = mustParseCIDR(t, "10.211.1.128/25")
+
+		err := allocator.Verify(ctx, sliceName)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "10.211.1.0/24 (allocated to cluster-a)")
+		assert.Contains(t, err.Error(), "10.211.1.128/25 (allocated to cluster-c)")
+	})
+
+	t.Run("Allocation overlapping a free block", func(t *testing.T) {
+		allocator := newAllocator(t)
+		pool := allocator.pools[sliceName]
+		pool.FreeBlocks = append(pool.FreeBlocks, mustParseCIDR(t, "10.211.0.0/23"))
+
+		err := allocator.Verify(ctx, sliceName)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "10.211.0.0/23 (free)")
+	})
+
+	t.Run("Block outside the slice subnet", func(t *testing.T) {
+		allocator := newAllocator(t)
+		pool := allocator.pools[sliceName]
+		pool.Allocated["cluster-c"] = mustParseCIDR(t, "10.212.0.0/24")
+
+		err := allocator.Verify(ctx, sliceName)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "10.212.0.0/24 (allocated to cluster-c) is not within slice subnet 10.211.0.0/16")
+	})
+
+	t.Run("Exclusion overlapping a free block", func(t *testing.T) {
+		allocator := newAllocator(t)
+		pool := allocator.pools[sliceName]
+		pool.Excluded = append(pool.Excluded, mustParseCIDR(t, "10.211.8.0/26"))
+
+		err := allocator.Verify(ctx, sliceName)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "10.211.8.0/26 (excluded)")
+		assert.Error(t, allocator.HealthCheck(ctx))
+	})
+
+	t.Run("Quarantined block overlapping an allocation", func(t *testing.T) {
+		allocator := newAllocator(t)
+		pool := allocator.pools[sliceName]
+		pool.Quarantined = append(pool.Quarantined, quarantinedBlock{Block: mustParseCIDR(t, "10.211.1.0/25")})
+
+		err := allocator.Verify(ctx, sliceName)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "10.211.1.0/25 (quarantined)")
+	})
+
+	t.Run("Exclusion outside the slice subnet", func(t *testing.T) {
+		allocator := newAllocator(t)
+		pool := allocator.pools[sliceName]
+		pool.Excluded = append(pool.Excluded, mustParseCIDR(t, "10.212.0.0/24"))
+
+		err := allocator.Verify(ctx, sliceName)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "10.212.0.0/24 (excluded) is not within slice subnet 10.211.0.0/16")
+	})
+
+	t.Run("Uninitialized pool", func(t *testing.T) {
+		assert.Error(t, NewDynamicIPAMAllocator().Verify(ctx, sliceName))
+	})
+}
+
+func TestDynamicIPAMAllocator_VerifyAfterMutation(t *testing.T) {
+	ctx := context.Background()
+	sliceName := "verify-mutation-slice"
+	allocator := NewDynamicIPAMAllocator(WithVerification())
+	require.NoError(t, allocator.InitializePool(sliceName, "10.213.0.0/16"))
+
+	_, err := allocator.Allocate(ctx, sliceName, "cluster-a", 24)
+	require.NoError(t, err)
+	require.NoError(t, allocator.Reclaim(ctx, sliceName, "cluster-a"))
+
+	// Hand out 10.213.1.0/24 while leaving it on the free list, as a bookkeeping bug would.
+	pool := allocator.pools[sliceName]
+	pool.Allocated["cluster-b"] = mustParseCIDR(t, "10.213.1.0/24")
+
+	_, err = allocator.Allocate(ctx, sliceName, "cluster-c", 24)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "after allocate")
+	assert.Contains(t, err.Error(), "allocated to cluster-b")
+
+	err = allocator.Reclaim(ctx, sliceName, "cluster-c")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "after reclaim")
+
+	t.Run("Every allocation path", func(t *testing.T) {
+		// A block outside the slice subnet is caught only by verification.
+		allocator := NewDynamicIPAMAllocator(WithVerification())
+		require.NoError(t, allocator.InitializePool(sliceName, "10.213.0.0/16"))
+		allocator.pools[sliceName].Allocated["cluster-b"] = mustParseCIDR(t, "10.214.0.0/24")
+
+		for name, allocate := range map[string]func() error{
+			"AllocateIdempotent": func() error {
+				_, err := allocator.AllocateIdempotent(ctx, sliceName, "cluster-idempotent", 26, "key")
+				return err
+			},
+			"AllocateIndexed": func() error {
+				_, err := allocator.AllocateIndexed(ctx, sliceName, "cluster-indexed", []int{0, 1}, 26)
+				return err
+			},
+			"AllocateBatch": func() error {
+				_, err := allocator.AllocateBatch(ctx, sliceName, map[string]int{"cluster-batch": 26})
+				return err
+			},
+			"AllocateWithValidator": func() error {
+				_, err := allocator.AllocateWithValidator(ctx, sliceName, "cluster-validated", 26, func(string) bool { return true })
+				return err
+			},
+			"AllocateTraced": func() error {
+				_, _, err := allocator.AllocateTraced(ctx, sliceName, "cluster-traced", 26)
+				return err
+			},
+			"AllocateContiguous": func() error {
+				_, err := allocator.AllocateContiguous(ctx, sliceName, "cluster-contiguous", 26)
+				return err
+			},
+		} {
+			err := allocate()
+			require.Error(t, err, name)
+			assert.Contains(t, err.Error(), "after allocate", name)
+			assert.Contains(t, err.Error(), "is not within slice subnet", name)
+		}
+	})
+}
+
+func TestDynamicIPAMAllocator_HealthCheck(t *testing.T) {
+	ctx := context.Background()
+	allocator := NewDynamicIPAMAllocator()
+	assert.NoError(t, allocator.HealthCheck(ctx), "an allocator without pools is healthy")
+
+	for _, sliceName := range []string{"health-slice-a", "health-slice-b", "health-slice-c"} {
+		require.NoError(t, allocator.InitializePool(sliceName, "10.214.0.0/16"))
+		_, err := allocator.Allocate(ctx, sliceName, "cluster-a", 24)
+		require.NoError(t, err)
+	}
+	require.NoError(t, allocator.HealthCheck(ctx))
+
+	allocator.pools["health-slice-b"].Allocated["cluster-b"] = mustParseCIDR(t, "10.214.1.0/25")
+	err := allocator.HealthCheck(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "ipam pool for slice health-slice-b is inconsistent")
+	assert.Contains(t, err.Error(), "allocated to cluster-b")
+	assert.NotContains(t, err.Error(), "health-slice-a")
+	assert.NotContains(t, err.Error(), "health-slice-c")
+
+	allocator.pools["health-slice-c"].FreeBlocks = append(allocator.pools["health-slice-c"].FreeBlocks, mustParseCIDR(t, "10.215.0.0/24"))
+	err = allocator.HealthCheck(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "health-slice-b")
+	assert.Contains(t, err.Error(), "ipam pool for slice health-slice-c is inconsistent: 10.215.0.0/24 (free) is not within slice subnet 10.214.0.0/16")
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.ErrorIs(t, allocator.HealthCheck(cancelled), context.Canceled)
+
+	t.Run("A held pool lock does not block past the deadline", func(t *testing.T) {
+		allocator := NewDynamicIPAMAllocator()
+		require.NoError(t, allocator.InitializePool("busy-slice", "10.216.0.0/16"))
+		pool := allocator.pools["busy-slice"]
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+
+		probe, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		done := make(chan error, 1)
+		go func() {
+			done <- allocator.HealthCheck(probe)
+		}()
+		require.NoError(t, allocator.InitializePool("other-slice", "10.217.0.0/16"), "the allocator is not locked meanwhile")
+		select {
+		case err := <-done:
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+		case <-time.After(5 * time.Second):
+			t.Fatal("HealthCheck ignored its deadline")
+		}
+	})
+}
@@ -0,0 +1,263 @@
+// Package cidrutil provides arithmetic on IP addresses and CIDR blocks for IPv4 and IPv6
+// alike. Functions that return blocks return them normalized: the network address in
+// canonical length (4 bytes for IPv4) and a canonical mask. Inputs are never modified.
+package cidrutil
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// CompareIP orders IP addresses numerically, with every IPv4 address before every IPv6
+// address. Either representation of an IPv4 address compares equal to the other. It
+// returns -1, 0 or 1.
+func CompareIP(a, b net.IP) int {
+	a, b = canonicalIP(a), canonicalIP(b)
+	if len(a) != len(b) {
+		// IPv4 before IPv6; a malformed address, which canonicalizes to nil, sorts first.
+		if len(a) < len(b) {
+			return -1
+		}
+		return 1
+	}
+	return bytes.Compare(a, b)
+}
+
+// Compare orders blocks by network address and, for blocks at the same address, puts the
+// longer prefix first, so that a block sorts before any block containing it. It returns
+// -1, 0 or 1.
+func Compare(a, b *net.IPNet) int {
+	cmp := CompareIP(a.IP, b.IP)
+	if cmp != 0 {
+		return cmp
+	}
+	// Mask.Size reports (0, 0) for non-canonical masks, which would make a malformed
+	// block look like a /0; derive the prefix from the mask bits instead.
+	bitsA, _, _ := maskPrefix(a)
+	bitsB, _, _ := maskPrefix(b)
+	if bitsA < bitsB {
+		return 1
+	}
+	if bitsA > bitsB {
+		return -1
+	}
+	return 0
+}
+
+// Increment returns ip advanced by n addresses. The second result is false if the
+// increment ran past the end of the address space, in which case there is no such address
+// and the returned IP must not be used.
+func Increment(ip net.IP, n int) (net.IP, bool) {
+	res := CopyIP(ip)
+
+	carry := n
+	for i := len(res) - 1; i >= 0; i-- {
+		if carry == 0 {
+			break
+		}
+		sum := int(res[i]) + carry
+		res[i] = byte(sum % 256)
+		carry = sum / 256
+	}
+	return res, carry == 0
+}
+
+// Merge returns the parent of a and b if they are the two halves of the same block, in
+// either order. Adjacent blocks of equal size that straddle a parent boundary, such as
+// 10.0.1.0/24 and 10.0.2.0/24, do not merge.
+func Merge(a, b *net.IPNet) (*net.IPNet, bool) {
+	a, b = Normalize(a), Normalize(b)
+
+	ones, bits := a.Mask.Size()
+	onesB, bitsB := b.Mask.Size()
+	if bits == 0 || bits != bitsB || ones != onesB || ones == 0 {
+		return nil, false
+	}
+
+	lower, upper := a, b
+	if CompareIP(b.IP, a.IP) < 0 {
+		lower, upper = b, a
+	}
+
+	mergedMask := net.CIDRMask(ones-1, bits)
+	if !lower.IP.Mask(mergedMask).Equal(lower.IP) {
+		return nil, false
+	}
+
+	// Step by the block size rather than adding it as an integer, which would overflow
+	// for IPv6 blocks.
+	next, ok := Next(lower)
+	if !ok || !next.IP.Equal(upper.IP) {
+		return nil, false
+	}
+
+	return &net.IPNet{IP: lower.IP, Mask: mergedMask}, true
+}
+
+// Split returns the lower and upper halves of block, taking the block at its network
+// address. The third result is false for a single address, which cannot be split.
+func Split(block *net.IPNet) (lower, upper *net.IPNet, ok bool) {
+	block = Normalize(block)
+	ones, bits := block.Mask.Size()
+	if bits == 0 || ones == bits {
+		return nil, nil, false
+	}
+	childMask := net.CIDRMask(ones+1, bits)
+
+	lower = &net.IPNet{IP: CopyIP(block.IP), Mask: childMask}
+	upperIP := CopyIP(block.IP)
+	upperIP[ones/8] |= 0x80 >> uint(ones%8)
+	upper = &net.IPNet{IP: upperIP, Mask: append(net.IPMask(nil), childMask...)}
+
+	return lower, upper, true
+}
+
+// Subtract returns the minimal set of aligned blocks that together cover outer minus
+// inner, ordered by ascending address. Subtracting a block from itself yields no blocks;
+// inner must be contained in outer.
+func Subtract(outer, inner *net.IPNet) ([]*net.IPNet, error) {
+	outerOnes, outerBits := outer.Mask.Size()
+	innerOnes, innerBits := inner.Mask.Size()
+	if outerBits == 0 || innerBits == 0 {
+		return nil, fmt.Errorf("cannot subtract %s from %s: non-canonical mask", inner.String(), outer.String())
+	}
+	if !Contains(outer, inner) {
+		return nil, fmt.Errorf("cannot subtract %s from %s: not contained", inner.String(), outer.String())
+	}
+
+	remainders := []*net.IPNet{}
+	current := Normalize(outer)
+	for ones := outerOnes; ones < innerOnes; ones++ {
+		lower, upper, _ := Split(current)
+		if upper.Contains(inner.IP) {
+			remainders = append(remainders, lower)
+			current = upper
+		} else {
+			remainders = append(remainders, upper)
+			current = lower
+		}
+	}
+
+	sort.Slice(remainders, func(i, j int) bool {
+		return Compare(remainders[i], remainders[j]) < 0
+	})
+	return remainders, nil
+}
+
+// Next returns the block of the same size that directly follows block, or false if block
+// ends the address space.
+func Next(block *net.IPNet) (*net.IPNet, bool) {
+	ones, bits := block.Mask.Size()
+	if ones == 0 || bits == 0 {
+		return nil, false
+	}
+	ip := NetworkIP(block)
+	carry := 0x80 >> uint((ones-1)%8)
+	for i := (ones - 1) / 8; i >= 0 && carry > 0; i-- {
+		sum := int(ip[i]) + carry
+		ip[i] = byte(sum)
+		carry = sum >> 8
+	}
+	if carry > 0 {
+		return nil, false
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, bits)}, true
+}
+
+// Contains reports whether every address of inner lies within outer. Blocks of different
+// address families never contain each other.
+func Contains(outer, inner *net.IPNet) bool {
+	outerOnes, outerBits := outer.Mask.Size()
+	innerOnes, innerBits := inner.Mask.Size()
+	return outerBits != 0 && outerBits == innerBits && innerOnes >= outerOnes && outer.Contains(inner.IP)
+}
+
+// Overlaps reports whether two aligned blocks share any address. Aligned blocks either
+// nest or are disjoint, so it is enough to check containment of the network addresses.
+func Overlaps(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// Normalize returns a copy of ipNet with the network address in canonical length and a
+// canonical mask for its prefix length. Blocks whose mask bits are not contiguous are
+// copied as is.
+func Normalize(ipNet *net.IPNet) *net.IPNet {
+	ones, bits, ok := maskPrefix(ipNet)
+	if !ok {
+		return &net.IPNet{IP: CopyIP(ipNet.IP), Mask: append(net.IPMask(nil), ipNet.Mask...)}
+	}
+	ip := canonicalIP(ipNet.IP)
+	mask := net.CIDRMask(ones, bits)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// canonicalIP returns ip in its canonical length: 4 bytes for IPv4, including IPv4
+// addresses held in the 16 byte form net.ParseIP returns, and 16 bytes otherwise. It
+// returns nil for a slice that is not an IP address.
+func canonicalIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
+
+// maskPrefix returns the prefix length and address width of ipNet. Unlike Mask.Size it
+// copes with masks whose length does not match the address (such as a 16 byte mask on an
+// IPv4 block) or that were truncated; ok is false only when the mask bits are not
+// contiguous, in which case ones is reported as the full address width.
+func maskPrefix(ipNet *net.IPNet) (ones, bits int, ok bool) {
+	bits = 8 * net.IPv6len
+	if ipNet.IP.To4() != nil {
+		bits = 8 * net.IPv4len
+	}
+
+	mask := ipNet.Mask
+	if len(mask) == net.IPv6len && bits == 8*net.IPv4len {
+		// An IPv4 mask in 16 byte form is prefixed by 96 one bits.
+		for _, b := range mask[:net.IPv6len-net.IPv4len] {
+			if b != 0xff {
+				return bits, bits, false
+			}
+		}
+		mask = mask[net.IPv6len-net.IPv4len:]
+	}
+
+	seenZero := false
+	for _, b := range mask {
+		for bit := 7; bit >= 0; bit-- {
+			if b&(1<<uint(bit)) == 0 {
+				seenZero = true
+			} else if seenZero {
+				return bits, bits, false
+			} else {
+				ones++
+			}
+		}
+	}
+	if ones > bits {
+		return bits, bits, false
+	}
+	return ones, bits, true
+}
+
+// NetworkIP returns a copy of the masked network address of ipNet, in its canonical
+// length when the mask is an IPv4 one.
+func NetworkIP(ipNet *net.IPNet) net.IP {
+	ip := ipNet.IP
+	if _, bits := ipNet.Mask.Size(); bits == 8*net.IPv4len {
+		ip = ip.To4()
+	}
+	return CopyIP(ip.Mask(ipNet.Mask))
+}
+
+// CopyIP returns a copy of ip that shares no memory with it, or nil for nil.
+func CopyIP(ip net.IP) net.IP {
+	if ip == nil {
+		return nil
+	}
+	out := make(net.IP, len(ip))
+	copy(out, ip)
+	return out
+}
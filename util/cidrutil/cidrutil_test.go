@@ -0,0 +1,223 @@
+package cidrutil
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustParseCIDR(t *testing.T, cidr string) *net.IPNet {
+	t.Helper()
+	_, ipNet, err := net.ParseCIDR(cidr)
+	require.NoError(t, err)
+	return ipNet
+}
+
+func TestCompareIP(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{a: "10.0.0.1", b: "10.0.0.2", want: -1},
+		{a: "10.0.1.0", b: "10.0.0.255", want: 1},
+		{a: "10.0.0.1", b: "10.0.0.1", want: 0},
+		{a: "fd00::1", b: "fd00::2", want: -1},
+		{a: "fd00::1:0", b: "fd00::ffff", want: 1},
+		{a: "255.255.255.255", b: "::", want: -1},
+	} {
+		assert.Equal(t, tc.want, CompareIP(net.ParseIP(tc.a), net.ParseIP(tc.b)), "%s vs %s", tc.a, tc.b)
+		assert.Equal(t, -tc.want, CompareIP(net.ParseIP(tc.b), net.ParseIP(tc.a)), "%s vs %s", tc.b, tc.a)
+	}
+	assert.Equal(t, 0, CompareIP(net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.1").To4()),
+		"the 4 and 16 byte forms of an IPv4 address are equal")
+}
+
+func TestCompare(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{a: "10.0.0.0/24", b: "10.0.1.0/24", want: -1},
+		{a: "10.0.0.0/25", b: "10.0.0.0/24", want: -1},
+		{a: "10.0.0.0/24", b: "10.0.0.0/24", want: 0},
+		{a: "fd00::/64", b: "fd00:0:0:1::/64", want: -1},
+		{a: "fd00::/65", b: "fd00::/64", want: -1},
+		{a: "10.0.0.0/8", b: "fd00::/64", want: -1},
+	} {
+		a, b := mustParseCIDR(t, tc.a), mustParseCIDR(t, tc.b)
+		assert.Equal(t, tc.want, Compare(a, b), "%s vs %s", tc.a, tc.b)
+		assert.Equal(t, -tc.want, Compare(b, a), "%s vs %s", tc.b, tc.a)
+	}
+
+	wide := &net.IPNet{IP: net.ParseIP("10.0.0.0"), Mask: net.CIDRMask(120, 128)}
+	assert.Equal(t, 0, Compare(wide, mustParseCIDR(t, "10.0.0.0/24")), "an IPv4 block in 16 byte form")
+}
+
+func TestIncrement(t *testing.T) {
+	for _, tc := range []struct {
+		ip   string
+		n    int
+		want string
+	}{
+		{ip: "192.168.1.255", n: 1, want: "192.168.2.0"},
+		{ip: "10.0.0.0", n: 4096, want: "10.0.16.0"},
+		{ip: "fd00::ffff", n: 1, want: "fd00::1:0"},
+		{ip: "fd00::", n: 0, want: "fd00::"},
+	} {
+		ip := net.ParseIP(tc.ip)
+		got, ok := Increment(ip, tc.n)
+		assert.True(t, ok, tc.ip)
+		assert.Equal(t, tc.want, got.String())
+		assert.Equal(t, tc.ip, ip.String(), "Increment must not modify its argument")
+	}
+
+	_, ok := Increment(net.ParseIP("255.255.255.255").To4(), 1)
+	assert.False(t, ok)
+	_, ok = Increment(net.ParseIP("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"), 1)
+	assert.False(t, ok)
+}
+
+func TestMerge(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want string
+	}{
+		{a: "10.0.0.0/25", b: "10.0.0.128/25", want: "10.0.0.0/24"},
+		{a: "10.0.0.128/25", b: "10.0.0.0/25", want: "10.0.0.0/24"},
+		{a: "fd00:10::/64", b: "fd00:10:0:1::/64", want: "fd00:10::/63"},
+		{a: "::/1", b: "8000::/1", want: "::/0"},
+		{a: "10.0.1.0/24", b: "10.0.2.0/24"},
+		{a: "10.0.0.0/24", b: "10.0.1.0/25"},
+		{a: "10.0.0.0/24", b: "10.0.0.0/24"},
+		{a: "10.0.0.0/24", b: "::a00:100/120"},
+	} {
+		merged, ok := Merge(mustParseCIDR(t, tc.a), mustParseCIDR(t, tc.b))
+		if tc.want == "" {
+			assert.False(t, ok, "%s and %s", tc.a, tc.b)
+			continue
+		}
+		require.True(t, ok, "%s and %s", tc.a, tc.b)
+		assert.Equal(t, tc.want, merged.String())
+	}
+}
+
+func TestSplit(t *testing.T) {
+	for _, tc := range []struct {
+		block, lower, upper string
+	}{
+		{block: "10.0.0.0/24", lower: "10.0.0.0/25", upper: "10.0.0.128/25"},
+		{block: "10.0.0.0/31", lower: "10.0.0.0/32", upper: "10.0.0.1/32"},
+		{block: "fd00::/63", lower: "fd00::/64", upper: "fd00:0:0:1::/64"},
+		{block: "::/0", lower: "::/1", upper: "8000::/1"},
+	} {
+		block := mustParseCIDR(t, tc.block)
+		lower, upper, ok := Split(block)
+		require.True(t, ok, tc.block)
+		assert.Equal(t, tc.lower, lower.String())
+		assert.Equal(t, tc.upper, upper.String())
+		assert.Equal(t, tc.block, block.String(), "Split must not modify its argument")
+
+		merged, ok := Merge(lower, upper)
+		require.True(t, ok)
+		assert.Equal(t, tc.block, merged.String(), "the halves merge back into the block")
+	}
+
+	_, _, ok := Split(mustParseCIDR(t, "10.0.0.1/32"))
+	assert.False(t, ok)
+	_, _, ok = Split(mustParseCIDR(t, "fd00::1/128"))
+	assert.False(t, ok)
+}
+
+func TestSubtract(t *testing.T) {
+	for _, tc := range []struct {
+		outer, inner string
+		want         []string
+	}{
+		{outer: "10.0.0.0/22", inner: "10.0.2.0/24", want: []string{"10.0.0.0/23", "10.0.3.0/24"}},
+		{outer: "10.0.0.0/22", inner: "10.0.0.0/24", want: []string{"10.0.1.0/24", "10.0.2.0/23"}},
+		{outer: "192.168.1.0/24", inner: "192.168.1.240/28", want: []string{"192.168.1.0/25", "192.168.1.128/26", "192.168.1.192/27", "192.168.1.224/28"}},
+		{outer: "fd00::/62", inner: "fd00:0:0:1::/64", want: []string{"fd00::/64", "fd00:0:0:2::/63"}},
+		{outer: "10.0.4.0/22", inner: "10.0.4.0/22", want: []string{}},
+	} {
+		outer := mustParseCIDR(t, tc.outer)
+		remainders, err := Subtract(outer, mustParseCIDR(t, tc.inner))
+		require.NoError(t, err, "%s - %s", tc.outer, tc.inner)
+		got := []string{}
+		for _, remainder := range remainders {
+			got = append(got, remainder.String())
+		}
+		assert.Equal(t, tc.want, got, "%s - %s", tc.outer, tc.inner)
+		assert.Equal(t, tc.outer, outer.String(), "Subtract must not modify its argument")
+	}
+
+	_, err := Subtract(mustParseCIDR(t, "10.0.0.0/22"), mustParseCIDR(t, "10.0.8.0/24"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not contained")
+	_, err = Subtract(mustParseCIDR(t, "10.0.0.0/22"), mustParseCIDR(t, "10.0.0.0/21"))
+	assert.Error(t, err, "a larger block cannot be subtracted from a smaller one")
+	_, err = Subtract(mustParseCIDR(t, "10.0.0.0/22"), mustParseCIDR(t, "fd00::/120"))
+	assert.Error(t, err, "blocks of different families do not contain each other")
+}
+
+func TestNext(t *testing.T) {
+	next, ok := Next(mustParseCIDR(t, "10.0.255.0/24"))
+	require.True(t, ok)
+	assert.Equal(t, "10.1.0.0/24", next.String())
+	next, ok = Next(mustParseCIDR(t, "fd00::/64"))
+	require.True(t, ok)
+	assert.Equal(t, "fd00:0:0:1::/64", next.String())
+
+	_, ok = Next(mustParseCIDR(t, "255.255.255.0/24"))
+	assert.False(t, ok)
+	_, ok = Next(mustParseCIDR(t, "0.0.0.0/0"))
+	assert.False(t, ok)
+}
+
+func TestContainsAndOverlaps(t *testing.T) {
+	for _, tc := range []struct {
+		outer, inner       string
+		contains, overlaps bool
+	}{
+		{outer: "10.0.0.0/16", inner: "10.0.4.0/24", contains: true, overlaps: true},
+		{outer: "10.0.0.0/16", inner: "10.0.0.0/16", contains: true, overlaps: true},
+		{outer: "10.0.4.0/24", inner: "10.0.0.0/16", overlaps: true},
+		{outer: "10.0.0.0/16", inner: "10.1.0.0/24"},
+		{outer: "fd00::/48", inner: "fd00:0:0:1::/64", contains: true, overlaps: true},
+		{outer: "fd00::/64", inner: "fd00:0:0:1::/64"},
+		{outer: "::/0", inner: "10.0.0.0/8"},
+	} {
+		outer, inner := mustParseCIDR(t, tc.outer), mustParseCIDR(t, tc.inner)
+		assert.Equal(t, tc.contains, Contains(outer, inner), "%s contains %s", tc.outer, tc.inner)
+		assert.Equal(t, tc.overlaps, Overlaps(outer, inner), "%s overlaps %s", tc.outer, tc.inner)
+		assert.Equal(t, tc.overlaps, Overlaps(inner, outer), "%s overlaps %s", tc.inner, tc.outer)
+	}
+}
+
+func TestNetworkIPAndCopyIP(t *testing.T) {
+	misaligned := &net.IPNet{IP: net.ParseIP("10.0.1.7"), Mask: net.CIDRMask(24, 32)}
+	network := NetworkIP(misaligned)
+	assert.Equal(t, "10.0.1.0", network.String())
+	assert.Len(t, network, net.IPv4len, "an IPv4 mask yields the 4 byte form")
+	assert.Equal(t, "fd00::", NetworkIP(mustParseCIDR(t, "fd00::/64")).String())
+
+	copied := CopyIP(misaligned.IP)
+	copied[len(copied)-1] = 0xff
+	assert.Equal(t, "10.0.1.7", misaligned.IP.String(), "CopyIP shares no memory with its argument")
+	assert.Nil(t, CopyIP(nil))
+}
+
+func TestNormalize(t *testing.T) {
+	wide := &net.IPNet{IP: net.ParseIP("10.0.1.7"), Mask: net.CIDRMask(120, 128)}
+	normalized := Normalize(wide)
+	assert.Equal(t, "10.0.1.0/24", normalized.String())
+	assert.Len(t, normalized.IP, net.IPv4len)
+	assert.Len(t, normalized.Mask, net.IPv4len)
+	assert.Equal(t, net.ParseIP("10.0.1.7"), wide.IP, "Normalize must not modify its argument")
+
+	assert.Equal(t, "fd00::/64", Normalize(&net.IPNet{IP: net.ParseIP("fd00::1"), Mask: net.CIDRMask(64, 128)}).String())
+
+	odd := &net.IPNet{IP: net.ParseIP("10.0.0.0").To4(), Mask: net.IPMask{0xff, 0x00, 0xff, 0x00}}
+	assert.Equal(t, odd.Mask, Normalize(odd).Mask, "non-contiguous masks are copied as is")
+}